@@ -1,9 +1,18 @@
-package main
+package dfm
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pelletier/go-toml"
 	"github.com/spf13/afero"
@@ -12,10 +21,117 @@ import (
 // TomlFilename is the filename where the dfm configuration can be found.
 const TomlFilename = ".dfm.toml"
 
+// LinkFallbackCopy is the value of the link_fallback config option which copies
+// files when symlinks can't be created.
+const LinkFallbackCopy = "copy"
+
+const (
+	// ConflictsAllow is the value of the conflicts config option for setups
+	// where repos deliberately override files from other repos, so files
+	// provided by more than one repo aren't warned about.
+	ConflictsAllow = "allow"
+	// ConflictsError is the value of the conflicts config option which makes
+	// files provided by more than one repo an error, instead of a warning.
+	ConflictsError = "error"
+)
+
+const (
+	// CaseSensitive is the value of the target_case config option for
+	// targets where file names which differ only in case are different files.
+	CaseSensitive = "sensitive"
+	// CaseInsensitive is the value of the target_case config option for
+	// targets where file names which differ only in case are the same file.
+	CaseInsensitive = "insensitive"
+)
+
+// DefaultAutocleanLimit is the smallest number of files the autoclean removes
+// without confirmation when the autoclean_limit config option is not set. The
+// limit grows to a fifth of the tracked files for large manifests.
+const DefaultAutocleanLimit = 10
+
+// IgnoreFilename is the name of the file in the root of a repo which lists
+// patterns of files to skip when adding directories to the repo, one per line.
+// It is not synced itself.
+const IgnoreFilename = ".dfmignore"
+
+// AddLimit and AddSizeLimit are the most files, and bytes, which AddFiles
+// adds from directories without confirmation.
+const (
+	AddLimit     = 100
+	AddSizeLimit = 10 << 20
+)
+
+// DirMarkerFilename is the name of a marker file which causes the directory
+// containing it to be linked as a whole, instead of linking each file in it.
+const DirMarkerFilename = ".dfmdir"
+
 type configFile struct {
-	Repos    []string `toml:"repos"`
-	Target   string   `toml:"target"`
-	Manifest []string `toml:"manifest"`
+	Repos          []string          `toml:"repos"`
+	Repo           []repoConfig      `toml:"repo,omitempty"`
+	Target         string            `toml:"target"`
+	Manifest       []string          `toml:"manifest"`
+	Strict         bool              `toml:"strict,omitempty"`
+	Hooks          *hooksConfig      `toml:"hooks,omitempty"`
+	OnChange       map[string]string `toml:"onchange,omitempty"`
+	Git            *gitConfig        `toml:"git,omitempty"`
+	HardLink       *hardLinkConfig   `toml:"hardlink,omitempty"`
+	SymlinkDirs    []string          `toml:"symlink_dirs,omitempty"`
+	AutoOSRepos    bool              `toml:"auto_os_repos,omitempty"`
+	IgnoreModes    bool              `toml:"ignore_modes,omitempty"`
+	NoClone        bool              `toml:"no_clone,omitempty"`
+	LinkFallback   string            `toml:"link_fallback,omitempty"`
+	TargetCase     string            `toml:"target_case,omitempty"`
+	Conflicts      string            `toml:"conflicts,omitempty"`
+	AutocleanLimit int               `toml:"autoclean_limit,omitempty"`
+	Trash          bool              `toml:"trash,omitempty"`
+	Backup         bool              `toml:"backup,omitempty"`
+	BackupDir      string            `toml:"backup_dir,omitempty"`
+	LogFile        string            `toml:"log_file,omitempty"`
+	PreviousPaths  []string          `toml:"previous_paths,omitempty"`
+	Copied         []string          `toml:"copied,omitempty"`
+	Checksums      map[string]string `toml:"checksums,omitempty"`
+	Sensitive      map[string]string `toml:"sensitive,omitempty"`
+	Permissions    map[string]string `toml:"permissions,omitempty"`
+	Map            map[string]string `toml:"map,omitempty"`
+	DotPrefix      []string          `toml:"dot_prefix,omitempty"`
+	Ignore         []string          `toml:"ignore,omitempty"`
+	TrackDirs      []string          `toml:"track_dirs,omitempty"`
+	TrackRepo      string            `toml:"track_repo,omitempty"`
+}
+
+// hardLinkConfig is the [hardlink] table of the config file. It lists the
+// files and repos which are hard linked instead of symlinked.
+type hardLinkConfig struct {
+	// Patterns of relative paths, in the same format as --exclude
+	Files []string `toml:"files,omitempty"`
+	// Names of repos whose files are all hard linked
+	Repos []string `toml:"repos,omitempty"`
+}
+
+// repoConfig is a [[repo]] table of the config file. The repo is only active on
+// machines which match its condition, after the repos in the repos list.
+type repoConfig struct {
+	Name string        `toml:"name"`
+	When repoCondition `toml:"when,omitempty"`
+}
+
+// repoCondition describes the machines a repo is active on. Every field which
+// is set has to match.
+type repoCondition struct {
+	// Operating system, as reported by runtime.GOOS
+	OS string `toml:"os,omitempty"`
+	// Glob which the hostname has to match
+	Hostname string `toml:"hostname,omitempty"`
+	// Name of an executable which has to be on the PATH
+	Executable string `toml:"executable,omitempty"`
+}
+
+// SkippedRepo is a repo from a [[repo]] table whose condition does not match
+// this machine.
+type SkippedRepo struct {
+	Name string
+	// Describes the part of the condition which did not match
+	Reason string
 }
 
 func manifestToConfig(manifest map[string]bool) []string {
@@ -23,13 +139,15 @@ func manifestToConfig(manifest map[string]bool) []string {
 	for k := range manifest {
 		keys = append(keys, k)
 	}
+	// Keep the config file the same between runs.
+	sort.Strings(keys)
 	return keys
 }
 
 func configToManifest(config []string) map[string]bool {
 	m := make(map[string]bool, len(config))
 	for _, key := range config {
-		m[key] = true
+		m[NormalizePath(key)] = true
 	}
 	return m
 }
@@ -37,9 +155,11 @@ func configToManifest(config []string) map[string]bool {
 var defaultConfig = func() configFile {
 	home, _ := os.LookupEnv("HOME")
 	return configFile{
-		Repos:    []string{},
-		Target:   path.Clean(home),
-		Manifest: []string{},
+		Repos:     []string{},
+		Target:    path.Clean(home),
+		Manifest:  []string{},
+		Copied:    []string{},
+		Checksums: map[string]string{},
 	}
 }()
 
@@ -50,10 +170,332 @@ type Config struct {
 	path string
 	// Target directory, normally ~/
 	targetPath string
-	// All repositories
+	// All active repositories
 	repos []string
+	// Repos which are only active on some machines
+	repoTables []repoConfig
+	// Repos from repoTables which are not active on this machine
+	skippedRepos []SkippedRepo
+	// Active repos which were added by repoTables or autoOSRepos, rather than
+	// listed in the repos option
+	derivedRepos map[string]bool
+	// Activate the OS-specific repo of each repo, see addOSRepos
+	autoOSRepos bool
+	// Patterns of files which may contain secrets, mapped to one of the
+	// Sensitive constants
+	sensitive map[string]string
+	// Patterns of files mapped to the octal mode they should have
+	permissions map[string]string
+	// Don't update copies whose mode differs from the repo file
+	ignoreModes bool
+	// Always copy the data of files, instead of cloning them when possible
+	noClone bool
+	// What to do when symlinks can't be created, "" or LinkFallbackCopy
+	linkFallback string
+	// Whether the target is case sensitive, "" to detect it
+	targetCase string
+	// What to do about files provided by more than one repo, "" to warn,
+	// ConflictsAllow or ConflictsError
+	conflicts string
+	// Number of files the autoclean may remove without confirmation, 0 for
+	// the default, or negative for no limit
+	autocleanLimit int
+	// Move removed files to the trash instead of deleting them
+	trash bool
+	// Back up files before --force overwrites them
+	backup bool
+	// Directory for backups, relative to the dfm directory, or "" to keep
+	// them next to the original
+	backupDir string
+	// File which dfm's output is appended to, relative to the dfm directory
+	logFile string
+	// Places where the dfm directory used to be, so that links to them can
+	// be replaced
+	previousPaths []string
+	// Tracked files which are copied because symlinks couldn't be created
+	copied map[string]bool
+	// SHA-256 of the last synced contents of each tracked copy or hard link,
+	// used to check that autoclean only removes files dfm created
+	checksums map[string]string
+	// Hostname of this machine, used for conditions and variants
+	hostname string
+	// Canonical path to each repository, see resolveRepos
+	repoRoots map[string]string
 	// Tracked files
 	manifest map[string]bool
+	// Treat configuration problems as errors instead of warnings
+	strict bool
+	// Settings in the config file which dfm doesn't know
+	unknownKeys []UnknownKey
+	// Commands to run before and after syncing
+	hooks hooksConfig
+	// Commands to run when files matching a pattern change
+	onChange map[string]string
+	// Git integration settings
+	git gitConfig
+	// Files which are hard linked instead of symlinked
+	hardLink hardLinkConfig
+	// Patterns of directories which are linked as a whole
+	symlinkDirs []string
+	// Paths in the repos mapped to the path in the target directory they are
+	// synced to, for files which are stored somewhere else in the repo
+	pathMap map[string]string
+	// Repos which store files and directories starting with a dot with a
+	// dot_ prefix instead
+	dotPrefix []string
+	// Patterns of files which are skipped when adding directories
+	ignore []string
+	// Directories in the target directory whose new files are added during
+	// a full sync
+	trackDirs []string
+	// Repo which new files in trackDirs are added to, or "" for the only
+	// repo
+	trackRepo string
+}
+
+// InvalidReposError is returned by Validate when some of the configured repos
+// cannot be used.
+type InvalidReposError struct {
+	// Names of the repos which do not exist
+	Missing []string
+	// Names of the repos which exist but are not directories
+	NotDirectory []string
+	dir          string
+}
+
+func (err *InvalidReposError) Error() string {
+	var lines []string
+	for _, repo := range err.Missing {
+		lines = append(lines, fmt.Sprintf("repo %#v does not exist", repo))
+	}
+	for _, repo := range err.NotDirectory {
+		lines = append(lines, fmt.Sprintf("repo %#v is not a directory", repo))
+	}
+	if len(err.Missing) > 0 {
+		paths := make([]string, len(err.Missing))
+		for i, repo := range err.Missing {
+			paths[i] = pathJoin(err.dir, repo)
+		}
+		lines = append(lines, "To create the missing repos, run:", "mkdir -p "+strings.Join(paths, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ConfigSyntaxError is returned when the config file can't be parsed, or one of
+// its settings has the wrong type.
+type ConfigSyntaxError struct {
+	// Absolute path to the config file
+	Path string
+	// Position of the problem in the file, or 0 if it isn't known
+	Line   int
+	Column int
+	// The setting with the wrong type, like "hooks.before_link", if known
+	Key     string
+	Message string
+}
+
+func (err *ConfigSyntaxError) Error() string {
+	location := err.Path
+	if err.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", location, err.Line, err.Column)
+	}
+	return location + ": " + err.Message
+}
+
+var tomlErrorPattern = regexp.MustCompile(`^\((\d+), (\d+)\): (.*)$`)
+var tomlConvertPattern = regexp.MustCompile(`^Can't convert (.*)\((\w+)\) to (\S+?)(\(\w+\))?$`)
+
+// newConfigSyntaxError describes an error from the toml library, which reports
+// the position as "(line, column): message". When the problem is a setting
+// with the wrong type, the setting is looked up to name it in the message.
+func newConfigSyntaxError(filename string, bytes []byte, cause error) *ConfigSyntaxError {
+	err := &ConfigSyntaxError{Path: filename, Message: cause.Error()}
+	match := tomlErrorPattern.FindStringSubmatch(err.Message)
+	if match == nil {
+		return err
+	}
+	err.Line, _ = strconv.Atoi(match[1])
+	err.Column, _ = strconv.Atoi(match[2])
+	err.Message = match[3]
+	convert := tomlConvertPattern.FindStringSubmatch(err.Message)
+	if convert == nil {
+		return err
+	}
+	inList := false
+	if tree, treeErr := toml.LoadBytes(bytes); treeErr == nil {
+		err.Key = findTomlKey(tree, "", toml.Position{Line: err.Line, Col: err.Column})
+		_, inList = tree.Get(err.Key).([]interface{})
+	}
+	setting := "this setting"
+	if err.Key != "" {
+		setting = strconv.Quote(err.Key)
+	}
+	expected, actual := describeTomlType(convert[3]), describeTomlType(convert[2])
+	if inList && !strings.HasPrefix(convert[3], "[]") {
+		// The toml library reports the item of the list which has the
+		// wrong type.
+		err.Message = fmt.Sprintf("every item of %s must be %s, not %s", setting, expected, actual)
+	} else {
+		err.Message = fmt.Sprintf("%s must be %s, not %s", setting, expected, actual)
+	}
+	return err
+}
+
+// findTomlKey returns the dotted name of the key at the position, or "".
+func findTomlKey(tree *toml.Tree, prefix string, pos toml.Position) string {
+	for _, key := range tree.Keys() {
+		if tree.GetPosition(key) == pos {
+			return prefix + key
+		}
+		var tables []*toml.Tree
+		switch value := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			tables = []*toml.Tree{value}
+		case []*toml.Tree:
+			tables = value
+		}
+		for _, table := range tables {
+			if found := findTomlKey(table, prefix+key+".", pos); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+// describeTomlType names a Go type from an error of the toml library the way
+// it would be written in the config file.
+func describeTomlType(goType string) string {
+	switch goType {
+	case "string":
+		return "a string"
+	case "[]string":
+		return "a list of strings"
+	case "bool":
+		return "true or false"
+	case "int", "int64", "float64":
+		return "a number"
+	case "map[string]string":
+		return "a table of strings"
+	case "[]interface {}":
+		return "a list"
+	case "map[string]interface {}":
+		return "a table"
+	}
+	return goType
+}
+
+// UnknownKeysError is returned by CheckKeys when the config file has settings
+// which dfm doesn't know. They are ignored, and dropped when dfm saves the
+// config file.
+type UnknownKeysError struct {
+	Keys []UnknownKey
+	// Absolute path to the config file
+	Path string
+}
+
+// UnknownKey is a setting in the config file which dfm doesn't know.
+type UnknownKey struct {
+	// Dotted name of the setting, like "hooks.before_link"
+	Key string
+	// A known setting with a similar name, if there is one
+	Suggestion string
+}
+
+func (err *UnknownKeysError) Error() string {
+	lines := make([]string, len(err.Keys))
+	for i, key := range err.Keys {
+		lines[i] = fmt.Sprintf("unknown setting %#v in %s", key.Key, err.Path)
+		if key.Suggestion != "" {
+			lines[i] += fmt.Sprintf(" (did you mean %#v?)", key.Suggestion)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findUnknownKeys compares the keys of the toml tree with the fields of the
+// struct it is decoded into, and returns the ones which don't match any field.
+// Tables and arrays of tables are checked against the nested structs.
+func findUnknownKeys(tree *toml.Tree, structType reflect.Type, prefix string) []UnknownKey {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name != "" {
+			fields[name] = field.Type
+		}
+	}
+	keys := tree.Keys()
+	sort.Strings(keys)
+	var unknown []UnknownKey
+	for _, key := range keys {
+		fieldType, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, UnknownKey{Key: prefix + key, Suggestion: suggestKey(key, fields, prefix)})
+			continue
+		}
+		for fieldType.Kind() == reflect.Ptr || fieldType.Kind() == reflect.Slice {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() != reflect.Struct {
+			continue
+		}
+		switch value := tree.GetPath([]string{key}).(type) {
+		case *toml.Tree:
+			unknown = append(unknown, findUnknownKeys(value, fieldType, prefix+key+".")...)
+		case []*toml.Tree:
+			for _, table := range value {
+				unknown = append(unknown, findUnknownKeys(table, fieldType, prefix+key+".")...)
+			}
+		}
+	}
+	return unknown
+}
+
+// suggestKey returns the known key which is the closest to the unknown one, if
+// it is close enough to be a typo.
+func suggestKey(key string, fields map[string]reflect.Type, prefix string) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if distance := editDistance(key, name); distance < bestDistance || (distance == bestDistance && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+	if best == "" || bestDistance > len(key)/2 {
+		return ""
+	}
+	return prefix + best
+}
+
+// editDistance returns the Levenshtein distance between the strings.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
 }
 
 // SetDirectory takes a directory with a dfm.toml file in it and loads that
@@ -61,27 +503,31 @@ type Config struct {
 func (config *Config) SetDirectory(dir string) error {
 	fs := config.fs
 	// Clear out all old settings when changing directory
-	*config = Config{fs: fs}
+	hostname, _ := os.Hostname()
+	*config = Config{fs: fs, hostname: hostname}
 	config.applyFile(defaultConfig)
 
 	absPath, err := filepath.Abs(dir)
 	if err != nil {
 		return err
 	}
-	config.path = absPath
+	config.path = filepath.ToSlash(absPath)
 	if _, err := fs.Stat(dir); err != nil {
 		return err
 	}
 	bytes, err := afero.ReadFile(fs, path.Join(dir, TomlFilename))
 	// Not having a config file is the same as having an empty config file, so
 	// don't fail if the file doesn't exist.
-	if err != nil && !os.IsNotExist(err) {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 	if bytes != nil {
 		var file configFile
 		if err := toml.Unmarshal(bytes, &file); err != nil {
-			return err
+			return newConfigSyntaxError(pathJoin(config.path, TomlFilename), bytes, err)
+		}
+		if tree, err := toml.LoadBytes(bytes); err == nil {
+			config.unknownKeys = findUnknownKeys(tree, reflect.TypeOf(file), "")
 		}
 		config.applyFile(file)
 	}
@@ -89,15 +535,41 @@ func (config *Config) SetDirectory(dir string) error {
 	if err != nil {
 		return err
 	}
-	config.targetPath = targetPath
+	config.targetPath = filepath.ToSlash(targetPath)
 	return nil
 }
 
 // applyFile looks at all settings that are set in the config file and applies
 // them.
 func (config *Config) applyFile(file configFile) {
-	if file.Repos != nil {
-		config.repos = file.Repos
+	if file.AutoOSRepos {
+		config.autoOSRepos = true
+	}
+	if file.Repos != nil || file.Repo != nil || file.AutoOSRepos {
+		repos := file.Repos
+		if repos == nil {
+			repos = config.unconditionalRepos()
+		}
+		if file.Repo != nil {
+			config.repoTables = file.Repo
+		}
+		// Repo names are paths relative to the dfm dir, and may be nested.
+		active := make([]string, 0, len(repos)+len(config.repoTables))
+		for _, repo := range repos {
+			active = append(active, path.Clean(repo))
+		}
+		config.skippedRepos = nil
+		config.derivedRepos = map[string]bool{}
+		for _, table := range config.repoTables {
+			if reason := config.unmetCondition(table.When); reason != "" {
+				config.skippedRepos = append(config.skippedRepos, SkippedRepo{Name: table.Name, Reason: reason})
+			} else {
+				active = append(active, path.Clean(table.Name))
+				config.derivedRepos[path.Clean(table.Name)] = true
+			}
+		}
+		config.repos = config.addOSRepos(active)
+		config.resolveRepos()
 	}
 	if file.Target != "" {
 		config.targetPath = file.Target
@@ -105,19 +577,359 @@ func (config *Config) applyFile(file configFile) {
 	if file.Manifest != nil {
 		config.manifest = configToManifest(file.Manifest)
 	}
+	if file.Strict {
+		config.strict = true
+	}
+	if file.Hooks != nil {
+		config.hooks = *file.Hooks
+	}
+	if file.OnChange != nil {
+		config.onChange = file.OnChange
+	}
+	if file.Git != nil {
+		config.git = *file.Git
+	}
+	if file.HardLink != nil {
+		config.hardLink = *file.HardLink
+	}
+	if file.SymlinkDirs != nil {
+		config.symlinkDirs = file.SymlinkDirs
+	}
+	if file.Sensitive != nil {
+		config.sensitive = file.Sensitive
+	}
+	if file.Permissions != nil {
+		config.permissions = file.Permissions
+	}
+	if file.IgnoreModes {
+		config.ignoreModes = true
+	}
+	if file.NoClone {
+		config.noClone = true
+	}
+	if file.LinkFallback != "" {
+		config.linkFallback = file.LinkFallback
+	}
+	if file.TargetCase != "" {
+		config.targetCase = file.TargetCase
+	}
+	if file.Conflicts != "" {
+		config.conflicts = file.Conflicts
+	}
+	if file.AutocleanLimit != 0 {
+		config.autocleanLimit = file.AutocleanLimit
+	}
+	if file.Trash {
+		config.trash = true
+	}
+	if file.Backup {
+		config.backup = true
+	}
+	if file.BackupDir != "" {
+		config.backupDir = file.BackupDir
+	}
+	if file.LogFile != "" {
+		config.logFile = file.LogFile
+	}
+	if file.PreviousPaths != nil {
+		config.previousPaths = file.PreviousPaths
+	}
+	if file.Copied != nil {
+		config.copied = configToManifest(file.Copied)
+	}
+	if file.Checksums != nil {
+		config.checksums = make(map[string]string, len(file.Checksums))
+		for relative, checksum := range file.Checksums {
+			config.checksums[NormalizePath(relative)] = checksum
+		}
+	}
+	if file.Ignore != nil {
+		config.ignore = file.Ignore
+	}
+	if file.DotPrefix != nil {
+		config.dotPrefix = file.DotPrefix
+	}
+	if file.TrackDirs != nil {
+		config.trackDirs = make([]string, len(file.TrackDirs))
+		for i, dir := range file.TrackDirs {
+			config.trackDirs[i] = NormalizePath(path.Clean(dir))
+		}
+	}
+	if file.TrackRepo != "" {
+		config.trackRepo = file.TrackRepo
+	}
+	if file.Map != nil {
+		config.pathMap = make(map[string]string, len(file.Map))
+		for repoRelative, relative := range file.Map {
+			config.pathMap[NormalizePath(repoRelative)] = NormalizePath(relative)
+		}
+	}
+}
+
+// unmetCondition checks the condition against this machine, and returns a
+// description of the first part which doesn't match, or "" if it matches.
+func (config *Config) unmetCondition(when repoCondition) string {
+	if when.OS != "" && when.OS != runtime.GOOS {
+		return fmt.Sprintf("os is %s, not %s", runtime.GOOS, when.OS)
+	}
+	if when.Hostname != "" {
+		if matched, _ := path.Match(when.Hostname, config.hostname); !matched {
+			return fmt.Sprintf("hostname %s does not match %s", config.hostname, when.Hostname)
+		}
+	}
+	if when.Executable != "" {
+		if _, err := exec.LookPath(when.Executable); err != nil {
+			return fmt.Sprintf("%s is not on the PATH", when.Executable)
+		}
+	}
+	return ""
+}
+
+// addOSRepos adds the OS-specific repo, named like "files.linux", after each
+// repo which has one, so that its files take precedence. This only happens
+// when the auto_os_repos option is set.
+func (config *Config) addOSRepos(repos []string) []string {
+	if !config.autoOSRepos {
+		return repos
+	}
+	listed := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		listed[repo] = true
+	}
+	result := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		result = append(result, repo)
+		osRepo := repo + "." + runtime.GOOS
+		if listed[osRepo] {
+			continue
+		}
+		if isDir, _ := afero.IsDir(config.fs, pathJoin(config.path, osRepo)); isDir {
+			result = append(result, osRepo)
+			listed[osRepo] = true
+			config.derivedRepos[osRepo] = true
+		}
+	}
+	return result
+}
+
+// unconditionalRepos returns the active repos which are listed in the repos
+// option, as opposed to [[repo]] tables or auto_os_repos.
+func (config *Config) unconditionalRepos() []string {
+	repos := make([]string, 0, len(config.repos))
+	for _, repo := range config.repos {
+		if !config.derivedRepos[repo] {
+			repos = append(repos, repo)
+		}
+	}
+	return repos
+}
+
+// resolveRepos canonicalizes the path to each configured repo, so that repos
+// which are symlinks to other directories are handled consistently. Repos
+// which don't exist yet use the path as given.
+func (config *Config) resolveRepos() {
+	config.repoRoots = make(map[string]string, len(config.repos))
+	for _, repo := range config.repos {
+		root := pathJoin(config.path, repo)
+		if _, ok := config.fs.(*afero.OsFs); ok {
+			if resolved, err := filepath.EvalSymlinks(root); err == nil {
+				root = filepath.ToSlash(resolved)
+			}
+		}
+		config.repoRoots[repo] = root
+	}
+}
+
+// repoRoot returns the canonical path to the given repo.
+func (config *Config) repoRoot(repo string) string {
+	if root, ok := config.repoRoots[repo]; ok {
+		return root
+	}
+	return pathJoin(config.path, repo)
+}
+
+// Path returns the absolute path to the dfm directory.
+func (config *Config) Path() string {
+	return config.path
+}
+
+// Repos returns the names of the active repos, in priority order.
+func (config *Config) Repos() []string {
+	return config.repos
+}
+
+// SkippedRepos returns the repos which are not active because their condition
+// does not match this machine.
+func (config *Config) SkippedRepos() []SkippedRepo {
+	return config.skippedRepos
+}
+
+// SetRepos changes the repos which are active on every machine. Repo names are
+// paths relative to the dfm directory. Matching repos from [[repo]] tables
+// remain active after them.
+func (config *Config) SetRepos(repos []string) {
+	config.applyFile(configFile{Repos: repos})
+}
+
+// SetTargetPath changes the target directory. The path should be absolute,
+// with forward slashes even on Windows.
+func (config *Config) SetTargetPath(targetPath string) {
+	config.applyFile(configFile{Target: targetPath})
+}
+
+// CheckKeys returns an UnknownKeysError if the config file has settings which
+// dfm doesn't know, like misspelled ones.
+func (config *Config) CheckKeys() error {
+	if len(config.unknownKeys) == 0 {
+		return nil
+	}
+	return &UnknownKeysError{Keys: config.unknownKeys, Path: pathJoin(config.path, TomlFilename)}
+}
+
+// Strict returns true if configuration problems should be treated as errors.
+func (config *Config) Strict() bool {
+	return config.strict
+}
+
+// AutocleanLimit returns the number of files the autoclean may remove in a
+// single sync without confirmation, or -1 if there is no limit.
+func (config *Config) AutocleanLimit() int {
+	if config.autocleanLimit < 0 {
+		return -1
+	} else if config.autocleanLimit > 0 {
+		return config.autocleanLimit
+	} else if len(config.manifest)/5 > DefaultAutocleanLimit {
+		return len(config.manifest) / 5
+	}
+	return DefaultAutocleanLimit
+}
+
+// LogFile returns the absolute path to the file which dfm's output should be
+// appended to, or "" if it isn't configured.
+func (config *Config) LogFile() string {
+	if config.logFile == "" {
+		return ""
+	}
+	return pathJoin(config.path, config.logFile)
+}
+
+// Validate checks that every configured repo exists and is a directory. All
+// problems are reported at once using an InvalidReposError.
+func (config *Config) Validate() error {
+	invalid := &InvalidReposError{dir: config.path}
+	for _, repo := range config.repos {
+		stat, err := config.fs.Stat(pathJoin(config.path, repo))
+		if errors.Is(err, os.ErrNotExist) {
+			invalid.Missing = append(invalid.Missing, repo)
+		} else if err != nil {
+			return err
+		} else if !stat.IsDir() {
+			invalid.NotDirectory = append(invalid.NotDirectory, repo)
+		}
+	}
+	if len(invalid.Missing) > 0 || len(invalid.NotDirectory) > 0 {
+		return invalid
+	}
+	return nil
 }
 
 // Save writes a dfm.toml file to the config's path.
 func (config *Config) Save() error {
 	fs := config.fs
 	var file configFile
-	file.Repos = config.repos
+	file.Repos = config.unconditionalRepos()
+	file.Repo = config.repoTables
+	file.AutoOSRepos = config.autoOSRepos
+	file.Sensitive = config.sensitive
+	file.Permissions = config.permissions
+	file.IgnoreModes = config.ignoreModes
+	file.NoClone = config.noClone
+	file.LinkFallback = config.linkFallback
+	file.TargetCase = config.targetCase
+	file.Conflicts = config.conflicts
+	file.AutocleanLimit = config.autocleanLimit
+	file.Trash = config.trash
+	file.Backup = config.backup
+	file.BackupDir = config.backupDir
+	file.LogFile = config.logFile
+	file.PreviousPaths = config.previousPaths
+	// Files which are no longer tracked will be linked if they come back.
+	copied := map[string]bool{}
+	for relative := range config.copied {
+		if config.manifest[relative] {
+			copied[relative] = true
+		}
+	}
+	if len(copied) > 0 {
+		file.Copied = manifestToConfig(copied)
+	}
+	checksums := map[string]string{}
+	for relative, checksum := range config.checksums {
+		if config.manifest[relative] {
+			checksums[relative] = checksum
+		}
+	}
+	if len(checksums) > 0 {
+		file.Checksums = checksums
+	}
 	file.Target = config.targetPath
 	file.Manifest = manifestToConfig(config.manifest)
+	file.Strict = config.strict
+	if !reflect.DeepEqual(config.hooks, hooksConfig{}) {
+		file.Hooks = &config.hooks
+	}
+	file.OnChange = config.onChange
+	if config.git != (gitConfig{}) {
+		file.Git = &config.git
+	}
+	if !reflect.DeepEqual(config.hardLink, hardLinkConfig{}) {
+		file.HardLink = &config.hardLink
+	}
+	file.SymlinkDirs = config.symlinkDirs
+	if len(config.pathMap) > 0 {
+		file.Map = config.pathMap
+	}
+	file.DotPrefix = config.dotPrefix
+	file.Ignore = config.ignore
+	file.TrackDirs = config.trackDirs
+	file.TrackRepo = config.trackRepo
 
-	bytes, err := toml.Marshal(file)
+	bytes, err := marshalConfigFile(file)
 	if err != nil {
 		return err
 	}
 	return afero.WriteFile(fs, path.Join(config.path, TomlFilename), bytes, 0644)
 }
+
+// marshalConfigFile encodes the config file as TOML. Marshal splits the keys
+// of maps at each dot, but the keys of these tables are file names and
+// patterns like ".ssh/*", so the tables are added to the document afterwards
+// with their keys intact.
+func marshalConfigFile(file configFile) ([]byte, error) {
+	tables := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"onchange", file.OnChange},
+		{"checksums", file.Checksums},
+		{"sensitive", file.Sensitive},
+		{"permissions", file.Permissions},
+		{"map", file.Map},
+	}
+	file.OnChange, file.Checksums, file.Sensitive, file.Permissions, file.Map = nil, nil, nil, nil, nil
+	bytes, err := toml.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.LoadBytes(bytes)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		for key, value := range table.values {
+			tree.SetPath([]string{table.name, key}, value)
+		}
+	}
+	str, err := tree.ToTomlString()
+	return []byte(str), err
+}
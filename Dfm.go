@@ -1,14 +1,16 @@
-package main
+// Package dfm manages repositories of configuration files, linking or copying
+// them into a target directory. The dfm command line tool in cmd/dfm is a thin
+// wrapper around this package.
+package dfm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path"
-	"sort"
 	"strings"
 
-	"github.com/cevaris/ordered_map"
-
 	"github.com/spf13/afero"
 )
 
@@ -26,12 +28,206 @@ const (
 	// reason will be the original error, even though the ErrorHandler
 	// suppressed the error.
 	OperationSkip = "skipped"
+	// OperationWarning means dfm noticed a problem that did not stop the
+	// operation. The reason will describe the problem.
+	OperationWarning = "warning"
+	// OperationCreateRepo means a configured repo directory was created. The
+	// relative path will be the name of the repo.
+	OperationCreateRepo = "created repo"
+	// OperationOnChange means a command from the [onchange] table was run
+	// because matching files changed. The relative path will be the command,
+	// and the reason will describe the failure if the command failed. In a dry
+	// run, the command is logged but not run.
+	OperationOnChange = "onchange"
+	// OperationGit means a git command was run in the dfm directory. The
+	// relative path will be the command. In a dry run, the command is logged
+	// but not run.
+	OperationGit = "git"
+	// OperationChmod means the mode of a file was changed to match the
+	// [permissions] table. For links, the repo file is changed. If there was
+	// an error, reason will describe it.
+	OperationChmod = "changed mode"
+	// OperationAdopt means the repo file was replaced by a copy of the target
+	// file.
+	OperationAdopt = "adopted"
+	// OperationOverwrite means a file which was in the way of syncing was
+	// removed, because Force is set.
+	OperationOverwrite = "overwrote"
+	// OperationBackup means a file which was in the way of syncing was moved
+	// to its BackupPath, because Force and Backup are set.
+	OperationBackup = "backed up"
+	// OperationPrune means a tracked file which no longer exists in the
+	// target, and is no longer provided by any repo, was dropped from the
+	// manifest.
+	OperationPrune = "pruned"
+	// OperationRestore means a file which was moved to the trash or backed up
+	// was moved back to the target directory by Undo.
+	OperationRestore = "restored"
+	// OperationEject means a file was copied to the target by EjectFiles and
+	// is no longer tracked. If the target already was an identical copy, the
+	// reason will be ErrNotNeeded.
+	OperationEject = "ejected"
+	// OperationPurge means a file was deleted from a repo by PurgeFiles. The
+	// source path is the deleted file. If there was an error, reason will
+	// describe it.
+	OperationPurge = "purged"
+	// OperationMove means a file was moved to a new path in its repo by Move,
+	// or into another repo by MoveToRepo. The source path is the old path in
+	// the repo, and the target path is the new one.
+	OperationMove = "moved"
 )
 
 // Logger is the type of function that dfm calls whenever it performs a file
-// operation.
+// operation. An EventHandler receives more detail about each operation.
 type Logger func(operation, relative, repo string, reason error)
 
+// Summary counts the file operations that dfm has performed.
+type Summary struct {
+	Added    int `json:"added"`
+	Adopted  int `json:"adopted"`
+	Linked   int `json:"linked"`
+	Copied   int `json:"copied"`
+	Removed  int `json:"removed"`
+	Kept     int `json:"kept"`
+	Pruned   int `json:"pruned"`
+	Restored int `json:"restored"`
+	Ejected  int `json:"ejected"`
+	Purged   int `json:"purged"`
+	Moved    int `json:"moved"`
+	Chmodded int `json:"chmodded"`
+	UpToDate int `json:"up_to_date"`
+	Errors   int `json:"errors"`
+	// When set, the operations were only simulated.
+	DryRun bool `json:"dry_run"`
+}
+
+// record counts a single logged operation.
+func (summary *Summary) record(operation string, reason error) {
+	switch operation {
+	case OperationAdd:
+		summary.Added++
+	case OperationAdopt:
+		summary.Adopted++
+	case OperationLink:
+		summary.Linked++
+	case OperationCopy:
+		summary.Copied++
+	case OperationRemove:
+		if reason == nil || errors.Is(reason, os.ErrNotExist) {
+			summary.Removed++
+		} else {
+			summary.Errors++
+		}
+	case OperationSkip:
+		if IsNotNeeded(reason) {
+			summary.UpToDate++
+		} else if errors.Is(reason, ErrModifiedOutside) {
+			summary.Kept++
+		} else {
+			summary.Errors++
+		}
+	case OperationPrune:
+		summary.Pruned++
+	case OperationRestore:
+		summary.Restored++
+	case OperationEject:
+		summary.Ejected++
+	case OperationPurge:
+		if reason == nil {
+			summary.Purged++
+		} else {
+			summary.Errors++
+		}
+	case OperationMove:
+		summary.Moved++
+	case OperationChmod:
+		if reason == nil {
+			summary.Chmodded++
+		} else {
+			summary.Errors++
+		}
+	}
+}
+
+// String formats the summary as a single line, like "12 linked, 2 removed, 140
+// up to date, 1 error".
+func (summary Summary) String() string {
+	var parts []string
+	addCount := func(count int, verb, dryRunVerb string) {
+		if count == 0 {
+			return
+		} else if summary.DryRun {
+			parts = append(parts, fmt.Sprintf("would %s %d", dryRunVerb, count))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %s", count, verb))
+		}
+	}
+	addCount(summary.Added, "added", "add")
+	addCount(summary.Adopted, "adopted", "adopt")
+	addCount(summary.Linked, "linked", "link")
+	addCount(summary.Copied, "copied", "copy")
+	addCount(summary.Removed, "removed", "remove")
+	addCount(summary.Kept, "kept", "keep")
+	addCount(summary.Pruned, "pruned", "prune")
+	addCount(summary.Restored, "restored", "restore")
+	addCount(summary.Ejected, "ejected", "eject")
+	addCount(summary.Purged, "purged", "purge")
+	addCount(summary.Moved, "moved", "move")
+	addCount(summary.Chmodded, "chmodded", "chmod")
+	if summary.UpToDate > 0 {
+		parts = append(parts, fmt.Sprintf("%d up to date", summary.UpToDate))
+	}
+	if summary.Errors == 1 {
+		parts = append(parts, "1 error")
+	} else if summary.Errors > 1 {
+		parts = append(parts, fmt.Sprintf("%d errors", summary.Errors))
+	}
+	if len(parts) == 0 {
+		return "nothing to do"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SkippedFiles is a group of files which were skipped because of the same
+// error, see Dfm.Skipped.
+type SkippedFiles struct {
+	// The error message, without the file name
+	Reason string `json:"reason"`
+	// The error for the first file, which can be used to tell what kind of
+	// error it was
+	Err error `json:"-"`
+	// Paths relative to the target directory, in the order they were skipped
+	Paths []string `json:"paths"`
+}
+
+// Skipped returns the files this dfm instance skipped because of errors,
+// grouped by the error message in the order the messages first appeared.
+// Files which were already up to date, and files which the autoclean kept, are
+// not included.
+func (dfm *Dfm) Skipped() []SkippedFiles {
+	skipped := make([]SkippedFiles, len(dfm.skipped))
+	for i, group := range dfm.skipped {
+		skipped[i] = *group
+		skipped[i].Paths = append([]string(nil), group.Paths...)
+	}
+	return skipped
+}
+
+// recordSkip adds a skipped file to the group for its error.
+func (dfm *Dfm) recordSkip(relative string, reason error) {
+	message := reason.Error()
+	if fileErr, ok := reason.(*FileError); ok {
+		message = fileErr.Message
+	}
+	for _, group := range dfm.skipped {
+		if group.Reason == message {
+			group.Paths = append(group.Paths, relative)
+			return
+		}
+	}
+	dfm.skipped = append(dfm.skipped, &SkippedFiles{Reason: message, Err: reason, Paths: []string{relative}})
+}
+
 func noErrorHandler(err *FileError) error {
 	return err
 }
@@ -42,9 +238,125 @@ type Dfm struct {
 	Config Config
 	// The log function used by this dfm instance
 	Logger Logger
+	// Receives every operation this dfm instance performs, after Logger is
+	// called
+	Events EventHandler
 	// When set, don't actually do file operations, only log
 	DryRun bool
-	fs     afero.Fs
+	// When set, only sync files provided by these repos. Files provided by
+	// other repos are neither synced nor autocleaned.
+	OnlyRepos []string
+	// When set, files matching any of these patterns are neither synced nor
+	// autocleaned, nor added by AddFiles. Patterns are globs matched against
+	// the target-relative path; a pattern matching a directory excludes
+	// everything inside it.
+	Exclude []string
+	// The maximum number of files to sync at the same time. Values less than
+	// 2 sync files one at a time.
+	Jobs int
+	// When set, called after each file is synced with the number of files
+	// synced so far and the total number of files to sync.
+	Progress func(completed, total int)
+	// When set, called while copying a file larger than CopyProgressSize with
+	// the path being written, the number of bytes copied so far, and the size
+	// of the file.
+	CopyProgress func(filename string, copied, total int64)
+	// Files larger than this report CopyProgress. When 0,
+	// DefaultCopyProgressSize is used.
+	CopyProgressSize int64
+	// Size of the buffer used to copy files. When 0, DefaultCopyBufferSize is
+	// used.
+	CopyBufferSize int
+	// When set, AddFiles commits the added files to git, the same as the
+	// git.autocommit config option.
+	Commit bool
+	// When set, linked files are hard linked instead of symlinked, the same
+	// as listing them in the [hardlink] config table.
+	HardLink bool
+	// When set, files which are in the way of syncing are removed, and the
+	// autoclean removes tracked files even if they appear to have been
+	// changed outside of dfm.
+	Force bool
+	// When set along with Force, directories which are in the way of syncing
+	// a file are removed with everything in them. Otherwise, they are
+	// reported as errors.
+	ForceDirs bool
+	// When set, files which Force would remove from the target directory are
+	// moved to their BackupPath instead, the same as the backup config
+	// option.
+	Backup bool
+	// When set, a full sync also scans the whole target directory for links
+	// into the dfm directory or the repos whose destination no longer exists,
+	// and removes them. Links which point anywhere else are left alone.
+	PruneBroken bool
+	// When set, EjectFiles also deletes each file from its repo, once the
+	// copy in the target directory is verified.
+	DeleteEjected bool
+	// When set, files removed from the target directory are moved to the
+	// trash instead, the same as the trash config option. See TrashDirname.
+	Trash bool
+	// Called when the autoclean would remove more files than the
+	// autoclean_limit config option allows, with the files which would be
+	// removed. Unless it returns true, the sync is aborted with a
+	// TooManyRemovalsError before anything is modified. Not called in dry run
+	// mode.
+	ConfirmRemovals func(files []string) bool
+	// When set, files which can't be symlinked because the filesystem or
+	// operating system doesn't allow it are copied instead, the same as the
+	// link_fallback = "copy" config option.
+	FallbackCopy bool
+	// When set, AddFiles stores the added files as variants with this
+	// selector. See VariantSeparator.
+	Variant string
+	// When set, AddFiles adds files which may contain secrets, instead of
+	// refusing to. See the [sensitive] config table.
+	AllowSensitive bool
+	// When set, AddFiles moves files which are linked from another repo into
+	// the repo being added to, like MoveToRepo, instead of refusing to.
+	MoveFromCurrent bool
+	// When set, AddFiles stores the single file being added at this path in
+	// the repo, instead of at its path in the target directory, and records
+	// the path in the [map] table so that it is synced back to where it was.
+	StoreAs string
+	// When set, called before AddFiles adds any of the files it found in
+	// directories, with those files, their total size in bytes, and whether
+	// that is more than AddLimit or AddSizeLimit. The files are only added if
+	// it returns true. When it isn't set, adding more than the limits is
+	// refused.
+	ConfirmAdd func(files []string, size int64, overLimit bool) bool
+	// When set, a full sync doesn't add new files in the directories listed
+	// in the track_dirs config option.
+	NoAutoAdd bool
+	// When set, AddFiles adds the file a symlink points to, and replaces the
+	// symlink with dfm's own link, instead of refusing to add symlinks.
+	FollowSymlinks bool
+	// Name of the command being run, like "link", which is recorded in the
+	// journal.
+	Command string
+	// When set, the time spent in each part of a sync is measured, see
+	// Timings.
+	Timing bool
+	// Used to run hooks and git. When nil, commands are run with sh in the
+	// dfm directory.
+	RunCommand CommandRunner
+	fs         afero.Fs
+	summary    Summary
+	// Files skipped because of errors, see Skipped
+	skipped []*SkippedFiles
+	// Files changed by the current sync, used for [onchange]
+	changed []string
+	// Directory in the trash for files removed by this instance
+	trashTime string
+	// Files provided by more than one repo, found by the last buildFileList,
+	// mapped to the repos in order of precedence
+	shadowed map[string][]string
+	// Identifies this instance in the journal
+	journalRun string
+	// Set once writing to the journal failed, so that it is only warned
+	// about once
+	journalFailed bool
+	// Measured durations, when Timing is set
+	timings *Timings
 }
 
 // NewDfm creates a new dfm instance with the provided dfm dir.
@@ -60,19 +372,58 @@ func NewDfmFs(fs afero.Fs, dfmDir string) (*Dfm, error) {
 		return nil, err
 	}
 	return &Dfm{fs: fs, Config: config}, nil
-
 }
 
 func (dfm *Dfm) log(operation, relative, repo string, reason error) {
+	dfm.logPaths(operation, relative, repo, "", "", reason)
+}
+
+// logPaths is log for operations whose paths were already worked out, so that
+// the Event has the paths which were actually used. Empty paths are filled in
+// from the repo and the target directory.
+func (dfm *Dfm) logPaths(operation, relative, repo, source, target string, reason error) {
+	dfm.summary.record(operation, reason)
+	if operation == OperationSkip && eventLevel(operation, reason) == LevelError {
+		dfm.recordSkip(relative, reason)
+	}
+	dfm.journal(operation, relative, repo, reason)
+	if dfm.changed != nil {
+		switch operation {
+		case OperationLink, OperationCopy:
+			dfm.changed = append(dfm.changed, relative)
+		case OperationRemove:
+			if reason == nil || errors.Is(reason, os.ErrNotExist) {
+				dfm.changed = append(dfm.changed, relative)
+			}
+		}
+	}
 	if dfm.Logger != nil {
 		dfm.Logger(operation, relative, repo, reason)
 	}
+	if dfm.Events != nil {
+		event := dfm.newEvent(operation, relative, repo, reason)
+		if source != "" {
+			event.Source = source
+		}
+		if target != "" {
+			event.Target = target
+		}
+		dfm.Events.HandleEvent(event)
+	}
+}
+
+// Summary returns the counts of all operations this dfm instance has performed.
+func (dfm *Dfm) Summary() Summary {
+	summary := dfm.summary
+	summary.DryRun = dfm.DryRun
+	return summary
 }
 
 func (dfm *Dfm) saveConfig() error {
 	if dfm.DryRun {
 		return nil
 	}
+	defer dfm.addTime(phaseSaveConfig, dfm.timer())
 	if saveErr := dfm.Config.Save(); saveErr != nil {
 		return saveErr
 	}
@@ -80,11 +431,37 @@ func (dfm *Dfm) saveConfig() error {
 }
 
 // Init will prepare the configured directory for use with dfm, creating it if
-// necessary.
+// necessary. Any configured repos which do not exist will be created.
 func (dfm *Dfm) Init() error {
+	for _, repo := range dfm.Config.repos {
+		if err := dfm.createRepo(repo); err != nil {
+			return err
+		}
+	}
 	return dfm.saveConfig()
 }
 
+// createRepo makes sure that the directory for the given repo exists.
+func (dfm *Dfm) createRepo(repo string) error {
+	repoPath := dfm.RepoPath(repo, "")
+	stat, err := dfm.fs.Stat(repoPath)
+	if err == nil {
+		if !stat.IsDir() {
+			return NewFileErrorf(repoPath, "repo %#v exists but is not a directory", repo)
+		}
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return WrapFileError(err, repoPath)
+	}
+	if !dfm.DryRun {
+		if err := dfm.fs.MkdirAll(repoPath, 0777); err != nil {
+			return WrapFileError(err, repoPath)
+		}
+	}
+	dfm.log(OperationCreateRepo, repo, repo, nil)
+	return nil
+}
+
 // IsValidRepo returns true if the given name is a directory in the dfm dir.
 func (dfm *Dfm) IsValidRepo(repo string) bool {
 	fs := dfm.fs
@@ -98,6 +475,7 @@ func (dfm *Dfm) IsValidRepo(repo string) bool {
 // HasRepo returns true if the given name is a repository that is currently
 // configured to be used.
 func (dfm *Dfm) HasRepo(repo string) bool {
+	repo = path.Clean(repo)
 	for _, test := range dfm.Config.repos {
 		if test == repo {
 			return true
@@ -108,21 +486,23 @@ func (dfm *Dfm) HasRepo(repo string) bool {
 
 func (dfm *Dfm) assertIsActiveRepo(repo string) error {
 	if !dfm.IsValidRepo(repo) {
-		return fmt.Errorf("repo %#v does not exist. To create it, run:\nmkdir %s", repo, dfm.RepoPath(repo, ""))
+		return fmt.Errorf("repo %#v does not exist. To create it, run:\nmkdir -p %s", repo, dfm.RepoPath(repo, ""))
 	} else if !dfm.HasRepo(repo) {
 		return fmt.Errorf("repo %#v is not active, cannot add files to it", repo)
 	}
 	return nil
 }
 
-// RepoPath returns the path to the given file inside of the given repo.
+// RepoPath returns the path to the given file inside of the given repo. If the
+// repo is a symlink to another directory, the path will be inside of the
+// resolved directory.
 func (dfm *Dfm) RepoPath(repo string, relative string) string {
-	return pathJoin(dfm.Config.path, repo, relative)
+	return normalizedJoin(dfm.fs, dfm.Config.repoRoot(repo), dfm.Config.repoRelative(repo, relative))
 }
 
 // TargetPath returns the path to the given file inside of the target.
 func (dfm *Dfm) TargetPath(relative string) string {
-	return pathJoin(dfm.Config.targetPath, relative)
+	return normalizedJoin(dfm.fs, dfm.Config.targetPath, relative)
 }
 
 // addFile is the internal implementation of AddFile and AddFiles. Does less
@@ -130,26 +510,100 @@ func (dfm *Dfm) TargetPath(relative string) string {
 func (dfm *Dfm) addFile(relativePath string, repo string, link bool) (string, error) {
 	fs := dfm.fs
 	targetPath := dfm.TargetPath(relativePath)
-	repoPath := dfm.RepoPath(repo, relativePath)
+	repoPath := dfm.addedPath(relativePath, repo)
+	// The file whose contents are added, which is the file a link points to
+	// with FollowSymlinks.
+	source := targetPath
 	isRegular, err := IsRegularFile(fs, targetPath)
 	if err != nil {
 		return "", WrapFileError(err, targetPath)
-	} else if !isRegular {
+	} else if linkDest, isLink := readLink(fs, targetPath); isLink || !isRegular {
 		if linked, err := IsLinkedFile(fs, repoPath, targetPath); linked || err != nil {
 			if err != nil {
 				return "", err
 			}
 			return "", ErrNotNeeded
 		}
-		return "", NewFileError(targetPath, "only regular files are supported")
+		if current := dfm.linkedRepo(relativePath); current != "" && current != repo {
+			return "", NewFileErrorf(relativePath, "already synced from %s; to move it into %s, use dfm mv --repo %s, or add it with --move-from-current", current, repo, repo)
+		} else if !isLink {
+			stat, err := lstat(fs, targetPath)
+			if err != nil {
+				return "", WrapFileError(err, relativePath)
+			}
+			return "", NewFileErrorf(relativePath, "is %s; only regular files can be added", describeFileType(stat.Mode()))
+		}
+		linkDest = NormalizePath(pathJoin(path.Dir(targetPath), linkDest))
+		resolved, err := resolveLink(fs, targetPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", NewFileErrorf(relativePath, "is a link to %s, which doesn't exist", linkDest)
+		} else if err != nil {
+			return "", WrapFileError(err, relativePath)
+		} else if other := dfm.repoContaining(linkDest); other != "" && !dfm.FollowSymlinks {
+			return "", NewFileErrorf(relativePath, "is a link to %s, which is a different file in %s; to add a copy of it, use --follow-symlinks", linkDest, other)
+		} else if !dfm.FollowSymlinks {
+			return "", NewFileErrorf(relativePath, "is a link to %s; to add the file it points to instead, use --follow-symlinks", linkDest)
+		}
+		stat, err := lstat(fs, resolved)
+		if err != nil {
+			return "", WrapFileError(err, relativePath)
+		} else if !stat.Mode().IsRegular() {
+			return "", NewFileErrorf(relativePath, "is a link to %s, which is %s; only regular files can be added", linkDest, describeFileType(stat.Mode()))
+		}
+		source = resolved
+	}
+	if _, err := lstat(fs, repoPath); err == nil {
+		// The file may have been added before, for example by a setup
+		// script which is run again.
+		identical, err := IsIdenticalFile(fs, source, repoPath)
+		if err != nil {
+			return "", WrapFileError(err, repoPath)
+		} else if !identical {
+			return "", &FileError{
+				Message:  fmt.Sprintf("%s already has a different version of this file; use dfm adopt to replace it with this one, or --force", repo),
+				Filename: relativePath,
+				cause:    &os.PathError{Op: "add", Path: repoPath, Err: os.ErrExist},
+			}
+		} else if !link && source == targetPath {
+			return "", ErrNotNeeded
+		}
+		// Only the link, or the copy, is missing.
+		if !dfm.DryRun {
+			if err := RemoveFile(fs, targetPath); err != nil {
+				return "", WrapFileError(err, targetPath)
+			}
+			if err := dfm.placeAdded(repoPath, targetPath, link); err != nil {
+				return "", err
+			}
+		}
+		return relativePath, nil
+	}
+	if err := dfm.checkSensitive(relativePath, repo); err != nil {
+		return "", err
 	}
 	if dfm.DryRun {
 		// do nothing
 	} else {
-		if err := MakeDirAll(fs, path.Dir(relativePath), dfm.Config.targetPath, dfm.RepoPath(repo, "")); err != nil {
+		if repoRelative := dfm.Config.repoRelative(repo, relativePath); repoRelative != relativePath {
+			// The directories in the repo don't match the target's.
+			if err := fs.MkdirAll(path.Dir(repoPath), 0777); err != nil {
+				return "", WrapFileError(err, repoRelative)
+			}
+		} else if err := MakeDirAll(fs, path.Dir(relativePath), dfm.Config.targetPath, dfm.RepoPath(repo, "")); err != nil {
 			return "", WrapFileError(err, relativePath)
 		}
-		if link {
+		if source != targetPath {
+			// The old link is replaced by one to the repo, or a copy.
+			if err := copyFile(fs, source, repoPath, dfm.copyOptions(repoPath)); err != nil {
+				return "", WrapFileError(err, repoPath)
+			}
+			if err := RemoveFile(fs, targetPath); err != nil {
+				return "", WrapFileError(err, targetPath)
+			}
+			if err := dfm.placeAdded(repoPath, targetPath, link); err != nil {
+				return "", err
+			}
+		} else if link {
 			if err := MoveFile(fs, targetPath, repoPath); err != nil {
 				return "", WrapFileError(err, repoPath)
 			}
@@ -157,7 +611,7 @@ func (dfm *Dfm) addFile(relativePath string, repo string, link bool) (string, er
 				return "", WrapFileError(err, targetPath)
 			}
 		} else {
-			if err := CopyFile(fs, targetPath, repoPath); err != nil {
+			if err := copyFile(fs, targetPath, repoPath, dfm.copyOptions(repoPath)); err != nil {
 				return "", WrapFileError(err, repoPath)
 			}
 		}
@@ -165,6 +619,51 @@ func (dfm *Dfm) addFile(relativePath string, repo string, link bool) (string, er
 	return relativePath, nil
 }
 
+// placeAdded links or copies the file which was added to the repo back to
+// the target path, which must not exist.
+func (dfm *Dfm) placeAdded(repoPath, targetPath string, link bool) error {
+	var err error
+	if link {
+		err = LinkFile(dfm.fs, repoPath, targetPath)
+	} else {
+		err = copyFile(dfm.fs, repoPath, targetPath, dfm.copyOptions(targetPath))
+	}
+	if err != nil {
+		return WrapFileError(err, targetPath)
+	}
+	return nil
+}
+
+// addedPath returns the path in the repo which addFile adds the file to.
+func (dfm *Dfm) addedPath(relative, repo string) string {
+	if dfm.Variant != "" {
+		return normalizedJoin(dfm.fs, dfm.Config.repoRoot(repo), dfm.Config.repoRelative(repo, relative)+VariantSeparator+dfm.Variant)
+	}
+	return dfm.RepoPath(repo, relative)
+}
+
+// confirmAdd checks that the files found in directories are few and small
+// enough to add without confirmation, or that ConfirmAdd allows them. A
+// directory full of caches would otherwise end up in the repo. Nothing has
+// been added yet when this is called.
+func (dfm *Dfm) confirmAdd(files []string) error {
+	var size int64
+	for _, relative := range files {
+		if stat, err := lstat(dfm.fs, dfm.TargetPath(relative)); err == nil {
+			size += stat.Size()
+		}
+	}
+	overLimit := len(files) > AddLimit || size > AddSizeLimit
+	if dfm.ConfirmAdd != nil {
+		if dfm.ConfirmAdd(files, size, overLimit) {
+			return nil
+		}
+	} else if !overLimit {
+		return nil
+	}
+	return &TooManyAddsError{Files: files, Size: size}
+}
+
 // AddFile will copy the provided file into dfm, optionally replacing the
 // original with a symlink to the imported file.
 func (dfm *Dfm) AddFile(filename string, repo string, link bool) error {
@@ -174,313 +673,859 @@ func (dfm *Dfm) AddFile(filename string, repo string, link bool) error {
 // AddFiles will copy all of the provided files into dfm, optionally replacing
 // the originals with symlinks to the imported ones.
 func (dfm *Dfm) AddFiles(inputFilenames []string, repo string, link bool, errorHandler ErrorHandler) error {
+	return dfm.AddFilesContext(context.Background(), inputFilenames, repo, link, errorHandler)
+}
+
+// AddFilesContext is AddFiles with support for cancellation. If the context is
+// canceled, no more files are added and the context's error is returned.
+func (dfm *Dfm) AddFilesContext(ctx context.Context, inputFilenames []string, repo string, link bool, errorHandler ErrorHandler) error {
 	if err := dfm.assertIsActiveRepo(repo); err != nil {
 		return err
+	} else if dfm.Variant != "" && !containsString(dfm.variantSelectors(), dfm.Variant) {
+		// The target file is replaced with a link to the variant, so it
+		// needs to be the one this machine uses.
+		return fmt.Errorf("variant %#v does not match this machine (%s)", dfm.Variant, strings.Join(dfm.variantSelectors(), ", "))
 	}
 
-	fileList := ordered_map.NewOrderedMap()
+	patterns, err := dfm.ignorePatterns(repo)
+	if err != nil {
+		return err
+	}
+	fileList := newOrderedFiles()
+	canonicalTarget := resolvePath(dfm.fs, dfm.Config.targetPath)
+	var inputRelative string
+	// Files which were found by walking a directory
+	var fromDirs []string
 	for _, inputFilename := range inputFilenames {
 		joined := pathJoin(dfm.Config.targetPath, inputFilename)
-		if !strings.HasPrefix(joined, dfm.Config.targetPath) {
+		relative, ok := RelativePath(dfm.Config.targetPath, joined)
+		if !ok {
+			// The target may be reached through a symlinked directory.
+			relative, ok = RelativePath(canonicalTarget, canonicalPath(dfm.fs, joined))
+			joined = pathJoin(dfm.Config.targetPath, relative)
+		}
+		if !ok {
 			return NewFileErrorf(inputFilename, "not in target path (%s)", dfm.Config.targetPath)
-		} else if strings.HasPrefix(joined, dfm.Config.path) {
+		} else if relative == "." {
+			return NewFileError(inputFilename, "cannot add the entire target directory")
+		} else if dfm.isInsideRepos(joined) {
 			return NewFileError(inputFilename, "cannot add a file already inside the dfm directory")
 		}
-		err := populateFileList(dfm.fs, dfm.Config.targetPath, inputFilename, fileList, repo)
+		inputFiles := newOrderedFiles()
+		err := populateFileList(dfm.fs, dfm.Config.targetPath, relative, inputFiles, repo, nil, nil)
 		if err != nil {
 			return err
 		}
+		inputRelative = NormalizePath(relative)
+		for _, filename := range inputFiles.Keys() {
+			if dfm.isExcluded(filename) {
+				continue
+			} else if filename != inputRelative {
+				if isIgnored(patterns, inputRelative, filename) {
+					continue
+				}
+				fromDirs = append(fromDirs, filename)
+			}
+			fileList.Set(filename, repo)
+		}
+	}
+	if len(fromDirs) > 0 && !dfm.DryRun {
+		if err := dfm.confirmAdd(fromDirs); err != nil {
+			return err
+		}
 	}
 
-	iter := fileList.IterFunc()
+	fileList = sortFileList(fileList)
+	storedAs := ""
+	if dfm.StoreAs != "" {
+		if len(inputFilenames) != 1 || fileList.Len() != 1 || fileList.Keys()[0] != inputRelative {
+			return errors.New("only a single file can be stored at another path in the repo")
+		}
+		repoRelative, err := cleanRepoRelative(dfm.StoreAs)
+		if err != nil {
+			return err
+		} else if err := dfm.Config.mapPath(repoRelative, inputRelative); err != nil {
+			return err
+		}
+		storedAs = inputRelative
+	}
 	var overallErr error
-	for kv, ok := iter(); ok; kv, ok = iter() {
-		filename := kv.Key.(string)
+	stored := false
+	var added, moved []string
+	for _, filename := range fileList.Keys() {
+		if err := ctx.Err(); err != nil {
+			overallErr = err
+			break
+		}
+		if dfm.MoveFromCurrent {
+			if current := dfm.linkedRepo(filename); current != "" && current != repo {
+				moved = append(moved, filename)
+				continue
+			}
+		}
 		fileOperation := OperationAdd
 		var relativePath string
-		skip, abort, fileErr := processWithRetry(errorHandler, func() *FileError {
+		attempt := fileAttempt{OperationAdd, repo, dfm.addedPath(filename, repo), dfm.TargetPath(filename)}
+		skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, dfm.withForce(func() *FileError {
 			var rawErr error
 			relativePath, rawErr = dfm.addFile(filename, repo, link)
 			if rawErr == nil {
 				return nil
 			}
 			return WrapFileError(rawErr, filename)
-		})
+		}, nil))
 		if abort {
 			overallErr = fileErr
 			break
 		} else if skip {
 			fileOperation = OperationSkip
+			if IsNotNeeded(fileErr) {
+				// The file is already in the repo, so it is tracked.
+				dfm.Config.manifest[filename] = true
+				if !link && !dfm.DryRun {
+					dfm.recordChecksum(filename, dfm.TargetPath(filename))
+				}
+				stored = true
+			}
 		} else {
 			dfm.Config.manifest[relativePath] = true
+			stored = true
+			if !link && !dfm.DryRun {
+				// The original is left in place as a copy.
+				dfm.recordChecksum(relativePath, dfm.TargetPath(relativePath))
+			}
+			// Git needs the path the file has in the repo.
+			repoRelative := dfm.Config.repoRelative(repo, relativePath)
+			if dfm.Variant != "" {
+				added = append(added, repoRelative+VariantSeparator+dfm.Variant)
+			} else {
+				added = append(added, repoRelative)
+			}
 		}
-		dfm.log(fileOperation, filename, repo, fileErr)
+		dfm.logPaths(fileOperation, filename, repo, dfm.addedPath(filename, repo), dfm.TargetPath(filename), fileErr)
+	}
+	if overallErr == nil && len(moved) > 0 {
+		overallErr = dfm.moveFilesToRepo(ctx, moved, repo, errorHandler)
+	}
+	if storedAs != "" && !stored {
+		// The file isn't in the repo, so it isn't stored anywhere.
+		dfm.Config.unmapPath(storedAs)
 	}
 
 	if saveErr := dfm.saveConfig(); saveErr != nil {
 		return saveErr
+	} else if overallErr != nil {
+		return overallErr
+	}
+	if dfm.Commit || dfm.Config.git.Autocommit {
+		return dfm.commitAdded(repo, added)
 	}
-	return overallErr
+	return nil
+}
+
+// repoContaining returns the active repo which the absolute path is inside
+// of, or "" if there is none. When repos are nested, the innermost one is
+// returned.
+func (dfm *Dfm) repoContaining(absolute string) string {
+	found, longest := "", 0
+	for _, repo := range dfm.Config.repos {
+		root := dfm.RepoPath(repo, "")
+		if isInside(root, absolute) && len(root) > longest {
+			found, longest = repo, len(root)
+		}
+	}
+	return found
+}
+
+// isInsideRepos returns true if the given absolute path is inside of the dfm
+// directory or any of the configured repos. Repos are normally inside of the
+// dfm directory, but may be absolute paths elsewhere.
+func (dfm *Dfm) isInsideRepos(absolute string) bool {
+	if isInside(dfm.Config.path, absolute) {
+		return true
+	}
+	for _, repo := range dfm.Config.repos {
+		if isInside(dfm.RepoPath(repo, ""), absolute) ||
+			isInside(pathJoin(dfm.Config.path, repo), absolute) {
+			return true
+		}
+	}
+	return false
 }
 
 // buildFileList scans the given paths in each repo, and returns an OrderedMap
 // of relative -> repo. Only the file existing in the last-referenced repo will
-// be used.
-func (dfm *Dfm) buildFileList(paths []string) (*ordered_map.OrderedMap, error) {
-	fs := dfm.fs
+// be used. Files which are in more than one repo are warned about, unless the
+// conflicts config option allows them, or makes them an error, which
+// planFiles reports.
+func (dfm *Dfm) buildFileList(paths []string) (*orderedFiles, error) {
+	defer dfm.addTime(phaseFileList, dfm.timer())
 	// Map relative -> repo. Later repos override earlier ones.
-	fileList := ordered_map.NewOrderedMap()
+	fileList := newOrderedFiles()
+	// Map relative -> repos, in the order they were found.
+	providers := map[string][]string{}
 	for _, path := range paths {
 		found := false
 		for _, repo := range dfm.Config.repos {
-			err := populateFileList(fs, dfm.RepoPath(repo, ""), path, fileList, repo)
+			repoFiles := newOrderedFiles()
+			err := dfm.populateRepoFileList(repo, path, repoFiles)
 			if err == nil {
 				found = true
-			} else if !os.IsNotExist(err) {
+			} else if !errors.Is(err, os.ErrNotExist) {
 				return nil, err
 			}
+			for _, relative := range repoFiles.Keys() {
+				if !containsString(providers[relative], repo) {
+					providers[relative] = append(providers[relative], repo)
+				}
+				fileList.Set(relative, repo)
+			}
 		}
 		if !found {
 			return nil, NewFileError(path, "not found in any active repositories")
 		}
 	}
+	fileList = sortFileList(fileList)
+	dfm.shadowed = map[string][]string{}
+	for _, relative := range fileList.Keys() {
+		repos := providers[relative]
+		if len(repos) < 2 {
+			continue
+		}
+		// Put the repo which is used first.
+		ordered := make([]string, len(repos))
+		for i, repo := range repos {
+			ordered[len(repos)-1-i] = repo
+		}
+		dfm.shadowed[relative] = ordered
+		if dfm.Config.conflicts != ConflictsAllow && dfm.Config.conflicts != ConflictsError {
+			dfm.log(OperationWarning, relative, ordered[0], conflictError(relative, ordered))
+		}
+	}
 	return fileList, nil
 }
 
-// syncFiles will handle the given list of files and add files to the manifest
-// appropriately.
-func (dfm *Dfm) syncFiles(
-	fileList *ordered_map.OrderedMap,
-	nextManifest map[string]bool,
-	errorHandler ErrorHandler,
-	operation string,
-	handleFile func(s, d string) error,
-) error {
-	iter := fileList.IterFunc()
-	var overallErr error
-	for kv, ok := iter(); ok; kv, ok = iter() {
-		relative := kv.Key.(string)
-		// Add this file to the manifest now. Even if there is an error, we
-		// don't want autoclean to remove this file.
-		nextManifest[relative] = true
-		repo := kv.Value.(string)
-		repoPath := dfm.RepoPath(repo, relative)
-		targetPath := dfm.TargetPath(relative)
-		fileOperation := operation
-		skip, abort, fileErr := processWithRetry(errorHandler, func() *FileError {
-			rawErr := handleFile(repoPath, targetPath)
-			if rawErr == nil {
-				return nil
+// Overrides returns the repos which also contain the file, but are overridden
+// by the repo it is synced from, in order of precedence. It only knows about
+// the files found by the most recent sync, plan or status.
+func (dfm *Dfm) Overrides(relative string) []string {
+	if repos := dfm.shadowed[relative]; len(repos) > 1 {
+		return append([]string(nil), repos[1:]...)
+	}
+	return nil
+}
+
+// conflictError describes a file which is provided by more than one repo. The
+// repos are given in order of precedence.
+func conflictError(relative string, repos []string) *FileError {
+	return NewFileErrorf(relative, "provided by %s; using %s", strings.Join(repos, ", "), repos[0])
+}
+
+// populateRepoFileList adds the files in the repo under the relative path to
+// the file list. Directories which are linked as a whole are added as a single
+// entry, and variants are added under the path they provide. The repo's
+// IgnoreFilename is left out.
+func (dfm *Dfm) populateRepoFileList(repo, relative string, fileList *orderedFiles) error {
+	if len(dfm.Config.pathMap) > 0 || dfm.Config.usesDotPrefix(repo) {
+		return dfm.populateMappedFileList(repo, relative, fileList)
+	}
+	linkedDir := func(dir string) bool {
+		return dfm.isLinkedDir(repo, dir)
+	}
+	repoFiles := newOrderedFiles()
+	err := populateFileList(dfm.fs, dfm.RepoPath(repo, ""), relative, repoFiles, repo, linkedDir, dfm.variantSelectors())
+	for _, key := range repoFiles.Keys() {
+		// The ignore file belongs to the repo, not the target directory.
+		if key != IgnoreFilename {
+			fileList.Set(key, repo)
+		}
+	}
+	return err
+}
+
+// isLinkedDir returns true if the directory in the repo should be linked as a
+// whole instead of linking each file in it. This is the case when it matches
+// the symlink_dirs config option or contains a DirMarkerFilename file.
+func (dfm *Dfm) isLinkedDir(repo, relative string) bool {
+	repoPath := normalizedJoin(dfm.fs, dfm.Config.repoRoot(repo), relative)
+	if isDir, err := afero.IsDir(dfm.fs, repoPath); err != nil || !isDir {
+		return false
+	}
+	for _, pattern := range dfm.Config.symlinkDirs {
+		if matchesPattern(pattern, dfm.Config.targetRelative(repo, relative)) {
+			return true
+		}
+	}
+	exists, _ := afero.Exists(dfm.fs, pathJoin(repoPath, DirMarkerFilename))
+	return exists
+}
+
+// checkOnlyRepos verifies that every repo in OnlyRepos is active.
+func (dfm *Dfm) checkOnlyRepos() error {
+	for _, repo := range dfm.OnlyRepos {
+		if !dfm.HasRepo(repo) {
+			return fmt.Errorf("repo %#v is not active", repo)
+		}
+	}
+	return nil
+}
+
+// filterFileList removes the files which are excluded from this run from the
+// given file list. The excluded files are returned as a map of relative ->
+// repo.
+func (dfm *Dfm) filterFileList(fileList *orderedFiles) (*orderedFiles, map[string]string) {
+	excluded := map[string]string{}
+	if len(dfm.OnlyRepos) == 0 && len(dfm.Exclude) == 0 {
+		return fileList, excluded
+	}
+	filtered := newOrderedFiles()
+	for _, relative := range fileList.Keys() {
+		repo, _ := fileList.Get(relative)
+		if dfm.isOnlyRepo(repo) && !dfm.isExcluded(relative) {
+			filtered.Set(relative, repo)
+		} else {
+			excluded[relative] = repo
+		}
+	}
+	dfm.warnUnusedExcludes(fileList)
+	return filtered, excluded
+}
+
+// isExcluded returns true if the given relative path matches any of the
+// Exclude patterns.
+func (dfm *Dfm) isExcluded(relative string) bool {
+	for _, pattern := range dfm.Exclude {
+		if matchesPattern(pattern, relative) {
+			return true
+		}
+	}
+	return false
+}
+
+// useLinkFallback returns true if files should be copied when symlinks can't
+// be created.
+func (dfm *Dfm) useLinkFallback() bool {
+	return dfm.FallbackCopy || dfm.Config.linkFallback == LinkFallbackCopy
+}
+
+// useHardLink returns true if the file should be hard linked instead of
+// symlinked, either because of the HardLink option or the [hardlink] config
+// table.
+func (dfm *Dfm) useHardLink(relative, repo string) bool {
+	if dfm.HardLink {
+		return true
+	}
+	for _, name := range dfm.Config.hardLink.Repos {
+		if name == repo {
+			return true
+		}
+	}
+	for _, pattern := range dfm.Config.hardLink.Files {
+		if matchesPattern(pattern, relative) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnUnusedExcludes logs a warning for each Exclude pattern which matches
+// neither a file in the file list nor a tracked file, since that is most
+// likely a typo.
+func (dfm *Dfm) warnUnusedExcludes(fileList *orderedFiles) {
+	for _, pattern := range dfm.Exclude {
+		used := false
+		for _, relative := range fileList.Keys() {
+			if matchesPattern(pattern, relative) {
+				used = true
+				break
 			}
-			return WrapFileError(rawErr, relative)
-		})
-		if abort {
-			overallErr = fileErr
-			break
-		} else if skip {
-			fileOperation = OperationSkip
 		}
-		dfm.log(fileOperation, relative, repo, fileErr)
+		for filename := range dfm.Config.manifest {
+			if used {
+				break
+			}
+			used = matchesPattern(pattern, filename)
+		}
+		if !used {
+			dfm.log(OperationWarning, pattern, "", NewFileError(pattern, "exclusion did not match any files"))
+		}
 	}
-	return overallErr
+}
+
+// isOnlyRepo returns true if files from the given repo should be synced.
+func (dfm *Dfm) isOnlyRepo(repo string) bool {
+	if len(dfm.OnlyRepos) == 0 {
+		return true
+	}
+	for _, test := range dfm.OnlyRepos {
+		if path.Clean(test) == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// keepExcluded adds the tracked files which were excluded from this run to
+// nextManifest, so that the autoclean leaves them alone. A tracked file that no
+// repo provides anymore is only left for the autoclean if it is linked into
+// one of the repos being synced, since otherwise it may belong to an excluded
+// repo.
+func (dfm *Dfm) keepExcluded(nextManifest map[string]bool, excluded map[string]string) {
+	for filename := range dfm.Config.manifest {
+		if _, ok := nextManifest[filename]; ok {
+			continue
+		} else if _, ok := excluded[filename]; ok {
+			nextManifest[filename] = true
+		} else if dfm.isExcluded(filename) {
+			nextManifest[filename] = true
+		} else if len(dfm.OnlyRepos) > 0 && !dfm.isLinkedToOnlyRepos(filename) {
+			nextManifest[filename] = true
+		}
+	}
+}
+
+// isLinkedToOnlyRepos returns true if the target file is a link into one of
+// the repos being synced.
+func (dfm *Dfm) isLinkedToOnlyRepos(relative string) bool {
+	for _, repo := range dfm.OnlyRepos {
+		if dfm.isLinkedToRepo(path.Clean(repo), relative) {
+			return true
+		}
+	}
+	return false
 }
 
 // runPartialSync is used for syncing specific files. It accepts a list of
 // relative filenames to sync, updates the manifest, but does not run the
 // cleanup.
 func (dfm *Dfm) runPartialSync(
+	ctx context.Context,
 	inputFilenames []string,
 	errorHandler ErrorHandler,
 	operation string,
 	handleFile func(s, d string) error,
 ) error {
-	fileList, err := dfm.buildFileList(inputFilenames)
-	if err != nil {
+	return dfm.withHooks(operation, func() error {
+		plan, err := dfm.planPartialSync(inputFilenames, operation)
+		if err != nil {
+			return err
+		}
+		err = dfm.applyPlan(ctx, plan, errorHandler, handleFile)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
 		return err
-	}
-	err = dfm.syncFiles(fileList, dfm.Config.manifest, errorHandler, operation, handleFile)
-	if saveErr := dfm.saveConfig(); saveErr != nil {
-		return saveErr
-	}
-	return err
+	})
 }
 
 // runSync is the main sync function, responsible for listing all files to be
 // synced, syncing them, then running the cleanup.
 func (dfm *Dfm) runSync(
+	ctx context.Context,
 	errorHandler ErrorHandler,
 	operation string,
 	handleFile func(s, d string) error,
 ) error {
-	fileList, err := dfm.buildFileList([]string{"."})
-	if err != nil {
-		return err
-	}
-
-	nextManifest := make(map[string]bool, fileList.Len())
-	err = dfm.syncFiles(fileList, nextManifest, errorHandler, operation, handleFile)
-	if err != nil {
-		// Since there was an error, we will bypass the autoclean. This
-		// means all existing files plus all new files are presently synced.
-		// Merge the old and new manifests.
-		for filename := range dfm.Config.manifest {
-			nextManifest[filename] = true
+	return dfm.withHooks(operation, func() error {
+		if err := dfm.autoAdd(ctx, operation, errorHandler); err != nil {
+			return err
 		}
-		dfm.Config.manifest = nextManifest
-	} else {
-		dfm.autoclean(nextManifest)
-	}
-
-	if saveErr := dfm.saveConfig(); saveErr != nil {
-		return saveErr
-	}
-	return err
+		plan, err := dfm.planSync(operation)
+		if err != nil {
+			return err
+		}
+		// If there is an error, the autoclean is bypassed. This means all
+		// existing files plus all new files are presently synced.
+		err = dfm.applyPlan(ctx, plan, errorHandler, handleFile)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
 }
 
-// handleLink is the workhorse for linking files.
+// handleLink is the workhorse for linking files. The plan has already created
+// the parent directories and removed any file being replaced.
 func (dfm *Dfm) handleLink(s, d string) error {
-	done, err := IsLinkedFile(dfm.fs, s, d)
-	if err != nil {
-		return err
-	} else if done {
-		return ErrNotNeeded
-	} else if dfm.DryRun {
-		return nil
-	}
-	relativePath := d[len(dfm.Config.targetPath)+1:]
-	repoPath := s[:len(s)-len(relativePath)-1]
-	if err := MakeDirAll(dfm.fs, path.Dir(relativePath), repoPath, dfm.Config.targetPath); err != nil {
-		return err
-	}
 	return LinkFile(dfm.fs, s, d)
 }
 
 // handleCopy is the workhorse for copying files.
 func (dfm *Dfm) handleCopy(s, d string) error {
-	// XXX - check if file is identical
-	if dfm.DryRun {
-		return nil
+	return copyFile(dfm.fs, s, d, dfm.copyOptions(d))
+}
+
+// copyOptions returns the options for copying a file to dest.
+func (dfm *Dfm) copyOptions(dest string) copyOptions {
+	options := copyOptions{
+		clone:        !dfm.Config.noClone,
+		bufferSize:   dfm.CopyBufferSize,
+		progressSize: dfm.CopyProgressSize,
 	}
-	isLinked, err := IsLinkedFile(dfm.fs, s, d)
-	if err != nil {
-		return err
-	} else if isLinked {
-		// We allow copy to replace a link to its source file. This should only
-		// come up when ejecting.
-		err = RemoveFile(dfm.fs, d)
-		if err != nil {
-			return err
+	if dfm.CopyProgress != nil {
+		options.progress = func(copied, total int64) {
+			dfm.CopyProgress(dest, copied, total)
 		}
 	}
-	relativePath := d[len(dfm.Config.targetPath)+1:]
-	repoPath := s[:len(s)-len(relativePath)-1]
-	if err := MakeDirAll(dfm.fs, path.Dir(relativePath), repoPath, dfm.Config.targetPath); err != nil {
-		return err
-	}
-	return CopyFile(dfm.fs, s, d)
+	return options
 }
 
 // LinkFiles creates symlinks for the given files only. Does not run the
 // autoclean, but does update the manifest.
 func (dfm *Dfm) LinkFiles(inputFilenames []string, errorHandler ErrorHandler) error {
-	return dfm.runPartialSync(inputFilenames, errorHandler, OperationLink, dfm.handleLink)
+	return dfm.LinkFilesContext(context.Background(), inputFilenames, errorHandler)
+}
+
+// LinkFilesContext is LinkFiles with support for cancellation. If the context
+// is canceled, no more files are linked and the context's error is returned.
+func (dfm *Dfm) LinkFilesContext(ctx context.Context, inputFilenames []string, errorHandler ErrorHandler) error {
+	return dfm.runPartialSync(ctx, inputFilenames, errorHandler, OperationLink, dfm.handleLink)
+}
+
+// LinkChangedContext links the given files after they changed in the repos,
+// for example because they were edited. Unlike LinkFiles, the files don't need
+// to exist: tracked files which are no longer provided by any repo are removed
+// from the target directory.
+func (dfm *Dfm) LinkChangedContext(ctx context.Context, inputFilenames []string, errorHandler ErrorHandler) error {
+	return dfm.runChangedSync(ctx, inputFilenames, errorHandler, OperationLink, dfm.handleLink)
 }
 
 // LinkAll creates symlinks for files in all repos in the target directory and
-// runs the autoclean.
+// runs the autoclean. This is the same as applying PlanLink.
 func (dfm *Dfm) LinkAll(errorHandler ErrorHandler) error {
-	return dfm.runSync(errorHandler, OperationLink, dfm.handleLink)
+	return dfm.LinkAllContext(context.Background(), errorHandler)
+}
+
+// LinkAllContext is LinkAll with support for cancellation. If the context is
+// canceled, no more files are linked or removed and the context's error is
+// returned. The manifest is updated the same way as when the errorHandler
+// aborts.
+func (dfm *Dfm) LinkAllContext(ctx context.Context, errorHandler ErrorHandler) error {
+	return dfm.runSync(ctx, errorHandler, OperationLink, dfm.handleLink)
 }
 
 // CopyFiles copies the given files to the target directory. Does not run the
 // autoclean, but does update the manifest.
 func (dfm *Dfm) CopyFiles(inputFilenames []string, errorHandler ErrorHandler) error {
-	return dfm.runPartialSync(inputFilenames, errorHandler, OperationCopy, dfm.handleCopy)
+	return dfm.CopyFilesContext(context.Background(), inputFilenames, errorHandler)
+}
+
+// CopyFilesContext is CopyFiles with support for cancellation. If the context
+// is canceled, no more files are copied and the context's error is returned.
+func (dfm *Dfm) CopyFilesContext(ctx context.Context, inputFilenames []string, errorHandler ErrorHandler) error {
+	return dfm.runPartialSync(ctx, inputFilenames, errorHandler, OperationCopy, dfm.handleCopy)
+}
+
+// CopyChangedContext is LinkChangedContext, but copies the files instead of
+// linking them.
+func (dfm *Dfm) CopyChangedContext(ctx context.Context, inputFilenames []string, errorHandler ErrorHandler) error {
+	return dfm.runChangedSync(ctx, inputFilenames, errorHandler, OperationCopy, dfm.handleCopy)
 }
 
 // CopyAll copies all files in all report to the target directory and
-// runs the autoclean.
+// runs the autoclean. This is the same as applying PlanCopy.
 func (dfm *Dfm) CopyAll(errorHandler ErrorHandler) error {
-	return dfm.runSync(errorHandler, OperationCopy, dfm.handleCopy)
+	return dfm.CopyAllContext(context.Background(), errorHandler)
+}
+
+// CopyAllContext is CopyAll with support for cancellation. If the context is
+// canceled, no more files are copied or removed and the context's error is
+// returned. The manifest is updated the same way as when the errorHandler
+// aborts.
+func (dfm *Dfm) CopyAllContext(ctx context.Context, errorHandler ErrorHandler) error {
+	return dfm.runSync(ctx, errorHandler, OperationCopy, dfm.handleCopy)
 }
 
 // RemoveFiles removes the given files from the target directory and from the
 // manifest.
 func (dfm *Dfm) RemoveFiles(inputFilenames []string) error {
-	nextManifest := make(map[string]bool, len(dfm.Config.manifest))
-	for filename := range dfm.Config.manifest {
-		nextManifest[filename] = true
-	}
-	for _, filename := range inputFilenames {
-		if _, ok := nextManifest[filename]; !ok {
-			dfm.log(OperationSkip, filename, "", NewFileError(filename, "not tracked by dfm"))
-		} else {
+	return dfm.RemoveFilesContext(context.Background(), inputFilenames)
+}
+
+// RemoveFilesContext is RemoveFiles with support for cancellation. Files which
+// were not removed before the context was canceled remain in the manifest.
+func (dfm *Dfm) RemoveFilesContext(ctx context.Context, inputFilenames []string) error {
+	return dfm.withHooks(OperationRemove, func() error {
+		nextManifest := make(map[string]bool, len(dfm.Config.manifest))
+		for filename := range dfm.Config.manifest {
+			nextManifest[filename] = true
+		}
+		for _, filename := range inputFilenames {
+			if _, ok := nextManifest[filename]; !ok {
+				dfm.log(OperationSkip, filename, "", NewFileError(filename, "not tracked by dfm"))
+			} else {
+				delete(nextManifest, filename)
+			}
+		}
+		err := dfm.autoclean(ctx, nextManifest, ReasonNoLongerTracked)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
+}
+
+// PurgeFiles removes the given files from dfm entirely: like RemoveFiles, they
+// are removed from the target directory and the manifest, and then they are
+// also deleted from the repo which provides them, or from every repo which has
+// them when allRepos is set. Directories in the repos which are left empty are
+// removed as well. Unless Force is set, a file which was copied to the target
+// and no longer matches the repo file is passed to the errorHandler, since the
+// changes to it would be lost, and so is any file which can't be deleted.
+func (dfm *Dfm) PurgeFiles(inputFilenames []string, allRepos bool, errorHandler ErrorHandler) error {
+	return dfm.PurgeFilesContext(context.Background(), inputFilenames, allRepos, errorHandler)
+}
+
+// PurgeFilesContext is PurgeFiles with support for cancellation. Files which
+// were not removed from the target before the context was canceled are not
+// deleted from the repos either.
+func (dfm *Dfm) PurgeFilesContext(ctx context.Context, inputFilenames []string, allRepos bool, errorHandler ErrorHandler) error {
+	return dfm.withHooks(OperationRemove, func() error {
+		nextManifest := make(map[string]bool, len(dfm.Config.manifest))
+		for filename := range dfm.Config.manifest {
+			nextManifest[filename] = true
+		}
+		purged := map[string][]Provider{}
+		for _, filename := range inputFilenames {
+			if _, ok := nextManifest[filename]; !ok {
+				dfm.log(OperationSkip, filename, "", NewFileError(filename, "not tracked by dfm"))
+				continue
+			}
+			providers, err := dfm.Which(filename)
+			if err != nil {
+				return err
+			}
+			if len(providers) > 0 && !dfm.Force {
+				provider := providers[0]
+				attempt := fileAttempt{OperationPurge, provider.Repo, provider.SourcePath, dfm.TargetPath(filename)}
+				skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+					if modified, err := dfm.isModifiedCopy(filename, provider.SourcePath); err != nil {
+						return WrapFileError(err, filename)
+					} else if modified {
+						return NewFileErrorf(filename, "not purging: the file differs from the one in %s", provider.Repo)
+					}
+					return nil
+				})
+				if abort {
+					return fileErr
+				} else if skip {
+					dfm.log(OperationSkip, filename, provider.Repo, fileErr)
+					continue
+				}
+			}
+			if len(providers) > 1 && !allRepos {
+				providers = providers[:1]
+			}
+			purged[filename] = providers
 			delete(nextManifest, filename)
 		}
+		err := dfm.autoclean(ctx, nextManifest, ReasonNoLongerTracked)
+		for _, filename := range inputFilenames {
+			providers, ok := purged[filename]
+			if !ok || dfm.Config.manifest[filename] {
+				// The file is still in the target.
+				continue
+			}
+			for _, provider := range providers {
+				attempt := fileAttempt{OperationPurge, provider.Repo, provider.SourcePath, dfm.TargetPath(filename)}
+				_, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+					if err := dfm.purgeFile(provider); err != nil {
+						return WrapFileError(err, filename)
+					}
+					return nil
+				})
+				if abort {
+					err = fileErr
+					break
+				}
+				dfm.logPaths(OperationPurge, filename, provider.Repo, provider.SourcePath, "", fileErr)
+			}
+			if err != nil {
+				break
+			} else if _, target := dfm.Config.mapping(filename); target != filename || dfm.DryRun {
+				continue
+			} else if remaining, _ := dfm.Which(filename); len(remaining) == 0 {
+				// No repo stores the file anymore.
+				dfm.Config.unmapPath(filename)
+			}
+		}
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
+}
+
+// isModifiedCopy returns true if the target file is not a link to the source,
+// and its contents differ from it.
+func (dfm *Dfm) isModifiedCopy(relative, source string) (bool, error) {
+	target := dfm.TargetPath(relative)
+	if _, err := lstat(dfm.fs, target); errors.Is(err, os.ErrNotExist) {
+		return false, nil
 	}
-	dfm.autoclean(nextManifest)
-	if saveErr := dfm.saveConfig(); saveErr != nil {
-		return saveErr
+	if linked, err := IsLinkedFile(dfm.fs, source, target); err != nil || linked {
+		return false, err
 	}
-	return nil
+	if isDir, err := afero.IsDir(dfm.fs, source); err != nil || isDir {
+		return false, err
+	}
+	identical, err := IsIdenticalFile(dfm.fs, source, target)
+	return !identical, err
+}
+
+// purgeFile deletes a file from its repo, along with any directories in the
+// repo which are left empty.
+func (dfm *Dfm) purgeFile(provider Provider) error {
+	if dfm.DryRun {
+		return nil
+	}
+	if err := dfm.fs.RemoveAll(provider.SourcePath); err != nil {
+		return err
+	}
+	return CleanDirectories(dfm.fs, path.Dir(provider.SourcePath), dfm.RepoPath(provider.Repo, ""))
 }
 
 // RemoveAll removes all tracked files from the target directory.
 func (dfm *Dfm) RemoveAll() error {
-	nextManifest := map[string]bool{}
-	dfm.autoclean(nextManifest)
-	if saveErr := dfm.saveConfig(); saveErr != nil {
-		return saveErr
-	}
-	return nil
+	return dfm.RemoveAllContext(context.Background())
+}
+
+// RemoveAllContext is RemoveAll with support for cancellation. Files which were
+// not removed before the context was canceled remain in the manifest.
+func (dfm *Dfm) RemoveAllContext(ctx context.Context) error {
+	return dfm.withHooks(OperationRemove, func() error {
+		nextManifest := map[string]bool{}
+		err := dfm.autoclean(ctx, nextManifest, ReasonNoLongerTracked)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
 }
 
 // EjectFiles copies the given files to the target directory, but removes them
 // from the manifest. This results in future operations failing due to an
-// existing file, as well as the autoclean never removing the files.
+// existing file, as well as the autoclean never removing the files. With
+// DeleteEjected, the files are then deleted from their repos, but only if the
+// copy in the target matches the repo file. With OnlyRepos, only the files
+// which are synced from those repos are ejected; files which they provide, but
+// which are synced from another repo, are logged as skipped.
 func (dfm *Dfm) EjectFiles(inputFilenames []string, errorHandler ErrorHandler) error {
+	return dfm.EjectFilesContext(context.Background(), inputFilenames, errorHandler)
+}
+
+// EjectFilesContext is EjectFiles with support for cancellation.
+func (dfm *Dfm) EjectFilesContext(ctx context.Context, inputFilenames []string, errorHandler ErrorHandler) error {
+	if err := dfm.checkOnlyRepos(); err != nil {
+		return err
+	}
 	fileList, err := dfm.buildFileList(inputFilenames)
 	if err != nil {
 		return err
 	}
-	err = dfm.syncFiles(fileList, dfm.Config.manifest, errorHandler, OperationCopy, dfm.handleCopy)
-	iter := fileList.IterFunc()
-	for kv, ok := iter(); ok; kv, ok = iter() {
-		relative := kv.Key.(string)
+	if len(dfm.OnlyRepos) > 0 {
+		if fileList, err = dfm.ejectedFromRepos(ctx, fileList, errorHandler); err != nil {
+			return err
+		}
+	}
+	plan := newPlan(OperationCopy)
+	plan.logOperation = OperationEject
+	dfm.planFiles(plan, fileList)
+	err = dfm.applyPlan(ctx, plan, errorHandler, dfm.handleCopy)
+	for _, relative := range fileList.Keys() {
 		// Remove the file from the manifest
 		delete(dfm.Config.manifest, relative)
 	}
+	if err == nil && dfm.DeleteEjected {
+		err = dfm.deleteEjected(ctx, fileList, errorHandler)
+	}
 	if saveErr := dfm.saveConfig(); saveErr != nil {
 		return saveErr
 	}
 	return err
 }
 
-// autoclean will remove all synced files from the target directory except those
-// that are listed in nextManifest. The manifest will be updated but not saved.
-func (dfm *Dfm) autoclean(nextManifest map[string]bool) {
-	var toRemove []string
-	for filename := range dfm.Config.manifest {
-		_, needed := nextManifest[filename]
-		if !needed {
-			toRemove = append(toRemove, filename)
+// ejectedFromRepos returns the files in the list which are synced from one of
+// the OnlyRepos. Files which one of them provides, but which are synced from
+// another repo, are passed to the errorHandler.
+func (dfm *Dfm) ejectedFromRepos(ctx context.Context, fileList *orderedFiles, errorHandler ErrorHandler) (*orderedFiles, error) {
+	filtered := newOrderedFiles()
+	for _, relative := range fileList.Keys() {
+		repo, _ := fileList.Get(relative)
+		if dfm.isOnlyRepo(repo) {
+			filtered.Set(relative, repo)
+			continue
+		}
+		for _, shadowed := range dfm.shadowed[relative] {
+			if shadowed == repo || !dfm.isOnlyRepo(shadowed) {
+				continue
+			}
+			attempt := fileAttempt{OperationEject, shadowed, dfm.SourcePath(shadowed, relative), dfm.TargetPath(relative)}
+			_, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+				return NewFileErrorf(relative, "not ejecting: synced from %s, which takes precedence over %s", repo, shadowed)
+			})
+			if abort {
+				return nil, fileErr
+			}
+			dfm.log(OperationSkip, relative, shadowed, fileErr)
+			break
 		}
 	}
-	sort.Strings(toRemove)
-	for _, filename := range toRemove {
-		var err error
+	return filtered, nil
+}
+
+// deleteEjected deletes the ejected files from their repos. A file is only
+// deleted if the target is a copy of it, so a failed eject never loses it. The
+// failed eject was already logged, so these files are left alone silently.
+func (dfm *Dfm) deleteEjected(ctx context.Context, fileList *orderedFiles, errorHandler ErrorHandler) error {
+	for _, relative := range fileList.Keys() {
+		repo, _ := fileList.Get(relative)
+		provider := Provider{Relative: relative, Repo: repo, SourcePath: dfm.SourcePath(repo, relative)}
 		if !dfm.DryRun {
-			err = RemoveFile(dfm.fs, dfm.TargetPath(filename))
-			if err == nil {
-				err = CleanDirectories(dfm.fs, path.Dir(dfm.TargetPath(filename)), dfm.Config.targetPath)
+			if copied, err := dfm.isCopyOf(provider.SourcePath, dfm.TargetPath(relative)); err != nil || !copied {
+				continue
 			}
 		}
-		dfm.log(OperationRemove, filename, "", err)
-		if err == nil || os.IsNotExist(err) {
-			delete(dfm.Config.manifest, filename)
+		attempt := fileAttempt{OperationPurge, repo, provider.SourcePath, dfm.TargetPath(relative)}
+		skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+			if err := dfm.purgeFile(provider); err != nil {
+				return WrapFileError(err, relative)
+			}
+			return nil
+		})
+		if abort {
+			return fileErr
+		} else if skip {
+			dfm.log(OperationSkip, relative, repo, fileErr)
+		} else {
+			dfm.logPaths(OperationPurge, relative, repo, provider.SourcePath, "", nil)
 		}
 	}
-	for filename := range nextManifest {
-		dfm.Config.manifest[filename] = true
+	return nil
+}
+
+// isCopyOf returns true if target is a regular file with the same contents as
+// source, or, for directories, a directory rather than a link to one.
+func (dfm *Dfm) isCopyOf(source, target string) (bool, error) {
+	stat, err := dfm.fs.Stat(source)
+	if err != nil {
+		return false, err
+	} else if !stat.IsDir() {
+		return IsIdenticalFile(dfm.fs, source, target)
 	}
+	if linked, err := IsLinkedFile(dfm.fs, source, target); err != nil || linked {
+		return false, err
+	}
+	return afero.IsDir(dfm.fs, target)
+}
+
+// autoclean will remove all synced files from the target directory except those
+// that are listed in nextManifest. The manifest will be updated but not saved.
+// The only error returned is from the context.
+func (dfm *Dfm) autoclean(ctx context.Context, nextManifest map[string]bool, reason string) error {
+	plan := newPlan(OperationRemove)
+	plan.manifest = nextManifest
+	dfm.planRemovals(plan, nextManifest, reason)
+	// Removals never call the error handler.
+	return dfm.applyPlan(ctx, plan, noErrorHandler, nil)
 }
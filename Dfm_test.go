@@ -1,10 +1,22 @@
-package main
+package dfm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/pelletier/go-toml"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
@@ -69,6 +81,66 @@ func TestInit(t *testing.T) {
 	require.Equal(t, emptyConfig, string(cfgBytes))
 }
 
+func TestSaveTablesWithDots(t *testing.T) {
+	fs := newFs(emptyConfig, nil)
+	dfm := newDfm(t, fs)
+	dfm.Config.onChange = map[string]string{".config/fish/*.fish": "fish -c true"}
+	dfm.Config.sensitive = map[string]string{".ssh/id_*": SensitiveBlock}
+	dfm.Config.permissions = map[string]string{".ssh/*": "600"}
+	dfm.Config.checksums = map[string]string{".bashrc": "abc"}
+	dfm.Config.manifest = map[string]bool{".bashrc": true}
+	require.NoError(t, dfm.Config.Save())
+	dfm = newDfm(t, fs)
+	require.Equal(t, map[string]string{".config/fish/*.fish": "fish -c true"}, dfm.Config.onChange)
+	require.Equal(t, map[string]string{".ssh/id_*": SensitiveBlock}, dfm.Config.sensitive)
+	require.Equal(t, map[string]string{".ssh/*": "600"}, dfm.Config.permissions)
+	require.Equal(t, map[string]string{".bashrc": "abc"}, dfm.Config.checksums)
+}
+
+func TestInitCreatesRepos(t *testing.T) {
+	fs := newFs("", []string{})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.Config.repos = []string{"files", "work"}
+	err := dfm.Init()
+	require.NoError(t, err)
+	isDir, err := afero.IsDir(fs, "/home/test/dotfiles/work")
+	require.NoError(t, err)
+	require.True(t, isDir)
+	require.Equal(t, []logMessage{
+		{OperationCreateRepo, "work", "work", ""},
+	}, logger.messages)
+}
+
+func TestInitCreatesReposDryRun(t *testing.T) {
+	fs := newFs("", []string{})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.DryRun = true
+	dfm.Config.repos = []string{"work"}
+	err := dfm.Init()
+	require.NoError(t, err)
+	exists, err := afero.Exists(fs, "/home/test/dotfiles/work")
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.Equal(t, []logMessage{
+		{OperationCreateRepo, "work", "work", ""},
+	}, logger.messages)
+}
+
+func TestInitRepoIsFile(t *testing.T) {
+	fs := newFs("", []string{"/home/test/dotfiles/work"})
+	dfm := newDfm(t, fs)
+	dfm.Config.repos = []string{"work"}
+	err := dfm.Init()
+	require.IsType(t, (*FileError)(nil), err)
+	fileError := err.(*FileError)
+	require.Equal(t, "/home/test/dotfiles/work", fileError.Filename)
+	require.Equal(t, `repo "work" exists but is not a directory`, fileError.Message)
+}
+
 func TestInitBadPath(t *testing.T) {
 	fs := newFs("", []string{})
 	_, err := NewDfmFs(fs, "/home/test/wrongdir")
@@ -77,6 +149,56 @@ func TestInitBadPath(t *testing.T) {
 	require.Equal(t, pathError.Path, "/home/test/wrongdir")
 }
 
+func TestConfigSyntaxError(t *testing.T) {
+	tests := []struct {
+		config, expected string
+	}{
+		{"repos = [\"files\"]\ntarget = \"/home\n", ".dfm.toml:2:11: unescaped control character U+000A"},
+		{"manifest = \".fileA\"\n", `.dfm.toml:1:1: "manifest" must be a list of strings, not a string`},
+		{"manifest = [1, 2]\n", `.dfm.toml:1:1: every item of "manifest" must be a string, not a number`},
+		{"[[repo]]\nname = \"files\"\n[[repo]]\nname = 2\n", `.dfm.toml:4:1: "repo.name" must be a string, not a number`},
+	}
+	for _, test := range tests {
+		fs := newFs("", []string{})
+		afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(test.config), 0666)
+		_, err := NewDfmFs(fs, "/home/test/dotfiles")
+		require.IsType(t, (*ConfigSyntaxError)(nil), err)
+		require.Equal(t, "/home/test/dotfiles/.dfm.toml", err.(*ConfigSyntaxError).Path)
+		require.EqualError(t, err, "/home/test/dotfiles/"+test.expected)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	fs := newFs("", []string{})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`repos = ["files"]
+targets = "/home/other"
+[git]
+autocomit = true
+[[repo]]
+name = "work"
+[repo.when]
+hostnme = "work-*"
+[onchange]
+".vimrc" = "vim +PlugInstall"
+`), 0666)
+	dfm := newDfm(t, fs)
+	err := dfm.Config.CheckKeys()
+	require.IsType(t, (*UnknownKeysError)(nil), err)
+	require.Equal(t, []UnknownKey{
+		{Key: "git.autocomit", Suggestion: "git.autocommit"},
+		{Key: "repo.when.hostnme", Suggestion: "repo.when.hostname"},
+		{Key: "targets", Suggestion: "target"},
+	}, err.(*UnknownKeysError).Keys)
+
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`repos = ["files"]
+colour = "never"
+`), 0666)
+	dfm = newDfm(t, fs)
+	require.EqualError(t, dfm.Config.CheckKeys(), `unknown setting "colour" in /home/test/dotfiles/.dfm.toml`)
+
+	require.NoError(t, newDfm(t, newFs(emptyConfig, nil)).Config.CheckKeys())
+}
+
 func TestAdd(t *testing.T) {
 	fs := newFs(emptyConfig, []string{"/home/test/.bashrc"})
 	dfm := newDfm(t, fs)
@@ -91,6 +213,86 @@ func TestAdd(t *testing.T) {
 	require.Equal(t, map[string]bool{".bashrc": true}, dfm.Config.manifest)
 }
 
+func TestAddCommit(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.bashrc", "/home/test/.vimrc"})
+	dfm := newDfm(t, fs)
+	var runner testRunner
+	dfm.RunCommand = runner.run
+	dfm.Commit = true
+	err := dfm.AddFiles([]string{"/home/test/.bashrc", "/home/test/.vimrc"}, "files", true, noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"git rev-parse --is-inside-work-tree >/dev/null 2>&1",
+		"git add -- 'files/.bashrc' 'files/.vimrc'",
+		"git commit --quiet -m 'Add .bashrc, .vimrc' -- 'files/.bashrc' 'files/.vimrc'",
+	}, runner.commands)
+
+	// Outside of a git repository, nothing is committed.
+	afero.WriteFile(fs, "/home/test/.zshrc", []byte(fileContent), 0666)
+	runner = testRunner{err: fmt.Errorf("exit status 128")}
+	err = dfm.AddFiles([]string{"/home/test/.zshrc"}, "files", true, noErrorHandler)
+	require.NoError(t, err)
+	require.Len(t, runner.commands, 1)
+}
+
+func TestPull(t *testing.T) {
+	fs := newFs(emptyConfig, []string{})
+	dfm := newDfm(t, fs)
+	var runner testRunner
+	dfm.RunCommand = runner.run
+	require.NoError(t, dfm.Pull())
+	require.Equal(t, []string{
+		"git rev-parse --is-inside-work-tree >/dev/null 2>&1",
+		"git pull --ff-only --quiet",
+	}, runner.commands)
+
+	runner = testRunner{}
+	dfm.DryRun = true
+	require.NoError(t, dfm.Pull())
+	require.Equal(t, []string{
+		"git rev-parse --is-inside-work-tree >/dev/null 2>&1",
+		"git fetch --quiet",
+		"git log --oneline HEAD..@{upstream}",
+	}, runner.commands)
+}
+
+func TestAddSensitive(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/.ssh/id_ed25519",
+		"/home/test/.local/share/fish/fish_history",
+		"/home/test/.netrc",
+		"/home/test/.config/token",
+	})
+	dfm := newDfm(t, fs)
+	dfm.Config.sensitive = map[string]string{
+		".netrc":        SensitiveAllow,
+		".config/token": SensitiveWarn,
+	}
+	var logger testLog
+	dfm.Logger = logger.log
+	err := dfm.AddFiles([]string{
+		"/home/test/.ssh/id_ed25519",
+		"/home/test/.local/share/fish/fish_history",
+		"/home/test/.netrc",
+		"/home/test/.config/token",
+	}, "files", true, func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".netrc": true, ".config/token": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationWarning, ".config/token", "files", `.config/token: this file may contain secrets (matches ".config/token")`},
+		{OperationAdd, ".config/token", "files", ""},
+		{OperationSkip, ".local/share/fish/fish_history", "files", `.local/share/fish/fish_history: refusing to add a file which may contain secrets (matches "*_history"). To add it anyway, use --allow-sensitive, or set the pattern to "warn" in the [sensitive] table of the config`},
+		{OperationAdd, ".netrc", "files", ""},
+		{OperationSkip, ".ssh/id_ed25519", "files", `.ssh/id_ed25519: refusing to add a file which may contain secrets (matches ".ssh/id_*"). To add it anyway, use --allow-sensitive, or set the pattern to "warn" in the [sensitive] table of the config`},
+	}, logger.messages)
+
+	logger.messages = nil
+	dfm.AllowSensitive = true
+	err = dfm.AddFile("/home/test/.ssh/id_ed25519", "files", true)
+	require.NoError(t, err)
+	require.True(t, dfm.Config.manifest[".ssh/id_ed25519"])
+}
+
 func TestAddCopy(t *testing.T) {
 	fs := newFs(emptyConfig, []string{"/home/test/.bashrc"})
 	dfm := newDfm(t, fs)
@@ -105,186 +307,3147 @@ func TestAddCopy(t *testing.T) {
 	require.Equal(t, map[string]bool{".bashrc": true}, dfm.Config.manifest)
 }
 
-func TestAddOutside(t *testing.T) {
-	fs := newFs(emptyConfig, []string{"/mnt/external/.bashrc"})
+func TestAddFromOtherRepo(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/common/.gitconfig",
+		"/home/test/dotfiles/work/.bashrc",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["common", "work"]
+target = "/home/test"
+`), 0666)
 	dfm := newDfm(t, fs)
-	err := dfm.AddFile("/mnt/external/.bashrc", "files", true)
-	require.IsType(t, (*FileError)(nil), err)
-	fileError := err.(*FileError)
-	require.Equal(t, fileError.Filename, "/mnt/external/.bashrc")
-	require.Equal(t, fileError.Message, "not in target path (/home/test)")
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+
+	err := dfm.AddFile("/home/test/.gitconfig", "work", true)
+	require.EqualError(t, err, ".gitconfig: already synced from common; to move it into work, use dfm mv --repo work, or add it with --move-from-current")
+	// A file which is already linked from the repo is up to date.
+	require.NoError(t, dfm.AddFile("/home/test/.bashrc", "work", true))
+
+	dfm.MoveFromCurrent = true
+	require.NoError(t, dfm.AddFile("/home/test/.gitconfig", "work", true))
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/work/.gitconfig", "/home/test/.gitconfig")
+	require.NoError(t, err)
+	require.True(t, linked)
+	exists, _ := afero.Exists(fs, "/home/test/dotfiles/common/.gitconfig")
+	require.False(t, exists)
+	require.Equal(t, map[string]bool{".bashrc": true, ".gitconfig": true}, dfm.Config.manifest)
 }
 
-func TestAddNested(t *testing.T) {
-	fs := newFs(emptyConfig, []string{"/home/test/.config/fish/config.fish"})
+func TestAddTwice(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.bashrc", "/home/test/.vimrc"})
 	dfm := newDfm(t, fs)
-	err := dfm.AddFile("/home/test/.config/fish/config.fish", "files", true)
+	require.NoError(t, dfm.AddFiles([]string{".bashrc", ".vimrc"}, "files", false, noErrorHandler))
+
+	dfm = newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	require.NoError(t, dfm.AddFiles([]string{".bashrc"}, "files", false, noErrorHandler))
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+	}, logger.messages)
+
+	// Adding the identical copy again with a link only creates the link.
+	require.NoError(t, dfm.AddFiles([]string{".bashrc"}, "files", true, noErrorHandler))
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/files/.bashrc", "/home/test/.bashrc")
 	require.NoError(t, err)
-	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/files/.config/fish/config.fish")
+	require.True(t, linked)
+
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("changed"), 0666)
+	err = dfm.AddFiles([]string{".vimrc"}, "files", false, noErrorHandler)
+	require.EqualError(t, err, ".vimrc: files already has a different version of this file; use dfm adopt to replace it with this one, or --force")
+	dfm.Force = true
+	require.NoError(t, dfm.AddFiles([]string{".vimrc"}, "files", false, noErrorHandler))
+	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/files/.vimrc")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(bytes))
+}
+
+func TestAddAs(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/Library/Code/User/settings.json", "/home/test/.vimrc"})
+	dfm := newDfm(t, fs)
+	dfm.StoreAs = "vscode/settings.json"
+	err := dfm.AddFiles([]string{".vimrc", "Library/Code/User/settings.json"}, "files", true, noErrorHandler)
+	require.EqualError(t, err, "only a single file can be stored at another path in the repo")
+	require.NoError(t, dfm.AddFiles([]string{"Library/Code/User/settings.json"}, "files", true, noErrorHandler))
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/files/vscode/settings.json", "/home/test/Library/Code/User/settings.json")
+	require.NoError(t, err)
+	require.True(t, linked)
+
+	dfm = newDfm(t, fs)
+	require.Equal(t, map[string]string{"vscode/settings.json": "Library/Code/User/settings.json"}, dfm.Config.pathMap)
+	require.NoError(t, fs.RemoveAll("/home/test/Library"))
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	linked, err = IsLinkedFile(fs, "/home/test/dotfiles/files/vscode/settings.json", "/home/test/Library/Code/User/settings.json")
+	require.NoError(t, err)
+	require.True(t, linked)
+	exists, _ := afero.Exists(fs, "/home/test/vscode")
+	require.False(t, exists)
+
+	// The file goes away when it is removed from the repo.
+	require.NoError(t, fs.Remove("/home/test/dotfiles/files/vscode/settings.json"))
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	exists, _ = afero.Exists(fs, "/home/test/Library/Code/User/settings.json")
+	require.False(t, exists)
+
+	dfm.StoreAs = "../settings.json"
+	err = dfm.AddFiles([]string{".vimrc"}, "files", true, noErrorHandler)
+	require.EqualError(t, err, "../settings.json: not a path inside the repo")
+}
+
+func TestPathMap(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/vscode/settings.json",
+		"/home/test/dotfiles/files/vscode/snippets/go.json",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files"]
+target = "/home/test"
+
+[map]
+  vscode = "Library/Code/User"
+`), 0666)
+	dfm := newDfm(t, fs)
+	require.Equal(t, "/home/test/dotfiles/files/vscode/snippets/go.json", dfm.RepoPath("files", "Library/Code/User/snippets/go.json"))
+	require.Equal(t, "Library/Code/User/settings.json", dfm.TargetRelative("files", "vscode/settings.json"))
+	require.NoError(t, dfm.LinkFiles([]string{"Library"}, noErrorHandler))
+	require.Equal(t, map[string]bool{
+		"Library/Code/User/settings.json":    true,
+		"Library/Code/User/snippets/go.json": true,
+	}, dfm.Config.manifest)
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/files/vscode/snippets/go.json", "/home/test/Library/Code/User/snippets/go.json")
+	require.NoError(t, err)
+	require.True(t, linked)
+	exists, _ := afero.Exists(fs, "/home/test/vscode")
+	require.False(t, exists)
+
+	// Files are added to the mapped directory.
+	afero.WriteFile(fs, "/home/test/Library/Code/User/keybindings.json", []byte(fileContent), 0666)
+	require.NoError(t, dfm.AddFiles([]string{"Library/Code/User/keybindings.json"}, "files", true, noErrorHandler))
+	exists, _ = afero.Exists(fs, "/home/test/dotfiles/files/vscode/keybindings.json")
+	require.True(t, exists)
+
+	// A file which is stored at its literal path too is a conflict.
+	afero.WriteFile(fs, "/home/test/dotfiles/files/Library/Code/User/settings.json", []byte(fileContent), 0666)
+	err = dfm.LinkAll(noErrorHandler)
+	require.EqualError(t, err, "Library/Code/User/settings.json: Library/Code/User/settings.json in files is synced here, but dfm expects it at vscode/settings.json")
+
+	dfm.Config.pathMap["code"] = "Library/Code/User"
+	err = dfm.Config.CheckMap()
+	require.EqualError(t, err, "invalid [map] table in /home/test/dotfiles/.dfm.toml:\n  Library/Code/User: both code and vscode are mapped to it")
+}
+
+func TestDotPrefix(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/dot_bashrc",
+		"/home/test/dotfiles/files/dot_config/nvim/init.lua",
+		"/home/test/dotfiles/files/bin/script",
+		"/home/test/.vimrc",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files"]
+target = "/home/test"
+dot_prefix = ["files"]
+`), 0666)
+	dfm := newDfm(t, fs)
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	require.Equal(t, map[string]bool{
+		".bashrc":               true,
+		".config/nvim/init.lua": true,
+		"bin/script":            true,
+	}, dfm.Config.manifest)
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/files/dot_config/nvim/init.lua", "/home/test/.config/nvim/init.lua")
+	require.NoError(t, err)
+	require.True(t, linked)
+
+	require.NoError(t, dfm.AddFiles([]string{".vimrc"}, "files", true, noErrorHandler))
+	linked, err = IsLinkedFile(fs, "/home/test/dotfiles/files/dot_vimrc", "/home/test/.vimrc")
+	require.NoError(t, err)
+	require.True(t, linked)
+
+	// The literal name is a conflict.
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.bashrc", []byte(fileContent), 0666)
+	err = dfm.LinkAll(noErrorHandler)
+	require.EqualError(t, err, ".bashrc: .bashrc in files is synced here, but dfm expects it at dot_bashrc")
+}
+
+func TestAddFollowSymlinks(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/old-dotfiles/zshrc", "/home/test/old-dotfiles/vimrc"})
+	require.NoError(t, LinkFile(fs, "/home/test/old-dotfiles/zshrc", "/home/test/.zshrc"))
+	require.NoError(t, LinkFile(fs, "/home/test/old-dotfiles/vimrc", "/home/test/.vimrc"))
+	require.NoError(t, LinkFile(fs, "/home/test/old-dotfiles/missing", "/home/test/.inputrc"))
+	dfm := newDfm(t, fs)
+	err := dfm.AddFiles([]string{".zshrc"}, "files", true, noErrorHandler)
+	require.EqualError(t, err, ".zshrc: is a link to /home/test/old-dotfiles/zshrc; to add the file it points to instead, use --follow-symlinks")
+	err = dfm.AddFiles([]string{".inputrc"}, "files", true, noErrorHandler)
+	require.EqualError(t, err, ".inputrc: is a link to /home/test/old-dotfiles/missing, which doesn't exist")
+
+	dfm.FollowSymlinks = true
+	require.NoError(t, dfm.AddFiles([]string{".zshrc"}, "files", true, noErrorHandler))
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/files/.zshrc", "/home/test/.zshrc")
+	require.NoError(t, err)
+	require.True(t, linked)
+	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/files/.zshrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+
+	// With --copy, the link is replaced by a copy.
+	require.NoError(t, dfm.AddFiles([]string{".vimrc"}, "files", false, noErrorHandler))
+	_, isLink := readLink(fs, "/home/test/.vimrc")
+	require.False(t, isLink)
+	bytes, err = afero.ReadFile(fs, "/home/test/.vimrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	require.True(t, dfm.Config.manifest[".vimrc"])
+}
+
+func TestAddNonRegularFile(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/zshrc",
+		"/home/test/dotfiles/work/.gitconfig",
+		"/home/test/elsewhere/vimrc",
+	})
+	require.NoError(t, fs.MkdirAll("/home/test/.config/nvim", 0777))
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "work"]
+target = "/home/test"
+`), 0666)
+	require.NoError(t, LinkFile(fs, "/home/test/dotfiles/files/.bashrc", "/home/test/.bashrc"))
+	require.NoError(t, LinkFile(fs, "/home/test/dotfiles/work/.gitconfig", "/home/test/.gitconfig"))
+	require.NoError(t, LinkFile(fs, "/home/test/dotfiles/files/zshrc", "/home/test/.zshrc"))
+	require.NoError(t, LinkFile(fs, "/home/test/elsewhere/vimrc", "/home/test/.vimrc"))
+	require.NoError(t, LinkFile(fs, "/home/test/.config/nvim", "/home/test/.nvim"))
+	dfm := newDfm(t, fs)
+
+	_, err := dfm.addFile(".bashrc", "files", true)
+	require.Equal(t, ErrNotNeeded, err)
+	_, err = dfm.addFile(".gitconfig", "files", true)
+	require.EqualError(t, err, ".gitconfig: already synced from work; to move it into files, use dfm mv --repo files, or add it with --move-from-current")
+	_, err = dfm.addFile(".zshrc", "files", true)
+	require.EqualError(t, err, ".zshrc: is a link to /home/test/dotfiles/files/zshrc, which is a different file in files; to add a copy of it, use --follow-symlinks")
+	_, err = dfm.addFile(".vimrc", "files", true)
+	require.EqualError(t, err, ".vimrc: is a link to /home/test/elsewhere/vimrc; to add the file it points to instead, use --follow-symlinks")
+	_, err = dfm.addFile(".config/nvim", "files", true)
+	require.EqualError(t, err, ".config/nvim: is a directory; only regular files can be added")
+	dfm.FollowSymlinks = true
+	_, err = dfm.addFile(".nvim", "files", true)
+	require.EqualError(t, err, ".nvim: is a link to /home/test/.config/nvim, which is a directory; only regular files can be added")
+}
+
+func TestAddDirectory(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/.config/nvim/init.lua",
+		"/home/test/.config/nvim/lua/plugins.lua",
+		"/home/test/.config/nvim/plugin/packer_compiled.lua",
+		"/home/test/.config/nvim/spell/en.utf-8.add.spl",
+		"/home/test/.config/nvim/session.vim",
+		"/home/test/.config/nvim/lua/.luarc.json",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files"]
+target = "/home/test"
+ignore = ["*.spl", ".config/nvim/plugin"]
+`), 0666)
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.dfmignore", []byte("# Editor state\nsession.vim\n"), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Exclude = []string{".config/nvim/lua/.luarc.json"}
+	var confirmed []string
+	dfm.ConfirmAdd = func(files []string, size int64, overLimit bool) bool {
+		confirmed = files
+		require.Equal(t, int64(2*len(fileContent)), size)
+		require.False(t, overLimit)
+		return true
+	}
+	require.NoError(t, dfm.AddFiles([]string{".config/nvim"}, "files", true, noErrorHandler))
+	require.Equal(t, []string{".config/nvim/init.lua", ".config/nvim/lua/plugins.lua"}, confirmed)
+	require.Equal(t, map[string]bool{
+		".config/nvim/init.lua":        true,
+		".config/nvim/lua/plugins.lua": true,
+	}, dfm.Config.manifest)
+
+	// The ignore file isn't synced.
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	exists, _ := afero.Exists(fs, "/home/test/.dfmignore")
+	require.False(t, exists)
+
+	// A file which is named on its own is added even if it is ignored.
+	dfm.ConfirmAdd = nil
+	require.NoError(t, dfm.AddFiles([]string{".config/nvim/session.vim"}, "files", true, noErrorHandler))
+	require.True(t, dfm.Config.manifest[".config/nvim/session.vim"])
+
+	for i := 0; i <= AddLimit; i++ {
+		afero.WriteFile(fs, fmt.Sprintf("/home/test/.cache/%d", i), []byte(fileContent), 0666)
+	}
+	err := dfm.AddFiles([]string{".cache"}, "files", true, noErrorHandler)
+	require.EqualError(t, err, "not adding 101 files totaling 2 KB from directories; the limit without confirmation is 100 files or 10 MB")
+	exists, _ = afero.Exists(fs, "/home/test/dotfiles/files/.cache")
+	require.False(t, exists)
+}
+
+func TestTrackDirs(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.config/fish/functions/ll.fish",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files"]
+target = "/home/test"
+ignore = ["*.bak"]
+track_dirs = [".config/fish/functions"]
+`), 0666)
+	require.NoError(t, fs.MkdirAll("/home/test/.config/fish/functions", 0777))
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+
+	afero.WriteFile(fs, "/home/test/.config/fish/functions/gs.fish", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/.config/fish/functions/gs.fish.bak", []byte(fileContent), 0666)
+	dfm.NoAutoAdd = true
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	require.False(t, dfm.Config.manifest[".config/fish/functions/gs.fish"])
+
+	dfm.NoAutoAdd = false
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	require.Equal(t, map[string]bool{
+		".config/fish/functions/gs.fish": true,
+		".config/fish/functions/ll.fish": true,
+	}, dfm.Config.manifest)
+	require.Equal(t, 1, dfm.Summary().Added)
+	exists, _ := afero.Exists(fs, "/home/test/dotfiles/files/.config/fish/functions/gs.fish")
+	require.True(t, exists)
+	exists, _ = afero.Exists(fs, "/home/test/dotfiles/files/.config/fish/functions/gs.fish.bak")
+	require.False(t, exists)
+	target, _ := readLink(fs, "/home/test/.config/fish/functions/gs.fish")
+	require.Equal(t, "/home/test/dotfiles/files/.config/fish/functions/gs.fish", target)
+}
+
+func TestNewlineFilename(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.weird\nname"})
+	dfm := newDfm(t, fs)
+	require.NoError(t, dfm.AddFiles([]string{".weird\nname"}, "files", true, noErrorHandler))
+
+	dfm = newDfm(t, fs)
+	require.Equal(t, map[string]bool{".weird\nname": true}, dfm.Config.manifest)
+	require.NoError(t, fs.Remove("/home/test/dotfiles/files/.weird\nname"))
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	require.Equal(t, map[string]bool{}, dfm.Config.manifest)
+	exists, _ := afero.Exists(fs, "/home/test/.weird\nname")
+	require.False(t, exists)
+}
+
+func TestCopyFilePreservesMode(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/bin/script"})
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, fs.Chmod("/home/test/dotfiles/files/bin/script", 0750))
+	require.NoError(t, fs.Chtimes("/home/test/dotfiles/files/bin/script", modTime, modTime))
+	err := CopyFile(fs, "/home/test/dotfiles/files/bin/script", "/home/test/script")
+	require.NoError(t, err)
+	stat, err := fs.Stat("/home/test/script")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), stat.Mode().Perm())
+	require.True(t, modTime.Equal(stat.ModTime()))
+}
+
+func TestCopyModeChanged(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/bin/script"})
+	dfm := newDfm(t, fs)
+	err := dfm.CopyAll(noErrorHandler)
+	require.NoError(t, err)
+	require.NoError(t, fs.Chmod("/home/test/dotfiles/files/bin/script", 0755))
+	var logger testLog
+	dfm.Logger = logger.log
+
+	dfm.DryRun = true
+	err = dfm.CopyAll(noErrorHandler)
+	require.NoError(t, err)
+	dfm.DryRun = false
+	err = dfm.CopyAll(noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationChmod, "bin/script", "files", ""},
+		{OperationChmod, "bin/script", "files", ""},
+		{OperationSkip, "bin/script", "files", "bin/script: already up to date"},
+	}, logger.messages)
+	stat, err := fs.Stat("/home/test/bin/script")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+
+	// Mode changes can be ignored.
+	logger.messages = nil
+	dfm.Config.ignoreModes = true
+	require.NoError(t, fs.Chmod("/home/test/dotfiles/files/bin/script", 0700))
+	err = dfm.CopyAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, "bin/script", "files", "bin/script: already up to date"},
+	}, logger.messages)
+}
+
+func TestCopyFileOsFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfm-copy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := afero.NewOsFs()
+	source, dest := filepath.Join(dir, "source"), filepath.Join(dir, "dest")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, afero.WriteFile(fs, source, []byte(fileContent), 0600))
+	require.NoError(t, fs.Chmod(source, 0640))
+	require.NoError(t, fs.Chtimes(source, modTime, modTime))
+
+	require.NoError(t, CopyFile(fs, source, dest))
+	contents, err := afero.ReadFile(fs, dest)
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(contents))
+	stat, err := fs.Stat(dest)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+	require.True(t, modTime.Equal(stat.ModTime()))
+}
+
+func TestCopyFileExists(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/.bashrc"})
+	require.NoError(t, afero.WriteFile(fs, "/home/test/.bashrc", []byte("local"), 0644))
+	err := CopyFile(fs, "/home/test/dotfiles/files/.bashrc", "/home/test/.bashrc")
+	// --force relies on this to know that the file is in the way.
+	require.True(t, os.IsExist(err))
+	require.IsType(t, (*os.PathError)(nil), err)
+	require.Equal(t, "/home/test/.bashrc", err.(*os.PathError).Path)
+	contents, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "local", string(contents))
+}
+
+// fullDiskFs fails every write to a file it creates, like a full disk.
+type fullDiskFs struct {
+	afero.Fs
+}
+
+func (fs fullDiskFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil || flag&os.O_CREATE == 0 {
+		return file, err
+	}
+	return fullDiskFile{file}, nil
+}
+
+type fullDiskFile struct {
+	afero.File
+}
+
+func (file fullDiskFile) Write(p []byte) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+func TestCopyFilePartial(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/.bashrc"})
+	require.NoError(t, fs.MkdirAll("/home/test/.config", 0777))
+	err := CopyFile(fullDiskFs{fs}, "/home/test/dotfiles/files/.bashrc", "/home/test/.config/bashrc")
+	require.True(t, errors.Is(err, syscall.ENOSPC))
+	// Neither the copy nor the temporary file is left behind.
+	entries, err := afero.ReadDir(fs, "/home/test/.config")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+// BenchmarkCopyFile copies a few hundred small files, like a typical repo.
+func BenchmarkCopyFile(b *testing.B) {
+	dir, err := ioutil.TempDir("", "dfm-copy")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	fs := afero.NewOsFs()
+	const files = 300
+	for i := 0; i < files; i++ {
+		require.NoError(b, afero.WriteFile(fs, filepath.Join(dir, fmt.Sprintf("source%d", i)), []byte(fileContent), 0644))
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < files; i++ {
+			dest := filepath.Join(dir, fmt.Sprintf("dest%d", i))
+			require.NoError(b, CopyFile(fs, filepath.Join(dir, fmt.Sprintf("source%d", i)), dest))
+			b.StopTimer()
+			require.NoError(b, fs.Remove(dest))
+			b.StartTimer()
+		}
+	}
+}
+
+func TestCopyProgress(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/small"})
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	require.NoError(t, afero.WriteFile(fs, "/home/test/dotfiles/files/large", large, 0644))
+	dfm := newDfm(t, fs)
+	dfm.CopyBufferSize = 400
+	dfm.CopyProgressSize = 100
+	var progress []string
+	dfm.CopyProgress = func(filename string, copied, total int64) {
+		progress = append(progress, fmt.Sprintf("%s %d/%d", filename, copied, total))
+	}
+	err := dfm.CopyAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"/home/test/large 400/1000",
+		"/home/test/large 800/1000",
+		"/home/test/large 1000/1000",
+	}, progress)
+	bytes, err := afero.ReadFile(fs, "/home/test/large")
+	require.NoError(t, err)
+	require.Equal(t, large, bytes)
+	entries, err := afero.ReadDir(fs, "/home/test")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal(t, []string{"dotfiles", "large", "small"}, names)
+}
+
+func TestLinkFallback(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	unsupported := func(s, d string) error {
+		return &os.LinkError{Op: "symlink", Old: s, New: d, Err: syscall.EPERM}
+	}
+
+	// Without the fallback, the error is reported.
+	err := dfm.runSync(context.Background(), func(err *FileError) error { return nil }, OperationLink, unsupported)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: operation not permitted"},
+	}, logger.messages)
+
+	logger.messages = nil
+	dfm.FallbackCopy = true
+	err = dfm.runSync(context.Background(), noErrorHandler, OperationLink, unsupported)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationWarning, ".bashrc", "files", ".bashrc: symlinks can't be created here, so the file was copied instead"},
+		{OperationCopy, ".bashrc", "files", ""},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+
+	// The copy is remembered, so the next sync doesn't try to link it.
+	*dfm = *newDfm(t, fs)
+	require.Equal(t, map[string]bool{".bashrc": true}, dfm.Config.copied)
+	logger.messages = nil
+	dfm.Logger = logger.log
+	err = dfm.runSync(context.Background(), noErrorHandler, OperationLink, unsupported)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+	}, logger.messages)
+
+	// Other errors are not handled by copying.
+	require.False(t, isSymlinkUnsupported(&os.LinkError{Op: "symlink", Err: syscall.ENOENT}))
+}
+
+func TestUnicodeNormalization(t *testing.T) {
+	const composed = "caf\u00e9"
+	const decomposed = "cafe\u0301"
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/" + composed + "/config"})
+	// The target was linked on a filesystem which decomposes names.
+	afero.WriteFile(fs, "/home/test/"+decomposed+"/config", []byte("symlink to /home/test/dotfiles/files/"+decomposed+"/config"), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Config.manifest = configToManifest([]string{decomposed + "/config"})
+	require.Equal(t, map[string]bool{composed + "/config": true}, dfm.Config.manifest)
+	require.Equal(t, "/home/test/"+decomposed+"/config", dfm.TargetPath(composed+"/config"))
+
+	var logger testLog
+	dfm.Logger = logger.log
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, composed + "/config", "files", composed + "/config: already up to date"},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{composed + "/config": true}, dfm.Config.manifest)
+
+	// Input paths in either form refer to the same file.
+	require.Equal(t, composed+"/config", NormalizePath(decomposed+"/config"))
+	fileList := newOrderedFiles()
+	err = populateFileList(fs, "/home/test", decomposed, fileList, "", nil, nil)
+	require.NoError(t, err)
+	_, ok := fileList.Get(composed + "/config")
+	require.True(t, ok)
+}
+
+func TestCaseCollisions(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/Brewfile",
+		"/home/test/dotfiles/files/brewfile",
+		"/home/test/dotfiles/files/.bashrc",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	skipErrors := func(err *FileError) error { return nil }
+
+	// A case-sensitive target can hold both files.
+	err := dfm.LinkAll(skipErrors)
+	require.NoError(t, err)
+	require.Len(t, logger.messages, 3)
+	problems, err := dfm.Diagnose()
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	require.Equal(t, "Brewfile: differs only in case from brewfile, so they can't both be synced to a case-insensitive filesystem", problems[0].Error())
+
+	fs = newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/Brewfile",
+		"/home/test/dotfiles/files/brewfile",
+		"/home/test/dotfiles/files/.bashrc",
+	})
+	dfm = newDfm(t, fs)
+	dfm.Config.targetCase = CaseInsensitive
+	logger.messages = nil
+	dfm.Logger = logger.log
+	err = dfm.LinkAll(skipErrors)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationSkip, "Brewfile", "files", "Brewfile: differs only in case from brewfile, and the target is case-insensitive"},
+		{OperationSkip, "brewfile", "files", "brewfile: differs only in case from Brewfile, and the target is case-insensitive"},
+	}, logger.messages)
+	exists, err := afero.Exists(fs, "/home/test/Brewfile")
+	require.NoError(t, err)
+	require.False(t, exists)
+	// Both stay tracked, so neither is autocleaned.
+	require.Equal(t, map[string]bool{".bashrc": true, "Brewfile": true, "brewfile": true}, dfm.Config.manifest)
+
+	// Once one of them is gone, removing the other from the target would
+	// remove the file which replaced it, so it is only forgotten.
+	fs.Remove("/home/test/dotfiles/files/brewfile")
+	logger.messages = nil
+	err = dfm.LinkAll(skipErrors)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+		{OperationLink, "Brewfile", "files", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".bashrc": true, "Brewfile": true}, dfm.Config.manifest)
+}
+
+func TestWindowsPaths(t *testing.T) {
+	defer func(old bool) { windowsPaths = old }(windowsPaths)
+	windowsPaths = true
+	require.True(t, isAbs("C:/Users/test"))
+	require.True(t, isAbs("/home/test"))
+	require.False(t, isAbs("C:Users/test"))
+	require.False(t, isAbs("dotfiles/files"))
+	require.Equal(t, "C:/Users/test/.bashrc", pathJoin("C:/Users/test", ".bashrc"))
+	require.Equal(t, "D:/repos/work/.bashrc", pathJoin("C:/Users/test/dotfiles", "D:/repos/work", ".bashrc"))
+	windowsPaths = false
+	require.False(t, isAbs("C:/Users/test"))
+}
+
+func TestMoveFileExists(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.bashrc", "/home/test/dotfiles/files/.bashrc"})
+	err := MoveFile(fs, "/home/test/.bashrc", "/home/test/dotfiles/files/.bashrc")
+	require.True(t, os.IsExist(err))
+	require.IsType(t, (*os.PathError)(nil), err)
+	require.Equal(t, "/home/test/dotfiles/files/.bashrc", err.(*os.PathError).Path)
+	exists, err := afero.Exists(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+// crossDeviceFs fails to rename files into or out of the mount point with
+// EXDEV, like a separate filesystem, and records when files are synced and
+// removed.
+type crossDeviceFs struct {
+	afero.Fs
+	mount  string
+	events *[]string
+}
+
+func (fs crossDeviceFs) Rename(oldname, newname string) error {
+	if strings.HasPrefix(oldname, fs.mount+"/") != strings.HasPrefix(newname, fs.mount+"/") {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func (fs crossDeviceFs) Remove(name string) error {
+	*fs.events = append(*fs.events, "remove "+name)
+	return fs.Fs.Remove(name)
+}
+
+func (fs crossDeviceFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return syncRecordingFile{file, fs.events}, nil
+}
+
+type syncRecordingFile struct {
+	afero.File
+	events *[]string
+}
+
+func (file syncRecordingFile) Sync() error {
+	*file.events = append(*file.events, "sync")
+	return file.File.Sync()
+}
+
+func TestMoveFileCrossDevice(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.bashrc"})
+	require.NoError(t, fs.MkdirAll("/mnt/dotfiles", 0777))
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, fs.Chmod("/home/test/.bashrc", 0640))
+	require.NoError(t, fs.Chtimes("/home/test/.bashrc", modTime, modTime))
+
+	var events []string
+	err := MoveFile(crossDeviceFs{fs, "/mnt", &events}, "/home/test/.bashrc", "/mnt/dotfiles/.bashrc")
+	require.NoError(t, err)
+	contents, err := afero.ReadFile(fs, "/mnt/dotfiles/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(contents))
+	stat, err := fs.Stat("/mnt/dotfiles/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), stat.Mode().Perm())
+	require.True(t, modTime.Equal(stat.ModTime()))
+	exists, _ := afero.Exists(fs, "/home/test/.bashrc")
+	require.False(t, exists)
+	// The source is only removed once the copy is on disk.
+	require.Equal(t, []string{"sync", "remove /home/test/.bashrc"}, events)
+
+	// When the copy fails, the source is kept.
+	require.NoError(t, afero.WriteFile(fs, "/home/test/.bashrc", []byte(fileContent), 0644))
+	events = nil
+	err = MoveFile(crossDeviceFs{fullDiskFs{fs}, "/mnt", &events}, "/home/test/.bashrc", "/mnt/dotfiles/.profile")
+	require.True(t, errors.Is(err, syscall.ENOSPC))
+	contents, err = afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(contents))
+	exists, _ = afero.Exists(fs, "/mnt/dotfiles/.profile")
+	require.False(t, exists)
+}
+
+func TestAddOutside(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/mnt/external/.bashrc"})
+	dfm := newDfm(t, fs)
+	err := dfm.AddFile("/mnt/external/.bashrc", "files", true)
+	require.IsType(t, (*FileError)(nil), err)
+	fileError := err.(*FileError)
+	require.Equal(t, fileError.Filename, "/mnt/external/.bashrc")
+	require.Equal(t, fileError.Message, "not in target path (/home/test)")
+}
+
+func TestAddSiblingPrefix(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/testuser/.bashrc", "/home/test/.bashrc"})
+	dfm := newDfm(t, fs)
+	err := dfm.AddFile("/home/testuser/.bashrc", "files", true)
+	require.IsType(t, (*FileError)(nil), err)
+	require.Equal(t, "not in target path (/home/test)", err.(*FileError).Message)
+	err = dfm.AddFile("/home/test/", "files", true)
+	require.IsType(t, (*FileError)(nil), err)
+	require.Equal(t, "cannot add the entire target directory", err.(*FileError).Message)
+	require.Empty(t, dfm.Config.manifest)
+}
+
+func TestRelativePath(t *testing.T) {
+	cases := []struct {
+		root, target, relative string
+		ok                     bool
+	}{
+		{"/home/test", "/home/test/.bashrc", ".bashrc", true},
+		{"/home/test", "/home/test", ".", true},
+		{"/home/test/", "/home/test/.bashrc", ".bashrc", true},
+		{"/home/test", "/home/test/", ".", true},
+		{"/home/test", "/home/testuser/.bashrc", "", false},
+		{"/home/test", "/home", "", false},
+		{"/", "/etc/hosts", "etc/hosts", true},
+	}
+	for _, c := range cases {
+		relative, ok := RelativePath(c.root, c.target)
+		require.Equal(t, c.ok, ok, "%s in %s", c.target, c.root)
+		require.Equal(t, c.relative, relative, "%s in %s", c.target, c.root)
+	}
+}
+
+func TestAddNested(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.config/fish/config.fish"})
+	dfm := newDfm(t, fs)
+	err := dfm.AddFile("/home/test/.config/fish/config.fish", "files", true)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/files/.config/fish/config.fish")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+}
+
+func TestDirectoryModes(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/.ssh/config",
+		"/home/test/dotfiles/files/.gnupg/gpg.conf",
+	})
+	require.NoError(t, fs.Chmod("/home/test/.ssh", 0700))
+	require.NoError(t, fs.Chmod("/home/test/dotfiles/files/.gnupg", 0700))
+	dfm := newDfm(t, fs)
+	dfm.AllowSensitive = true
+
+	// Adding mirrors the target directories into the repo.
+	err := dfm.AddFile("/home/test/.ssh/config", "files", true)
+	require.NoError(t, err)
+	stat, err := fs.Stat("/home/test/dotfiles/files/.ssh")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	// Linking mirrors the repo directories into the target.
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	stat, err = fs.Stat("/home/test/.gnupg")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+}
+
+func TestSync(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.config/fish/config.fish",
+	})
+	dfm := newDfm(t, fs)
+	logger := &testLog{}
+	dfm.Logger = logger.log
+	handleFile := func(s, d string) error {
+		return nil
+	}
+	err := dfm.runSync(context.Background(), noErrorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".config/fish/config.fish": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".config/fish/config.fish", "files", ""},
+	}, logger.messages)
+}
+
+func TestSummary(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileB",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	fs.Remove("/home/test/dotfiles/files/.fileB")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileC", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileD", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/.fileD", []byte("other content"), 0666)
+	errorHandler := func(err *FileError) error {
+		return nil
+	}
+	err := dfm.LinkAll(errorHandler)
+	require.NoError(t, err)
+	summary := dfm.Summary()
+	require.Equal(t, Summary{Linked: 1, Removed: 1, UpToDate: 1, Errors: 1}, summary)
+	require.Equal(t, "1 linked, 1 removed, 1 up to date, 1 error", summary.String())
+	summary.DryRun = true
+	require.Equal(t, "would link 1, would remove 1, 1 up to date, 1 error", summary.String())
+	require.Equal(t, "nothing to do", Summary{}.String())
+}
+
+func TestAdoptIdentical(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileB",
+		"/home/test/.fileA",
+	})
+	afero.WriteFile(fs, "/home/test/.fileB", []byte("other content"), 0666)
+	dfm := newDfm(t, fs)
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	require.Equal(t, ActionReplaceFile, plan.Actions[0].Type)
+	require.Equal(t, ReasonIdenticalFile, plan.Actions[0].Reason)
+	require.Equal(t, ReasonFileExists, plan.Actions[1].Reason)
+	var logger testLog
+	dfm.Logger = logger.log
+	err = dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".fileA", "files", ""},
+		{OperationSkip, ".fileB", "files", ".fileB: file already exists"},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/.fileA")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.fileA", string(bytes))
+}
+
+func TestMovedDfmDir(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/app/settings.conf",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/backup/files/.vimrc",
+		"/home/test/other/files/.inputrc",
+	})
+	// Links into the old location, which no longer exists.
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("symlink to /home/test/old/files/.bashrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.config/app/settings.conf", []byte("symlink to ../../old/files/.config/app/settings.conf"), 0666)
+	// A previous path which still exists.
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("symlink to /home/test/backup/files/.vimrc"), 0666)
+	// An unrelated link to a file which exists.
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("symlink to /home/test/other/files/.inputrc"), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Config.previousPaths = []string{"/home/test/backup"}
+
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	reasons := map[string]string{}
+	for _, action := range plan.Actions {
+		reasons[action.Relative] = action.Reason
+	}
+	require.Equal(t, map[string]string{
+		".bashrc":                   ReasonDirMoved,
+		".config/app/settings.conf": ReasonDirMoved,
+		".vimrc":                    ReasonDirMoved,
+		".inputrc":                  ReasonFileExists,
+	}, reasons)
+
+	err = dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	for _, relative := range []string{".bashrc", ".config/app/settings.conf", ".vimrc"} {
+		bytes, err := afero.ReadFile(fs, "/home/test/"+relative)
+		require.NoError(t, err)
+		require.Equal(t, "symlink to /home/test/dotfiles/files/"+relative, string(bytes))
+	}
+	bytes, err := afero.ReadFile(fs, "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/other/files/.inputrc", string(bytes))
+	_, err = fs.Stat("/home/test/.bashrc.dfm-new")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestVerify(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/dotfiles/files/.zshrc",
+		"/home/test/dotfiles/files/.muttrc",
+		"/home/test/dotfiles/files/.profile",
+		"/home/test/dotfiles/files/.gitconfig",
+	})
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".bashrc", ".vimrc", ".muttrc", ".profile"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".inputrc", ".zshrc", ".gitconfig"}, noErrorHandler)
+	require.NoError(t, err)
+	// Same size and modification time, different contents.
+	stat, err := fs.Stat("/home/test/dotfiles/files/.zshrc")
+	require.NoError(t, err)
+	modTime := stat.ModTime()
+	afero.WriteFile(fs, "/home/test/.zshrc", []byte("# other  file"), 0666)
+	fs.Chtimes("/home/test/.zshrc", modTime, modTime)
+	afero.WriteFile(fs, "/home/test/.gitconfig", []byte("edited"), 0666)
+	fs.Remove("/home/test/.vimrc")
+	fs.Remove("/home/test/.muttrc")
+	afero.WriteFile(fs, "/home/test/.muttrc", []byte("symlink to /home/test/dotfiles/files/.bashrc"), 0666)
+	fs.Remove("/home/test/dotfiles/files/.profile")
+
+	mismatches, err := dfm.Verify(nil, false)
+	require.NoError(t, err)
+	require.Equal(t, []Mismatch{
+		{Relative: ".gitconfig", Repo: "files", TargetPath: "/home/test/.gitconfig", Problem: MismatchModified},
+		{Relative: ".muttrc", Repo: "files", TargetPath: "/home/test/.muttrc", Problem: MismatchWrongLink, Link: "/home/test/dotfiles/files/.bashrc"},
+		{Relative: ".profile", TargetPath: "/home/test/.profile", Problem: MismatchOrphaned},
+		{Relative: ".vimrc", Repo: "files", TargetPath: "/home/test/.vimrc", Problem: MismatchMissing},
+	}, mismatches)
+
+	mismatches, err = dfm.Verify([]string{".zshrc"}, true)
+	require.NoError(t, err)
+	require.Equal(t, []Mismatch{
+		{Relative: ".zshrc", Repo: "files", TargetPath: "/home/test/.zshrc", Problem: MismatchModified},
+	}, mismatches)
+
+	_, err = dfm.Verify([]string{".config"}, false)
+	require.EqualError(t, err, ".config: not tracked")
+}
+
+func TestRepair(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.muttrc",
+		"/home/test/dotfiles/files/.zshrc",
+		"/home/test/dotfiles/files/.profile",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/dotfiles/files/.gitconfig",
+		"/home/test/dotfiles/work/.muttrc",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "work"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".bashrc", ".vimrc", ".muttrc", ".zshrc", ".profile"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".inputrc", ".gitconfig"}, noErrorHandler)
+	require.NoError(t, err)
+	fs.Remove("/home/test/.bashrc")
+	fs.Remove("/home/test/.inputrc")
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("symlink to /home/test/old/files/.vimrc"), 0666)
+	dfm.Config.previousPaths = []string{"/home/test/old"}
+	// Shadowed by the work repo.
+	afero.WriteFile(fs, "/home/test/.muttrc", []byte("symlink to /home/test/dotfiles/files/.muttrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.zshrc", []byte("local changes"), 0666)
+	afero.WriteFile(fs, "/home/test/.gitconfig", []byte("edited"), 0666)
+
+	problems, err := dfm.Repair(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []*FileError{
+		NewFileError(".gitconfig", "modified outside dfm"),
+		NewFileError(".zshrc", "modified outside dfm"),
+	}, problems)
+	for _, relative := range []string{".bashrc", ".vimrc", ".profile"} {
+		bytes, err := afero.ReadFile(fs, "/home/test/"+relative)
+		require.NoError(t, err)
+		require.Equal(t, "symlink to /home/test/dotfiles/files/"+relative, string(bytes))
+	}
+	bytes, err := afero.ReadFile(fs, "/home/test/.muttrc")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/work/.muttrc", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.zshrc")
+	require.NoError(t, err)
+	require.Equal(t, "local changes", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.gitconfig")
+	require.NoError(t, err)
+	require.Equal(t, "edited", string(bytes))
+}
+
+func TestStats(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/dotfiles/files/.gitconfig",
+		"/home/test/dotfiles/files/.zshrc",
+		"/home/test/dotfiles/work/.bashrc",
+		"/home/test/dotfiles/work/.profile",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "work"]
+target = "/home/test"
+conflicts = "allow"
+`), 0666)
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".bashrc", ".vimrc", ".profile"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".inputrc", ".gitconfig"}, noErrorHandler)
+	require.NoError(t, err)
+	afero.WriteFile(fs, "/home/test/.gitconfig", []byte("edited"), 0666)
+
+	stats, err := dfm.Stats()
+	require.NoError(t, err)
+	require.Equal(t, &Stats{
+		Repos:       []RepoStats{{Name: "files", Files: 4}, {Name: "work", Files: 2}},
+		Tracked:     5,
+		Links:       3,
+		Copies:      2,
+		OutOfSync:   2,
+		CopiedBytes: int64(len(fileContent) + len("edited")),
+	}, stats)
+}
+
+// unwritableJournalFs fails to open the journal.
+type unwritableJournalFs struct {
+	afero.Fs
+}
+
+func (fs unwritableJournalFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if strings.HasSuffix(name, "/"+JournalFilename) {
+		return nil, os.ErrPermission
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func TestJournal(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/app.conf",
+	})
+	dfm := newDfm(t, fs)
+	dfm.Command = "link"
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	dfm.Command = "remove"
+	dfm.DryRun = true
+	err = dfm.RemoveFiles([]string{".bashrc"})
+	require.NoError(t, err)
+	dfm = newDfm(t, fs)
+	dfm.Command = "remove"
+	err = dfm.RemoveFiles([]string{".bashrc"})
+	require.NoError(t, err)
+
+	entries, err := dfm.History("", 0)
+	require.NoError(t, err)
+	var summary []string
+	for _, entry := range entries {
+		summary = append(summary, fmt.Sprintf("%s %s %s %s %s", entry.Command, entry.Operation, entry.Relative, entry.Repo, entry.Result))
+	}
+	require.Equal(t, []string{
+		"link linked .bashrc files ok",
+		"link linked .config/app.conf files ok",
+		"remove removed .bashrc  ok",
+	}, summary)
+	entries, err = dfm.History(".bashrc", 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, OperationRemove, entries[0].Operation)
+	entries, err = dfm.History(".config", 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, ".config/app.conf", entries[0].Relative)
+
+	// An unwritable journal is only warned about once.
+	dfm.fs = unwritableJournalFs{fs}
+	var logger testLog
+	dfm.Logger = logger.log
+	err = dfm.RemoveAll()
+	require.NoError(t, err)
+	require.Len(t, logger.messages, 2)
+	require.Equal(t, OperationWarning, logger.messages[0].operation)
+	require.Contains(t, logger.messages[0].reason, "can't write to the journal")
+	require.Equal(t, logMessage{OperationRemove, ".config/app.conf", "", ""}, logger.messages[1])
+}
+
+func TestPurgeFiles(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/app/app.conf",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/work/.vimrc",
+		"/home/test/dotfiles/work/.bashrc",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "work"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	require.NoError(t, dfm.LinkFiles([]string{".bashrc", ".config/app/app.conf", ".vimrc"}, noErrorHandler))
+	require.NoError(t, dfm.CopyFiles([]string{".inputrc"}, noErrorHandler))
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("changed"), 0666)
+
+	dfm = newDfm(t, fs)
+	dfm.DryRun = true
+	require.NoError(t, dfm.PurgeFiles([]string{".config/app/app.conf"}, false, noErrorHandler))
+	exists, _ := afero.Exists(fs, "/home/test/dotfiles/files/.config/app/app.conf")
+	require.True(t, exists)
+
+	dfm = newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	skipErrors := func(err *FileError) error { return nil }
+	err := dfm.PurgeFiles([]string{".config/app/app.conf", ".vimrc", ".inputrc", ".zshrc"}, false, skipErrors)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".inputrc", "files", ".inputrc: not purging: the file differs from the one in files"},
+		{OperationSkip, ".zshrc", "", ".zshrc: not tracked by dfm"},
+		{OperationRemove, ".config/app/app.conf", "", ""},
+		{OperationRemove, ".vimrc", "", ""},
+		{OperationPurge, ".config/app/app.conf", "files", ""},
+		{OperationPurge, ".vimrc", "work", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".bashrc": true, ".inputrc": true}, dfm.Config.manifest)
+	for _, filename := range []string{"dotfiles/files/.config", "dotfiles/work/.vimrc", ".vimrc"} {
+		exists, _ := afero.Exists(fs, pathJoin("/home/test", filename))
+		require.False(t, exists, filename)
+	}
+	// The shadowed file is left alone.
+	exists, _ = afero.Exists(fs, "/home/test/dotfiles/files/.vimrc")
+	require.True(t, exists)
+
+	dfm = newDfm(t, fs)
+	dfm.Force = true
+	require.NoError(t, dfm.PurgeFiles([]string{".bashrc", ".inputrc"}, true, noErrorHandler))
+	require.Equal(t, map[string]bool{}, dfm.Config.manifest)
+	for _, filename := range []string{"files/.bashrc", "work/.bashrc", "files/.inputrc"} {
+		exists, _ := afero.Exists(fs, pathJoin("/home/test/dotfiles", filename))
+		require.False(t, exists, filename)
+	}
+}
+
+func TestMove(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.config/vim/vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/.profile",
+	})
+	dfm := newDfm(t, fs)
+	require.NoError(t, dfm.LinkFiles([]string{".config/vim/vimrc", ".bashrc"}, noErrorHandler))
+	require.NoError(t, dfm.CopyFiles([]string{".inputrc"}, noErrorHandler))
+
+	dfm = newDfm(t, fs)
+	dfm.DryRun = true
+	require.NoError(t, dfm.Move(".config/vim/vimrc", ".vimrc", noErrorHandler))
+	exists, _ := afero.Exists(fs, "/home/test/dotfiles/files/.config/vim/vimrc")
+	require.True(t, exists)
+
+	dfm = newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	require.NoError(t, dfm.Move(".config/vim/vimrc", ".vimrc", noErrorHandler))
+	require.Equal(t, []logMessage{
+		{OperationMove, ".config/vim/vimrc", "files", ""},
+		{OperationRemove, ".config/vim/vimrc", "", ""},
+		{OperationLink, ".vimrc", "files", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".vimrc": true, ".bashrc": true, ".inputrc": true}, dfm.Config.manifest)
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/files/.vimrc", "/home/test/.vimrc")
+	require.NoError(t, err)
+	require.True(t, linked)
+	for _, filename := range []string{"dotfiles/files/.config", ".config"} {
+		exists, _ := afero.Exists(fs, pathJoin("/home/test", filename))
+		require.False(t, exists, filename)
+	}
+
+	// A copy stays a copy.
+	dfm = newDfm(t, fs)
+	require.NoError(t, dfm.Move(".inputrc", ".config/inputrc", noErrorHandler))
+	linked, _ = IsLinkedFile(fs, "/home/test/dotfiles/files/.config/inputrc", "/home/test/.config/inputrc")
+	require.False(t, linked)
+	identical, err := IsIdenticalFile(fs, "/home/test/dotfiles/files/.config/inputrc", "/home/test/.config/inputrc")
+	require.NoError(t, err)
+	require.True(t, identical)
+
+	dfm = newDfm(t, fs)
+	err = dfm.Move(".bashrc", ".vimrc", noErrorHandler)
+	require.EqualError(t, err, ".vimrc: already exists in files")
+	err = dfm.Move(".bashrc", ".profile", noErrorHandler)
+	require.EqualError(t, err, ".profile: already exists in the target directory")
+	err = dfm.Move(".zshrc", ".zprofile", noErrorHandler)
+	require.EqualError(t, err, ".zshrc: not tracked by dfm")
+	afero.WriteFile(fs, "/home/test/.config/inputrc", []byte("changed"), 0666)
+	err = dfm.Move(".config/inputrc", ".inputrc", noErrorHandler)
+	require.EqualError(t, err, ".config/inputrc: not moving: the file differs from the one in files")
+
+	dfm.Force = true
+	require.NoError(t, dfm.Move(".bashrc", ".profile", noErrorHandler))
+	linked, _ = IsLinkedFile(fs, "/home/test/dotfiles/files/.profile", "/home/test/.profile")
+	require.True(t, linked)
+}
+
+func TestMoveToRepo(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/common/.config/vpn.conf",
+		"/home/test/dotfiles/common/.bashrc",
+		"/home/test/dotfiles/common/.inputrc",
+		"/home/test/dotfiles/work/.bashrc",
+		"/home/test/dotfiles/work/.gitconfig",
+		"/home/test/dotfiles/extra/.gitconfig",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["common", "work", "extra"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	require.NoError(t, dfm.LinkFiles([]string{".config/vpn.conf", ".bashrc", ".gitconfig"}, noErrorHandler))
+	require.NoError(t, dfm.CopyFiles([]string{".inputrc"}, noErrorHandler))
+
+	dfm = newDfm(t, fs)
+	dfm.DryRun = true
+	require.NoError(t, dfm.MoveToRepo([]string{".config/vpn.conf"}, "work", noErrorHandler))
+	exists, _ := afero.Exists(fs, "/home/test/dotfiles/work/.config/vpn.conf")
+	require.False(t, exists)
+
+	dfm = newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	skipErrors := func(err *FileError) error { return nil }
+	require.NoError(t, dfm.MoveToRepo([]string{".config/vpn.conf", ".bashrc", ".gitconfig", ".zshrc"}, "common", skipErrors))
+	require.NoError(t, dfm.MoveToRepo([]string{".config/vpn.conf", ".inputrc"}, "work", skipErrors))
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".config/vpn.conf", "common", ".config/vpn.conf: already up to date"},
+		{OperationSkip, ".bashrc", "work", ".bashrc: already exists in common"},
+		{OperationSkip, ".gitconfig", "extra", ".gitconfig: would still be synced from work, which takes precedence over common"},
+		{OperationSkip, ".zshrc", "", ".zshrc: not in any repo"},
+		{OperationLink, ".config/vpn.conf", "work", ""},
+		{OperationMove, ".config/vpn.conf", "work", ""},
+		{OperationMove, ".inputrc", "work", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".config/vpn.conf": true, ".bashrc": true, ".gitconfig": true, ".inputrc": true}, dfm.Config.manifest)
+	linked, err := IsLinkedFile(fs, "/home/test/dotfiles/work/.config/vpn.conf", "/home/test/.config/vpn.conf")
+	require.NoError(t, err)
+	require.True(t, linked)
+	for _, filename := range []string{"common/.config", "common/.inputrc"} {
+		exists, _ := afero.Exists(fs, pathJoin("/home/test/dotfiles", filename))
+		require.False(t, exists, filename)
+	}
+	// The copy in the target is left alone.
+	identical, err := IsIdenticalFile(fs, "/home/test/dotfiles/work/.inputrc", "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.True(t, identical)
+
+	require.EqualError(t, dfm.MoveToRepo([]string{".bashrc"}, "missing", noErrorHandler), `repo "missing" does not exist. To create it, run:
+mkdir -p /home/test/dotfiles/missing`)
+}
+
+func TestUndo(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+	})
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".bashrc", ".vimrc"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".inputrc"}, noErrorHandler)
+	require.NoError(t, err)
+
+	_, err = newDfm(t, fs).Undo(noErrorHandler)
+	require.EqualError(t, err, "nothing to undo: the last run (dfm ) didn't remove or overwrite any files")
+
+	dfm = newDfm(t, fs)
+	dfm.Command = "remove"
+	dfm.Trash = true
+	err = dfm.RemoveAll()
+	require.NoError(t, err)
+	for _, relative := range []string{".bashrc", ".vimrc", ".inputrc"} {
+		exists, err := afero.Exists(fs, "/home/test/"+relative)
+		require.NoError(t, err)
+		require.False(t, exists)
+	}
+
+	dfm = newDfm(t, fs)
+	dfm.Command = "undo"
+	var logger testLog
+	dfm.Logger = logger.log
+	problems, err := dfm.Undo(noErrorHandler)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.Equal(t, []logMessage{
+		{OperationRestore, ".inputrc", "", ""},
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationLink, ".vimrc", "files", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".bashrc": true, ".vimrc": true, ".inputrc": true}, dfm.Config.manifest)
+	bytes, err := afero.ReadFile(fs, "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	require.True(t, dfm.ownsTarget(".inputrc"))
+
+	_, err = newDfm(t, fs).Undo(noErrorHandler)
+	require.EqualError(t, err, "the last run was an undo, which can't be undone")
+}
+
+func TestUndoForce(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("local bashrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("local vimrc"), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Command = "link"
+	dfm.Force = true
+	dfm.Backup = true
+	err := dfm.LinkFiles([]string{".bashrc"}, noErrorHandler)
+	require.NoError(t, err)
+	dfm.Backup = false
+	err = dfm.LinkFiles([]string{".vimrc"}, noErrorHandler)
+	require.NoError(t, err)
+
+	dfm = newDfm(t, fs)
+	dfm.Command = "undo"
+	problems, err := dfm.Undo(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []*FileError{
+		NewFileError(".vimrc", "can't be restored: it was overwritten without a backup"),
+	}, problems)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "local bashrc", string(bytes))
+	require.Equal(t, map[string]bool{".vimrc": true}, dfm.Config.manifest)
+}
+
+func TestWhich(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.gitconfig##work-laptop",
+		"/home/test/dotfiles/files/.config/nvim/init.vim",
+		"/home/test/dotfiles/work/.bashrc",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "work"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Config.hostname = "work-laptop"
+	dfm.Config.symlinkDirs = []string{".config/nvim"}
+
+	providers, err := dfm.Which(".bashrc")
+	require.NoError(t, err)
+	require.Equal(t, []Provider{
+		{Relative: ".bashrc", Repo: "work", SourcePath: "/home/test/dotfiles/work/.bashrc"},
+		{Relative: ".bashrc", Repo: "files", SourcePath: "/home/test/dotfiles/files/.bashrc"},
+	}, providers)
+
+	providers, err = dfm.Which(".gitconfig")
+	require.NoError(t, err)
+	require.Equal(t, []Provider{
+		{Relative: ".gitconfig", Repo: "files", SourcePath: "/home/test/dotfiles/files/.gitconfig##work-laptop"},
+	}, providers)
+
+	providers, err = dfm.Which(".config/nvim/init.vim")
+	require.NoError(t, err)
+	require.Equal(t, []Provider{
+		{Relative: ".config/nvim/init.vim", Repo: "files", SourcePath: "/home/test/dotfiles/files/.config/nvim/init.vim"},
+	}, providers)
+
+	for _, relative := range []string{".vimrc", ".config/nvim/missing.vim"} {
+		providers, err = dfm.Which(relative)
+		require.NoError(t, err)
+		require.Empty(t, providers)
+	}
+}
+
+func TestTrackExistingLinks(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/app/settings.conf",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/other/.inputrc",
+	})
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("symlink to /home/test/dotfiles/files/.bashrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.config/app/settings.conf", []byte("symlink to /home/test/dotfiles/files/.config/app/settings.conf"), 0666)
+	// Points to a different file in the repo.
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("symlink to /home/test/dotfiles/files/.bashrc"), 0666)
+	// Points outside of the repos.
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("symlink to /home/test/other/.inputrc"), 0666)
+	// Excluded.
+	afero.WriteFile(fs, "/home/test/cache/.bashrc", []byte("symlink to /home/test/dotfiles/files/.bashrc"), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Exclude = []string{"cache"}
+
+	tracked, err := dfm.TrackExistingLinks()
+	require.NoError(t, err)
+	require.Equal(t, []string{".bashrc", ".config/app/settings.conf"}, tracked)
+	dfm = newDfm(t, fs)
+	require.Equal(t, map[string]bool{".bashrc": true, ".config/app/settings.conf": true}, dfm.Config.manifest)
+
+	// Nothing needs to be relinked.
+	var logger testLog
+	dfm.Logger = logger.log
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	require.Equal(t, ActionNone, plan.Actions[0].Type)
+	require.Equal(t, ActionNone, plan.Actions[1].Type)
+}
+
+func TestPruneStaleManifest(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.muttrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	// Removed by hand, and later from the repo as well.
+	fs.Remove("/home/test/.muttrc")
+	fs.Remove("/home/test/dotfiles/files/.muttrc")
+	// Removed by hand, but still in the repo.
+	fs.Remove("/home/test/.vimrc")
+	var logger testLog
+	dfm.Logger = logger.log
+
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	require.Contains(t, plan.Actions, Action{
+		Type:        ActionForget,
+		Relative:    ".muttrc",
+		Destination: "/home/test/.muttrc",
+		Reason:      ReasonTargetMissing,
+		State:       StateMissing,
+	})
+
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+		{OperationLink, ".vimrc", "files", ""},
+		{OperationPrune, ".muttrc", "", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".bashrc": true, ".vimrc": true}, dfm.Config.manifest)
+	require.Equal(t, 1, dfm.Summary().Pruned)
+}
+
+func TestMigrateTarget(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/app.conf",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+	})
+	fs.MkdirAll("/home/new", 0777)
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".bashrc", ".config/app.conf", ".inputrc"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".vimrc"}, noErrorHandler)
+	require.NoError(t, err)
+	// The user replaced this file, so it stays behind.
+	fs.Remove("/home/test/.inputrc")
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("my own"), 0666)
+
+	err = dfm.MigrateTarget("/home/missing", noErrorHandler)
+	require.Error(t, err)
+
+	dfm.DryRun = true
+	err = dfm.MigrateTarget("/home/new", noErrorHandler)
+	require.NoError(t, err)
+	_, err = fs.Stat("/home/test/.bashrc")
+	require.NoError(t, err)
+	_, err = fs.Stat("/home/new/.bashrc")
+	require.True(t, os.IsNotExist(err))
+
+	dfm = newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	err = dfm.MigrateTarget("/home/new", noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationRemove, ".bashrc", "", ""},
+		{OperationRemove, ".config/app.conf", "", ""},
+		{OperationSkip, ".inputrc", "", ".inputrc: not removing: modified outside dfm"},
+		{OperationRemove, ".vimrc", "", ""},
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationLink, ".config/app.conf", "files", ""},
+		{OperationLink, ".inputrc", "files", ""},
+		{OperationCopy, ".vimrc", "files", ""},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/new/.config/app.conf")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.config/app.conf", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/new/.vimrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	_, err = fs.Stat("/home/test/.bashrc")
+	require.True(t, os.IsNotExist(err))
+	bytes, err = afero.ReadFile(fs, "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.Equal(t, "my own", string(bytes))
+
+	dfm = newDfm(t, fs)
+	require.Equal(t, "/home/new", dfm.Config.targetPath)
+	require.True(t, dfm.ownsTarget(".vimrc"))
+}
+
+func TestPruneBroken(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+	})
+	afero.WriteFile(fs, "/home/test/.oldrc", []byte("symlink to /home/test/dotfiles/files/.oldrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.config/app/old.conf", []byte("symlink to ../../dotfiles/inactive/.config/app/old.conf"), 0666)
+	afero.WriteFile(fs, "/home/test/.elsewhere", []byte("symlink to /opt/missing"), 0666)
+	afero.WriteFile(fs, "/home/test/.working", []byte("symlink to /home/test/dotfiles/files/.bashrc"), 0666)
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	// Without PruneBroken, nothing outside of the manifest is touched.
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	require.Len(t, plan.Actions, 1)
+
+	dfm.PruneBroken = true
+	dfm.DryRun = true
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	_, err = fs.Stat("/home/test/.oldrc")
+	require.NoError(t, err)
+	dfm.DryRun = false
+
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationRemove, ".config/app/old.conf", "", ""},
+		{OperationRemove, ".oldrc", "", ""},
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationRemove, ".config/app/old.conf", "", ""},
+		{OperationRemove, ".oldrc", "", ""},
+	}, logger.messages)
+	_, err = fs.Stat("/home/test/.oldrc")
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat("/home/test/.config/app/old.conf")
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat("/home/test/.elsewhere")
+	require.NoError(t, err)
+	_, err = fs.Stat("/home/test/.working")
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".bashrc": true}, dfm.Config.manifest)
+}
+
+func TestAdoptFiles(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.inputrc",
+	})
+	dfm := newDfm(t, fs)
+	dfm.Config.repos = []string{"files", "inactive"}
+	err := dfm.CopyFiles([]string{".bashrc"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.LinkFiles([]string{".vimrc"}, noErrorHandler)
+	require.NoError(t, err)
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("edited bashrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("better inputrc"), 0666)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	dfm.DryRun = true
+	err = dfm.AdoptFiles([]string{".bashrc"}, "", noErrorHandler)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/files/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	dfm.DryRun = false
+
+	err = dfm.AdoptFiles([]string{".bashrc", ".vimrc"}, "", noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.AdoptFiles([]string{".inputrc"}, "inactive", noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationAdopt, ".bashrc", "files", ""},
+		{OperationAdopt, ".bashrc", "files", ""},
+		{OperationSkip, ".vimrc", "files", ".vimrc: already up to date"},
+		{OperationAdopt, ".inputrc", "inactive", ""},
+	}, logger.messages)
+	bytes, err = afero.ReadFile(fs, "/home/test/dotfiles/files/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "edited bashrc", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "edited bashrc", string(bytes))
+	require.True(t, dfm.ownsTarget(".bashrc"))
+	bytes, err = afero.ReadFile(fs, "/home/test/dotfiles/inactive/.inputrc")
+	require.NoError(t, err)
+	require.Equal(t, "better inputrc", string(bytes))
+
+	err = dfm.AdoptFiles([]string{".profile"}, "", noErrorHandler)
+	require.EqualError(t, err, ".profile: not found in any active repositories")
+}
+
+func TestSyncErrorPartial(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileC",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	handleFile := func(s, d string) error {
+		if d == "/home/test/.fileB" {
+			return fmt.Errorf("fake error")
+		} else if d == "/home/test/.fileC" {
+			require.FailNow(t, "runSync should have aborted at fileB")
+		}
+		exists, err := afero.Exists(fs, d)
+		if err != nil {
+			return err
+		} else if exists {
+			return ErrNotNeeded
+		}
+		return LinkFile(dfm.fs, s, d)
+	}
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileB", []byte(fileContent), 0666)
+	err := dfm.runSync(context.Background(), noErrorHandler, OperationLink, handleFile)
+	require.Error(t, err)
+	require.Equal(t, ".fileB: fake error", err.Error())
+	require.Equal(t, map[string]bool{".fileA": true, ".fileB": true, ".fileC": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".fileA", "files", ".fileA: already up to date"},
+	}, logger.messages)
+}
+
+func TestSyncOrder(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.zshrc",
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/work/.config/work",
+		"/home/test/dotfiles/work/.bashrc",
+		"/home/test/dotfiles/work/.aliases",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "work"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.DryRun = true
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	expected := []logMessage{
+		{OperationWarning, ".bashrc", "work", ".bashrc: provided by work, files; using work"},
+		{OperationLink, ".aliases", "work", ""},
+		{OperationLink, ".bashrc", "work", ""},
+		{OperationLink, ".config/work", "work", ""},
+		{OperationLink, ".zshrc", "files", ""},
+	}
+	require.Equal(t, expected, logger.messages)
+
+	// Files given in any order are synced in the same order.
+	logger.messages = nil
+	err = dfm.LinkFiles([]string{".zshrc", ".config", ".bashrc", ".aliases"}, noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, expected, logger.messages)
+
+	// The manifest is saved in the same order, so the config file only
+	// changes when the tracked files do.
+	dfm.DryRun = false
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	cfgBytes, err := afero.ReadFile(fs, "/home/test/dotfiles/.dfm.toml")
+	require.NoError(t, err)
+	require.Contains(t, string(cfgBytes), `manifest = [".aliases",".bashrc",".config/work",".zshrc"]`)
+}
+
+func TestConflicts(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/common/.gitconfig",
+		"/home/test/dotfiles/common/.bashrc",
+		"/home/test/dotfiles/work/.gitconfig",
+		"/home/test/dotfiles/laptop/.gitconfig",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["common", "work", "laptop"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationWarning, ".gitconfig", "laptop", ".gitconfig: provided by laptop, work, common; using laptop"},
+		{OperationLink, ".bashrc", "common", ""},
+		{OperationLink, ".gitconfig", "laptop", ""},
+	}, logger.messages)
+	require.Equal(t, []string{"work", "common"}, dfm.Overrides(".gitconfig"))
+	require.Nil(t, dfm.Overrides(".bashrc"))
+
+	logger.messages = nil
+	dfm.Config.conflicts = ConflictsAllow
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "common", ".bashrc: already up to date"},
+		{OperationSkip, ".gitconfig", "laptop", ".gitconfig: already up to date"},
+	}, logger.messages)
+
+	fs.Remove("/home/test/.gitconfig")
+	dfm.Config.conflicts = ConflictsError
+	var errors []string
+	err = dfm.LinkAll(func(err *FileError) error {
+		errors = append(errors, err.Error())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{".gitconfig: provided by laptop, work, common; using laptop"}, errors)
+	exists, err := afero.Exists(fs, "/home/test/.gitconfig")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestSyncIgnoreError(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileC",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	handleFile := func(s, d string) error {
+		if d == "/home/test/.fileB" {
+			return fmt.Errorf("fake error")
+		}
+		exists, err := afero.Exists(fs, d)
+		if err != nil {
+			return err
+		} else if exists {
+			return ErrNotNeeded
+		}
+		return LinkFile(dfm.fs, s, d)
+	}
+	errorHandler := func(err *FileError) error {
+		return nil
+	}
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileB", []byte(fileContent), 0666)
+	err := dfm.runSync(context.Background(), errorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".fileA": true, ".fileB": true, ".fileC": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".fileA", "files", ".fileA: already up to date"},
+		{OperationSkip, ".fileB", "files", ".fileB: fake error"},
+		{OperationSkip, ".fileC", "files", ".fileC: already up to date"},
+	}, logger.messages)
+}
+
+func TestFileErrorUnwrap(t *testing.T) {
+	pathErr := &os.PathError{Op: "open", Path: "/home/test/.fileA", Err: syscall.ENOENT}
+	fileErr := WrapFileError(pathErr, ".fileA")
+	require.True(t, errors.Is(fileErr, os.ErrNotExist))
+	var unwrapped *os.PathError
+	require.True(t, errors.As(fileErr, &unwrapped))
+	require.Equal(t, pathErr, unwrapped)
+
+	linkErr := &os.LinkError{Op: "symlink", Old: "/home/test/dotfiles/files/.fileA", New: "/home/test/.fileA", Err: syscall.EEXIST}
+	fileErr = WrapFileError(fmt.Errorf("linking: %w", linkErr), ".fileA")
+	require.True(t, errors.Is(fileErr, os.ErrExist))
+	existing, ok := existingPath(fileErr)
+	require.True(t, ok)
+	require.Equal(t, "/home/test/.fileA", existing)
+
+	require.False(t, errors.Is(NewFileError(".fileA", "conflict"), os.ErrExist))
+	require.True(t, IsNotNeeded(WrapFileError(fmt.Errorf("checking: %w", ErrNotNeeded), ".fileA")))
+	require.True(t, IsNotNeeded(fmt.Errorf("syncing: %w", WrapFileError(ErrNotNeeded, ".fileA"))))
+	require.False(t, IsNotNeeded(WrapFileError(errors.New("already up to date"), ".fileA")))
+}
+
+func TestSyncRetry(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	timesCalled := 0
+	handleFile := func(s, d string) (err error) {
+		timesCalled++
+		if timesCalled == 1 {
+			return fmt.Errorf("temporary error")
+		}
+		exists, err := afero.Exists(fs, d)
+		if err != nil {
+			return err
+		} else if exists {
+			return nil
+		}
+		return LinkFile(dfm.fs, s, d)
+	}
+	errorHandler := func(err *FileError) error {
+		if err.Message == "temporary error" {
+			return Retry
+		}
+		return err
+	}
+	err := dfm.runSync(context.Background(), errorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".fileA": true}, dfm.Config.manifest)
+	require.Equal(t, timesCalled, 2)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".fileA", "files", ""},
+	}, logger.messages)
+}
+
+func TestErrorHandlerContext(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileB",
+	})
+	dfm := newDfm(t, fs)
+	afero.WriteFile(fs, "/home/test/.fileA", []byte("local"), 0666)
+	afero.WriteFile(fs, "/home/test/.fileB", []byte("local"), 0666)
+
+	var handled []FileError
+	errorHandler := func(err *FileError) error {
+		handled = append(handled, *err)
+		if err.Operation == OperationLink {
+			fs.Remove(err.Target)
+			return Retry
+		}
+		return nil
+	}
+	err := dfm.LinkFiles([]string{".fileA"}, errorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".fileB"}, errorHandler)
+	require.NoError(t, err)
+	require.Len(t, handled, 2)
+	require.Equal(t, OperationLink, handled[0].Operation)
+	require.Equal(t, "files", handled[0].Repo)
+	require.Equal(t, "/home/test/dotfiles/files/.fileA", handled[0].Source)
+	require.Equal(t, "/home/test/.fileA", handled[0].Target)
+	require.Equal(t, OperationCopy, handled[1].Operation)
+	require.Equal(t, "/home/test/.fileB", handled[1].Target)
+	content, _ := afero.ReadFile(fs, "/home/test/.fileA")
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.fileA", string(content))
+	content, _ = afero.ReadFile(fs, "/home/test/.fileB")
+	require.Equal(t, "local", string(content))
+}
+
+func TestSyncRetryAfter(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	var failed time.Time
+	handleFile := func(s, d string) (err error) {
+		if failed.IsZero() {
+			failed = time.Now()
+			return fmt.Errorf("temporary error")
+		}
+		require.True(t, time.Since(failed) >= 10*time.Millisecond)
+		return LinkFile(dfm.fs, s, d)
+	}
+	errorHandler := func(err *FileError) error {
+		return RetryAfter(10 * time.Millisecond)
+	}
+	err := dfm.runSync(context.Background(), errorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".fileA", "files", ""},
+	}, logger.messages)
+}
+
+func TestSyncRetryAfterCanceled(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleFile := func(s, d string) (err error) {
+		return fmt.Errorf("temporary error")
+	}
+	errorHandler := func(err *FileError) error {
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return RetryAfter(time.Hour)
+	}
+	start := time.Now()
+	err := dfm.runSync(ctx, errorHandler, OperationLink, handleFile)
+	require.Equal(t, context.Canceled, err)
+	require.True(t, time.Since(start) < time.Minute)
+	require.Empty(t, logger.messages)
+	exists, _ := afero.Exists(fs, "/home/test/.fileA")
+	require.False(t, exists)
+}
+
+func TestSyncRetryLimit(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	timesCalled := 0
+	handleFile := func(s, d string) (err error) {
+		timesCalled++
+		return fmt.Errorf("permanent error")
+	}
+	errorHandler := func(err *FileError) error {
+		return Retry
+	}
+	err := dfm.runSync(context.Background(), errorHandler, OperationLink, handleFile)
+	require.EqualError(t, err, ".fileA: gave up after 10 retries: permanent error")
+	require.Equal(t, MaxRetries+1, timesCalled)
+
+	// A handler which gives up once the retries are exhausted skips the file.
+	timesCalled = 0
+	logger.messages = nil
+	errorHandler = func(err *FileError) error {
+		if strings.HasPrefix(err.Message, "gave up") {
+			return nil
+		}
+		return Retry
+	}
+	err = dfm.runSync(context.Background(), errorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, MaxRetries+1, timesCalled)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".fileA", "files", ".fileA: gave up after 10 retries: permanent error"},
+	}, logger.messages)
+}
+
+func TestSyncCanceled(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileD",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	fs.Remove("/home/test/dotfiles/files/.fileD")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileB", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileC", []byte(fileContent), 0666)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handleFile := func(s, d string) error {
+		if d == "/home/test/.fileC" {
+			require.FailNow(t, "runSync should have stopped after fileB")
+		}
+		// Cancel while the first file is being handled.
+		cancel()
+		return LinkFile(dfm.fs, s, d)
+	}
+	err := dfm.runSync(ctx, noErrorHandler, OperationLink, handleFile)
+	require.Equal(t, context.Canceled, err)
+	// The autoclean must not have run, and the new file must be tracked.
+	require.Equal(t, map[string]bool{".fileA": true, ".fileB": true, ".fileD": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".fileA", "files", ".fileA: already up to date"},
+		{OperationLink, ".fileB", "files", ""},
+	}, logger.messages)
+}
+
+func TestSyncParallel(t *testing.T) {
+	fs := newFs(emptyConfig, nil)
+	var expected []logMessage
+	for i := 0; i < 20; i++ {
+		filename := fmt.Sprintf(".file%02d", i)
+		afero.WriteFile(fs, "/home/test/dotfiles/files/"+filename, []byte(fileContent), 0666)
+		expected = append(expected, logMessage{OperationLink, filename, "files", ""})
+	}
+	dfm := newDfm(t, fs)
+	dfm.Jobs = 4
+	var logger testLog
+	dfm.Logger = logger.log
+
+	handleFile := func(s, d string) error {
+		// Finish the earlier files last.
+		time.Sleep(time.Duration(len(d)) * time.Millisecond)
+		return LinkFile(dfm.fs, s, d)
+	}
+	err := dfm.runSync(context.Background(), noErrorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, expected, logger.messages)
+	require.Len(t, dfm.Config.manifest, 20)
+}
+
+func TestSyncParallelAbort(t *testing.T) {
+	fs := newFs(emptyConfig, nil)
+	for i := 0; i < 20; i++ {
+		filename := fmt.Sprintf("/home/test/dotfiles/files/.file%02d", i)
+		afero.WriteFile(fs, filename, []byte(fileContent), 0666)
+	}
+	dfm := newDfm(t, fs)
+	dfm.Jobs = 4
+	var logger testLog
+	dfm.Logger = logger.log
+
+	var started int32
+	handleFile := func(s, d string) error {
+		atomic.AddInt32(&started, 1)
+		if d == "/home/test/.file05" {
+			return fmt.Errorf("fake error")
+		}
+		return LinkFile(dfm.fs, s, d)
+	}
+	err := dfm.runSync(context.Background(), noErrorHandler, OperationLink, handleFile)
+	require.Error(t, err)
+	require.Equal(t, ".file05: fake error", err.Error())
+	// Files already in progress are allowed to finish, but no new files are
+	// started after the abort.
+	require.True(t, atomic.LoadInt32(&started) < 20)
+	require.True(t, len(logger.messages) >= 5)
+	for i, message := range logger.messages[:5] {
+		require.Equal(t, fmt.Sprintf(".file%02d", i), message.relative)
+	}
+	for i, message := range logger.messages[5:] {
+		require.True(t, message.relative > ".file05")
+		require.True(t, message.relative > logger.messages[4+i].relative)
+	}
+	require.True(t, dfm.Config.manifest[".file05"])
+}
+
+func TestSyncParallelFallback(t *testing.T) {
+	fs := newFs(emptyConfig, nil)
+	for i := 0; i < 20; i++ {
+		filename := fmt.Sprintf("/home/test/dotfiles/files/.file%02d", i)
+		afero.WriteFile(fs, filename, []byte(fileContent), 0666)
+	}
+	dfm := newDfm(t, fs)
+	dfm.Jobs = 4
+	dfm.FallbackCopy = true
+
+	// Every other file fails once, so it is planned again while the files
+	// before it are being recorded as copies.
+	var lock sync.Mutex
+	failed := map[string]bool{}
+	handleFile := func(s, d string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if d[len(d)-1]%2 == 1 && !failed[d] {
+			failed[d] = true
+			return fmt.Errorf("temporary error")
+		}
+		return &os.LinkError{Op: "symlink", Old: s, New: d, Err: syscall.EPERM}
+	}
+	retry := func(err *FileError) error {
+		return Retry
+	}
+	err := dfm.runSync(context.Background(), retry, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Len(t, failed, 10)
+	require.Len(t, dfm.Config.copied, 20)
+	require.Len(t, dfm.Config.manifest, 20)
+}
+
+func TestSyncProgress(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileB",
+		"/home/test/dotfiles/files/.config/fish/config.fish",
+	})
+	dfm := newDfm(t, fs)
+	var progress [][2]int
+	dfm.Progress = func(completed, total int) {
+		progress = append(progress, [2]int{completed, total})
+	}
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, [][2]int{{1, 3}, {2, 3}, {3, 3}}, progress)
+}
+
+func TestLinkChanged(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.config/fish/config.fish",
+		"/home/test/dotfiles/files/.config/fish/functions.fish",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	fs.RemoveAll("/home/test/dotfiles/files/.config")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileB", []byte(fileContent), 0666)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	err := dfm.LinkChangedContext(context.Background(), []string{".config", ".fileB"}, noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".fileA": true, ".fileB": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".fileB", "files", ""},
+		{OperationRemove, ".config/fish/config.fish", "", ""},
+		{OperationRemove, ".config/fish/functions.fish", "", ""},
+	}, logger.messages)
+	exists, _ := afero.Exists(fs, "/home/test/.config")
+	require.False(t, exists)
+}
+
+const hooksConfigFile = emptyConfig + `
+[hooks]
+pre_sync = ["pre"]
+post_sync = ["post"]
+`
+
+type testRunner struct {
+	commands []string
+	env      [][]string
+	err      error
+}
+
+func (runner *testRunner) run(command string, env []string) error {
+	runner.commands = append(runner.commands, command)
+	runner.env = append(runner.env, env)
+	return runner.err
+}
+
+func TestHooks(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(hooksConfigFile), 0666)
+	dfm := newDfm(t, fs)
+	var runner testRunner
+	dfm.RunCommand = runner.run
+
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pre", "post"}, runner.commands)
+	require.Equal(t, []string{
+		"DFM_DIR=/home/test/dotfiles",
+		"DFM_TARGET=/home/test",
+		"DFM_HOOK=post_sync",
+		"DFM_OPERATION=link",
+		"DFM_CHANGED=1",
+	}, runner.env[1])
+
+	// Nothing changed, so the post_sync hook doesn't run.
+	runner = testRunner{}
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pre"}, runner.commands)
+
+	// Hooks survive rewriting the config file.
+	dfm = newDfm(t, fs)
+	dfm.RunCommand = runner.run
+	dfm.DryRun = true
+	runner = testRunner{}
+	err = dfm.RemoveAll()
+	require.NoError(t, err)
+	require.Equal(t, []string{"pre"}, runner.commands)
+}
+
+func TestHookFailure(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(hooksConfigFile), 0666)
+	dfm := newDfm(t, fs)
+	runner := testRunner{err: fmt.Errorf("exit status 1")}
+	dfm.RunCommand = runner.run
+	var logger testLog
+	dfm.Logger = logger.log
+
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationWarning, HookPreSync, "", `pre_sync: hook "pre" failed: exit status 1`},
+		{OperationLink, ".fileA", "files", ""},
+		{OperationWarning, HookPostSync, "", `post_sync: hook "post" failed: exit status 1`},
+	}, logger.messages)
+
+	// Fatal hook failures stop the sync.
+	dfm.Config.hooks.Fatal = true
+	fs.Remove("/home/test/.fileA")
+	logger.messages = nil
+	err = dfm.LinkAll(noErrorHandler)
+	require.Error(t, err)
+	require.Equal(t, `pre_sync: hook "pre" failed: exit status 1`, err.Error())
+	require.Empty(t, logger.messages)
+}
+
+func TestRunShellCommandNoShell(t *testing.T) {
+	dfm := newDfm(t, newFs(emptyConfig, nil))
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "")
+
+	err := dfm.runShellCommand("true", nil)
+	require.True(t, errors.Is(err, exec.ErrNotFound))
+	require.Equal(t, "sh: executable file not found in $PATH", err.Error())
+}
+
+func TestMatchOnChange(t *testing.T) {
+	onChange := map[string]string{
+		".fonts":             "fc-cache",
+		".fonts/*.ttf":       "fc-cache",
+		".config/bat/config": "bat cache --build",
+		".tmux.conf":         "tmux source-file ~/.tmux.conf",
+	}
+	commands := matchOnChange(onChange, []string{
+		".fonts/a.ttf",
+		".fonts/b.ttf",
+		".config/bat/config",
+		".bashrc",
+	})
+	require.Equal(t, []onChangeCommand{
+		{command: "bat cache --build", files: []string{".config/bat/config"}},
+		{command: "fc-cache", files: []string{".fonts/a.ttf", ".fonts/b.ttf"}},
+	}, commands)
+}
+
+func TestOnChange(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fonts/a.ttf",
+		"/home/test/dotfiles/files/.fonts/b.ttf",
+	})
+	dfm := newDfm(t, fs)
+	dfm.Config.onChange = map[string]string{".fonts": "fc-cache"}
+	var runner testRunner
+	dfm.RunCommand = runner.run
+	var logger testLog
+	dfm.Logger = logger.log
+
+	// A dry run only logs the command.
+	dfm.DryRun = true
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Empty(t, runner.commands)
+	require.Equal(t, logMessage{OperationOnChange, "fc-cache", "", ""}, logger.messages[len(logger.messages)-1])
+
+	dfm.DryRun = false
+	logger.messages = nil
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []string{"fc-cache"}, runner.commands)
+	require.Contains(t, runner.env[0], "DFM_CHANGED_FILES=.fonts/a.ttf\n.fonts/b.ttf")
+	require.Equal(t, logMessage{OperationOnChange, "fc-cache", "", ""}, logger.messages[len(logger.messages)-1])
+
+	// Removed files count as changes too.
+	runner = testRunner{}
+	fs.Remove("/home/test/dotfiles/files/.fonts/a.ttf")
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []string{"fc-cache"}, runner.commands)
+
+	// Nothing changed, so nothing runs.
+	runner = testRunner{}
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Empty(t, runner.commands)
+}
+
+func TestPlanSync(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileB",
+		"/home/test/dotfiles/files/.config/old/fileC",
+	})
+	dfm := newDfm(t, fs)
+	dfm.Config.repos = []string{"files", "work"}
+	initialSync(t, dfm)
+	fs.MkdirAll("/home/test/dotfiles/work", 0777)
+	fs.Rename("/home/test/dotfiles/files/.fileB", "/home/test/dotfiles/work/.fileB")
+	fs.Remove("/home/test/dotfiles/files/.config/old/fileC")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.config/new/fileD", []byte(fileContent), 0666)
+
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	require.Equal(t, StateLink, plan.Actions[3].State)
+	types := make([]string, len(plan.Actions))
+	for i, action := range plan.Actions {
+		types[i] = action.Type + " " + action.Relative + " (" + action.Reason + ")"
+	}
+	require.Equal(t, []string{
+		"mkdir .config/new (parent directory)",
+		"create-link .config/new/fileD (new file)",
+		"none .fileA (already up to date)",
+		"replace-file .fileB (repo changed)",
+		"remove .config/old/fileC (removed from repo)",
+		"rmdir .config/old (empty directory)",
+	}, types)
+	exists, err := afero.Exists(fs, "/home/test/.config/new")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	err = dfm.Apply(plan, noErrorHandler)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/.fileB")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/work/.fileB", string(bytes))
+	exists, err = afero.Exists(fs, "/home/test/.config/old")
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.Equal(t, map[string]bool{
+		".fileA": true, ".fileB": true, ".config/new/fileD": true,
+	}, dfm.Config.manifest)
+}
+
+func TestStatus(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.linked",
+		"/home/test/dotfiles/files/.identical",
+		"/home/test/dotfiles/files/.modified",
+		"/home/test/dotfiles/files/.orphaned",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	require.NoError(t, dfm.CopyFiles([]string{".identical", ".modified"}, noErrorHandler))
+	afero.WriteFile(fs, "/home/test/.modified", []byte("changed"), 0666)
+	fs.Remove("/home/test/dotfiles/files/.orphaned")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.missing", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.conflict", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/.conflict", []byte("local"), 0666)
+	manifest := map[string]bool{}
+	for filename := range dfm.Config.manifest {
+		manifest[filename] = true
+	}
+
+	statuses, err := dfm.Status(nil)
+	require.NoError(t, err)
+	require.Equal(t, []FileStatus{
+		{".conflict", "files", "/home/test/.conflict", StatusConflict, "", nil},
+		{".identical", "files", "/home/test/.identical", StatusCopiedIdentical, "", nil},
+		{".linked", "files", "/home/test/.linked", StatusLinked, "", nil},
+		{".missing", "files", "/home/test/.missing", StatusMissing, "", nil},
+		{".modified", "files", "/home/test/.modified", StatusCopiedModified, "", nil},
+		{".orphaned", "", "/home/test/.orphaned", StatusOrphaned, "", nil},
+	}, statuses)
+	require.Equal(t, manifest, dfm.Config.manifest)
+
+	statuses, err = dfm.Status([]string{".orphaned"})
+	require.NoError(t, err)
+	require.Equal(t, []FileStatus{
+		{".orphaned", "", "/home/test/.orphaned", StatusOrphaned, "", nil},
+	}, statuses)
+	_, err = dfm.Status([]string{".unknown"})
+	require.Error(t, err)
+}
+
+func TestSyncOnlyRepos(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.fileC",
+		"/home/test/dotfiles/work/.fileB",
+		"/home/test/dotfiles/work/.fileC",
+	})
+	dfm := newDfm(t, fs)
+	dfm.Config.repos = []string{"files", "work"}
+	initialSync(t, dfm)
+	dfm.Config.repos = []string{"files", "work"}
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.OnlyRepos = []string{"files"}
+
+	fs.Remove("/home/test/dotfiles/files/.fileA")
+	fs.Remove("/home/test/dotfiles/work/.fileB")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileD", []byte(fileContent), 0666)
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".fileB": true, ".fileC": true, ".fileD": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationWarning, ".fileC", "work", ".fileC: provided by work, files; using work"},
+		{OperationLink, ".fileD", "files", ""},
+		{OperationRemove, ".fileA", "", ""},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/.fileC")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/work/.fileC", string(bytes))
+}
+
+func TestSyncOnlyReposUnknown(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.fileA",
+	})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.OnlyRepos = []string{"inactive"}
+	err := dfm.LinkAll(noErrorHandler)
+	require.Error(t, err)
+	require.Equal(t, `repo "inactive" is not active`, err.Error())
+	require.Nil(t, logger.messages)
+	require.Equal(t, map[string]bool{}, dfm.Config.manifest)
+}
+
+func TestSyncExclude(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.config/nvim/init.vim",
+		"/home/test/dotfiles/files/.config/nvim/after/ftplugin.vim",
+		"/home/test/dotfiles/files/.config/fish/config.fish",
+		"/home/test/dotfiles/files/.bashrc",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.Exclude = []string{".config/nvim", "*rc", ".config/nvm"}
+
+	fs.Remove("/home/test/dotfiles/files/.config/nvim/init.vim")
+	fs.Remove("/home/test/dotfiles/files/.bashrc")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.config/nvim/new.vim", []byte(fileContent), 0666)
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.vimrc", []byte(fileContent), 0666)
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{
+		".bashrc":                         true,
+		".config/fish/config.fish":        true,
+		".config/nvim/after/ftplugin.vim": true,
+		".config/nvim/init.vim":           true,
+	}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationWarning, ".config/nvm", "", ".config/nvm: exclusion did not match any files"},
+		{OperationSkip, ".config/fish/config.fish", "files", ".config/fish/config.fish: already up to date"},
+	}, logger.messages)
+}
+
+func TestMatchesPattern(t *testing.T) {
+	require.True(t, matchesPattern(".config/nvim", ".config/nvim/init.vim"))
+	require.True(t, matchesPattern(".config/nvim/", ".config/nvim/init.vim"))
+	require.True(t, matchesPattern("*.vim", "init.vim"))
+	require.True(t, matchesPattern(".config/*/init.vim", ".config/nvim/init.vim"))
+	require.False(t, matchesPattern(".config/nvim", ".config/nvim-old/init.vim"))
+	require.False(t, matchesPattern("*.vim", ".config/nvim/init.vim"))
+}
+
+func TestEjectFiles(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/.bashrc"})
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	err := dfm.EjectFiles([]string{".bashrc"}, noErrorHandler)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	require.Equal(t, map[string]bool{}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationEject, ".bashrc", "files", ""},
+	}, logger.messages)
+	require.Equal(t, 1, dfm.Summary().Ejected)
+}
+
+func TestEjectDeleteFromRepo(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.config/app/app.conf",
+		"/home/test/dotfiles/files/.inputrc",
+	})
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("local"), 0666)
+	dfm := newDfm(t, fs)
+	dfm.DeleteEjected = true
+	var logger testLog
+	dfm.Logger = logger.log
+	skipErrors := func(err *FileError) error { return nil }
+	err := dfm.EjectFiles([]string{".config/app/app.conf", ".inputrc"}, skipErrors)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationEject, ".config/app/app.conf", "files", ""},
+		{OperationSkip, ".inputrc", "files", ".inputrc: file already exists"},
+		{OperationPurge, ".config/app/app.conf", "files", ""},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/.config/app/app.conf")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	exists, _ := afero.Exists(fs, "/home/test/dotfiles/files/.config")
+	require.False(t, exists)
+	// The eject failed, so the repo file is kept.
+	exists, _ = afero.Exists(fs, "/home/test/dotfiles/files/.inputrc")
+	require.True(t, exists)
+}
+
+func TestEjectRepo(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/legacy/.bashrc",
+		"/home/test/dotfiles/legacy/.vimrc",
+		"/home/test/dotfiles/legacy/.inputrc",
+		"/home/test/dotfiles/work/.vimrc",
+	})
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(`manifest = []
+repos = ["files", "legacy", "work"]
+target = "/home/test"
+`), 0666)
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.OnlyRepos = []string{"legacy"}
+	skipErrors := func(err *FileError) error { return nil }
+	err := dfm.EjectFiles([]string{"."}, skipErrors)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationWarning, ".bashrc", "legacy", ".bashrc: provided by legacy, files; using legacy"},
+		{OperationWarning, ".vimrc", "work", ".vimrc: provided by work, legacy, files; using work"},
+		{OperationSkip, ".vimrc", "legacy", ".vimrc: not ejecting: synced from work, which takes precedence over legacy"},
+		{OperationEject, ".bashrc", "legacy", ""},
+		{OperationEject, ".inputrc", "legacy", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".vimrc": true}, dfm.Config.manifest)
+
+	dfm.OnlyRepos = []string{"missing"}
+	require.EqualError(t, dfm.EjectFiles([]string{"."}, noErrorHandler), `repo "missing" is not active`)
+}
+
+func TestAutoclean(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.config/fileA",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	fs.Rename(
+		"/home/test/dotfiles/files/.config/fileA",
+		"/home/test/dotfiles/files/.fileB",
+	)
+
+	handleFile := func(s, d string) error {
+		return nil
+	}
+	err := dfm.runSync(context.Background(), noErrorHandler, OperationLink, handleFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".fileB": true}, dfm.Config.manifest)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".fileB", "files", ""},
+		{OperationRemove, ".config/fileA", "", ""},
+	}, logger.messages)
+}
+
+func TestAutocleanOwnership(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.zshrc",
+		"/home/test/dotfiles/files/.inputrc",
+	})
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".vimrc", ".bashrc"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".zshrc", ".inputrc"}, noErrorHandler)
+	require.NoError(t, err)
+	require.Len(t, dfm.Config.checksums, 2)
+	*dfm = *newDfm(t, fs)
+	require.Len(t, dfm.Config.checksums, 2)
+	var logger testLog
+	dfm.Logger = logger.log
+
+	// .vimrc is replaced with a real file and .zshrc is edited, so they are
+	// no longer the files dfm synced.
+	fs.Remove("/home/test/.vimrc")
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("my own vimrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.zshrc", []byte("edited zshrc"), 0666)
+	for _, filename := range []string{".vimrc", ".bashrc", ".zshrc", ".inputrc"} {
+		fs.Remove("/home/test/dotfiles/files/" + filename)
+	}
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".vimrc", "", ".vimrc: not removing: modified outside dfm"},
+		{OperationSkip, ".zshrc", "", ".zshrc: not removing: modified outside dfm"},
+		{OperationRemove, ".bashrc", "", ""},
+		{OperationRemove, ".inputrc", "", ""},
+	}, logger.messages)
+	require.Equal(t, "2 removed, 2 kept", dfm.Summary().String())
+	require.Empty(t, dfm.Config.manifest)
+	bytes, err := afero.ReadFile(fs, "/home/test/.vimrc")
+	require.NoError(t, err)
+	require.Equal(t, "my own vimrc", string(bytes))
+	exists, err := afero.Exists(fs, "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// With Force, the files are removed anyway.
+	fs = newFs(emptyConfig, []string{"/home/test/dotfiles/files/.vimrc"})
+	dfm = newDfm(t, fs)
+	initialSync(t, dfm)
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("my own vimrc"), 0666)
+	fs.Remove("/home/test/dotfiles/files/.vimrc")
+	dfm.Force = true
+	logger.messages = nil
+	dfm.Logger = logger.log
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{{OperationRemove, ".vimrc", "", ""}}, logger.messages)
+}
+
+func TestAutocleanLimit(t *testing.T) {
+	filenames := []string{".bashrc", ".inputrc", ".vimrc"}
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.inputrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	require.Equal(t, DefaultAutocleanLimit, dfm.Config.AutocleanLimit())
+	dfm.Config.autocleanLimit = 2
+	for _, filename := range filenames {
+		fs.Remove("/home/test/dotfiles/files/" + filename)
+	}
+
+	// Without confirmation, nothing is changed.
+	var logger testLog
+	dfm.Logger = logger.log
+	err := dfm.LinkAll(noErrorHandler)
+	require.Equal(t, &TooManyRemovalsError{Files: filenames, Limit: 2}, err)
+	require.Empty(t, logger.messages)
+	require.Len(t, dfm.Config.manifest, 3)
+	exists, err := afero.Exists(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// Dry run warns, then lists the files.
+	dfm.DryRun = true
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationWarning, "", "", "autoclean would remove 3 files, more than the limit of 2"},
+		{OperationRemove, ".bashrc", "", ""},
+		{OperationRemove, ".inputrc", "", ""},
+		{OperationRemove, ".vimrc", "", ""},
+	}, logger.messages)
+	dfm = newDfm(t, fs)
+	dfm.Config.autocleanLimit = 2
+	require.Len(t, dfm.Config.manifest, 3)
+
+	// A refused confirmation is the same as none.
+	var confirmed []string
+	dfm.ConfirmRemovals = func(files []string) bool {
+		confirmed = files
+		return false
+	}
+	err = dfm.LinkAll(noErrorHandler)
+	require.IsType(t, &TooManyRemovalsError{}, err)
+	require.Equal(t, filenames, confirmed)
+	require.Len(t, dfm.Config.manifest, 3)
+
+	dfm.ConfirmRemovals = func(files []string) bool { return true }
+	logger.messages = nil
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, "3 removed", dfm.Summary().String())
+	require.Empty(t, dfm.Config.manifest)
+
+	// Large manifests allow a fifth of the files to be removed, and a
+	// negative limit turns the check off.
+	dfm.Config.autocleanLimit = 0
+	for i := 0; i < 100; i++ {
+		dfm.Config.manifest[fmt.Sprintf(".file%d", i)] = true
+	}
+	require.Equal(t, 20, dfm.Config.AutocleanLimit())
+	dfm.Config.autocleanLimit = -5
+	require.Equal(t, -1, dfm.Config.AutocleanLimit())
+}
+
+func TestTrash(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.config/app.conf",
+	})
+	dfm := newDfm(t, fs)
+	err := dfm.LinkFiles([]string{".vimrc"}, noErrorHandler)
+	require.NoError(t, err)
+	err = dfm.CopyFiles([]string{".config/app.conf"}, noErrorHandler)
+	require.NoError(t, err)
+	files, err := dfm.TrashedFiles()
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// Copies are moved to the trash, but links are just removed.
+	dfm.Trash = true
+	err = dfm.RemoveAll()
+	require.NoError(t, err)
+	exists, err := afero.Exists(fs, "/home/test/.config/app.conf")
+	require.NoError(t, err)
+	require.False(t, exists)
+	files, err = dfm.TrashedFiles()
+	require.NoError(t, err)
+	require.Equal(t, []TrashedFile{{Time: dfm.trashTime, Relative: ".config/app.conf"}}, files)
+	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/.trash/"+dfm.trashTime+"/.config/app.conf")
+	require.NoError(t, err)
+	require.Equal(t, "# config file", string(bytes))
+	exists, err = afero.Exists(fs, "/home/test/dotfiles/.trash/.gitignore")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	err = dfm.EmptyTrash()
+	require.NoError(t, err)
+	files, err = dfm.TrashedFiles()
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestForceBackup(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("my own bashrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("my own vimrc"), 0666)
+	afero.WriteFile(fs, "/home/test/.vimrc.dfm-backup", []byte("older vimrc"), 0666)
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.Force = true
+	dfm.Backup = true
+	err := dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationBackup, ".bashrc", "", ""},
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationSkip, ".vimrc", "files", ".vimrc: not overwriting: backup /home/test/.vimrc.dfm-backup already exists"},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc.dfm-backup")
+	require.NoError(t, err)
+	require.Equal(t, "my own bashrc", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.vimrc")
+	require.NoError(t, err)
+	require.Equal(t, "my own vimrc", string(bytes))
+
+	// With backup_dir, the relative path is kept.
+	fs.Remove("/home/test/.vimrc.dfm-backup")
+	dfm.Backup = false
+	dfm.Config.backupDir = "backups"
+	require.Equal(t, "/home/test/dotfiles/backups/.vimrc", dfm.BackupPath(".vimrc"))
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	bytes, err = afero.ReadFile(fs, "/home/test/dotfiles/backups/.vimrc")
+	require.NoError(t, err)
+	require.Equal(t, "my own vimrc", string(bytes))
+
+	// Without backups, Force removes the file.
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.inputrc", []byte("config"), 0666)
+	afero.WriteFile(fs, "/home/test/.inputrc", []byte("my own inputrc"), 0666)
+	dfm.Config.backupDir = ""
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	bytes, err = afero.ReadFile(fs, "/home/test/.inputrc")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.inputrc", string(bytes))
+	exists, err := afero.Exists(fs, "/home/test/.inputrc.dfm-backup")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestForceDryRun(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/.bashrc"})
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("my own bashrc"), 0666)
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.DryRun = true
+	err := dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	dfm.Force = true
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	dfm.Backup = true
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: file exists"},
+		{OperationOverwrite, ".bashrc", "", ""},
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationBackup, ".bashrc", "", ""},
+		{OperationLink, ".bashrc", "files", ""},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "my own bashrc", string(bytes))
+	exists, err := afero.Exists(fs, "/home/test/.bashrc.dfm-backup")
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestDirectoryConflicts(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.config",
+	})
+	fs.MkdirAll("/home/test/.config/app", 0777)
+	afero.WriteFile(fs, "/home/test/.config/app/settings", []byte("settings"), 0666)
+	dfm := newDfm(t, fs)
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.Force = true
+	err := dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".config", "files", ".config: target is a directory, refusing to replace it"},
+		{OperationLink, ".vimrc", "files", ""},
+	}, logger.messages)
+	exists, err := afero.Exists(fs, "/home/test/.config/app/settings")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	dfm.ForceDirs = true
+	logger.messages = nil
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationOverwrite, ".config", "", ""},
+		{OperationLink, ".config", "files", ""},
+		{OperationSkip, ".vimrc", "files", ".vimrc: already up to date"},
+	}, logger.messages)
+
+	// The repo file is replaced by a directory.
+	fs.Remove("/home/test/dotfiles/files/.vimrc")
+	afero.WriteFile(fs, "/home/test/dotfiles/files/.vimrc/init", []byte("init"), 0666)
+	problems, err := dfm.Diagnose()
+	require.NoError(t, err)
+	require.Equal(t, []*FileError{
+		NewFileError(".vimrc/init", ".vimrc was synced as a whole, but the repo now has files inside it"),
+	}, problems)
+	logger.messages = nil
+	err = dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".config", "files", ".config: already up to date"},
+		{OperationSkip, ".vimrc/init", "files", ".vimrc/init: .vimrc was synced as a whole, but the repo now has files inside it; sync again once it has been removed"},
+		{OperationRemove, ".vimrc", "", ""},
+	}, logger.messages)
+	logger.messages = nil
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".config", "files", ".config: already up to date"},
+		{OperationLink, ".vimrc/init", "files", ""},
+	}, logger.messages)
+	bytes, err := afero.ReadFile(fs, "/home/test/dotfiles/files/.vimrc/init")
 	require.NoError(t, err)
-	require.Equal(t, fileContent, string(bytes))
+	require.Equal(t, "init", string(bytes))
 }
 
-func TestSync(t *testing.T) {
+func TestHardLink(t *testing.T) {
 	fs := newFs(emptyConfig, []string{
-		"/home/test/dotfiles/files/.config/fish/config.fish",
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/app.conf",
 	})
 	dfm := newDfm(t, fs)
-	logger := &testLog{}
+	dfm.Config.hardLink.Files = []string{".config/*"}
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.bashrc", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.config/app.conf")
+	require.NoError(t, err)
+	require.Equal(t, "hardlink to /home/test/dotfiles/files/.config/app.conf", string(bytes))
+
+	// Hard linked files are up to date, and switching modes replaces them.
+	var logger testLog
 	dfm.Logger = logger.log
-	handleFile := func(s, d string) error {
-		return nil
+	dfm.HardLink = true
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationSkip, ".config/app.conf", "files", ".config/app.conf: already up to date"},
+	}, logger.messages)
+	bytes, err = afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "hardlink to /home/test/dotfiles/files/.bashrc", string(bytes))
+	status, err := dfm.Status(nil)
+	require.NoError(t, err)
+	for _, file := range status {
+		require.Equal(t, StatusLinked, file.State, file.Relative)
 	}
-	err := dfm.runSync(noErrorHandler, OperationLink, handleFile)
+
+	// Autoclean removes hard links to files which left the repo.
+	logger.messages = nil
+	require.NoError(t, fs.Remove("/home/test/dotfiles/files/.bashrc"))
+	err = dfm.LinkAll(noErrorHandler)
 	require.NoError(t, err)
-	require.Equal(t, map[string]bool{".config/fish/config.fish": true}, dfm.Config.manifest)
 	require.Equal(t, []logMessage{
-		{OperationLink, ".config/fish/config.fish", "files", ""},
+		{OperationSkip, ".config/app.conf", "files", ".config/app.conf: already up to date"},
+		{OperationRemove, ".bashrc", "", ""},
 	}, logger.messages)
+	_, err = fs.Stat("/home/test/.bashrc")
+	require.True(t, os.IsNotExist(err))
 }
 
-func TestSyncErrorPartial(t *testing.T) {
+func TestPermissions(t *testing.T) {
 	fs := newFs(emptyConfig, []string{
-		"/home/test/dotfiles/files/.fileA",
-		"/home/test/dotfiles/files/.fileC",
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.ssh/config",
 	})
 	dfm := newDfm(t, fs)
-	initialSync(t, dfm)
+	dfm.Config.permissions = map[string]string{".ssh/*": "0600"}
 	var logger testLog
 	dfm.Logger = logger.log
 
-	handleFile := func(s, d string) error {
-		if d == "/home/test/.fileB" {
-			return fmt.Errorf("fake error")
-		} else if d == "/home/test/.fileC" {
-			require.FailNow(t, "runSync should have aborted at fileB")
-		}
-		exists, err := afero.Exists(fs, d)
-		if err != nil {
-			return err
-		} else if exists {
-			return ErrNotNeeded
-		}
-		return LinkFile(dfm.fs, s, d)
-	}
-	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileB", []byte(fileContent), 0666)
-	err := dfm.runSync(noErrorHandler, OperationLink, handleFile)
-	require.Error(t, err)
-	require.Equal(t, ".fileB: fake error", err.Error())
-	require.Equal(t, map[string]bool{".fileA": true, ".fileB": true, ".fileC": true}, dfm.Config.manifest)
+	// Links apply the rule to the repo file.
+	status, err := dfm.Status(nil)
+	require.NoError(t, err)
+	require.Equal(t, "", status[1].PermissionProblem)
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
 	require.Equal(t, []logMessage{
-		{OperationSkip, ".fileA", "files", ".fileA: already up to date"},
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationLink, ".ssh/config", "files", ""},
+		{OperationChmod, ".ssh/config", "files", ""},
+	}, logger.messages)
+	stat, err := fs.Stat("/home/test/dotfiles/files/.ssh/config")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// Status reports files which violate the rule, and the next sync fixes
+	// them.
+	require.NoError(t, fs.Chmod("/home/test/dotfiles/files/.ssh/config", 0644))
+	status, err = dfm.Status(nil)
+	require.NoError(t, err)
+	require.Equal(t, ".ssh/config", status[1].Relative)
+	require.Equal(t, "mode is 0644, should be 0600", status[1].PermissionProblem)
+	logger.messages = nil
+	dfm.DryRun = true
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+		{OperationSkip, ".ssh/config", "files", ".ssh/config: already up to date"},
+		{OperationChmod, ".ssh/config", "files", ""},
+	}, logger.messages)
+	stat, err = fs.Stat("/home/test/dotfiles/files/.ssh/config")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), stat.Mode().Perm())
+	dfm.DryRun = false
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	status, err = dfm.Status(nil)
+	require.NoError(t, err)
+	require.Equal(t, "", status[1].PermissionProblem)
+
+	// Copies apply the rule to the copy.
+	require.NoError(t, fs.Remove("/home/test/.ssh/config"))
+	require.NoError(t, fs.Chmod("/home/test/dotfiles/files/.ssh/config", 0644))
+	logger.messages = nil
+	err = dfm.CopyFiles([]string{".ssh/config"}, noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationCopy, ".ssh/config", "files", ""},
+		{OperationChmod, ".ssh/config", "files", ""},
+	}, logger.messages)
+	stat, err = fs.Stat("/home/test/.ssh/config")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	// Invalid modes are reported.
+	dfm.Config.permissions = map[string]string{".bashrc": "rw"}
+	logger.messages = nil
+	err = dfm.LinkFiles([]string{".bashrc"}, noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+		{OperationChmod, ".bashrc", "files", `.bashrc: invalid mode "rw" for ".bashrc" in [permissions]`},
 	}, logger.messages)
 }
 
-func TestSyncIgnoreError(t *testing.T) {
+func TestLinkedDir(t *testing.T) {
 	fs := newFs(emptyConfig, []string{
-		"/home/test/dotfiles/files/.fileA",
-		"/home/test/dotfiles/files/.fileC",
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.config/nvim/init.vim",
+		"/home/test/dotfiles/files/.config/nvim/lua/plugins.lua",
+		"/home/test/dotfiles/files/.vim/.dfmdir",
+		"/home/test/dotfiles/files/.vim/vimrc",
 	})
 	dfm := newDfm(t, fs)
-	initialSync(t, dfm)
+	dfm.Config.symlinkDirs = []string{".config/nvim"}
+	// A file tracked before the directory was linked as a whole must not be
+	// removed through the directory link.
+	dfm.Config.manifest[".vim/vimrc"] = true
 	var logger testLog
 	dfm.Logger = logger.log
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationLink, ".config/nvim", "files", ""},
+		{OperationLink, ".vim", "files", ""},
+	}, logger.messages)
+	require.Equal(t, map[string]bool{".bashrc": true, ".config/nvim": true, ".vim": true}, dfm.Config.manifest)
+	bytes, err := afero.ReadFile(fs, "/home/test/.config/nvim")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.config/nvim", string(bytes))
 
-	handleFile := func(s, d string) error {
-		if d == "/home/test/.fileB" {
-			return fmt.Errorf("fake error")
-		}
-		exists, err := afero.Exists(fs, d)
-		if err != nil {
-			return err
-		} else if exists {
-			return ErrNotNeeded
-		}
-		return LinkFile(dfm.fs, s, d)
-	}
-	errorHandler := func(err *FileError) error {
-		return nil
-	}
-	afero.WriteFile(fs, "/home/test/dotfiles/files/.fileB", []byte(fileContent), 0666)
-	err := dfm.runSync(errorHandler, OperationLink, handleFile)
+	// Files inside of a linked directory refer to the directory.
+	logger.messages = nil
+	err = dfm.LinkFiles([]string{".config/nvim/lua/plugins.lua"}, noErrorHandler)
 	require.NoError(t, err)
-	require.Equal(t, map[string]bool{".fileA": true, ".fileB": true, ".fileC": true}, dfm.Config.manifest)
 	require.Equal(t, []logMessage{
-		{OperationSkip, ".fileA", "files", ".fileA: already up to date"},
-		{OperationSkip, ".fileB", "files", ".fileB: fake error"},
-		{OperationSkip, ".fileC", "files", ".fileC: already up to date"},
+		{OperationSkip, ".config/nvim", "files", ".config/nvim: already up to date"},
 	}, logger.messages)
+
+	// Autoclean removes the directory link.
+	logger.messages = nil
+	require.NoError(t, fs.RemoveAll("/home/test/dotfiles/files/.config/nvim"))
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []logMessage{
+		{OperationSkip, ".bashrc", "files", ".bashrc: already up to date"},
+		{OperationSkip, ".vim", "files", ".vim: already up to date"},
+		{OperationRemove, ".config/nvim", "", ""},
+	}, logger.messages)
+	exists, err := afero.Exists(fs, "/home/test/.config/nvim")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Linked directories can't be copied.
+	err = dfm.CopyFiles([]string{".vim"}, noErrorHandler)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "directory is linked as a whole and cannot be copied")
 }
 
-func TestSyncRetry(t *testing.T) {
+func TestVariants(t *testing.T) {
 	fs := newFs(emptyConfig, []string{
-		"/home/test/dotfiles/files/.fileA",
+		"/home/test/dotfiles/files/.gitconfig##default",
+		"/home/test/dotfiles/files/.gitconfig##work-laptop",
+		"/home/test/dotfiles/files/.profile",
+		"/home/test/dotfiles/files/.profile##" + runtime.GOOS,
+		"/home/test/dotfiles/files/.plan##other-host",
+		"/home/test/.vimrc",
 	})
 	dfm := newDfm(t, fs)
+	dfm.Config.hostname = "work-laptop"
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".gitconfig": true, ".profile": true}, dfm.Config.manifest)
+	bytes, err := afero.ReadFile(fs, "/home/test/.gitconfig")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.gitconfig##work-laptop", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.profile")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.profile##"+runtime.GOOS, string(bytes))
+
+	// On another machine, the link is replaced with the default variant.
+	dfm.Config.hostname = "home-desktop"
 	var logger testLog
 	dfm.Logger = logger.log
-
-	timesCalled := 0
-	handleFile := func(s, d string) (err error) {
-		timesCalled++
-		if timesCalled == 1 {
-			return fmt.Errorf("temporary error")
-		}
-		exists, err := afero.Exists(fs, d)
-		if err != nil {
-			return err
-		} else if exists {
-			return nil
-		}
-		return LinkFile(dfm.fs, s, d)
-	}
-	errorHandler := func(err *FileError) error {
-		if err.Message == "temporary error" {
-			return Retry
-		}
-		return err
-	}
-	err := dfm.runSync(errorHandler, OperationLink, handleFile)
+	err = dfm.LinkFiles([]string{".gitconfig"}, noErrorHandler)
 	require.NoError(t, err)
-	require.Equal(t, map[string]bool{".fileA": true}, dfm.Config.manifest)
-	require.Equal(t, timesCalled, 2)
 	require.Equal(t, []logMessage{
-		{OperationLink, ".fileA", "files", ""},
+		{OperationLink, ".gitconfig", "files", ""},
 	}, logger.messages)
-}
+	bytes, err = afero.ReadFile(fs, "/home/test/.gitconfig")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.gitconfig##default", string(bytes))
 
-func TestEjectFiles(t *testing.T) {
-	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/files/.bashrc"})
-	dfm := newDfm(t, fs)
-	err := dfm.EjectFiles([]string{".bashrc"}, noErrorHandler)
+	// Added files can be stored as variants.
+	dfm.Variant = "work-laptop"
+	err = dfm.AddFile("/home/test/.vimrc", "files", true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match this machine")
+	dfm.Variant = runtime.GOOS
+	err = dfm.AddFile("/home/test/.vimrc", "files", true)
 	require.NoError(t, err)
-	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	bytes, err = afero.ReadFile(fs, "/home/test/.vimrc")
 	require.NoError(t, err)
-	require.Equal(t, fileContent, string(bytes))
-	require.Equal(t, map[string]bool{}, dfm.Config.manifest)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.vimrc##"+runtime.GOOS, string(bytes))
+	require.True(t, dfm.Config.manifest[".vimrc"])
 }
 
-func TestAutoclean(t *testing.T) {
+func TestNestedRepos(t *testing.T) {
 	fs := newFs(emptyConfig, []string{
-		"/home/test/dotfiles/files/.config/fileA",
+		"/home/test/dotfiles/repos/common/.bashrc",
+		"/home/test/dotfiles/repos/common/.vimrc",
+		"/home/test/dotfiles/repos/linux/.bashrc",
+		"/home/test/.zshrc",
 	})
 	dfm := newDfm(t, fs)
-	initialSync(t, dfm)
-	var logger testLog
-	dfm.Logger = logger.log
+	dfm.Config.repos = []string{"repos/common", "repos/linux/"}
+	dfm.Config.applyFile(configFile{Repos: dfm.Config.repos})
+	require.Equal(t, []string{"repos/common", "repos/linux"}, dfm.Config.repos)
+	require.NoError(t, dfm.Config.Validate())
 
-	fs.Rename(
-		"/home/test/dotfiles/files/.config/fileA",
-		"/home/test/dotfiles/files/.fileB",
-	)
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/repos/linux/.bashrc", string(bytes))
 
-	handleFile := func(s, d string) error {
-		return nil
-	}
-	err := dfm.runSync(noErrorHandler, OperationLink, handleFile)
+	require.NoError(t, dfm.assertIsActiveRepo("repos/linux/"))
+	err = dfm.AddFile("/home/test/.zshrc", "repos/linux", true)
 	require.NoError(t, err)
-	require.Equal(t, map[string]bool{".fileB": true}, dfm.Config.manifest)
-	require.Equal(t, []logMessage{
-		{OperationLink, ".fileB", "files", ""},
-		{OperationRemove, ".config/fileA", "", ""},
-	}, logger.messages)
+	bytes, err = afero.ReadFile(fs, "/home/test/dotfiles/repos/linux/.zshrc")
+	require.NoError(t, err)
+	require.Equal(t, fileContent, string(bytes))
+	err = dfm.AddFile("/home/test/dotfiles/repos/common/.vimrc", "repos/linux", true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot add a file already inside the dfm directory")
+
+	var logger testLog
+	dfm.Logger = logger.log
+	fs.Remove("/home/test/dotfiles/repos/common/.vimrc")
+	err = dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{".bashrc": true, ".zshrc": true}, dfm.Config.manifest)
+	require.Contains(t, logger.messages, logMessage{OperationRemove, ".vimrc", "", ""})
 }
 
 func TestIsActiveRepo(t *testing.T) {
@@ -298,6 +3461,44 @@ func TestIsActiveRepo(t *testing.T) {
 	require.Contains(t, err.Error(), `repo "invalid" does not exist`)
 }
 
+func TestValidateOneMissing(t *testing.T) {
+	fs := newFs(emptyConfig, []string{})
+	dfm := newDfm(t, fs)
+	fs.MkdirAll("/home/test/dotfiles/work", 0777)
+	dfm.Config.repos = []string{"files", "missing", "work"}
+	err := dfm.Config.Validate()
+	require.IsType(t, (*InvalidReposError)(nil), err)
+	invalidErr := err.(*InvalidReposError)
+	require.Equal(t, []string{"missing"}, invalidErr.Missing)
+	require.Nil(t, invalidErr.NotDirectory)
+	require.Equal(t, `repo "missing" does not exist
+To create the missing repos, run:
+mkdir -p /home/test/dotfiles/missing`, err.Error())
+}
+
+func TestValidateAllMissing(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/dotfiles/notdir"})
+	dfm := newDfm(t, fs)
+	dfm.Config.repos = []string{"one", "two", "notdir"}
+	err := dfm.Config.Validate()
+	require.IsType(t, (*InvalidReposError)(nil), err)
+	invalidErr := err.(*InvalidReposError)
+	require.Equal(t, []string{"one", "two"}, invalidErr.Missing)
+	require.Equal(t, []string{"notdir"}, invalidErr.NotDirectory)
+	require.Equal(t, `repo "one" does not exist
+repo "two" does not exist
+repo "notdir" is not a directory
+To create the missing repos, run:
+mkdir -p /home/test/dotfiles/one /home/test/dotfiles/two`, err.Error())
+}
+
+func TestValidateAllPresent(t *testing.T) {
+	fs := newFs(emptyConfig, []string{})
+	dfm := newDfm(t, fs)
+	dfm.Config.repos = []string{"files", "inactive"}
+	require.NoError(t, dfm.Config.Validate())
+}
+
 func TestChangeConfig(t *testing.T) {
 	fs := newFs(emptyConfig, []string{})
 	dfm := newDfm(t, fs)
@@ -316,6 +3517,88 @@ target = "/home/test"
 	)
 }
 
+func TestConditionalRepos(t *testing.T) {
+	fs := newFs(emptyConfig, []string{})
+	config := `repos = ["files"]
+target = "/home/test"
+
+[[repo]]
+name = "work"
+when = { hostname = "work-*" }
+
+[[repo]]
+name = "os"
+when = { os = "` + runtime.GOOS + `" }
+
+[[repo]]
+name = "other-os"
+when = { os = "plan9", hostname = "work-*" }
+`
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(config), 0666)
+	dfm := newDfm(t, fs)
+	dfm.Config.hostname = "work-laptop"
+	var file configFile
+	require.NoError(t, toml.Unmarshal([]byte(config), &file))
+	dfm.Config.applyFile(file)
+	require.Equal(t, []string{"files", "work", "os"}, dfm.Config.Repos())
+	require.Equal(t, []SkippedRepo{
+		{"other-os", "os is " + runtime.GOOS + ", not plan9"},
+	}, dfm.Config.SkippedRepos())
+
+	dfm.Config.hostname = "home-desktop"
+	dfm.Config.SetRepos([]string{"files", "shared"})
+	require.Equal(t, []string{"files", "shared", "os"}, dfm.Config.Repos())
+	require.Equal(t, []SkippedRepo{
+		{"work", "hostname home-desktop does not match work-*"},
+		{"other-os", "os is " + runtime.GOOS + ", not plan9"},
+	}, dfm.Config.SkippedRepos())
+
+	// Conditional repos are saved as they were configured.
+	require.NoError(t, dfm.Config.Save())
+	cfgBytes, err := afero.ReadFile(fs, "/home/test/dotfiles/.dfm.toml")
+	require.NoError(t, err)
+	var saved configFile
+	require.NoError(t, toml.Unmarshal(cfgBytes, &saved))
+	require.Equal(t, []string{"files", "shared"}, saved.Repos)
+	require.Equal(t, file.Repo, saved.Repo)
+}
+
+func TestAutoOSRepos(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.profile",
+		"/home/test/dotfiles/files." + runtime.GOOS + "/.bashrc",
+		"/home/test/dotfiles/files.plan9/.profile",
+	})
+	config := `auto_os_repos = true
+repos = ["files"]
+target = "/home/test"
+`
+	afero.WriteFile(fs, "/home/test/dotfiles/.dfm.toml", []byte(config), 0666)
+	dfm := newDfm(t, fs)
+	osRepo := "files." + runtime.GOOS
+	require.Equal(t, []string{"files", osRepo}, dfm.Config.Repos())
+	require.NoError(t, dfm.assertIsActiveRepo(osRepo))
+
+	// The OS-specific repo takes precedence.
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	bytes, err := afero.ReadFile(fs, "/home/test/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/"+osRepo+"/.bashrc", string(bytes))
+	bytes, err = afero.ReadFile(fs, "/home/test/.profile")
+	require.NoError(t, err)
+	require.Equal(t, "symlink to /home/test/dotfiles/files/.profile", string(bytes))
+
+	// The OS-specific repo is not saved in the repos list.
+	cfgBytes, err := afero.ReadFile(fs, "/home/test/dotfiles/.dfm.toml")
+	require.NoError(t, err)
+	var saved configFile
+	require.NoError(t, toml.Unmarshal(cfgBytes, &saved))
+	require.Equal(t, []string{"files"}, saved.Repos)
+	require.True(t, saved.AutoOSRepos)
+}
+
 func TestDryRun(t *testing.T) {
 	fs := newFs(emptyConfig, []string{
 		"/home/test/dotfiles/files/.fileA",
@@ -336,7 +3619,7 @@ func TestDryRun(t *testing.T) {
 	handleFile := func(s, d string) error {
 		return nil
 	}
-	err = dfm.runSync(noErrorHandler, OperationLink, handleFile)
+	err = dfm.runSync(context.Background(), noErrorHandler, OperationLink, handleFile)
 	require.NoError(t, err)
 	require.Equal(t, map[string]bool{".fileB": true}, dfm.Config.manifest)
 	require.Equal(t, []logMessage{
@@ -344,3 +3627,131 @@ func TestDryRun(t *testing.T) {
 		{OperationRemove, ".fileA", "", ""},
 	}, logger.messages)
 }
+
+func TestEvents(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	fs.Remove("/home/test/.bashrc")
+	var events []Event
+	var logger testLog
+	dfm.Logger = logger.log
+	dfm.Events = EventHandlerFunc(func(event Event) {
+		events = append(events, event)
+	})
+	dfm.DryRun = true
+	err := dfm.LinkAll(noErrorHandler)
+	require.NoError(t, err)
+	require.Equal(t, []Event{
+		{
+			Operation: OperationLink,
+			Relative:  ".bashrc",
+			Repo:      "files",
+			Source:    "/home/test/dotfiles/files/.bashrc",
+			Target:    "/home/test/.bashrc",
+			DryRun:    true,
+			Level:     LevelInfo,
+		},
+		{
+			Operation: OperationSkip,
+			Relative:  ".vimrc",
+			Repo:      "files",
+			Source:    "/home/test/dotfiles/files/.vimrc",
+			Target:    "/home/test/.vimrc",
+			Err:       events[1].Err,
+			DryRun:    true,
+			Level:     LevelDebug,
+		},
+	}, events)
+	require.True(t, IsNotNeeded(events[1].Err))
+	// The Logger receives the same operations.
+	require.Equal(t, []logMessage{
+		{OperationLink, ".bashrc", "files", ""},
+		{OperationSkip, ".vimrc", "files", events[1].Err.Error()},
+	}, logger.messages)
+}
+
+func TestEventPaths(t *testing.T) {
+	fs := newFs(emptyConfig, []string{"/home/test/.bashrc"})
+	dfm := newDfm(t, fs)
+	var events []Event
+	dfm.Events = EventHandlerFunc(func(event Event) {
+		events = append(events, event)
+	})
+	dfm.Variant = runtime.GOOS
+	err := dfm.AddFile("/home/test/.bashrc", "files", true)
+	require.NoError(t, err)
+	err = dfm.RemoveFiles([]string{".bashrc"})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, OperationAdd, events[0].Operation)
+	require.Equal(t, "/home/test/dotfiles/files/.bashrc"+VariantSeparator+runtime.GOOS, events[0].Source)
+	require.Equal(t, "/home/test/.bashrc", events[0].Target)
+	require.Equal(t, OperationRemove, events[1].Operation)
+	require.Equal(t, "", events[1].Source)
+	require.Equal(t, "/home/test/.bashrc", events[1].Target)
+}
+
+func TestSkipped(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+		"/home/test/dotfiles/files/.zshrc",
+		"/home/test/.bashrc",
+		"/home/test/.vimrc",
+	})
+	afero.WriteFile(fs, "/home/test/.bashrc", []byte("local"), 0666)
+	afero.WriteFile(fs, "/home/test/.vimrc", []byte("local"), 0666)
+	dfm := newDfm(t, fs)
+	err := dfm.LinkAll(func(err *FileError) error { return nil })
+	require.NoError(t, err)
+	skipped := dfm.Skipped()
+	require.Len(t, skipped, 1)
+	require.Equal(t, skipped[0].Err.(*FileError).Message, skipped[0].Reason)
+	require.Equal(t, []string{".bashrc", ".vimrc"}, skipped[0].Paths)
+	require.True(t, os.IsExist(skipped[0].Err.(*FileError).Cause()))
+}
+
+func TestPlanChanges(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	dfm := newDfm(t, fs)
+	initialSync(t, dfm)
+	plan, err := dfm.PlanLink()
+	require.NoError(t, err)
+	require.Empty(t, plan.Changes())
+
+	fs.Remove("/home/test/dotfiles/files/.vimrc")
+	plan, err = dfm.PlanLink()
+	require.NoError(t, err)
+	changes := plan.Changes()
+	require.Len(t, changes, 1)
+	require.Equal(t, ActionRemove, changes[0].Type)
+	require.Equal(t, ".vimrc", changes[0].Relative)
+}
+
+func TestTimings(t *testing.T) {
+	fs := newFs(emptyConfig, []string{
+		"/home/test/dotfiles/files/.bashrc",
+		"/home/test/dotfiles/files/.vimrc",
+	})
+	dfm := newDfm(t, fs)
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	require.Nil(t, dfm.Timings())
+
+	dfm = newDfm(t, fs)
+	dfm.Timing = true
+	fs.Remove("/home/test/.vimrc")
+	require.NoError(t, dfm.LinkAll(noErrorHandler))
+	timings := dfm.Timings()
+	require.NotNil(t, timings)
+	require.Len(t, timings.Slowest, 2)
+	require.ElementsMatch(t, []string{".bashrc", ".vimrc"}, []string{timings.Slowest[0].Relative, timings.Slowest[1].Relative})
+	require.True(t, timings.Slowest[0].Duration >= timings.Slowest[1].Duration)
+	require.Equal(t, timings.Slowest[0].Duration+timings.Slowest[1].Duration, timings.Sync)
+}
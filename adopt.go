@@ -0,0 +1,99 @@
+package dfm
+
+import (
+	"context"
+	"path"
+)
+
+// AdoptFiles copies the given target files over the repo files which provide
+// them, so that changes made to the target are kept in the repo. The target
+// files are left alone. Each file has to be provided by a repo already. When
+// repo is set, the file is copied into that repo instead of the one which
+// provides it.
+func (dfm *Dfm) AdoptFiles(inputFilenames []string, repo string, errorHandler ErrorHandler) error {
+	return dfm.AdoptFilesContext(context.Background(), inputFilenames, repo, errorHandler)
+}
+
+// AdoptFilesContext is AdoptFiles with support for cancellation. If the
+// context is canceled, no more files are adopted and the context's error is
+// returned.
+func (dfm *Dfm) AdoptFilesContext(ctx context.Context, inputFilenames []string, repo string, errorHandler ErrorHandler) error {
+	if repo != "" {
+		if err := dfm.assertIsActiveRepo(repo); err != nil {
+			return err
+		}
+	}
+	fileList, err := dfm.buildFileList(inputFilenames)
+	if err != nil {
+		return err
+	}
+	var overallErr error
+	for _, relative := range fileList.Keys() {
+		if err := ctx.Err(); err != nil {
+			overallErr = err
+			break
+		}
+		fileRepo, _ := fileList.Get(relative)
+		dest := dfm.SourcePath(fileRepo, relative)
+		if repo != "" && repo != fileRepo {
+			fileRepo = repo
+			dest = dfm.RepoPath(repo, relative)
+		}
+		attempt := fileAttempt{OperationAdopt, fileRepo, dest, dfm.TargetPath(relative)}
+		skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+			if err := dfm.adoptFile(relative, fileRepo, dest); err != nil {
+				return WrapFileError(err, relative)
+			}
+			return nil
+		})
+		if abort {
+			overallErr = fileErr
+			break
+		} else if skip {
+			dfm.logPaths(OperationSkip, relative, fileRepo, dest, "", fileErr)
+		} else {
+			dfm.logPaths(OperationAdopt, relative, fileRepo, dest, "", nil)
+		}
+	}
+	if saveErr := dfm.saveConfig(); saveErr != nil {
+		return saveErr
+	}
+	return overallErr
+}
+
+// adoptFile copies the target file to dest in the repo.
+func (dfm *Dfm) adoptFile(relative, repo, dest string) error {
+	targetPath := dfm.TargetPath(relative)
+	isRegular, err := IsRegularFile(dfm.fs, targetPath)
+	if err != nil {
+		return err
+	} else if _, isLink := readLink(dfm.fs, targetPath); isLink || !isRegular {
+		if linked, err := IsLinkedFile(dfm.fs, dest, targetPath); err != nil {
+			return err
+		} else if linked {
+			return ErrNotNeeded
+		}
+		return NewFileError(relative, "only regular files can be adopted")
+	}
+	if identical, err := IsIdenticalFile(dfm.fs, targetPath, dest); err != nil {
+		return err
+	} else if identical {
+		return ErrNotNeeded
+	}
+	if dfm.DryRun {
+		return nil
+	}
+	if err := MakeDirAll(dfm.fs, path.Dir(relative), dfm.Config.targetPath, dfm.RepoPath(repo, "")); err != nil {
+		return err
+	}
+	options := dfm.copyOptions(dest)
+	options.replace = true
+	if err := copyFile(dfm.fs, targetPath, dest, options); err != nil {
+		return err
+	}
+	if dfm.Config.manifest[relative] {
+		// The target is now an unmodified copy of the repo file.
+		dfm.recordChecksum(relative, targetPath)
+	}
+	return nil
+}
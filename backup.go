@@ -0,0 +1,109 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+)
+
+// BackupSuffix is appended to the name of a file which Force would overwrite,
+// when backups are enabled and no backup_dir is configured.
+const BackupSuffix = ".dfm-backup"
+
+// useBackup returns true if files which Force overwrites are backed up first.
+func (dfm *Dfm) useBackup() bool {
+	return dfm.Backup || dfm.Config.backup || dfm.Config.backupDir != ""
+}
+
+// BackupPath returns the path where the target file is moved to when Force
+// overwrites it: the same path with BackupSuffix, or the same relative path in
+// the backup_dir config option.
+func (dfm *Dfm) BackupPath(relative string) string {
+	if dfm.Config.backupDir == "" {
+		return dfm.TargetPath(relative) + BackupSuffix
+	}
+	return pathJoin(dfm.Config.path, dfm.Config.backupDir, relative)
+}
+
+// existingPath returns the path of the file which already existed, if err is
+// an ErrExist error from a file operation.
+func existingPath(err error) (string, bool) {
+	if !errors.Is(err, os.ErrExist) {
+		return "", false
+	}
+	var linkErr *os.LinkError
+	var pathErr *os.PathError
+	if errors.As(err, &linkErr) {
+		return linkErr.New, true
+	} else if errors.As(err, &pathErr) {
+		return pathErr.Path, true
+	}
+	return "", false
+}
+
+// withForce wraps the process so that with Force, a file which is in the way
+// is removed and the process is tried again. When cleared is not nil, the file
+// is in the target directory, and it is set to OperationOverwrite, or to
+// OperationBackup if the file was backed up instead. In dry run mode, nothing
+// is removed, and the process isn't tried again.
+func (dfm *Dfm) withForce(process func() *FileError, cleared *string) func() *FileError {
+	if !dfm.Force {
+		return process
+	}
+	return func() *FileError {
+		fileErr := process()
+		if fileErr == nil {
+			return nil
+		}
+		existing, ok := existingPath(fileErr)
+		if !ok {
+			return fileErr
+		}
+		relative, inTarget := RelativePath(dfm.Config.targetPath, existing)
+		inTarget = inTarget && cleared != nil
+		switch {
+		case inTarget && dfm.useBackup():
+			if err := dfm.backupFile(relative); err != nil {
+				return WrapFileError(err, fileErr.Filename)
+			}
+			*cleared = OperationBackup
+		case dfm.DryRun:
+			if inTarget {
+				*cleared = OperationOverwrite
+			}
+			return nil
+		default:
+			remove := RemoveFile
+			if stat, err := lstat(dfm.fs, existing); err == nil && stat.IsDir() && dfm.ForceDirs {
+				remove = afero.Fs.RemoveAll
+			}
+			if err := remove(dfm.fs, existing); err != nil {
+				return WrapFileError(err, fileErr.Filename)
+			}
+			if inTarget {
+				*cleared = OperationOverwrite
+			}
+		}
+		if dfm.DryRun {
+			return nil
+		}
+		return process()
+	}
+}
+
+// backupFile moves the target file to its BackupPath. An existing backup is
+// never overwritten. In dry run mode, the file is only checked.
+func (dfm *Dfm) backupFile(relative string) error {
+	backup := dfm.BackupPath(relative)
+	if _, err := lstat(dfm.fs, backup); err == nil {
+		return NewFileErrorf(relative, "not overwriting: backup %s already exists", backup)
+	} else if dfm.DryRun {
+		return nil
+	}
+	if err := dfm.fs.MkdirAll(path.Dir(backup), 0777); err != nil {
+		return err
+	}
+	return MoveFile(dfm.fs, dfm.TargetPath(relative), backup)
+}
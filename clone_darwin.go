@@ -0,0 +1,39 @@
+package dfm
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// sysClonefileat is the clonefileat system call, which creates a
+	// copy-on-write clone of a file on APFS.
+	sysClonefileat = 462
+	// atFdcwd makes clonefileat resolve relative paths from the working
+	// directory.
+	atFdcwd = -2
+)
+
+// cloneFile creates dest as a clone of source. It fails if the filesystem
+// doesn't support cloning, in which case dest is not created.
+func cloneFile(source, dest string) error {
+	sourcePtr, err := syscall.BytePtrFromString(source)
+	if err != nil {
+		return err
+	}
+	destPtr, err := syscall.BytePtrFromString(dest)
+	if err != nil {
+		return err
+	}
+	fd := atFdcwd
+	_, _, errno := syscall.Syscall6(
+		sysClonefileat,
+		uintptr(fd), uintptr(unsafe.Pointer(sourcePtr)),
+		uintptr(fd), uintptr(unsafe.Pointer(destPtr)),
+		0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
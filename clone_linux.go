@@ -0,0 +1,31 @@
+package dfm
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which makes the destination file share the
+// data of the source file on filesystems like btrfs and XFS.
+const ficlone = 0x40049409
+
+// cloneFile creates dest as a clone of source. It fails if the filesystem
+// doesn't support cloning, in which case dest is not created.
+func cloneFile(source, dest string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, destFile.Fd(), ficlone, sourceFile.Fd())
+	if errno != 0 {
+		destFile.Close()
+		os.Remove(dest)
+		return errno
+	}
+	return destFile.Close()
+}
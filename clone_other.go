@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package dfm
+
+import "errors"
+
+// cloneFile always fails, because cloning files is not supported on this
+// operating system.
+func cloneFile(source, dest string) error {
+	return errors.New("cloning files is not supported")
+}
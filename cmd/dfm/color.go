@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorDim    = "\x1b[2m"
+)
+
+// useColor is set when the CLI output should be colorized.
+var useColor bool
+
+// colorize wraps the text in the given color code, if color is enabled.
+func colorize(color, text string) string {
+	if !useColor {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// isTerminal returns true if the given file is a terminal.
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// shouldUseColor interprets the value of the --color flag. In auto mode, color
+// is used only when stdout is a terminal and NO_COLOR is not set.
+func shouldUseColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if noColor, _ := os.LookupEnv("NO_COLOR"); noColor != "" {
+			return false, nil
+		}
+		return isTerminal(os.Stdout), nil
+	default:
+		return false, fmt.Errorf("invalid value for --color: %#v (must be auto, always, or never)", mode)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// expandArgs expands the arguments which are glob patterns, for shells which
+// don't, or when the arguments were quoted. An argument is only a pattern if
+// it contains an unescaped *, ? or [ and no file has that literal name; other
+// arguments are kept as they are, with escapes removed. A pattern which
+// matches nothing is an error.
+func expandArgs(args []string) ([]string, error) {
+	results := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !hasGlobMeta(arg) {
+			results = append(results, unescapeGlob(arg))
+			continue
+		} else if _, err := os.Lstat(arg); err == nil {
+			results = append(results, arg)
+			continue
+		}
+		matches, err := expandGlob(expandHome(arg))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", arg, err)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no files match the pattern", arg)
+		}
+		results = append(results, matches...)
+	}
+	return results, nil
+}
+
+// hasGlobMeta returns true if the argument contains an unescaped *, ? or [.
+// On Windows, backslashes separate paths, so nothing can be escaped.
+func hasGlobMeta(arg string) bool {
+	for i := 0; i < len(arg); i++ {
+		switch arg[i] {
+		case '\\':
+			if runtime.GOOS != "windows" {
+				i++
+			}
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeGlob removes the backslashes which escape characters in a pattern.
+func unescapeGlob(arg string) string {
+	if runtime.GOOS == "windows" || !strings.Contains(arg, "\\") {
+		return arg
+	}
+	var result strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '\\' && i+1 < len(arg) {
+			i++
+		}
+		result.WriteByte(arg[i])
+	}
+	return result.String()
+}
+
+// expandHome replaces a leading ~ with the home directory, since the shell
+// didn't.
+func expandHome(pattern string) string {
+	if pattern != "~" && !strings.HasPrefix(pattern, "~/") && !strings.HasPrefix(pattern, "~"+string(filepath.Separator)) {
+		return pattern
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return pattern
+	}
+	return home + pattern[1:]
+}
+
+// expandGlob returns the paths which match the pattern, in order. The pattern
+// is matched one path element at a time like filepath.Match, except that an
+// element of ** matches any number of directories, including none.
+func expandGlob(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	var matches []string
+	if filepath.IsAbs(pattern) {
+		root := filepath.VolumeName(pattern) + string(filepath.Separator)
+		matches = []string{root}
+		pattern = pattern[len(root):]
+	} else {
+		matches = []string{"."}
+	}
+	for _, element := range strings.Split(pattern, string(filepath.Separator)) {
+		var next []string
+		for _, dir := range matches {
+			switch {
+			case element == "**":
+				next = append(next, walkAll(dir)...)
+			case !hasGlobMeta(element):
+				candidate := filepath.Join(dir, unescapeGlob(element))
+				if _, err := os.Lstat(candidate); err == nil {
+					next = append(next, candidate)
+				}
+			default:
+				entries, err := ioutil.ReadDir(dir)
+				if err != nil {
+					// Not a directory, or not readable, so nothing inside
+					// it matches.
+					continue
+				}
+				for _, entry := range entries {
+					if matched, err := filepath.Match(element, entry.Name()); err != nil {
+						return nil, err
+					} else if matched {
+						next = append(next, filepath.Join(dir, entry.Name()))
+					}
+				}
+			}
+		}
+		matches = next
+	}
+	sort.Strings(matches)
+	return dedupe(matches), nil
+}
+
+// walkAll returns dir and everything inside of it. Links to directories are
+// not followed.
+func walkAll(dir string) []string {
+	var paths []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths
+}
+
+// dedupe removes repeated strings from a sorted list.
+func dedupe(sorted []string) []string {
+	result := sorted[:0]
+	for i, str := range sorted {
+		if i == 0 || str != sorted[i-1] {
+			result = append(result, str)
+		}
+	}
+	return result
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasGlobMeta(t *testing.T) {
+	require.True(t, hasGlobMeta("*.fish"))
+	require.True(t, hasGlobMeta("file?.txt"))
+	require.True(t, hasGlobMeta("[ab].txt"))
+	require.False(t, hasGlobMeta(".bashrc"))
+	require.False(t, hasGlobMeta(`\*.fish`))
+	require.Equal(t, "*.fish", unescapeGlob(`\*.fish`))
+}
+
+func TestExpandArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfm-glob")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, filename := range []string{"a.fish", "b.fish", "c.txt", "deep/nested/d.fish", "[x].fish"} {
+		path := filepath.Join(dir, filename)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		require.NoError(t, ioutil.WriteFile(path, nil, 0666))
+	}
+
+	args, err := expandArgs([]string{filepath.Join(dir, "*.fish"), filepath.Join(dir, "c.txt")})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "[x].fish"),
+		filepath.Join(dir, "a.fish"),
+		filepath.Join(dir, "b.fish"),
+		filepath.Join(dir, "c.txt"),
+	}, args)
+
+	args, err = expandArgs([]string{filepath.Join(dir, "**", "*.fish")})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "[x].fish"),
+		filepath.Join(dir, "a.fish"),
+		filepath.Join(dir, "b.fish"),
+		filepath.Join(dir, "deep/nested/d.fish"),
+	}, args)
+
+	// A file whose name looks like a pattern is used as it is.
+	args, err = expandArgs([]string{filepath.Join(dir, "[x].fish")})
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "[x].fish")}, args)
+
+	_, err = expandArgs([]string{filepath.Join(dir, "*.zsh")})
+	require.EqualError(t, err, filepath.Join(dir, "*.zsh")+": no files match the pattern")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cgamesplay/dfm"
+)
+
+// logFile appends a timestamped record of everything dfm does to a file, see
+// --log-file. The file is only opened once there is something to write. A nil
+// logFile discards everything.
+type logFile struct {
+	path string
+	lock sync.Mutex
+	file *os.File
+	// Set once the file couldn't be opened, so the warning is only shown
+	// once
+	failed bool
+}
+
+func newLogFile(path string) *logFile {
+	return &logFile{path: path}
+}
+
+// wrap returns an EventHandler which records each operation in the log file
+// before passing it to the given handler.
+func (log *logFile) wrap(handler dfm.EventHandler) dfm.EventHandler {
+	if log == nil {
+		return handler
+	}
+	return dfm.EventHandlerFunc(func(event dfm.Event) {
+		message := event.Operation + " " + event.Relative
+		if event.Repo != "" {
+			message += " (" + event.Repo + ")"
+		}
+		if event.Err != nil {
+			message += ": " + event.Err.Error()
+		}
+		log.println(message)
+		handler.HandleEvent(event)
+	})
+}
+
+// println writes a single line to the log file, prefixed with the time and,
+// in a dry run, a marker so the line isn't mistaken for a real change.
+func (log *logFile) println(message string) {
+	if log == nil {
+		return
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if !log.open() {
+		return
+	}
+	prefix := time.Now().Format(time.RFC3339)
+	if dryRun {
+		prefix += " (dry run)"
+	}
+	for _, line := range strings.Split(message, "\n") {
+		fmt.Fprintf(log.file, "%s %s\n", prefix, line)
+	}
+}
+
+// open opens the log file the first time it is needed, starting with the
+// command line. It returns false if the file can't be written.
+func (log *logFile) open() bool {
+	if log.file != nil {
+		return true
+	} else if log.failed {
+		return false
+	}
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		log.failed = true
+		progress.clear()
+		fmt.Fprintln(os.Stderr, colorize(colorYellow, fmt.Sprintf("warning: can't write to the log file: %s", err)))
+		return false
+	}
+	log.file = file
+	fmt.Fprintf(log.file, "%s dfm %s\n", time.Now().Format(time.RFC3339), strings.Join(os.Args[1:], " "))
+	return true
+}
@@ -0,0 +1,1486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cgamesplay/dfm"
+	"github.com/mitchellh/go-wordwrap"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	dfmDir       string
+	app          *dfm.Dfm
+	ctx          context.Context
+	initRepos    []string
+	initTarget   string
+	verbose      bool
+	quiet        bool
+	colorMode    string
+	outputFormat string
+	porcelain    bool
+	dryRun       bool
+	force        bool
+	massDelete   bool
+	useTrash     bool
+	backup       bool
+	forceDirs    bool
+	pruneBroken  bool
+	noAutoAdd    bool
+	strict       bool
+	jobs         int
+	retries      int
+	retryDelay   time.Duration
+	addToRepo    string
+	adoptRepo    string
+	syncRepos    []string
+	syncExclude  []string
+	addWithCopy  bool
+	addCommit    bool
+	addVariant   string
+	addSensitive bool
+	addMove      bool
+	addAs        string
+	addFollow    bool
+	addYes       bool
+	planCopy     bool
+	syncCheck    bool
+	showTiming   bool
+	hardLink     bool
+	fallbackCopy bool
+	watchCopy    bool
+	initClone    string
+	initLink     bool
+	adoptLinks   bool
+	verifySums   bool
+	historyLimit int
+	whichAll     bool
+	pathOnly     bool
+	logPath      string
+	removePurge  bool
+	purgeAll     bool
+	ejectDelete  bool
+	moveRepo     string
+	filesFrom    string
+	nullInput    bool
+	listedPaths  []string
+	conflicted   bool
+	errored      bool
+	attempts     = map[string]int{}
+	attemptsLock sync.Mutex
+	progress     *progressBar
+	logOutput    *logFile
+)
+
+// textOutput is the EventHandler for the default text output. Verbose output
+// also shows files which were already up to date, and quiet output only shows
+// warnings and errors.
+type textOutput struct {
+	verbose bool
+	quiet   bool
+}
+
+func (output textOutput) HandleEvent(event dfm.Event) {
+	if output.quiet && event.Level < dfm.LevelWarning {
+		return
+	} else if !output.verbose && event.Level == dfm.LevelDebug {
+		return
+	}
+	progress.clear()
+	relative, repo, reason := event.Relative, event.Repo, event.Err
+	switch event.Operation {
+	case dfm.OperationLink, dfm.OperationCopy:
+		message := fmt.Sprintf("%s -> %s", path.Join(repo, relative), event.Target)
+		if overrides := app.Overrides(relative); output.verbose && len(overrides) > 0 {
+			for i, other := range overrides {
+				overrides[i] = path.Join(other, relative)
+			}
+			message += fmt.Sprintf(" (overrides %s)", strings.Join(overrides, ", "))
+		}
+		fmt.Println(colorize(colorGreen, message))
+	case dfm.OperationAdopt:
+		fmt.Println(colorize(colorGreen, fmt.Sprintf("%s -> %s", event.Target, path.Join(repo, relative))))
+	case dfm.OperationSkip:
+		color := colorYellow
+		if event.Level == dfm.LevelDebug {
+			color = colorDim
+		}
+		if fileErr, ok := reason.(*dfm.FileError); ok {
+			reason = fmt.Errorf(fileErr.Message)
+		}
+		fmt.Println(colorize(color, fmt.Sprintf("skipping %s: %s", event.Target, reason)))
+	case dfm.OperationWarning:
+		fmt.Fprintln(os.Stderr, colorize(colorYellow, fmt.Sprintf("warning: %s", reason)))
+	case dfm.OperationBackup:
+		if event.DryRun {
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("would back up %s to %s", event.Source, event.Target)))
+		} else {
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("backed up %s to %s", event.Source, event.Target)))
+		}
+	case dfm.OperationOverwrite:
+		if event.DryRun {
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("would overwrite %s", event.Target)))
+		} else {
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("overwrote %s", event.Target)))
+		}
+	case dfm.OperationGit:
+		if event.DryRun {
+			fmt.Println(relative)
+		}
+	case dfm.OperationOnChange:
+		if event.DryRun {
+			fmt.Println(colorize(colorDim, fmt.Sprintf("would run %s", relative)))
+		} else if reason != nil {
+			fmt.Println(colorize(colorRed, fmt.Sprintf("ran %s: %s", relative, errorMessage(reason))))
+		} else {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("ran %s", relative)))
+		}
+	case dfm.OperationChmod:
+		if reason != nil {
+			fmt.Println(colorize(colorRed, fmt.Sprintf("chmod %s: %s", event.Target, errorMessage(reason))))
+		} else if event.DryRun {
+			fmt.Println(colorize(colorDim, fmt.Sprintf("would chmod %s", event.Target)))
+		} else {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("chmod %s", event.Target)))
+		}
+	case dfm.OperationPrune:
+		if event.DryRun {
+			fmt.Println(colorize(colorDim, fmt.Sprintf("would prune stale manifest entry %s", relative)))
+		} else {
+			fmt.Println(colorize(colorDim, fmt.Sprintf("pruned stale manifest entry %s", relative)))
+		}
+	case dfm.OperationRestore:
+		if event.DryRun {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("would restore %s", event.Target)))
+		} else {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("restored %s", event.Target)))
+		}
+	case dfm.OperationEject:
+		if event.Level == dfm.LevelDebug {
+			fmt.Println(colorize(colorDim, fmt.Sprintf("ejected %s (already a copy, no longer tracked)", event.Target)))
+		} else if event.DryRun {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("would eject %s (no longer tracked)", event.Target)))
+		} else {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("ejected %s (no longer tracked)", event.Target)))
+		}
+	case dfm.OperationPurge:
+		if reason != nil {
+			fmt.Println(colorize(colorRed, fmt.Sprintf("purge %s: %s", event.Source, errorMessage(reason))))
+		} else if event.DryRun {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("would purge %s", event.Source)))
+		} else {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("purged %s", event.Source)))
+		}
+	case dfm.OperationMove:
+		if event.DryRun {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("would move %s to %s", event.Source, event.Target)))
+		} else {
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("moved %s to %s", event.Source, event.Target)))
+		}
+	case dfm.OperationRemove:
+		color := colorGreen
+		if event.Level == dfm.LevelError {
+			color = colorRed
+		}
+		fmt.Println(colorize(color, fmt.Sprintf("%s %s", event.Operation, relative)))
+	default:
+		fmt.Printf("%s %s\n", event.Operation, relative)
+	}
+}
+
+// Exit statuses, as described in the help for the root command.
+const (
+	exitFatal       = 1
+	exitConflicts   = 2
+	exitErrors      = 3
+	exitBoth        = 4
+	exitPending     = 5
+	exitInterrupted = 130
+)
+
+func errorHandler(fileError *dfm.FileError) error {
+	if !isConflict(fileError) && shouldRetry(fileError.Filename) {
+		if verbose && outputFormat == "text" {
+			progress.clear()
+			fmt.Fprintln(os.Stderr, colorize(colorYellow, fmt.Sprintf("retrying %s %s", fileError.Operation, fileError)))
+		}
+		return dfm.RetryAfter(retryDelay)
+	}
+	recordFailure(fileError)
+	return nil
+}
+
+// shouldRetry counts the attempts for a file which failed, and returns true
+// until --retries is used up.
+func shouldRetry(filename string) bool {
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+	if attempts[filename] >= retries {
+		return false
+	}
+	attempts[filename]++
+	return true
+}
+
+// recordFailure notes a file which couldn't be handled, for the exit status.
+func recordFailure(fileError *dfm.FileError) {
+	if isConflict(fileError) {
+		conflicted = true
+	} else {
+		errored = true
+	}
+}
+
+// isConflict returns true for files that dfm refused to touch, like files in
+// the way of a link, which are errors without a cause. The rest are
+// operations which failed.
+func isConflict(fileError *dfm.FileError) bool {
+	return fileError.Cause() == nil || errors.Is(fileError, os.ErrExist)
+}
+
+// exitStatus returns the exit status for the files which couldn't be handled.
+func exitStatus() int {
+	switch {
+	case conflicted && errored:
+		return exitBoth
+	case conflicted:
+		return exitConflicts
+	case errored:
+		return exitErrors
+	}
+	return 0
+}
+
+// confirmRemovals lists the files which the autoclean would remove and asks
+// whether to continue. Without a terminal to ask on, the sync is aborted
+// unless --allow-mass-delete was given.
+func confirmRemovals(files []string) bool {
+	if massDelete {
+		return true
+	}
+	progress.clear()
+	fmt.Fprintln(os.Stderr, colorize(colorYellow, fmt.Sprintf("The autoclean would remove %d files:", len(files))))
+	for _, relative := range files {
+		fmt.Fprintf(os.Stderr, "  %s\n", app.TargetPath(relative))
+	}
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, "Remove these files? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// confirmAdd prints how much dfm add found in directories, and asks whether
+// to continue if that is more than the limit. Without a terminal to ask on,
+// the add is aborted unless --yes was given.
+func confirmAdd(files []string, size int64, overLimit bool) bool {
+	ask := overLimit && !addYes
+	if ask || (outputFormat == "text" && !quiet) {
+		progress.clear()
+		fmt.Fprintf(os.Stderr, "Adding %d files (%s) from directories\n", len(files), formatBytes(size))
+	}
+	if !ask {
+		return true
+	} else if !isTerminal(os.Stdin) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, "Add these files? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// printSummary prints the one-line summary of everything the command did.
+func printSummary() {
+	logOutput.println(app.Summary().String())
+	switch outputFormat {
+	case "json":
+		printJSON(struct {
+			Summary dfm.Summary        `json:"summary"`
+			Skipped []dfm.SkippedFiles `json:"skipped,omitempty"`
+			Timing  *dfm.Timings       `json:"timing,omitempty"`
+		}{app.Summary(), app.Skipped(), app.Timings()})
+		return
+	case "porcelain":
+		// The porcelain format only lists files.
+		return
+	}
+	fmt.Println(app.Summary())
+	if timings := app.Timings(); timings != nil {
+		printTimings(timings)
+	}
+}
+
+// printSkipped lists the files which were skipped because of errors, grouped
+// by the reason, so that they don't scroll away in a long sync. The other
+// output formats include them in the summary instead.
+func printSkipped() {
+	if outputFormat != "text" {
+		return
+	}
+	for _, group := range app.Skipped() {
+		header := fmt.Sprintf("%d files skipped: %s", len(group.Paths), group.Reason)
+		if len(group.Paths) == 1 {
+			header = fmt.Sprintf("1 file skipped: %s", group.Reason)
+		}
+		if hint := skipHint(group.Err); hint != "" {
+			header += " (" + hint + ")"
+		}
+		fmt.Println(colorize(colorYellow, header))
+		for _, relative := range group.Paths {
+			fmt.Printf("  %s\n", app.TargetPath(relative))
+		}
+	}
+}
+
+// skipHint suggests how to deal with files which were skipped because of the
+// error, or returns "".
+func skipHint(err error) string {
+	if errors.Is(err, os.ErrExist) && !force {
+		return "rerun with --force to overwrite"
+	}
+	return ""
+}
+
+func fatal(err error) {
+	printError(err)
+	os.Exit(exitFatal)
+}
+
+func handleCommandError(err error) {
+	var removalsErr *dfm.TooManyRemovalsError
+	var addsErr *dfm.TooManyAddsError
+	if errors.Is(err, context.Canceled) {
+		printError(errors.New("interrupted"))
+		os.Exit(exitInterrupted)
+	} else if errors.As(err, &removalsErr) {
+		fatal(fmt.Errorf("%s\nNothing was changed. To remove them, rerun with --allow-mass-delete.", removalsErr))
+		return
+	} else if errors.As(err, &addsErr) {
+		fatal(fmt.Errorf("%s\nNothing was added. To add them anyway, rerun with --yes.", addsErr))
+		return
+	} else if err != nil {
+		fatal(err)
+		return
+	}
+	if status := exitStatus(); status != 0 {
+		os.Exit(status)
+	}
+}
+
+// resolveInputFilenames transforms the given list of filenames to relative
+// paths in the target directory, taking into account the pwd. Glob patterns
+// are expanded first, see expandArgs. A single -, or --files-from, reads the
+// paths from stdin or the file instead, see readListedPaths. Errors will abort
+// the program.
+func resolveInputFilenames(filenames []string, allowRepoPath bool) []string {
+	if filesFrom != "" {
+		if len(filenames) > 0 {
+			fatal(errors.New("--files-from can't be combined with files on the command line"))
+		}
+		return resolvePaths(readListedPaths(), allowRepoPath)
+	} else if len(filenames) == 1 && filenames[0] == "-" {
+		return resolvePaths(readListedPaths(), allowRepoPath)
+	}
+	expanded, err := expandArgs(filenames)
+	if err != nil {
+		fatal(err)
+	}
+	return resolvePaths(expanded, allowRepoPath)
+}
+
+// readListedPaths returns the paths listed in the --files-from file, or on
+// stdin, one per line or, with --null, separated by NUL characters. Blank
+// lines are skipped. The paths aren't patterns, since they usually come from
+// another tool. The list is only read once, so later calls return the same
+// paths.
+func readListedPaths() []string {
+	if listedPaths != nil {
+		return listedPaths
+	}
+	input := os.Stdin
+	if filesFrom != "" && filesFrom != "-" {
+		file, err := os.Open(filesFrom)
+		if err != nil {
+			fatal(err)
+		}
+		defer file.Close()
+		input = file
+	}
+	listedPaths = []string{}
+	scanner := bufio.NewScanner(input)
+	if nullInput {
+		scanner.Split(scanNull)
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !nullInput {
+			line = strings.TrimSuffix(line, "\r")
+		}
+		if strings.TrimSpace(line) != "" {
+			listedPaths = append(listedPaths, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fatal(fmt.Errorf("reading the list of files: %s", err))
+	}
+	return listedPaths
+}
+
+// scanNull is a bufio.SplitFunc for NUL-separated input, like the output of
+// find -print0.
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	} else if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// minimumFiles is cobra.MinimumNArgs, except that the files may be given with
+// --files-from instead.
+func minimumFiles(n int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if filesFrom != "" {
+			return nil
+		}
+		return cobra.MinimumNArgs(n)(cmd, args)
+	}
+}
+
+// noFileArgs returns true if a command was given no files to work on, neither
+// as arguments nor with --files-from.
+func noFileArgs(args []string) bool {
+	return len(args) == 0 && filesFrom == ""
+}
+
+// resolvePaths is resolveInputFilenames for paths which are never patterns,
+// like the new name of a file.
+func resolvePaths(filenames []string, allowRepoPath bool) []string {
+	targetPath := app.TargetPath("")
+	allowedPrefixes := make([]string, 0, len(app.Config.Repos())+1)
+	repoPrefixes := map[string]string{}
+	if allowRepoPath {
+		for _, repo := range app.Config.Repos() {
+			allowedPrefixes = append(allowedPrefixes, app.RepoPath(repo, ""))
+			repoPrefixes[app.RepoPath(repo, "")] = repo
+			// If the repo is a symlink, also allow paths through the link.
+			unresolved := repo
+			if !filepath.IsAbs(filepath.FromSlash(repo)) {
+				unresolved = path.Join(app.Config.Path(), repo)
+			}
+			if unresolved != app.RepoPath(repo, "") {
+				allowedPrefixes = append(allowedPrefixes, unresolved)
+				repoPrefixes[unresolved] = repo
+			}
+		}
+	}
+	allowedPrefixes = append(allowedPrefixes, targetPath)
+	// The target may also be reached through a symlinked directory.
+	if resolved := app.ResolvePath(targetPath); resolved != targetPath {
+		allowedPrefixes = append(allowedPrefixes, resolved)
+	}
+	// Nested repos may share a parent directory with each other or with the
+	// target, so the most specific prefix needs to be tested first.
+	sort.SliceStable(allowedPrefixes, func(i, j int) bool {
+		return len(allowedPrefixes[i]) > len(allowedPrefixes[j])
+	})
+
+	results := make([]string, 0, len(filenames))
+	invalid := false
+	for _, input := range filenames {
+		absolute, err := filepath.Abs(input)
+		if err != nil {
+			// If Abs fails, none of the paths will be valid. Just abort.
+			fatal(err)
+		}
+		absolute = filepath.ToSlash(absolute)
+		found := false
+		for _, candidate := range []string{absolute, app.CanonicalPath(absolute)} {
+			for _, prefix := range allowedPrefixes {
+				if relative, ok := dfm.RelativePath(prefix, candidate); ok {
+					relative = dfm.NormalizePath(relative)
+					if repo, ok := repoPrefixes[prefix]; ok {
+						// Files in a repo may be synced somewhere else.
+						relative = app.TargetRelative(repo, relative)
+					}
+					results = append(results, relative)
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			printError(dfm.NewFileErrorf(input, "not in target path (%s)", targetPath))
+			invalid = true
+		}
+	}
+	if invalid {
+		os.Exit(exitFatal)
+	}
+	return results
+}
+
+// validateConfig warns about configuration problems before running a command,
+// or aborts if the configuration is strict.
+func validateConfig(cmd *cobra.Command, args []string) {
+	app.Command = strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	reportConfigProblem(app.Config.CheckKeys())
+	if err := app.Config.CheckMap(); err != nil {
+		// Files could be synced to the wrong place.
+		fatal(err)
+	}
+	// dfm init creates any missing repos itself, and dfm git doesn't use the
+	// repos at all.
+	if cmd.Name() == "init" || cmd.Name() == "git" {
+		return
+	}
+	reportConfigProblem(app.Config.Validate())
+}
+
+func reportConfigProblem(err error) {
+	if err == nil {
+		return
+	} else if strict || app.Config.Strict() {
+		fatal(err)
+	}
+	app.Events.HandleEvent(dfm.Event{Operation: dfm.OperationWarning, Err: err, Level: dfm.LevelWarning})
+}
+
+func runInit(cmd *cobra.Command, args []string) {
+	handleCommandError(app.Init())
+	if outputFormat == "text" {
+		fmt.Printf("Initialized %s as a dfm directory.\n", app.Config.Path())
+	}
+	if adoptLinks {
+		tracked, err := app.TrackExistingLinks()
+		handleCommandError(err)
+		if outputFormat == "text" {
+			if verbose {
+				for _, relative := range tracked {
+					fmt.Printf("tracking %s\n", relative)
+				}
+			}
+			fmt.Printf("Tracked %d existing links.\n", len(tracked))
+		}
+	}
+	if initLink {
+		handleCommandError(app.LinkAllContext(ctx, errorHandler))
+	}
+}
+
+// cloneDfmDir clones the repository given to dfm init --clone into the dfm
+// directory. In dry run mode, there is no directory to initialize yet, so
+// instead print the commands that would be run and exit.
+func cloneDfmDir() {
+	absDir, err := filepath.Abs(dfmDir)
+	if err != nil {
+		fatal(err)
+	}
+	if !dryRun {
+		if err := dfm.CloneRepository(initClone, absDir); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	initArgs := ""
+	if initRepos != nil {
+		initArgs += " --repos " + strings.Join(initRepos, ",")
+	}
+	if initTarget != "" {
+		initArgs += " --target " + initTarget
+	}
+	fmt.Printf("git clone %s %s\n", initClone, absDir)
+	fmt.Printf("dfm --dfm-dir %s init%s\n", absDir, initArgs)
+	if initLink {
+		fmt.Printf("dfm --dfm-dir %s link\n", absDir)
+	}
+	os.Exit(0)
+}
+
+func runLink(cmd *cobra.Command, args []string) {
+	if syncCheck {
+		runCheck(false, args)
+	}
+	var err error
+	if noFileArgs(args) {
+		err = app.LinkAllContext(ctx, errorHandler)
+	} else {
+		err = app.LinkFilesContext(ctx, resolveInputFilenames(args, true), errorHandler)
+	}
+	printSummary()
+	printSkipped()
+	handleCommandError(err)
+}
+
+func runCopy(cmd *cobra.Command, args []string) {
+	if syncCheck {
+		runCheck(true, args)
+	}
+	var err error
+	if noFileArgs(args) {
+		err = app.CopyAllContext(ctx, errorHandler)
+	} else {
+		err = app.CopyFilesContext(ctx, resolveInputFilenames(args, true), errorHandler)
+	}
+	printSummary()
+	printSkipped()
+	handleCommandError(err)
+}
+
+func runUpdate(cmd *cobra.Command, args []string) {
+	// A failed pull still leaves the repos in a usable state, so link them
+	// anyway and report both problems.
+	pullErr := app.Pull()
+	if pullErr != nil {
+		printError(pullErr)
+	}
+	err := app.LinkAllContext(ctx, errorHandler)
+	printSummary()
+	printSkipped()
+	handleCommandError(err)
+	if pullErr != nil {
+		os.Exit(exitFatal)
+	}
+}
+
+// makePlan plans dfm link, or dfm copy, for the given files or for everything.
+func makePlan(copy bool, args []string) *dfm.Plan {
+	var plan *dfm.Plan
+	var err error
+	if noFileArgs(args) && copy {
+		plan, err = app.PlanCopy()
+	} else if noFileArgs(args) {
+		plan, err = app.PlanLink()
+	} else if copy {
+		plan, err = app.PlanCopyFiles(resolveInputFilenames(args, true))
+	} else {
+		plan, err = app.PlanLinkFiles(resolveInputFilenames(args, true))
+	}
+	if err != nil {
+		fatal(err)
+	}
+	return plan
+}
+
+func runPlan(cmd *cobra.Command, args []string) {
+	plan := makePlan(planCopy, args)
+	for _, action := range plan.Actions {
+		if action.Type != dfm.ActionNone || verbose {
+			printAction(action)
+		}
+	}
+}
+
+// runCheck lists what dfm link or dfm copy would change, without changing
+// anything, and exits with exitPending if there is anything.
+func runCheck(copy bool, args []string) {
+	changes := makePlan(copy, args).Changes()
+	for _, action := range changes {
+		printAction(action)
+	}
+	if len(changes) > 0 {
+		os.Exit(exitPending)
+	} else if outputFormat == "text" {
+		fmt.Println("All files are up to date.")
+	}
+	os.Exit(0)
+}
+
+func runGit(cmd *cobra.Command, args []string) {
+	dfmArgs, gitArgs := splitGitArgs(cmd.InheritedFlags(), args)
+	if err := cmd.InheritedFlags().Parse(dfmArgs); err != nil {
+		fatal(err)
+	}
+	// Flag parsing is disabled for this command, so the configuration has to
+	// be loaded again now that the flags are known.
+	initConfig()
+	err := app.RunGit(gitArgs, os.Stdin, os.Stdout, os.Stderr)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	handleCommandError(err)
+}
+
+// splitGitArgs separates the arguments of dfm git into dfm's own flags and the
+// arguments for git. Leading arguments are dfm flags as long as dfm knows them,
+// and everything after the first other argument, or after "--", is for git.
+// This allows both "dfm -d ~/dotfiles git status" and "dfm git log --oneline".
+func splitGitArgs(flags *pflag.FlagSet, args []string) (dfmArgs, gitArgs []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		} else if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return args[:i], args[i:]
+		}
+		var flag *pflag.Flag
+		name := strings.TrimLeft(arg, "-")
+		hasValue := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if strings.HasPrefix(arg, "--") {
+			flag = flags.Lookup(name)
+		} else if len(name) == 1 {
+			flag = flags.ShorthandLookup(name)
+		}
+		if flag == nil {
+			return args[:i], args[i:]
+		}
+		if !hasValue && flag.NoOptDefVal == "" {
+			i++
+		}
+	}
+	return args, nil
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	var paths []string
+	if !noFileArgs(args) {
+		paths = resolveInputFilenames(args, true)
+	}
+	mismatches, err := app.Verify(paths, verifySums)
+	if err != nil {
+		fatal(err)
+	}
+	for _, mismatch := range mismatches {
+		printMismatch(mismatch)
+		conflicted = true
+	}
+	if len(mismatches) == 0 && outputFormat == "text" {
+		fmt.Println("All tracked files match the repos.")
+	}
+	handleCommandError(nil)
+}
+
+func runWhich(cmd *cobra.Command, args []string) {
+	for _, relative := range resolveInputFilenames(args, true) {
+		providers, err := app.Which(relative)
+		if err != nil {
+			fatal(err)
+		}
+		if len(providers) == 0 {
+			problem := dfm.NewFileError(relative, "not in any repo")
+			printError(problem)
+			recordFailure(problem)
+			continue
+		}
+		if !whichAll {
+			providers = providers[:1]
+		}
+		for _, provider := range providers {
+			switch {
+			case outputFormat == "json":
+				printJSON(provider)
+			case pathOnly:
+				fmt.Println(provider.SourcePath)
+			default:
+				fmt.Printf("%s\t%s\n", provider.Repo, provider.SourcePath)
+			}
+		}
+	}
+	handleCommandError(nil)
+}
+
+func runStats(cmd *cobra.Command, args []string) {
+	stats, err := app.Stats()
+	if err != nil {
+		fatal(err)
+	}
+	if outputFormat == "json" {
+		printJSON(stats)
+		return
+	}
+	fmt.Printf("%-16s %s\n", "repo", "files")
+	for _, repo := range stats.Repos {
+		fmt.Printf("%-16s %d\n", repo.Name, repo.Files)
+	}
+	fmt.Println()
+	fmt.Printf("%-16s %d\n", "tracked", stats.Tracked)
+	fmt.Printf("%-16s %d\n", "links", stats.Links)
+	fmt.Printf("%-16s %d (%s)\n", "copies", stats.Copies, formatBytes(stats.CopiedBytes))
+	fmt.Printf("%-16s %d\n", "out of sync", stats.OutOfSync)
+}
+
+func runHistory(cmd *cobra.Command, args []string) {
+	var relative string
+	if len(args) > 0 {
+		relative = resolvePaths(args, false)[0]
+	}
+	entries, err := app.History(relative, historyLimit)
+	if err != nil {
+		fatal(err)
+	}
+	for _, entry := range entries {
+		printJournalEntry(entry)
+	}
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	problems, err := app.Diagnose()
+	if err != nil {
+		fatal(err)
+	}
+	for _, problem := range problems {
+		printError(problem)
+		recordFailure(problem)
+	}
+	if len(problems) == 0 && outputFormat == "text" {
+		fmt.Println("No problems found.")
+	}
+	handleCommandError(nil)
+}
+
+func runTrashList(cmd *cobra.Command, args []string) {
+	files, err := app.TrashedFiles()
+	if err != nil {
+		fatal(err)
+	}
+	for _, file := range files {
+		switch outputFormat {
+		case "json":
+			printJSON(file)
+		default:
+			fmt.Printf("%s\t%s\n", file.Time, file.Relative)
+		}
+	}
+	if len(files) == 0 && outputFormat == "text" {
+		fmt.Println("The trash is empty.")
+	}
+}
+
+func runTrashEmpty(cmd *cobra.Command, args []string) {
+	files, err := app.TrashedFiles()
+	if err != nil {
+		fatal(err)
+	}
+	handleCommandError(app.EmptyTrash())
+	if outputFormat != "text" {
+		return
+	} else if dryRun {
+		fmt.Printf("would delete %d\n", len(files))
+	} else {
+		fmt.Printf("%d deleted\n", len(files))
+	}
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	var paths []string
+	if !noFileArgs(args) {
+		paths = resolveInputFilenames(args, true)
+	}
+	statuses, err := app.Status(paths)
+	if err != nil {
+		fatal(err)
+	}
+	for _, status := range statuses {
+		upToDate := status.Err == nil && (status.State == dfm.StatusLinked || status.State == dfm.StatusCopiedIdentical)
+		if !upToDate || verbose || outputFormat != "text" {
+			printStatus(status)
+		}
+	}
+}
+
+// Copy the given files into the repository and replace them with symlinks
+func runAdd(cmd *cobra.Command, args []string) {
+	// If there is only one repo, allow add without specifying which one.
+	if addToRepo == "" {
+		if len(app.Config.Repos()) == 0 {
+			fatal(fmt.Errorf("no repos are configured. Have you run dfm init?"))
+			return
+		} else if len(app.Config.Repos()) > 1 {
+			fatal(fmt.Errorf("repo must be specified when multiple are configured"))
+			return
+		} else {
+			addToRepo = app.Config.Repos()[0]
+		}
+	}
+	app.Commit = addCommit
+	app.Variant = addVariant
+	app.AllowSensitive = addSensitive
+	app.MoveFromCurrent = addMove
+	app.StoreAs = addAs
+	app.FollowSymlinks = addFollow
+	app.ConfirmAdd = confirmAdd
+	filenames := resolveInputFilenames(args, false)
+	if addAs != "" && len(filenames) != 1 {
+		fatal(errors.New("--as can only be used with a single file"))
+	}
+	err := app.AddFilesContext(ctx, filenames, addToRepo, !addWithCopy, errorHandler)
+	printSummary()
+	handleCommandError(err)
+}
+
+func runRemove(cmd *cobra.Command, args []string) {
+	var err error
+	if removePurge {
+		if noFileArgs(args) {
+			fatal(errors.New("--purge requires the files to purge"))
+		}
+		err = app.PurgeFilesContext(ctx, resolveInputFilenames(args, true), purgeAll, errorHandler)
+	} else if noFileArgs(args) {
+		err = app.RemoveAllContext(ctx)
+	} else {
+		err = app.RemoveFilesContext(ctx, resolveInputFilenames(args, true))
+	}
+	printSummary()
+	handleCommandError(err)
+}
+
+func runMove(cmd *cobra.Command, args []string) {
+	var err error
+	if moveRepo != "" {
+		err = app.MoveToRepoContext(ctx, resolveInputFilenames(args, false), moveRepo, errorHandler)
+	} else {
+		from := resolveInputFilenames(args[:1], false)
+		if len(from) != 1 {
+			fatal(fmt.Errorf("%s matches %d files, but only one file can be renamed at a time", args[0], len(from)))
+		}
+		err = app.MoveContext(ctx, from[0], resolvePaths(args[1:], false)[0], errorHandler)
+	}
+	printSummary()
+	handleCommandError(err)
+}
+
+func runAdopt(cmd *cobra.Command, args []string) {
+	err := app.AdoptFilesContext(ctx, resolveInputFilenames(args, false), adoptRepo, errorHandler)
+	printSummary()
+	handleCommandError(err)
+}
+
+func runMigrateTarget(cmd *cobra.Command, args []string) {
+	absPath, err := filepath.Abs(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	err = app.MigrateTargetContext(ctx, filepath.ToSlash(absPath), errorHandler)
+	printSummary()
+	handleCommandError(err)
+}
+
+func runRepair(cmd *cobra.Command, args []string) {
+	problems, err := app.RepairContext(ctx, errorHandler)
+	printSummary()
+	for _, problem := range problems {
+		printError(problem)
+		recordFailure(problem)
+	}
+	handleCommandError(err)
+}
+
+func runUndo(cmd *cobra.Command, args []string) {
+	problems, err := app.UndoContext(ctx, errorHandler)
+	if err != nil && problems == nil && app.Summary() == (dfm.Summary{DryRun: dryRun}) {
+		// There was nothing to undo.
+		fatal(err)
+	}
+	printSummary()
+	for _, problem := range problems {
+		printError(problem)
+		recordFailure(problem)
+	}
+	handleCommandError(err)
+}
+
+func runEject(cmd *cobra.Command, args []string) {
+	if noFileArgs(args) {
+		args = []string{"."}
+	} else {
+		args = resolveInputFilenames(args, false)
+	}
+	err := app.EjectFilesContext(ctx, args, errorHandler)
+	printSummary()
+	handleCommandError(err)
+}
+
+func initConfig() {
+	var err error
+	if porcelain {
+		outputFormat = "porcelain"
+	}
+	if outputFormat != "text" {
+		useColor = false
+	} else if useColor, err = shouldUseColor(colorMode); err != nil {
+		fatal(err)
+	}
+	if dfmDir == "" {
+		var exists bool
+		if dfmDir, exists = os.LookupEnv("DFM_DIR"); !exists {
+			if dfmDir, err = os.Getwd(); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if initClone != "" {
+		cloneDfmDir()
+	}
+	app, err = dfm.NewDfm(dfmDir)
+	var syntaxErr *dfm.ConfigSyntaxError
+	if errors.As(err, &syntaxErr) {
+		fatal(fmt.Errorf("%s\nTo fix it, open %s in an editor.", err, syntaxErr.Path))
+	} else if err != nil {
+		fatal(err)
+		return
+	}
+	app.DryRun = dryRun
+	app.OnlyRepos = syncRepos
+	app.Exclude = syncExclude
+	app.Jobs = jobs
+	if retries < 0 || retries > dfm.MaxRetries {
+		fatal(fmt.Errorf("invalid value for --retries: %d (must be between 0 and %d)", retries, dfm.MaxRetries))
+	}
+	app.HardLink = hardLink
+	app.FallbackCopy = fallbackCopy
+	app.Force = force
+	app.Trash = useTrash
+	app.Backup = backup
+	app.ForceDirs = forceDirs
+	app.PruneBroken = pruneBroken
+	app.NoAutoAdd = noAutoAdd
+	app.DeleteEjected = ejectDelete
+	app.Timing = showTiming
+	app.ConfirmRemovals = confirmRemovals
+	switch outputFormat {
+	case "text":
+		app.Events = textOutput{verbose: verbose, quiet: quiet}
+	case "json":
+		app.Events = jsonOutput{}
+	case "porcelain":
+		app.Events = porcelainOutput{}
+	default:
+		fatal(fmt.Errorf("invalid value for --output: %#v (must be text, json, or porcelain)", outputFormat))
+	}
+	if logPath != "" {
+		absPath, err := filepath.Abs(logPath)
+		if err != nil {
+			fatal(err)
+		}
+		logOutput = newLogFile(absPath)
+	} else if configured := app.Config.LogFile(); configured != "" {
+		logOutput = newLogFile(filepath.FromSlash(configured))
+	}
+	app.Events = logOutput.wrap(app.Events)
+	// The progress bar would be interleaved with the output of the other
+	// formats, and verbose output already shows every file.
+	if outputFormat == "text" && !verbose && isTerminal(os.Stderr) {
+		progress = newProgressBar(os.Stderr)
+		app.Progress = progress.update
+		app.CopyProgress = progress.updateFile
+	}
+	if initRepos != nil {
+		app.Config.SetRepos(initRepos)
+	}
+	if initTarget != "" {
+		absPath, err := filepath.Abs(initTarget)
+		if err != nil {
+			fatal(err)
+			return
+		}
+		app.Config.SetTargetPath(filepath.ToSlash(absPath))
+	}
+	if verbose && outputFormat == "text" {
+		for _, skipped := range app.Config.SkippedRepos() {
+			fmt.Fprintln(os.Stderr, colorize(colorDim, fmt.Sprintf("skipping repo %s: %s", skipped.Name, skipped.Reason)))
+		}
+	}
+}
+
+// cancelOnSignal returns a context which is canceled when dfm receives SIGINT
+// or SIGTERM, so that the current operation can stop cleanly and save the
+// manifest. A second signal terminates dfm immediately.
+func cancelOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx
+}
+
+func main() {
+	ctx = cancelOnSignal()
+	cobra.OnInitialize(initConfig)
+
+	var rootCmd = &cobra.Command{
+		Use:              "dfm",
+		Version:          Version,
+		PersistentPreRun: validateConfig,
+		Long: wordwrap.WrapString(`dfm is a tool to manage repositories of configuration files. A simple workflow for dfm might look like this:
+
+  mkdir -p ~/dotfiles/files; cd ~/dotfiles
+  dfm init --repos files
+  dfm add ~/.bashrc
+
+Now ~/dotfiles can be tracked in source control, and to install on another machine you would use:
+
+  cd ~/dotfiles
+  dfm init --repos files
+  dfm link
+
+Note that .dfm.toml is a per-machine configuration and should not be tracked in source control.
+
+Exit status:
+  0    success
+  1    usage or configuration error, or the command could not run at all
+  2    some files were skipped because something was in the way
+  3    some file operations failed
+  4    both 2 and 3
+  5    with --check, some files are not in sync
+  130  interrupted
+
+`, 80),
+	}
+	rootCmd.PersistentFlags().StringVarP(&dfmDir, "dfm-dir", "d", "", "directory where dfm repositories live")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "output every file, even unchanged ones")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "text", "output format: text, json, or porcelain")
+	rootCmd.PersistentFlags().BoolVar(&porcelain, "porcelain", false, "use the stable porcelain output format, same as --output porcelain")
+	rootCmd.PersistentFlags().StringVar(&colorMode, "color", "auto", "colorize output: auto, always, or never")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "only output warnings, errors, and a summary of the changes")
+	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "n", false, "show what would happen, but don't actually modify files")
+	rootCmd.PersistentFlags().BoolVarP(&force, "force", "f", false, "overwrite existing files, and let the autoclean remove files changed outside of dfm")
+	rootCmd.PersistentFlags().BoolVar(&forceDirs, "force-dirs", false, "with --force, also replace directories which are in the way, with everything in them")
+	rootCmd.PersistentFlags().BoolVar(&backup, "backup", false, "with --force, move files out of the way instead of deleting them")
+	rootCmd.PersistentFlags().BoolVar(&massDelete, "allow-mass-delete", false, "let the autoclean remove more files than autoclean_limit without asking")
+	rootCmd.PersistentFlags().BoolVar(&useTrash, "trash", false, "move removed files to the trash in the dfm directory instead of deleting them")
+	rootCmd.PersistentFlags().BoolVar(&strict, "strict", false, "treat configuration problems as errors")
+	rootCmd.PersistentFlags().BoolVar(&showTiming, "timing", false, "measure where the time goes, and print it after the summary")
+	rootCmd.PersistentFlags().StringVar(&logPath, "log-file", "", "append everything dfm does to this file, with timestamps")
+	rootCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", runtime.NumCPU(), "number of files to sync at the same time")
+	rootCmd.PersistentFlags().IntVar(&retries, "retries", 0, "number of times to retry a file operation which failed, like on a flaky network file system")
+	rootCmd.PersistentFlags().DurationVar(&retryDelay, "retry-delay", 500*time.Millisecond, "with --retries, how long to wait before each retry")
+	rootCmd.PersistentFlags().StringVar(&filesFrom, "files-from", "", "read the files to work on from this file, one per line, instead of the command line")
+	rootCmd.PersistentFlags().BoolVarP(&nullInput, "null", "0", false, "the files read from stdin with -, or from --files-from, are separated by NUL characters instead of newlines")
+
+	rootCmd.SetUsageTemplate(rootCmd.UsageTemplate() + "\n" + CopyrightString + "\n")
+
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Initialize the dfm directory",
+		Long: wordwrap.WrapString(`Initialize a directory to be used with dfm by creating the .dfm.toml file there.
+
+Specifying --repos and --target will allow you to configure which repos are used and where the files should be stored. Any repos which do not exist yet will be created. It is safe to run dfm init on an already-initialized dfm directory, to change the repos that are being used.
+
+To set up a new machine in one step, use --clone to clone an existing git repository into the dfm directory (which must be empty or not exist) before initializing it, and --link to link all files afterwards.
+
+If the .dfm.toml file was lost, but the links it made are still in the target directory, use --adopt-links to track them again, so that the autoclean can remove them when they are removed from the repo. The whole target directory is scanned; use --exclude to skip large directories.`, 80),
+		Example: `  dfm init --repos files
+  dfm init --clone https://github.com/me/dotfiles.git --repos files --link`,
+		Args: cobra.NoArgs,
+		Run:  runInit,
+	}
+	initCmd.Flags().StringSliceVar(&initRepos, "repos", nil, "repositories to track")
+	initCmd.Flags().StringVar(&initTarget, "target", "", "directory to place files in")
+	initCmd.Flags().StringVar(&initClone, "clone", "", "git repository to clone into the dfm directory")
+	initCmd.Flags().BoolVar(&initLink, "link", false, "link all files after initializing")
+	initCmd.Flags().BoolVar(&adoptLinks, "adopt-links", false, "track the links into the repos which are already in the target directory")
+	initCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "with --adopt-links, skip directories matching this path or glob (can be repeated)")
+	rootCmd.AddCommand(initCmd)
+
+	linkCmd := &cobra.Command{
+		Use:   "link [files]",
+		Short: "Create symlinks to tracked files",
+		Args:  cobra.ArbitraryArgs,
+		Run:   runLink,
+	}
+	linkCmd.Flags().StringSliceVarP(&syncRepos, "repo", "r", nil, "only link files provided by this repo (can be repeated)")
+	linkCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "skip files matching this path or glob (can be repeated)")
+	linkCmd.Flags().BoolVar(&hardLink, "hard", false, "create hard links instead of symlinks")
+	linkCmd.Flags().BoolVar(&fallbackCopy, "fallback-copy", false, "copy files which can't be symlinked on this filesystem")
+	linkCmd.Flags().BoolVar(&pruneBroken, "prune-broken", false, "also remove broken links into the dfm directory from the target directory")
+	linkCmd.Flags().BoolVar(&noAutoAdd, "no-auto-add", false, "don't add new files in the track_dirs directories")
+	linkCmd.Flags().BoolVar(&syncCheck, "check", false, "only list what would change, and exit with status 5 if anything would")
+	rootCmd.AddCommand(linkCmd)
+
+	copyCmd := &cobra.Command{
+		Use:   "copy [files]",
+		Short: "Create copies of tracked files",
+		Args:  cobra.ArbitraryArgs,
+		Run:   runCopy,
+	}
+	copyCmd.Flags().StringSliceVarP(&syncRepos, "repo", "r", nil, "only copy files provided by this repo (can be repeated)")
+	copyCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "skip files matching this path or glob (can be repeated)")
+	copyCmd.Flags().BoolVar(&pruneBroken, "prune-broken", false, "also remove broken links into the dfm directory from the target directory")
+	copyCmd.Flags().BoolVar(&noAutoAdd, "no-auto-add", false, "don't add new files in the track_dirs directories")
+	copyCmd.Flags().BoolVar(&syncCheck, "check", false, "only list what would change, and exit with status 5 if anything would")
+	rootCmd.AddCommand(copyCmd)
+
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "Pull the dfm directory and link all files",
+		Long: wordwrap.WrapString(`Run git pull --ff-only in the dfm directory, then run dfm link. If the dfm directory is not a git repository, this is the same as dfm link.
+
+With --dry-run, dfm runs git fetch instead and shows the commits which would be pulled, along with what dfm link would do with the files as they are now.`, 80),
+		Args: cobra.NoArgs,
+		Run:  runUpdate,
+	}
+	updateCmd.Flags().StringSliceVarP(&syncRepos, "repo", "r", nil, "only link files provided by this repo (can be repeated)")
+	updateCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "skip files matching this path or glob (can be repeated)")
+	updateCmd.Flags().BoolVar(&pruneBroken, "prune-broken", false, "also remove broken links into the dfm directory from the target directory")
+	updateCmd.Flags().BoolVar(&noAutoAdd, "no-auto-add", false, "don't add new files in the track_dirs directories")
+	rootCmd.AddCommand(updateCmd)
+
+	planCmd := &cobra.Command{
+		Use:   "plan [files]",
+		Short: "Show what dfm link would do",
+		Long: wordwrap.WrapString(`List the actions that dfm link (or dfm copy, with --copy) would take, without modifying any files. Each action is one of create-link, copy, replace-file, remove, mkdir, or rmdir, along with the reason for it. Files which are already up to date are only listed with --verbose.
+
+Use --output json to get the plan in a machine-readable format.`, 80),
+		Args: cobra.ArbitraryArgs,
+		Run:  runPlan,
+	}
+	planCmd.Flags().BoolVar(&planCopy, "copy", false, "plan dfm copy instead of dfm link")
+	planCmd.Flags().StringSliceVarP(&syncRepos, "repo", "r", nil, "only plan files provided by this repo (can be repeated)")
+	planCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "skip files matching this path or glob (can be repeated)")
+	planCmd.Flags().BoolVar(&hardLink, "hard", false, "plan hard links instead of symlinks")
+	planCmd.Flags().BoolVar(&pruneBroken, "prune-broken", false, "also plan to remove broken links into the dfm directory from the target directory")
+	rootCmd.AddCommand(planCmd)
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "git [args]",
+		Short: "Run git in the dfm directory",
+		Long: wordwrap.WrapString(`Run git with the given arguments in the dfm directory, which must be a git repository. For example, dfm git status is the same as running git status in the dfm directory.
+
+Any dfm flags must come before the git arguments. Use -- to pass an argument to git which dfm would otherwise interpret, for example dfm git -- -v.`, 80),
+		DisableFlagParsing: true,
+		Run:                runGit,
+	})
+
+	watchCmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Sync files as they change in the repos",
+		Long: wordwrap.WrapString(`Watch all repos for changes and run dfm link (or dfm copy, with --copy) for the changed files. Files which are deleted from the repos are removed from the target directory. Changes are synced once the repos have been quiet for a moment, so saving several files at once only syncs once.
+
+Press Ctrl-C to stop watching. A sync which is in progress will finish first.`, 80),
+		Args: cobra.NoArgs,
+		Run:  runWatch,
+	}
+	watchCmd.Flags().BoolVar(&watchCopy, "copy", false, "copy files instead of linking them")
+	watchCmd.Flags().StringSliceVarP(&syncRepos, "repo", "r", nil, "only sync files provided by this repo (can be repeated)")
+	watchCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "skip files matching this path or glob (can be repeated)")
+	rootCmd.AddCommand(watchCmd)
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "status [files]",
+		Short: "Show the state of tracked files",
+		Long:  wordwrap.WrapString(`Show the state of each file provided by a repo or tracked by dfm. The state is one of linked, copied-identical, copied-modified (a copy which has been changed in the target directory), missing (not synced yet), conflict (a different file is in the way), or orphaned (no repo provides the file anymore, so it will be removed by the next sync). Files which are up to date are only listed with --verbose.`, 80),
+		Args:  cobra.ArbitraryArgs,
+		Run:   runStatus,
+	})
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "doctor",
+		Short: "Check the repos for problems",
+		Long:  wordwrap.WrapString(`Check the repos for problems which dfm link and dfm copy can't fix on their own, like files whose names differ only in case, which can't both exist on a case-insensitive filesystem such as the default one on macOS. Each problem is listed, and the exit status is 2 if any were found.`, 80),
+		Args:  cobra.NoArgs,
+		Run:   runDoctor,
+	})
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify [files]",
+		Short: "Check that tracked files match the repos",
+		Long:  wordwrap.WrapString(`Check that every tracked file still matches the repo file which provides it: links have to point to the repo file, and copies have to have the same contents. Copies with the same size and modification time as the repo file are assumed to match, unless --checksum is given. Each file which doesn't match is listed, and the exit status is 2 if there were any. Nothing is modified.`, 80),
+		Args:  cobra.ArbitraryArgs,
+		Run:   runVerify,
+	}
+	verifyCmd.Flags().BoolVar(&verifySums, "checksum", false, "compare the contents of every copy, even if its size and modification time match")
+	rootCmd.AddCommand(verifyCmd)
+
+	historyCmd := &cobra.Command{
+		Use:   "history [file]",
+		Short: "Show the changes dfm has made",
+		Long:  wordwrap.WrapString(`Show the changes dfm has made to the target directory, the repos and the manifest, oldest first. Every command which changes files records them in the .dfm-journal file in the dfm directory; dry runs are not recorded. When a file or directory is given, only the changes to it are shown.`, 80),
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runHistory,
+	}
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 0, "only show the last `count` changes")
+	rootCmd.AddCommand(historyCmd)
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Summarize the repos and tracked files",
+		Long:  wordwrap.WrapString(`Show the number of files each repo provides, how many files are tracked, how many of those are links and how many are copies, along with the total size of the copies, and how many files are out of sync, as dfm status would list them. Nothing is modified.`, 80),
+		Args:  cobra.NoArgs,
+		Run:   runStats,
+	})
+
+	whichCmd := &cobra.Command{
+		Use:   "which <files>",
+		Short: "Show which repo provides a file",
+		Long:  wordwrap.WrapString(`Show the repo which provides each file, and the path of the file in that repo. Files can be given as paths in the target directory or in a repo, the same as for dfm link. With --all, every repo containing the file is listed, in order of precedence, so the repos after the first are the ones being shadowed. The exit status is 2 if any file isn't in a repo.`, 80),
+		Args:  minimumFiles(1),
+		Run:   runWhich,
+	}
+	whichCmd.Flags().BoolVarP(&whichAll, "all", "a", false, "list every repo containing the file, not only the one it is synced from")
+	whichCmd.Flags().BoolVar(&pathOnly, "path-only", false, "only print the path of the file in the repo")
+	rootCmd.AddCommand(whichCmd)
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "migrate-target <new-target>",
+		Short: "Move all tracked files to a new target directory",
+		Long:  wordwrap.WrapString(`Change the target directory in the config, and move every tracked file there. Files which dfm synced are removed from the old target directory, if it still exists, and synced to the new one: copies are copied again, and everything else is linked. Files which were changed outside of dfm are left in the old target directory. The new target directory must already exist.`, 80),
+		Args:  cobra.ExactArgs(1),
+		Run:   runMigrateTarget,
+	})
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "repair",
+		Short: "Fix tracked files which no longer match the repos",
+		Long:  wordwrap.WrapString(`Fix every tracked file which no longer matches the repo file which provides it, with the smallest change possible: links into the wrong repo or into the old location of the dfm directory are pointed at the right file, and missing links and copies are created again. Files which need a decision, like copies which were modified in the target or regular files in the way of a link, are left alone and listed at the end, and the exit status is 2 if there were any.`, 80),
+		Args:  cobra.NoArgs,
+		Run:   runRepair,
+	})
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "undo",
+		Short: "Restore the files removed or overwritten by the last run",
+		Long:  wordwrap.WrapString(`Undo the last run of dfm, using the journal in the dfm directory. Files which it removed are put back from the trash, or linked or copied again from the repo, and files which --force backed up are moved back from their backup. Files which can't be restored, like ones which were overwritten without a backup, are listed at the end, and the exit status is 2 if there were any. An undo can't itself be undone.`, 80),
+		Args:  cobra.NoArgs,
+		Run:   runUndo,
+	})
+
+	trashCmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage removed files",
+		Long:  wordwrap.WrapString(`With the trash config option or the --trash flag, files which dfm removes from the target directory are moved to the .trash directory in the dfm directory instead of being deleted. Links are still deleted, since their contents are in the repo. Each run gets its own directory in the trash, named after the time it ran.`, 80),
+	}
+	trashCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the files in the trash",
+		Args:  cobra.NoArgs,
+		Run:   runTrashList,
+	})
+	trashCmd.AddCommand(&cobra.Command{
+		Use:   "empty",
+		Short: "Permanently delete the files in the trash",
+		Args:  cobra.NoArgs,
+		Run:   runTrashEmpty,
+	})
+	rootCmd.AddCommand(trashCmd)
+
+	addCmd := &cobra.Command{
+		Use:     "add [files]",
+		Aliases: []string{"import"},
+		Short:   "Begin tracking files",
+		Long: wordwrap.WrapString(`Copy the given files into the repository and replace the originals with links to the tracked files.
+
+This command is a convenient way to replace the following 2 commands:
+  mv ~/myfile $DFM_DIR/files/myfile
+  dfm link ~/myfile`, 80),
+		Args: minimumFiles(1),
+		Run:  runAdd,
+	}
+	addCmd.Flags().StringVarP(&addToRepo, "repo", "r", "", "repository to add the file to")
+	addCmd.Flags().BoolVar(&addWithCopy, "copy", false, "copy the file instead of moving and creating a link")
+	addCmd.Flags().BoolVar(&addCommit, "commit", false, "commit the added files to git")
+	addCmd.Flags().StringVar(&addVariant, "variant", "", "store the files as variants for this hostname or OS")
+	addCmd.Flags().BoolVar(&addSensitive, "allow-sensitive", false, "add files even if they may contain secrets")
+	addCmd.Flags().BoolVar(&addMove, "move-from-current", false, "move files which are already linked from another repo into this one, like dfm mv --repo")
+	addCmd.Flags().StringArrayVar(&syncExclude, "exclude", nil, "skip files matching this path or glob (can be repeated)")
+	addCmd.Flags().BoolVarP(&addYes, "yes", "y", false, "add large directories without asking")
+	addCmd.Flags().BoolVar(&addFollow, "follow-symlinks", false, "add the files which symlinks point to, and replace the symlinks with dfm's")
+	addCmd.Flags().StringVar(&addAs, "as", "", "store the file at this path in the repo, and sync it back to where it is now")
+	rootCmd.AddCommand(addCmd)
+
+	adoptCmd := &cobra.Command{
+		Use:   "adopt [files]",
+		Short: "Copy changes to tracked files back into the repo",
+		Long: wordwrap.WrapString(`Copy the given files from the target directory over the files in the repo which provide them, leaving the target files alone. This is useful when a copied file was edited in place, or when another machine has a better version of a file than the repo.
+
+The files have to be in a repo already; use dfm add to start tracking new files. When a file is provided by several repos, the one which is linked is updated, unless --repo picks another one.`, 80),
+		Args: minimumFiles(1),
+		Run:  runAdopt,
+	}
+	adoptCmd.Flags().StringVarP(&adoptRepo, "repo", "r", "", "repository to copy the files into")
+	rootCmd.AddCommand(adoptCmd)
+
+	removeCmd := &cobra.Command{
+		Use:     "remove [files]",
+		Aliases: []string{"rm"},
+		Short:   "Remove tracked files",
+		Long: wordwrap.WrapString(`Remove files from the target directory. The files will remain in the dfm repo, so they will be recreated the next time dfm copy or dfm link is run.
+
+To remove a config file from a dfm repo entirely, use --purge: the files are removed from the target directory and deleted from the repo which provides them, or from every repo which has them with --all-repos. Empty directories left in the repo are removed too. A copied file which was changed since it was synced is skipped, so the changes aren't lost; use --force to purge it anyway.
+
+Without --purge, this command is only useful if you want dfm to stop tracking a file, but dfm eject is a more convenient way of doing this.`, 80),
+		Args: cobra.ArbitraryArgs,
+		Run:  runRemove,
+	}
+	removeCmd.Flags().BoolVar(&removePurge, "purge", false, "also delete the files from the repo")
+	removeCmd.Flags().BoolVar(&purgeAll, "all-repos", false, "with --purge, delete the files from every repo which has them, not only the one they are synced from")
+	rootCmd.AddCommand(removeCmd)
+
+	moveCmd := &cobra.Command{
+		Use:     "mv [old] [new]",
+		Aliases: []string{"move"},
+		Short:   "Rename a tracked file",
+		Long: wordwrap.WrapString(`Move a tracked file to a new path in the target directory. The file is renamed inside the repo which provides it, the old link or copy is removed, and the file is synced to the new path the same way it was synced before. Directories which are left empty, in the repo and in the target directory, are removed.
+
+dfm refuses to move the file if any repo or the target directory already has a file at the new path, or if the file is a copy which was changed since it was synced. Use --force to move it anyway.
+
+With --repo, the given files keep their paths, but are moved from the repo they are synced from into another repo. Links in the target directory are replaced by links to the new place before the old files are removed, so they never break. Files which the other repo already has are reported instead, and so are files which would still be synced from a third repo that takes precedence.`, 80),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if moveRepo != "" {
+				return minimumFiles(1)(cmd, args)
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
+		Run: runMove,
+	}
+	moveCmd.Flags().StringVarP(&moveRepo, "repo", "r", "", "move the files into this repo, keeping their paths")
+	rootCmd.AddCommand(moveCmd)
+
+	ejectCmd := &cobra.Command{
+		Use:   "eject [files]",
+		Short: "Stop tracking files",
+		Long: wordwrap.WrapString(`Copy the given files into the target directory without tracking them. This means that dfm link will refuse to overwrite the files (without --force), and removing the files will not cause the autoclean to remove them from the target directory.
+
+This command is meant to be used when you want to keep a config file, but stop tracking it with dfm. Once you have ejected a file, it is safe to remove from the dfm repo. Note: if your dfm repo is shared between multiple machines, any other machines will NOT correctly eject the file: on other machines, it will appear as though the file has been deleted normally.
+
+With --repo and no files, every file which is synced from that repo is ejected, so that the repo can be removed afterwards without the autoclean touching the files. Files which the repo has, but which are synced from another repo, are reported instead.
+
+To delete the files from the repo as well, use --delete-from-repo. Each file is only deleted once the copy in the target directory matches it.
+
+This command is the inverse of dfm add, and is a convenient way to replace the following 2 commands:
+  dfm remove ~/myfile
+  cp $DFM_DIR/files/myfile ~/myfile`, 80),
+		Args: cobra.ArbitraryArgs,
+		Run:  runEject,
+	}
+	ejectCmd.Flags().StringSliceVarP(&syncRepos, "repo", "r", nil, "only eject files synced from this repo, like every file of a repo which is being retired (can be repeated)")
+	ejectCmd.Flags().BoolVar(&ejectDelete, "delete-from-repo", false, "also delete the ejected files from the repo; other machines sharing the repo will see them as deleted, and remove them")
+	rootCmd.AddCommand(ejectCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(exitFatal)
+	}
+}
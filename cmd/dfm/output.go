@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cgamesplay/dfm"
+)
+
+// jsonEvent is a single line of output in JSON mode.
+type jsonEvent struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Repo      string `json:"repo,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// printJSON writes the value to stdout as a single line of JSON.
+func printJSON(value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(bytes))
+}
+
+// errorMessage returns the message of the error without the filename, if the
+// error is a dfm.FileError.
+func errorMessage(err error) string {
+	if fileErr, ok := err.(*dfm.FileError); ok {
+		return fileErr.Message
+	}
+	return err.Error()
+}
+
+// jsonOutput is the EventHandler which prints each operation as a JSON object.
+type jsonOutput struct{}
+
+func (jsonOutput) HandleEvent(event dfm.Event) {
+	line := jsonEvent{
+		Operation: event.Operation,
+		Path:      event.Relative,
+		Repo:      event.Repo,
+		Source:    event.Source,
+		Target:    event.Target,
+	}
+	if event.Err != nil {
+		if event.Level == dfm.LevelDebug || (event.Operation == dfm.OperationRemove && errors.Is(event.Err, os.ErrNotExist)) {
+			line.Reason = errorMessage(event.Err)
+		} else {
+			line.Error = errorMessage(event.Err)
+		}
+	}
+	printJSON(line)
+}
+
+// porcelainOutput is the EventHandler which prints each operation in the stable
+// porcelain format, as described in the README. Each line is a single-character
+// code, a tab, and the relative path. Skipped files and errors also include a
+// tab and the reason.
+type porcelainOutput struct{}
+
+func (porcelainOutput) HandleEvent(event dfm.Event) {
+	var code string
+	reason := event.Err
+	switch event.Operation {
+	case dfm.OperationAdd:
+		code = "A"
+	case dfm.OperationAdopt:
+		code = "U"
+	case dfm.OperationLink:
+		code = "L"
+	case dfm.OperationCopy:
+		code = "C"
+	case dfm.OperationChmod:
+		code = "P"
+		if reason != nil {
+			code = "E"
+		}
+	case dfm.OperationRemove:
+		code = "R"
+		if event.Level == dfm.LevelError {
+			code = "E"
+		} else {
+			reason = nil
+		}
+	case dfm.OperationSkip:
+		code = "E"
+		if event.Level == dfm.LevelDebug {
+			code = "="
+			reason = nil
+		} else if fileErr, ok := reason.(*dfm.FileError); ok && fileErr.Cause() == nil {
+			// Errors without a cause are files that dfm refused to touch,
+			// rather than operations which failed.
+			code = "S"
+		}
+	case dfm.OperationPrune:
+		code = "F"
+	case dfm.OperationRestore:
+		code = "T"
+	case dfm.OperationEject:
+		code = "J"
+		reason = nil
+	case dfm.OperationPurge:
+		code = "X"
+		if reason != nil {
+			code = "E"
+		}
+	case dfm.OperationMove:
+		// The new path in the repo takes the place of the reason.
+		code = "M"
+		reason = errors.New(event.Target)
+	case dfm.OperationOverwrite:
+		code = "O"
+	case dfm.OperationBackup:
+		// The backup path takes the place of the reason.
+		code = "B"
+		reason = errors.New(event.Target)
+	case dfm.OperationWarning:
+		fmt.Fprintf(os.Stderr, "warning: %s\n", reason)
+		return
+	default:
+		return
+	}
+	line := code + "\t" + porcelainQuote(event.Relative)
+	if reason != nil {
+		line += "\t" + porcelainQuote(errorMessage(reason))
+	}
+	fmt.Println(line)
+}
+
+// porcelainQuote returns the string unchanged if it is unambiguous in porcelain
+// output, otherwise it returns the string in double quotes with C-style
+// escapes.
+func porcelainQuote(str string) string {
+	needsQuote := strings.IndexFunc(str, func(r rune) bool {
+		return r == '"' || r == '\\' || unicode.IsControl(r)
+	}) != -1
+	if needsQuote {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// printAction prints a single action from a plan in the current output format.
+func printAction(action dfm.Action) {
+	var errMessage string
+	if action.Err != nil {
+		errMessage = errorMessage(action.Err)
+	}
+	switch outputFormat {
+	case "json":
+		printJSON(struct {
+			dfm.Action
+			Error string `json:"error,omitempty"`
+		}{action, errMessage})
+	case "porcelain":
+		line := action.Type + "\t" + porcelainQuote(action.Relative) + "\t" + porcelainQuote(action.Reason)
+		if errMessage != "" {
+			line += "\t" + porcelainQuote(errMessage)
+		}
+		fmt.Println(line)
+	default:
+		var line string
+		if action.Repo != "" && action.Type != dfm.ActionMkdir {
+			line = fmt.Sprintf("%s %s -> %s (%s)", action.Type, path.Join(action.Repo, action.Relative), action.Destination, action.Reason)
+		} else {
+			line = fmt.Sprintf("%s %s (%s)", action.Type, action.Destination, action.Reason)
+		}
+		if errMessage != "" {
+			line = colorize(colorRed, fmt.Sprintf("%s: %s", line, errMessage))
+		}
+		fmt.Println(line)
+	}
+}
+
+// statusCodes are the porcelain codes for each file status.
+var statusCodes = map[string]string{
+	dfm.StatusLinked:          "L",
+	dfm.StatusCopiedIdentical: "C",
+	dfm.StatusCopiedModified:  "M",
+	dfm.StatusMissing:         "-",
+	dfm.StatusConflict:        "X",
+	dfm.StatusOrphaned:        "O",
+}
+
+// printStatus prints the status of a single file in the current output format.
+func printStatus(status dfm.FileStatus) {
+	var errMessage string
+	if status.Err != nil {
+		errMessage = errorMessage(status.Err)
+	}
+	switch outputFormat {
+	case "json":
+		printJSON(struct {
+			dfm.FileStatus
+			Error string `json:"error,omitempty"`
+		}{status, errMessage})
+	case "porcelain":
+		line := statusCodes[status.State] + "\t" + porcelainQuote(status.Relative)
+		if status.PermissionProblem != "" {
+			line += "\t" + porcelainQuote(status.PermissionProblem)
+		}
+		if errMessage != "" {
+			line = "E\t" + porcelainQuote(status.Relative) + "\t" + porcelainQuote(errMessage)
+		}
+		fmt.Println(line)
+	default:
+		switch {
+		case errMessage != "":
+			fmt.Println(colorize(colorRed, fmt.Sprintf("%-16s %s: %s", "error", status.Relative, errMessage)))
+		case status.PermissionProblem != "":
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("%-16s %s: %s", status.State, status.Relative, status.PermissionProblem)))
+		case status.State == dfm.StatusLinked || status.State == dfm.StatusCopiedIdentical:
+			fmt.Println(colorize(colorDim, fmt.Sprintf("%-16s %s", status.State, status.Relative)))
+		case status.State == dfm.StatusConflict:
+			fmt.Println(colorize(colorRed, fmt.Sprintf("%-16s %s", status.State, status.Relative)))
+		default:
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("%-16s %s", status.State, status.Relative)))
+		}
+	}
+}
+
+// mismatchCodes are the porcelain codes for each problem found by dfm verify.
+var mismatchCodes = map[string]string{
+	dfm.MismatchMissing:   "-",
+	dfm.MismatchWrongLink: "W",
+	dfm.MismatchModified:  "M",
+	dfm.MismatchNotAFile:  "X",
+	dfm.MismatchOrphaned:  "O",
+}
+
+// printMismatch prints a single file found by dfm verify in the current output
+// format.
+func printMismatch(mismatch dfm.Mismatch) {
+	var errMessage string
+	if mismatch.Err != nil {
+		errMessage = errorMessage(mismatch.Err)
+	}
+	switch outputFormat {
+	case "json":
+		printJSON(struct {
+			dfm.Mismatch
+			Error string `json:"error,omitempty"`
+		}{mismatch, errMessage})
+	case "porcelain":
+		line := mismatchCodes[mismatch.Problem] + "\t" + porcelainQuote(mismatch.Relative)
+		if mismatch.Link != "" {
+			line += "\t" + porcelainQuote(mismatch.Link)
+		}
+		if errMessage != "" {
+			line = "E\t" + porcelainQuote(mismatch.Relative) + "\t" + porcelainQuote(errMessage)
+		}
+		fmt.Println(line)
+	default:
+		switch {
+		case errMessage != "":
+			fmt.Println(colorize(colorRed, fmt.Sprintf("%-16s %s: %s", "error", mismatch.Relative, errMessage)))
+		case mismatch.Link != "":
+			fmt.Println(colorize(colorRed, fmt.Sprintf("%-16s %s -> %s", mismatch.Problem, mismatch.Relative, mismatch.Link)))
+		default:
+			fmt.Println(colorize(colorRed, fmt.Sprintf("%-16s %s", mismatch.Problem, mismatch.Relative)))
+		}
+	}
+}
+
+// printJournalEntry prints a single change recorded in the journal in the
+// current output format.
+func printJournalEntry(entry dfm.JournalEntry) {
+	switch outputFormat {
+	case "json":
+		printJSON(entry)
+	case "porcelain":
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.Command, entry.Operation, porcelainQuote(entry.Relative), porcelainQuote(entry.Result))
+	default:
+		line := fmt.Sprintf("%s  %-8s %-12s %s", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Command, entry.Operation, entry.Relative)
+		if entry.Result != "ok" {
+			fmt.Println(colorize(colorRed, line+": "+entry.Result))
+		} else {
+			fmt.Println(line)
+		}
+	}
+}
+
+// printTimings prints where the time of the command went, for --timing.
+func printTimings(timings *dfm.Timings) {
+	fmt.Println("Time spent:")
+	fmt.Printf("  %-12s %s\n", "file list", formatDuration(timings.FileList))
+	fmt.Printf("  %-12s %s\n", "plan", formatDuration(timings.Plan))
+	fmt.Printf("  %-12s %s\n", "sync", formatDuration(timings.Sync))
+	fmt.Printf("  %-12s %s\n", "autoclean", formatDuration(timings.Autoclean))
+	fmt.Printf("  %-12s %s\n", "save", formatDuration(timings.SaveConfig))
+	if len(timings.Slowest) > 0 {
+		fmt.Println("Slowest files:")
+		for _, file := range timings.Slowest {
+			fmt.Printf("  %-12s %s\n", formatDuration(file.Duration), app.TargetPath(file.Relative))
+		}
+	}
+}
+
+// formatDuration rounds the duration so that it is easy to read.
+func formatDuration(duration time.Duration) string {
+	if duration >= time.Second {
+		return duration.Round(10 * time.Millisecond).String()
+	}
+	return duration.Round(10 * time.Microsecond).String()
+}
+
+// printError reports an error to the user, on stderr in text mode or as a JSON
+// object on stdout in JSON mode.
+func printError(err error) {
+	progress.clear()
+	logOutput.println("error: " + err.Error())
+	switch outputFormat {
+	case "json":
+		printJSON(struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	case "porcelain":
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	fmt.Fprintln(os.Stderr, colorize(colorRed, err.Error()))
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPorcelainQuote(t *testing.T) {
+	require.Equal(t, ".bashrc", porcelainQuote(".bashrc"))
+	require.Equal(t, "my file", porcelainQuote("my file"))
+	require.Equal(t, "café", porcelainQuote("café"))
+	require.Equal(t, `"tab\tfile"`, porcelainQuote("tab\tfile"))
+	require.Equal(t, `"new\nline"`, porcelainQuote("new\nline"))
+	require.Equal(t, `"\"quoted\""`, porcelainQuote(`"quoted"`))
+	require.Equal(t, `"back\\slash"`, porcelainQuote(`back\slash`))
+}
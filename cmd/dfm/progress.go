@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressDelay is how long an operation runs before the progress bar is
+	// shown, so that quick operations don't flash a bar.
+	progressDelay = 500 * time.Millisecond
+	progressWidth = 30
+)
+
+// progressBar renders a single-line progress bar. It is safe to call from
+// multiple goroutines.
+type progressBar struct {
+	out     io.Writer
+	start   time.Time
+	lock    sync.Mutex
+	visible bool
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out, start: time.Now()}
+}
+
+// update redraws the bar. The bar is removed once all files are complete.
+func (bar *progressBar) update(completed, total int) {
+	bar.lock.Lock()
+	defer bar.lock.Unlock()
+	if completed >= total {
+		bar.clearLocked()
+		return
+	} else if !bar.visible && time.Since(bar.start) < progressDelay {
+		return
+	}
+	filled := progressWidth * completed / total
+	fmt.Fprintf(bar.out, "\r[%s%s] %d/%d",
+		strings.Repeat("#", filled), strings.Repeat(" ", progressWidth-filled),
+		completed, total)
+	bar.visible = true
+}
+
+// updateFile redraws the bar to show the progress of copying a single large
+// file. The bar is removed once the file is complete.
+func (bar *progressBar) updateFile(filename string, copied, total int64) {
+	bar.lock.Lock()
+	defer bar.lock.Unlock()
+	if copied >= total {
+		bar.clearLocked()
+		return
+	} else if !bar.visible && time.Since(bar.start) < progressDelay {
+		return
+	}
+	filled := int(progressWidth * copied / total)
+	fmt.Fprintf(bar.out, "\r\x1b[K[%s%s] %s %s/%s",
+		strings.Repeat("#", filled), strings.Repeat(" ", progressWidth-filled),
+		path.Base(filename), formatBytes(copied), formatBytes(total))
+	bar.visible = true
+}
+
+// formatBytes formats a size for humans, like "1.5 GB".
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / unit
+	for _, suffix := range []string{"KB", "MB", "GB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f TB", value)
+}
+
+// clear removes the bar so that other output can be written. It will be
+// redrawn on the next update.
+func (bar *progressBar) clear() {
+	if bar == nil {
+		return
+	}
+	bar.lock.Lock()
+	defer bar.lock.Unlock()
+	bar.clearLocked()
+}
+
+func (bar *progressBar) clearLocked() {
+	if bar.visible {
+		fmt.Fprint(bar.out, "\r\x1b[K")
+		bar.visible = false
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	bar := newProgressBar(&out)
+	bar.update(1, 4)
+	require.Equal(t, "", out.String(), "bar should not be shown immediately")
+
+	bar.start = time.Now().Add(-progressDelay)
+	bar.update(2, 4)
+	require.Equal(t, "\r[###############               ] 2/4", out.String())
+
+	out.Reset()
+	bar.clear()
+	require.Equal(t, "\r\x1b[K", out.String())
+
+	out.Reset()
+	bar.update(3, 4)
+	bar.update(4, 4)
+	require.Equal(t, "\r[######################        ] 3/4\r\x1b[K", out.String())
+}
+
+func TestProgressBarFile(t *testing.T) {
+	var out bytes.Buffer
+	bar := newProgressBar(&out)
+	bar.start = time.Now().Add(-progressDelay)
+	bar.updateFile("/home/test/disk.img", 512*1024*1024, 2*1024*1024*1024)
+	require.Equal(t, "\r\x1b[K[#######                       ] disk.img 512.0 MB/2.0 GB", out.String())
+
+	out.Reset()
+	bar.updateFile("/home/test/disk.img", 2*1024*1024*1024, 2*1024*1024*1024)
+	require.Equal(t, "\r\x1b[K", out.String())
+}
@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests that adding a file which the repo already has is a no-op.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR"
+echo 'bashrc' > ~/.bashrc
+echo 'vimrc' > ~/.vimrc
+
+dfm init --repos files
+dfm add --copy ~/.bashrc ~/.vimrc
+
+banner 'Adding again'
+dfm add --copy ~/.bashrc
+echo "exit status $?"
+
+banner 'The repo has a different version'
+echo 'changed' > ~/.vimrc
+dfm add --copy ~/.vimrc || echo "exit status $?"
+dfm add --copy --force ~/.vimrc
+cat ~/dfmdir/files/.vimrc
@@ -0,0 +1,31 @@
+#!/bin/bash
+# Tests storing a file at a different path in the repo with dfm add --as.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR" "$HOME/Library/Code/User"
+echo 'settings' > "$HOME/Library/Code/User/settings.json"
+echo 'bashrc' > ~/.bashrc
+
+dfm init --repos files
+dfm add --as vscode/settings.json ~/Library/Code/User/settings.json
+find ~/dfmdir/files -type f | sort
+readlink ~/Library/Code/User/settings.json
+cat ~/dfmdir/.dfm.toml
+
+banner 'Linking it again'
+rm ~/Library/Code/User/settings.json
+dfm link -v ~/Library
+readlink ~/Library/Code/User/settings.json
+test ! -e ~/vscode || fail "the repo path was linked"
+
+banner 'Only one file'
+dfm add --as shell/bashrc ~/.bashrc ~/Library/Code/User/settings.json || echo "exit status $?"
+
+banner 'Autoclean'
+rm ~/dfmdir/files/vscode/settings.json
+dfm link
+test ! -e ~/Library/Code/User/settings.json || fail "the link was not removed"
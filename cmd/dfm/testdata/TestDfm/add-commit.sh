@@ -0,0 +1,32 @@
+#!/bin/bash
+# Tests committing added files with dfm add --commit.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+export GIT_AUTHOR_NAME=test GIT_AUTHOR_EMAIL=test@example.com
+export GIT_COMMITTER_NAME=test GIT_COMMITTER_EMAIL=test@example.com
+
+mkdir -p "$DFM_DIR"
+dfm init --repos files
+echo 'bash config' > ~/.bashrc
+echo 'vim config' > ~/.vimrc
+echo 'zsh config' > ~/.zshrc
+
+banner 'Not a git repository'
+dfm add --commit ~/.zshrc
+[ -L ~/.zshrc ] || fail '.zshrc was not added'
+
+git -C "$DFM_DIR" init --quiet
+git -C "$DFM_DIR" add .dfm.toml
+git -C "$DFM_DIR" commit --quiet -m 'Initial commit'
+
+banner 'Dry run'
+dfm add --commit --dry-run ~/.bashrc ~/.vimrc
+git -C "$DFM_DIR" log --format=%s
+
+banner 'Committing added files'
+dfm add --commit ~/.bashrc ~/.vimrc ~/.zshrc
+git -C "$DFM_DIR" log --format=%s
+git -C "$DFM_DIR" status --short
@@ -0,0 +1,35 @@
+#!/bin/bash
+# Tests adding whole directories with ignore patterns, --exclude and the
+# confirmation for large directories.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR" ~/.config/nvim/lua ~/.config/nvim/plugin ~/.config/nvim/spell
+echo 'init' > ~/.config/nvim/init.lua
+echo 'plugins' > ~/.config/nvim/lua/plugins.lua
+echo 'compiled' > ~/.config/nvim/plugin/packer_compiled.lua
+echo 'spell' > ~/.config/nvim/spell/en.utf-8.add.spl
+echo 'notes' > ~/.config/nvim/notes.txt
+
+dfm init --repos files
+echo 'ignore = ["*.spl"]' >> "$DFM_DIR/.dfm.toml"
+printf '# Generated by packer\nplugin/\n' > "$DFM_DIR/files/.dfmignore"
+
+dfm add --exclude .config/nvim/notes.txt ~/.config/nvim
+find ~/dfmdir/files -type f | sort
+
+banner 'The ignore file is not linked'
+dfm link
+test ! -e ~/.dfmignore || fail "the ignore file was linked"
+
+banner 'Large directories need confirmation'
+mkdir -p ~/.cache/thumbnails
+for i in $(seq 1 101); do echo "$i" > ~/.cache/thumbnails/$i.png; done
+true | dfm add ~/.cache && fail 'add did not fail'
+dfm add ~/.cache < /dev/null && fail 'add did not fail'
+test ! -e ~/dfmdir/files/.cache || fail "files were added"
+dfm add --yes --quiet ~/.cache
+ls ~/dfmdir/files/.cache/thumbnails | wc -l
@@ -0,0 +1,34 @@
+#!/bin/bash
+# Tests adding files which are symlinks into another dotfiles system.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR" "$HOME/old-dotfiles"
+echo 'zshrc' > ~/old-dotfiles/zshrc
+ln -s old-dotfiles/zshrc ~/.zshrc
+ln -s old-dotfiles/missing ~/.inputrc
+
+dfm init --repos files
+
+banner 'Symlinks are refused'
+dfm add ~/.zshrc || echo "exit status $?"
+
+banner 'Dangling symlinks'
+dfm add --follow-symlinks ~/.inputrc || echo "exit status $?"
+
+banner 'Following the symlink'
+dfm add --follow-symlinks ~/.zshrc
+readlink ~/.zshrc
+cat ~/dfmdir/files/.zshrc
+test -e ~/old-dotfiles/zshrc || fail "the old file was removed"
+
+banner 'Links to other files in the repo'
+ln -s dfmdir/files/.zshrc ~/.zshenv
+dfm add ~/.zshenv || echo "exit status $?"
+
+banner 'Special files'
+mkfifo ~/.fifo
+dfm add ~/.fifo || echo "exit status $?"
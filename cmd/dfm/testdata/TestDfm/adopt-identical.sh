@@ -0,0 +1,20 @@
+#!/bin/bash
+# Tests that existing files which are identical to the repo are replaced.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'config' > ~/.bashrc
+echo 'my own vimrc' > ~/.vimrc
+
+dfm init --repos files
+dfm plan
+dfm link && fail 'link did not fail'
+[ -L ~/.bashrc ] || fail 'bashrc was not linked'
+[ "$(cat ~/.vimrc)" = 'my own vimrc' ] || fail 'vimrc was replaced'
+true
@@ -0,0 +1,28 @@
+#!/bin/bash
+# Tests rebuilding the manifest from the links in the target directory.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config/app ~/other
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.config/app/settings.conf
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'config' > ~/other/.vimrc
+
+dfm init --repos files
+dfm link
+rm ~/dfmdir/.dfm.toml ~/.vimrc
+ln -s ~/other/.vimrc ~/.vimrc
+
+banner 'Links into the repos are tracked again'
+dfm init --repos files --adopt-links -v
+dfm link && fail 'link did not fail'
+
+banner 'The autoclean works again'
+rm ~/dfmdir/files/.config/app/settings.conf
+dfm link --force
+[ -L ~/.config/app/settings.conf ] && fail 'the autoclean did not remove the link'
+true
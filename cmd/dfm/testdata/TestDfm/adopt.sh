@@ -0,0 +1,33 @@
+#!/bin/bash
+# Tests that changes to copied files can be adopted back into the repo.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files ~/dfmdir/other
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+
+dfm init --repos files,other
+dfm copy
+echo 'edited' > ~/.bashrc
+echo 'mine' > ~/.profile
+
+banner 'Dry run leaves the repo alone'
+dfm adopt --dry-run ~/.bashrc
+[ "$(cat ~/dfmdir/files/.bashrc)" = 'config' ] || fail 'repo file was changed'
+
+banner 'Adopt copies the target into the repo'
+dfm adopt -v ~/.bashrc ~/.vimrc
+[ "$(cat ~/dfmdir/files/.bashrc)" = 'edited' ] || fail 'repo file was not changed'
+dfm status --verbose
+
+banner 'Adopt into another repo'
+dfm adopt --repo other ~/.bashrc
+[ "$(cat ~/dfmdir/other/.bashrc)" = 'edited' ] || fail 'other repo file was not created'
+
+banner 'Files must already be in a repo'
+dfm adopt ~/.profile && fail 'adopt did not fail'
+true
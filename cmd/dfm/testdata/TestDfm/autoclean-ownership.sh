@@ -0,0 +1,31 @@
+#!/bin/bash
+# Tests that the autoclean leaves files which were changed outside of dfm.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.zshrc
+
+dfm init --repos files
+dfm link
+rm ~/.vimrc
+echo 'my own vimrc' > ~/.vimrc
+rm ~/dfmdir/files/.vimrc ~/dfmdir/files/.bashrc
+dfm plan
+dfm link
+[ "$(cat ~/.vimrc)" = 'my own vimrc' ] || fail 'vimrc was removed'
+[ -e ~/.bashrc ] && fail 'bashrc was not removed'
+dfm status
+
+banner "Forcing the removal"
+rm ~/.zshrc
+echo 'my own zshrc' > ~/.zshrc
+rm ~/dfmdir/files/.zshrc
+dfm link --force
+[ -e ~/.zshrc ] && fail 'zshrc was not removed'
+true
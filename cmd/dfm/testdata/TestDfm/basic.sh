@@ -21,6 +21,8 @@ dfm link
 
 banner "Everything is up to date"
 dfm link -v
+dfm link -q
+dfm link -v --color=always
 
 banner "Adding a new config file"
 mkdir -p dfmdir/files/.ssh
@@ -34,6 +36,13 @@ rm -rf dfmdir/files/.ssh
 dfm link
 [ ! -e test_home/.ssh/config ] || fail '.ssh/config was not removed'
 
+banner "Quiet output still shows problems"
+echo 'local file' > test_home/.profile
+echo 'config file' > dfmdir/files/.profile
+dfm link -q || echo "exit status $?"
+rm dfmdir/files/.profile test_home/.profile
+dfm link -q
+
 banner "Importing with add"
 mkdir -p test_home/.config/fish
 echo 'config file' > test_home/.config/fish/config.fish
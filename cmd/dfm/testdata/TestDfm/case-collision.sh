@@ -0,0 +1,29 @@
+#!/bin/bash
+# Tests files whose names differ only in case.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'brew "git"' > ~/dfmdir/files/Brewfile
+echo 'brew "git"' > ~/dfmdir/files/brewfile
+echo 'config' > ~/dfmdir/files/.bashrc
+
+dfm init --repos files
+dfm doctor && fail 'doctor did not report the collision'
+
+banner "Case-insensitive target"
+cat >> ~/dfmdir/.dfm.toml <<'TOML'
+target_case = "insensitive"
+TOML
+dfm link && fail 'linked colliding files'
+[ -e ~/Brewfile ] && fail 'Brewfile was linked'
+dfm status
+
+banner "Collision resolved"
+rm ~/dfmdir/files/brewfile
+dfm doctor
+dfm link
+true
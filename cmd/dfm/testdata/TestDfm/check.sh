@@ -0,0 +1,25 @@
+#!/bin/bash
+# Tests that dfm link --check lists what would change without changing it.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+
+dfm init --repos files
+dfm link --check || echo "exit status $?"
+[ ! -e ~/.bashrc ] || fail 'check created a link'
+[ ! -e ~/dfmdir/.dfm-journal ] || fail 'check wrote to the journal'
+dfm link
+dfm link --check
+echo "exit status $?"
+
+banner 'Removals and copies'
+rm ~/dfmdir/files/.vimrc
+dfm link --check --porcelain || echo "exit status $?"
+dfm copy --check ~/.bashrc || echo "exit status $?"
+[ -L ~/.bashrc ] || fail 'check replaced a link'
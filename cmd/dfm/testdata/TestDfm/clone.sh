@@ -0,0 +1,29 @@
+#!/bin/bash
+# Tests bootstrapping a new machine with dfm init --clone.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p upstream/files ~
+echo 'config file' > upstream/files/.bashrc
+git -C upstream init --quiet
+git -C upstream add .
+git -C upstream -c user.name=test -c user.email=test@example.com commit --quiet -m 'Initial commit'
+
+banner 'Clone dry run'
+dfm init --clone "$(pwd)/upstream" --repos files --link -n
+[ ! -e "$DFM_DIR" ] || fail 'dry-run cloned the repository'
+
+banner 'Cloning a missing repository'
+dfm init --clone "$(pwd)/missing" --repos files && fail 'clone of missing repository allowed'
+[ ! -e "$DFM_DIR" ] || fail 'failed clone left a directory behind'
+
+banner 'Cloning and linking'
+dfm init --clone "$(pwd)/upstream" --repos files --link
+[ -L ~/.bashrc ] || fail '.bashrc is not a symlink'
+
+banner 'Cloning into an existing directory'
+dfm init --clone "$(pwd)/upstream" --repos files && fail 'clone into non-empty directory allowed'
+[ -L ~/.bashrc ] || fail '.bashrc was removed'
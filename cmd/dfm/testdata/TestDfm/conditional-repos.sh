@@ -0,0 +1,28 @@
+#!/bin/bash
+# Tests repos which are only active on some machines.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files ~/dfmdir/shell ~/dfmdir/missing
+echo 'bashrc' > ~/dfmdir/files/.bashrc
+echo 'shell' > ~/dfmdir/shell/.profile
+echo 'missing' > ~/dfmdir/missing/.missingrc
+
+dfm init --repos files
+cat >> ~/dfmdir/.dfm.toml <<'TOML'
+
+[[repo]]
+name = "shell"
+when = { executable = "sh", hostname = "*" }
+
+[[repo]]
+name = "missing"
+when = { executable = "dfm-test-missing-executable" }
+TOML
+dfm link --verbose
+[ -e ~/.missingrc ] && fail '.missingrc was linked'
+dfm add --repo missing ~/.bashrc && fail 'added to a skipped repo'
+true
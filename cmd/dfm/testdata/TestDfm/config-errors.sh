@@ -0,0 +1,31 @@
+#!/bin/bash
+# Tests that mistakes in .dfm.toml are reported with their position.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+cat > ~/dfmdir/.dfm.toml <<'TOML'
+repos = ["files"]
+target = "~
+TOML
+dfm link 2>&1 || echo "exit status $?"
+
+banner 'Wrong type'
+cat > ~/dfmdir/.dfm.toml <<'TOML'
+repos = ["files"]
+manifest = ".bashrc"
+TOML
+dfm link 2>&1 || echo "exit status $?"
+
+banner 'Unknown settings'
+cat > ~/dfmdir/.dfm.toml <<'TOML'
+repos = ["files"]
+targets = "/elsewhere"
+TOML
+dfm link --strict 2>&1 || echo "exit status $?"
+dfm link 2>&1
+# Saving the config dropped the unknown setting.
+cat ~/dfmdir/.dfm.toml | grep targets || true
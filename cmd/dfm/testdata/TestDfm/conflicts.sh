@@ -0,0 +1,29 @@
+#!/bin/bash
+# Tests warnings for files provided by more than one repo.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/common ~/dotfiles/work ~/dotfiles/laptop
+echo 'common' > ~/dotfiles/common/.gitconfig
+echo 'work' > ~/dotfiles/work/.gitconfig
+echo 'laptop' > ~/dotfiles/laptop/.gitconfig
+echo 'config' > ~/dotfiles/common/.bashrc
+
+dfm init --repos common,work,laptop
+dfm link --dry-run
+
+banner 'Conflicts can be allowed'
+echo 'conflicts = "allow"' >> ~/dotfiles/.dfm.toml
+dfm link --dry-run
+
+banner 'Verbose output shows the overridden repos'
+dfm link --dry-run --verbose
+
+banner 'Conflicts can be errors'
+sed -i.bak 's/conflicts = "allow"/conflicts = "error"/' ~/dotfiles/.dfm.toml
+dfm link && fail 'link should fail when files are provided by more than one repo'
+[ -e ~/.gitconfig ] && fail 'conflicting file was linked'
+true
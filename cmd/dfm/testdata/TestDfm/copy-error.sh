@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests that copies and moves which fail report the reason.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config
+echo 'app' > ~/dfmdir/files/.config/app.conf
+echo 'not a directory' > ~/.config
+
+dfm init --repos files
+dfm copy && fail 'copy succeeded'
+dfm copy --porcelain && fail 'copy succeeded'
+
+banner "Adding fails when the repo can't hold the file"
+rm ~/.config
+mkdir -p ~/.local
+echo 'data' > ~/.local/data
+echo 'not a directory' > ~/dfmdir/files/.local
+dfm add ~/.local/data && fail 'add succeeded'
+[ -f ~/.local/data ] || fail 'original file was lost'
+true
@@ -0,0 +1,29 @@
+#!/bin/bash
+# Tests files and directories taking each other's place.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config ~/.config/app
+echo 'config' > ~/dfmdir/files/.config/app
+echo 'settings' > ~/.config/app/settings
+echo 'vimrc' > ~/dfmdir/files/.vimrc
+
+dfm init --repos files
+dfm link --force && fail 'link did not fail'
+[ -f ~/.config/app/settings ] || fail 'the directory was removed'
+dfm link --force --force-dirs
+[ -L ~/.config/app ] || fail 'app was not linked'
+
+banner "A file in the repo becomes a directory"
+rm ~/dfmdir/files/.vimrc
+mkdir ~/dfmdir/files/.vimrc
+echo 'init' > ~/dfmdir/files/.vimrc/init
+dfm doctor && fail 'doctor did not fail'
+dfm link && fail 'link did not fail'
+dfm link
+[ "$(cat ~/dfmdir/files/.vimrc/init)" = 'init' ] || fail 'the repo file was changed'
+[ -L ~/.vimrc/init ] || fail 'init was not linked'
+true
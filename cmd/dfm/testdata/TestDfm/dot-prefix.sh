@@ -0,0 +1,35 @@
+#!/bin/bash
+# Tests repos which store leading dots as dot_ with the dot_prefix option.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR/files/dot_config/nvim"
+echo 'bashrc' > "$DFM_DIR/files/dot_bashrc"
+echo 'init' > "$DFM_DIR/files/dot_config/nvim/init.lua"
+echo 'vimrc' > ~/.vimrc
+cat > "$DFM_DIR/.dfm.toml" <<TOML
+repos = ["files"]
+manifest = []
+target = "$HOME"
+dot_prefix = ["files"]
+TOML
+
+dfm link
+readlink ~/.bashrc ~/.config/nvim/init.lua
+
+banner 'Adding a file'
+dfm add ~/.vimrc
+readlink ~/.vimrc
+dfm which ~/dfmdir/files/dot_vimrc
+
+banner 'Autoclean'
+rm ~/dfmdir/files/dot_config/nvim/init.lua
+dfm link
+test ! -e ~/.config/nvim/init.lua || fail "the link was not removed"
+
+banner 'Mixing literal names'
+echo 'other' > ~/dfmdir/files/.bashrc
+dfm link || echo "exit status $?"
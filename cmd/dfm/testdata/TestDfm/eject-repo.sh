@@ -0,0 +1,25 @@
+#!/bin/bash
+# Tests that dfm eject --repo ejects every file synced from a repo.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files ~/dfmdir/legacy/.config ~/dfmdir/work
+echo 'files' > ~/dfmdir/files/.bashrc
+echo 'legacy' > ~/dfmdir/legacy/.bashrc
+echo 'legacy' > ~/dfmdir/legacy/.vimrc
+echo 'legacy' > ~/dfmdir/legacy/.config/app.conf
+echo 'work' > ~/dfmdir/work/.vimrc
+
+dfm init --repos files,legacy,work
+dfm link --quiet
+
+dfm eject --repo legacy 2>&1 || echo "exit status $?"
+
+banner 'Retiring the repo'
+rm -r ~/dfmdir/legacy
+dfm init --repos files,work
+dfm link || echo "exit status $?"
+cat ~/.bashrc ~/.config/app.conf ~/.vimrc
@@ -9,6 +9,7 @@ export DFM_DIR="$HOME/dfmdir"
 mkdir -p ~/dfmdir/files
 echo 'config' > ~/dfmdir/files/.bashrc
 echo 'config' > ~/dfmdir/files/.zshrc
+echo 'config' > ~/dfmdir/files/.vimrc
 
 dfm init --repos files
 dfm link
@@ -20,9 +21,26 @@ dfm link
 [ ! -L ~/.bashrc ] || fail 'bashrc still linked'
 [ -e ~/.bashrc ] || fail 'bashrc missing'
 
+banner 'Ejecting a file which is already a copy'
+dfm copy ~/.vimrc
+dfm eject --verbose ~/.vimrc
+dfm eject --output porcelain ~/.vimrc
+rm ~/dfmdir/files/.vimrc
+
 banner 'Ejecting everything'
 dfm eject
 rm ~/dfmdir/files/.zshrc
 dfm link
 [ ! -L ~/.zshrc ] || fail 'zshrc still linked'
 [ -e ~/.zshrc ] || fail 'zshrc missing'
+
+banner 'Deleting from the repo'
+mkdir -p ~/dfmdir/files/.config/app
+echo 'app' > ~/dfmdir/files/.config/app/app.conf
+echo 'inputrc' > ~/dfmdir/files/.inputrc
+echo 'local' > ~/.inputrc
+dfm link ~/.config/app/app.conf
+dfm eject --delete-from-repo --dry-run ~/.config/app/app.conf
+dfm eject --delete-from-repo ~/.config/app/app.conf ~/.inputrc || echo "exit status $?"
+find ~/dfmdir/files | sort
+cat ~/.config/app/app.conf
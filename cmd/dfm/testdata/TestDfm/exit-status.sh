@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests that the exit status tells conflicts apart from failed operations.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'app' > ~/dfmdir/files/.config/app.conf
+echo 'local' > ~/.bashrc
+echo 'not a directory' > ~/.config
+
+dfm init --repos files
+dfm link ~/.bashrc || echo "exit status $?"
+dfm link ~/.config/app.conf || echo "exit status $?"
+dfm link || echo "exit status $?"
+dfm link /elsewhere || echo "exit status $?"
+
+banner 'Success'
+rm ~/.bashrc ~/.config
+dfm link
+echo "exit status $?"
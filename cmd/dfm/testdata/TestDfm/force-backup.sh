@@ -0,0 +1,38 @@
+#!/bin/bash
+# Tests that --force can back up the files it overwrites.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'my own bashrc' > ~/.bashrc
+
+dfm init --repos files
+dfm link && fail 'link did not fail'
+dfm link --force --backup
+[ "$(cat ~/.bashrc.dfm-backup)" = 'my own bashrc' ] || fail 'bashrc was not backed up'
+[ -L ~/.bashrc ] || fail 'bashrc was not linked'
+
+banner "Existing backups are kept"
+rm ~/.bashrc
+echo 'my newer bashrc' > ~/.bashrc
+dfm link --force --backup && fail 'link did not fail'
+[ "$(cat ~/.bashrc.dfm-backup)" = 'my own bashrc' ] || fail 'backup was overwritten'
+
+banner "Backing up to a directory"
+echo 'backup_dir = "backups"' >> ~/dfmdir/.dfm.toml
+dfm link --force --porcelain
+[ "$(cat ~/dfmdir/backups/.bashrc)" = 'my newer bashrc' ] || fail 'bashrc was not backed up'
+
+banner "Forcing without a backup"
+rm ~/.vimrc
+echo 'my own vimrc' > ~/.vimrc
+sed -i.bak '/backup_dir/d' ~/dfmdir/.dfm.toml
+dfm link --force
+[ -L ~/.vimrc ] || fail 'vimrc was not linked'
+[ -e ~/.vimrc.dfm-backup ] && fail 'vimrc was backed up'
+true
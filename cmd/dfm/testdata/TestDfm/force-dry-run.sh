@@ -0,0 +1,21 @@
+#!/bin/bash
+# Tests that --force doesn't touch anything in a dry run.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'my own bashrc' > ~/.bashrc
+
+dfm init --repos files
+dfm link -n && fail 'link did not fail'
+dfm link --force -n
+[ "$(cat ~/.bashrc)" = 'my own bashrc' ] || fail 'bashrc was overwritten'
+dfm link --force --backup -n --porcelain
+[ -e ~/.bashrc.dfm-backup ] && fail 'bashrc was backed up'
+[ "$(cat ~/.bashrc)" = 'my own bashrc' ] || fail 'bashrc was overwritten'
+true
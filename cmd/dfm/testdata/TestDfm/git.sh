@@ -0,0 +1,33 @@
+#!/bin/bash
+# Tests running git in the dfm directory with dfm git.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR/files"
+echo 'config file' > "$DFM_DIR/files/.bashrc"
+dfm init --repos files
+
+banner 'Not a git repository'
+dfm git status && fail 'git ran outside of a git repository'
+
+git -C "$DFM_DIR" init --quiet
+
+banner 'Passing flags through to git'
+dfm git add --all
+dfm git status --short
+dfm git -c user.name=test -c user.email=test@example.com commit --quiet -m 'Initial commit'
+dfm git log --format=%s
+
+banner 'Using dfm flags'
+cd "$HOME"
+dfmdir="$DFM_DIR"
+unset DFM_DIR
+dfm -d "$dfmdir" git ls-files
+dfm git -d "$dfmdir" -- ls-files -- files
+export DFM_DIR="$dfmdir"
+
+banner 'Exit code'
+dfm git rev-parse --verify --quiet missing-branch || echo "exit status $?"
@@ -0,0 +1,23 @@
+#!/bin/bash
+# Tests that dfm expands glob patterns which the shell didn't.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR" ~/.config/fish/functions/nested
+touch ~/.config/fish/functions/a.fish ~/.config/fish/functions/b.fish
+touch ~/.config/fish/functions/nested/c.fish ~/.config/fish/config.txt
+dfm init --repos files
+
+banner 'Patterns'
+dfm add '~/.config/fish/functions/*.fish'
+dfm add "$HOME/.config/**/*.txt"
+
+banner 'Patterns which match nothing'
+dfm add '~/.config/*.zsh' || echo "exit status $?"
+
+banner 'Files named like patterns'
+touch "$HOME/[weird].conf"
+dfm add "$HOME/[weird].conf"
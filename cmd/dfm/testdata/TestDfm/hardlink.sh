@@ -0,0 +1,35 @@
+#!/bin/bash
+# Tests hard linking files instead of symlinking them.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'app' > ~/dfmdir/files/.config/app.conf
+
+dfm init --repos files
+cat >> ~/dfmdir/.dfm.toml <<'TOML'
+
+[hardlink]
+files = [".config/*"]
+TOML
+dfm link
+[ -L ~/.bashrc ] || fail '.bashrc is not a symlink'
+[ ~/.config/app.conf -ef ~/dfmdir/files/.config/app.conf ] || fail 'app.conf is not hard linked'
+[ -L ~/.config/app.conf ] && fail 'app.conf is a symlink'
+dfm link # no output on second run
+dfm status --verbose
+
+banner "Switching to hard links replaces symlinks"
+dfm link --hard
+[ -L ~/.bashrc ] && fail '.bashrc is still a symlink'
+[ ~/.bashrc -ef ~/dfmdir/files/.bashrc ] || fail '.bashrc is not hard linked'
+
+banner "Autoclean removes hard links"
+rm ~/dfmdir/files/.config/app.conf
+dfm link --hard
+[ -e ~/.config/app.conf ] && fail 'app.conf was not removed'
+true
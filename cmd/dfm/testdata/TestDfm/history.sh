@@ -0,0 +1,23 @@
+#!/bin/bash
+# Tests that changes are recorded in the journal and shown by dfm history.
+set -e -o pipefail
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files/.config
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.config/app.conf
+
+dfm init --repos files
+dfm link
+dfm remove --dry-run ~/.bashrc
+dfm remove ~/.bashrc
+# Timestamps change on every run.
+dfm history | sed 's/^[0-9-]* [0-9:]*/TIME/'
+
+banner 'Filtering by path'
+dfm history ~/.bashrc | sed 's/^[0-9-]* [0-9:]*/TIME/'
+dfm history --limit 1 | sed 's/^[0-9-]* [0-9:]*/TIME/'
+true
@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests the JSON output mode.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'local' > ~/.vimrc
+echo 'local' > ~/.zshrc
+
+dfm init --repos files -o json
+dfm link -o json && fail 'conflict was not reported'
+rm ~/.vimrc
+dfm link -v -o json -n
+dfm add ~/.zshrc --output json
+rm ~/dfmdir/files/.bashrc
+dfm link -o json
+dfm add ~/.missing -o json && fail 'added a file outside the target'
+dfm link -o yaml && fail 'invalid output format allowed'
+true
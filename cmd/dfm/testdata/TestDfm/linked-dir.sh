@@ -0,0 +1,40 @@
+#!/bin/bash
+# Tests linking whole directories instead of each file in them.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config/nvim/lua ~/dfmdir/files/.vim
+echo 'config' > ~/dfmdir/files/.config/nvim/init.vim
+echo 'plugins' > ~/dfmdir/files/.config/nvim/lua/plugins.lua
+echo 'vimrc' > ~/dfmdir/files/.vim/vimrc
+
+dfm init --repos files
+dfm link
+[ -L ~/.vim/vimrc ] || fail '.vim/vimrc is not a symlink'
+
+banner "Directories are linked as a whole"
+touch ~/dfmdir/files/.vim/.dfmdir
+cat >> ~/dfmdir/.dfm.toml <<'TOML'
+symlink_dirs = [".config/nvim"]
+TOML
+# Files which were linked one at a time need to be removed first.
+rm -r ~/.config/nvim ~/.vim
+dfm link
+[ -L ~/.config/nvim ] || fail '.config/nvim is not a symlink'
+[ -L ~/.vim ] || fail '.vim is not a symlink'
+[ -f ~/dfmdir/files/.vim/vimrc ] || fail '.vim/vimrc was removed from the repo'
+grep -q vimrc ~/dfmdir/.dfm.toml && fail ".vim/vimrc is still tracked"
+echo 'new' > ~/dfmdir/files/.config/nvim/new.vim
+cat ~/.config/nvim/new.vim
+dfm link ~/.config/nvim/init.vim
+dfm status
+
+banner "Autoclean removes only the directory link"
+mv ~/dfmdir/files/.config/nvim ~/nvim
+dfm link
+[ -e ~/.config/nvim ] && fail '.config/nvim was not removed'
+[ -f ~/nvim/init.vim ] || fail 'nvim contents were removed'
+true
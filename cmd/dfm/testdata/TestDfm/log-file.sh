@@ -0,0 +1,26 @@
+#!/bin/bash
+# Tests that --log-file and the log_file option append dfm's output to a file.
+set -e -o pipefail
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.vimrc
+
+dfm init --repos files
+dfm link --dry-run --log-file dfm.log
+dfm link --log-file dfm.log
+dfm add --log-file dfm.log ~/missing || true
+# Timestamps change on every run.
+sed 's/^[0-9T:+Z-]* /TIME /' dfm.log
+
+banner 'Configured in .dfm.toml'
+echo 'log_file = "dfm.log"' >> ~/dotfiles/.dfm.toml
+dfm remove ~/.vimrc
+sed 's/^[0-9T:+Z-]* /TIME /' ~/dotfiles/dfm.log
+
+banner 'Unwritable log file'
+dfm link --log-file missing/dfm.log
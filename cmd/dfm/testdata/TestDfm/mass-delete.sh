@@ -0,0 +1,33 @@
+#!/bin/bash
+# Tests that the autoclean asks before removing many files at once.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+for name in a b c d; do
+  echo 'config' > ~/dfmdir/files/.${name}rc
+done
+
+dfm init --repos files
+echo 'autoclean_limit = 2' >> ~/dfmdir/.dfm.toml
+dfm link
+
+banner "Too many files disappear from the repos"
+sed -i.bak 's/"files"/"flies"/' ~/dfmdir/.dfm.toml
+mkdir ~/dfmdir/flies
+dfm link --dry-run
+true | dfm link && fail 'link did not fail'
+[ -L ~/.arc ] || fail 'arc was removed'
+
+
+banner "Declining the prompt"
+dfm link < /dev/null && fail 'link did not fail'
+[ -L ~/.arc ] || fail 'arc was removed'
+
+banner "Allowing the removal"
+dfm link --allow-mass-delete
+[ -e ~/.arc ] && fail 'arc was not removed'
+true
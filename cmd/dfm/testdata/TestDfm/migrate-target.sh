@@ -0,0 +1,31 @@
+#!/bin/bash
+# Tests moving the tracked files to a new target directory.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$(pwd)/dfmdir"
+
+mkdir -p dfmdir/files/.config home
+echo 'config' > dfmdir/files/.bashrc
+echo 'config' > dfmdir/files/.config/app.conf
+
+dfm init --repos files
+dfm link
+mkdir newhome
+
+banner 'The new target has to exist'
+dfm migrate-target "$(pwd)/missing" && fail 'migrate-target did not fail'
+
+banner 'Dry run changes nothing'
+dfm migrate-target --dry-run "$(pwd)/newhome"
+[ -L ~/.bashrc ] || fail 'dry run removed the old link'
+[ -e newhome/.bashrc ] && fail 'dry run created the new link'
+
+banner 'The old target is gone'
+rm -rf home
+dfm migrate-target "$(pwd)/newhome"
+[ -L newhome/.config/app.conf ] || fail 'link was not created in the new target'
+grep -q "target = \"$(pwd)/newhome\"" dfmdir/.dfm.toml || fail 'config was not updated'
+dfm link
+true
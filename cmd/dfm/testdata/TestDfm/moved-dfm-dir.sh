@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests that links are repaired after the dfm directory is moved.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files/.config/app
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.config/app/settings.conf
+
+dfm init --repos files
+dfm link
+
+banner 'Links to the old location are replaced'
+mkdir ~/src
+mv ~/dotfiles ~/src/dotfiles
+export DFM_DIR="$HOME/src/dotfiles"
+dfm plan
+dfm link
+[ "$(readlink ~/.config/app/settings.conf)" = "$DFM_DIR/files/.config/app/settings.conf" ] || fail 'nested link was not repaired'
+dfm link
+true
@@ -0,0 +1,36 @@
+#!/bin/bash
+# Tests that dfm mv --repo moves files between repos without breaking links.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/common/.config ~/dfmdir/work
+echo 'vpn' > ~/dfmdir/common/.config/work-vpn.conf
+echo 'bashrc' > ~/dfmdir/common/.bashrc
+echo 'work bashrc' > ~/dfmdir/work/.bashrc
+
+dfm init --repos common,work
+dfm link
+
+banner 'Dry run'
+dfm mv --repo work --dry-run ~/.config/work-vpn.conf
+find ~/dfmdir/common ~/dfmdir/work | sort
+
+banner 'Move'
+dfm mv --repo work ~/.config/work-vpn.conf
+find ~/dfmdir/common ~/dfmdir/work | sort
+readlink ~/.config/work-vpn.conf
+cat ~/.config/work-vpn.conf
+
+banner 'Conflicts'
+dfm mv --repo common ~/.bashrc || echo "exit status $?"
+dfm mv --repo nope ~/.bashrc || echo "exit status $?"
+
+banner 'Adding a file from another repo'
+echo 'gitconfig' > ~/dfmdir/common/.gitconfig
+dfm link ~/.gitconfig
+dfm add -r work ~/.gitconfig || echo "exit status $?"
+dfm add -r work --move-from-current ~/.gitconfig
+readlink ~/.gitconfig
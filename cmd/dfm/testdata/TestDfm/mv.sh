@@ -0,0 +1,37 @@
+#!/bin/bash
+# Tests that dfm mv renames tracked files in the repo and the target.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config/vim
+echo 'vimrc' > ~/dfmdir/files/.config/vim/vimrc
+echo 'bashrc' > ~/dfmdir/files/.bashrc
+echo 'inputrc' > ~/dfmdir/files/.inputrc
+echo 'profile' > ~/.profile
+
+dfm init --repos files
+dfm link ~/.config/vim/vimrc ~/.bashrc
+dfm copy ~/.inputrc
+
+banner 'Dry run'
+dfm mv --dry-run ~/.config/vim/vimrc ~/.vimrc
+find ~/dfmdir/files | sort
+
+banner 'Move'
+dfm mv ~/.config/vim/vimrc ~/.vimrc
+find ~/dfmdir/files | sort
+ls -A ~
+readlink ~/.vimrc
+
+banner 'Copies stay copies'
+dfm mv ~/.inputrc ~/.config/inputrc
+test -L ~/.config/inputrc || echo "not a link"
+
+banner 'Existing files need --force'
+dfm mv ~/.bashrc ~/.vimrc || echo "exit status $?"
+dfm mv ~/.bashrc ~/.profile || echo "exit status $?"
+dfm mv --force ~/.bashrc ~/.profile
+cat ~/.profile
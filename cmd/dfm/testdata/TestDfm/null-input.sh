@@ -0,0 +1,28 @@
+#!/bin/bash
+# Tests reading NUL-separated file lists with --null and --files-from.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR"
+weird="$HOME/.weird
+name"
+touch "$weird" ~/.bashrc ~/.vimrc
+dfm init --repos files
+
+banner 'NUL-separated stdin'
+printf '%s\0' "$weird" ~/.bashrc | dfm add --porcelain -0 -
+grep -A3 manifest ~/dfmdir/.dfm.toml
+
+banner 'Files from a file'
+echo ~/.vimrc > list.txt
+dfm add --files-from list.txt
+dfm add --files-from list.txt ~/.bashrc || echo "exit status $?"
+
+banner 'Autoclean'
+rm "$DFM_DIR/files/.weird
+name"
+dfm link --porcelain
+[ ! -e "$weird" ] || fail 'the file was not removed'
@@ -0,0 +1,48 @@
+#!/bin/bash
+# Tests the [map] table, which syncs files to a different path than the one
+# they have in the repo.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR/files/vscode" "$DFM_DIR/files/fish"
+echo 'settings' > "$DFM_DIR/files/vscode/settings.json"
+echo 'keybindings' > "$DFM_DIR/files/vscode/keybindings.json"
+echo 'config' > "$DFM_DIR/files/fish/config.fish"
+echo 'bashrc' > "$DFM_DIR/files/.bashrc"
+cat > "$DFM_DIR/.dfm.toml" <<TOML
+repos = ["files"]
+manifest = []
+target = "$HOME"
+
+[map]
+  vscode = "Library/Code/User"
+  "fish/config.fish" = ".config/fish/config.fish"
+TOML
+
+dfm link
+find ~ -type l | sort
+readlink ~/Library/Code/User/settings.json
+
+banner 'Files can be given by their path in the repo'
+dfm status -v ~/dfmdir/files/vscode/settings.json
+dfm which ~/.config/fish/config.fish
+
+banner 'Autoclean'
+rm ~/dfmdir/files/vscode/keybindings.json
+dfm link
+test ! -e ~/Library/Code/User/keybindings.json || fail "the link was not removed"
+
+banner 'A repo file hidden by the map'
+mkdir -p ~/dfmdir/files/.config/fish
+echo 'other' > ~/dfmdir/files/.config/fish/config.fish
+dfm link || echo "exit status $?"
+rm -r ~/dfmdir/files/.config
+
+banner 'Two paths mapped to the same place'
+cat >> "$DFM_DIR/.dfm.toml" <<TOML
+  code = "Library/Code/User"
+TOML
+dfm link || echo "exit status $?"
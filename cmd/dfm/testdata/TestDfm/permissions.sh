@@ -0,0 +1,39 @@
+#!/bin/bash
+# Tests fixing file modes with the [permissions] table.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.ssh
+echo 'Host *' > ~/dfmdir/files/.ssh/config
+chmod 644 ~/dfmdir/files/.ssh/config
+
+dfm init --repos files
+cat >> ~/dfmdir/.dfm.toml <<'TOML'
+
+[permissions]
+".ssh/*" = "0600"
+TOML
+dfm status
+dfm link --dry-run
+dfm link
+[ "$(stat -c %a ~/dfmdir/files/.ssh/config)" = 600 ] || fail 'repo file mode was not changed'
+dfm link # no output on second run
+
+banner "Copies are fixed"
+rm ~/.ssh/config
+chmod 644 ~/dfmdir/files/.ssh/config
+dfm copy --porcelain
+[ "$(stat -c %a ~/.ssh/config)" = 600 ] || fail 'copy mode was not changed'
+chmod 640 ~/.ssh/config
+dfm status --porcelain
+
+banner "Copies follow mode changes in the repo"
+sed -i '/^\[permissions\]/,$d' ~/dfmdir/.dfm.toml
+chmod 755 ~/dfmdir/files/.ssh/config
+dfm copy --dry-run
+dfm copy
+[ "$(stat -c %a ~/.ssh/config)" = 755 ] || fail 'copy mode was not changed'
+dfm copy --verbose
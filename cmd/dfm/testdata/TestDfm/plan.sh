@@ -0,0 +1,31 @@
+#!/bin/bash
+# Tests dfm plan.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/shared/.config/fish ~/dfmdir/work/.config/old
+echo 'config' > ~/dfmdir/shared/.bashrc
+echo 'config' > ~/dfmdir/shared/.my.cnf
+echo 'config' > ~/dfmdir/work/.config/old/settings
+echo 'local' > ~/.vimrc
+
+dfm init --repos shared,work
+dfm link
+
+banner "Changes to the repos"
+echo 'config' > ~/dfmdir/shared/.config/fish/config.fish
+echo 'config' > ~/dfmdir/shared/.vimrc
+mv ~/dfmdir/shared/.my.cnf ~/dfmdir/work/.my.cnf
+rm -r ~/dfmdir/work/.config
+dfm plan
+dfm plan -v --copy ~/.bashrc
+dfm plan -o json
+[ ! -e ~/.config/fish ] || fail 'dfm plan modified files'
+
+banner "Applying the plan"
+dfm link && fail 'conflict was not reported'
+[ -L ~/.my.cnf ] || fail '.my.cnf was not replaced'
+[ ! -e ~/.config/old ] || fail 'empty directory was not removed'
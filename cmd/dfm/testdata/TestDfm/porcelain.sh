@@ -0,0 +1,23 @@
+#!/bin/bash
+# Tests the porcelain output format.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'config' > ~/dfmdir/files/$'tab\tfile'
+echo 'local' > ~/.vimrc
+echo 'local' > ~/.zshrc
+
+dfm init --repos files --porcelain
+dfm link --porcelain && fail 'conflict was not reported'
+rm ~/.vimrc
+dfm link --porcelain -n
+dfm add ~/.zshrc --porcelain
+rm ~/dfmdir/files/.bashrc
+dfm link --output porcelain
+dfm remove ~/.missing --porcelain
@@ -0,0 +1,26 @@
+#!/bin/bash
+# Tests that broken links into the dfm directory can be removed.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files ~/.config
+echo 'config' > ~/dfmdir/files/.bashrc
+ln -s "$DFM_DIR/files/.oldrc" ~/.oldrc
+ln -s ../dfmdir/files/.config/old.conf ~/.config/old.conf
+ln -s /nonexistent/file ~/.elsewhere
+
+dfm init --repos files
+dfm link
+
+banner 'Broken links are only removed with --prune-broken'
+dfm plan --prune-broken
+dfm link --prune-broken --dry-run
+[ -L ~/.oldrc ] || fail 'dry run removed the link'
+dfm link --prune-broken
+[ -L ~/.oldrc ] && fail 'broken link was not removed'
+[ -L ~/.config/old.conf ] && fail 'relative broken link was not removed'
+[ -L ~/.elsewhere ] || fail 'link outside of the dfm directory was removed'
+true
@@ -0,0 +1,23 @@
+#!/bin/bash
+# Tests that tracked files which were removed everywhere are dropped from the
+# manifest.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.muttrc
+
+dfm init --repos files
+dfm link
+rm ~/.muttrc ~/dfmdir/files/.muttrc
+
+banner 'Stale entries are pruned'
+dfm link --dry-run
+dfm link --porcelain
+grep -q muttrc ~/dfmdir/.dfm.toml && fail 'muttrc is still in the manifest'
+dfm link
+true
@@ -0,0 +1,35 @@
+#!/bin/bash
+# Tests that dfm remove --purge deletes files from the repo as well.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config/app ~/dfmdir/work
+echo 'bashrc' > ~/dfmdir/files/.bashrc
+echo 'work bashrc' > ~/dfmdir/work/.bashrc
+echo 'app' > ~/dfmdir/files/.config/app/app.conf
+echo 'inputrc' > ~/dfmdir/files/.inputrc
+
+dfm init --repos files,work
+dfm link
+dfm copy ~/.inputrc
+
+banner 'Dry run'
+dfm remove --purge --dry-run ~/.config/app/app.conf
+find ~/dfmdir/files | sort
+
+banner 'Purge'
+dfm remove --purge ~/.config/app/app.conf ~/.bashrc
+find ~/dfmdir/files ~/dfmdir/work | sort
+ls -A ~
+
+banner 'Modified copies need --force'
+echo 'changed' > ~/.inputrc
+dfm remove --purge ~/.inputrc || echo "exit status $?"
+dfm remove --purge --force ~/.inputrc
+find ~/dfmdir/files | sort
+
+banner 'Files are required'
+dfm remove --purge || echo "exit status $?"
@@ -0,0 +1,37 @@
+#!/bin/bash
+# Tests that dfm repair fixes tracked files without touching local changes.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files ~/dotfiles/work
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.vimrc
+echo 'config' > ~/dotfiles/files/.zshrc
+echo 'config' > ~/dotfiles/files/.inputrc
+echo 'config' > ~/dotfiles/files/.gitconfig
+echo 'work config' > ~/dotfiles/work/.vimrc
+
+dfm init --repos files,work
+dfm link ~/.bashrc ~/.vimrc ~/.zshrc
+dfm copy ~/.inputrc ~/.gitconfig
+
+banner 'Mechanical problems are fixed, local changes are listed'
+rm ~/.bashrc ~/.inputrc
+ln -sf "$DFM_DIR/files/.vimrc" ~/.vimrc
+rm ~/.zshrc && echo 'local' > ~/.zshrc
+echo 'edited' > ~/.gitconfig
+dfm repair --dry-run && fail 'repair should report the local changes'
+[ -e ~/.bashrc ] && fail 'dry run created a file'
+dfm repair && fail 'repair should report the local changes'
+[ "$(readlink ~/.vimrc)" = "$DFM_DIR/work/.vimrc" ] || fail 'link was not retargeted'
+[ "$(cat ~/.zshrc)" = 'local' ] || fail 'local changes were overwritten'
+[ "$(cat ~/.gitconfig)" = 'edited' ] || fail 'local changes were overwritten'
+
+banner 'Nothing left to fix'
+rm ~/.zshrc
+echo 'config' > ~/.gitconfig
+dfm repair --verbose
+true
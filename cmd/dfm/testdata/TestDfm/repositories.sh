@@ -22,3 +22,19 @@ echo 'two' > ~/.yarnrc
 dfm add ~/.yarnrc && fail 'ambiguous dfm add allowed'
 dfm add -r two ~/.yarnrc
 [ "$(readlink ~/.yarnrc)" == ~/dfmdir/two/.yarnrc ] || fail 'yarnrc wrong repo'
+
+banner 'Linking a single repo'
+echo 'one' > ~/dfmdir/one/.inputrc
+echo 'two' > ~/dfmdir/two/.gitconfig
+rm ~/dfmdir/two/.zshrc
+dfm link -r one
+[ -L ~/.zshrc ] || fail 'zshrc from excluded repo was removed'
+[ ! -e ~/.gitconfig ] || fail 'gitconfig from excluded repo was linked'
+dfm link -r bogus && fail 'unknown repo allowed'
+
+banner 'Missing repositories'
+dfm init --repos one,missing,two
+rmdir ~/dfmdir/missing
+dfm link
+dfm link --strict && fail 'strict mode allowed missing repo'
+true
@@ -0,0 +1,22 @@
+#!/bin/bash
+# Tests that --retries attempts failed file operations again before giving up.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'app' > ~/dfmdir/files/.config/app.conf
+echo 'local' > ~/.bashrc
+echo 'not a directory' > ~/.config
+
+dfm init --repos files
+dfm link -v --retries 2 --retry-delay 1ms ~/.config/app.conf 2>&1 || echo "exit status $?"
+
+banner 'Conflicts are not retried'
+dfm link -v --retries 2 --retry-delay 1ms ~/.bashrc 2>&1 || echo "exit status $?"
+
+banner 'Invalid retries'
+dfm link --retries 20 2>&1 || echo "exit status $?"
@@ -0,0 +1,20 @@
+#!/bin/bash
+# Tests the summary shown by dfm stats.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files ~/dotfiles/work
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.vimrc
+echo 'config' > ~/dotfiles/files/.inputrc
+echo 'config' > ~/dotfiles/work/.profile
+
+dfm init --repos files,work
+dfm link ~/.bashrc ~/.profile
+dfm copy ~/.inputrc
+dfm stats
+dfm stats --output=json
+true
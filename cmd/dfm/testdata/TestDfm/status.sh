@@ -0,0 +1,26 @@
+#!/bin/bash
+# Tests dfm status.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+for file in .bashrc .vimrc .zshrc .inputrc .gitconfig; do
+  echo 'config' > ~/dfmdir/files/$file
+done
+echo 'local' > ~/.inputrc
+
+dfm init --repos files
+dfm link --exclude .gitconfig && fail 'conflict was not reported'
+dfm copy ~/.zshrc ~/.vimrc
+echo 'changed' >> ~/.zshrc
+rm ~/dfmdir/files/.bashrc
+
+dfm status
+dfm status -v ~/.vimrc
+dfm status --porcelain
+dfm status -o json ~/.zshrc
+dfm status ~/.missing && fail 'status of an unknown file allowed'
+true
@@ -0,0 +1,23 @@
+#!/bin/bash
+# Tests reading the files to work on from stdin.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR" ~/.config
+touch ~/.bashrc "$HOME/.config/with space"
+dfm init --repos files
+
+banner 'Adding from stdin'
+printf '%s\n\n%s\n' ~/.bashrc "$HOME/.config/with space" | dfm add -
+find ~/dfmdir/files -type f | sort
+
+banner 'Removing and linking from stdin'
+echo ~/.bashrc | dfm remove -
+echo ~/.bashrc | dfm link -
+
+banner 'Empty stdin'
+dfm add - < /dev/null
+dfm eject - < /dev/null
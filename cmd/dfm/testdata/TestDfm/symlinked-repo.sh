@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests a repo which is a symlink to a directory elsewhere on disk.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir elsewhere/files
+ln -s "$(pwd)/elsewhere/files" ~/dfmdir/files
+echo 'config' > elsewhere/files/.bashrc
+echo 'config' > elsewhere/files/.vimrc
+# Simulate a link created through the symlinked repo path.
+ln -s ~/dfmdir/files/.vimrc ~/.vimrc
+
+dfm init --repos files
+dfm link
+[ "$(readlink ~/.bashrc)" == "$(pwd)/elsewhere/files/.bashrc" ] || fail 'bashrc not linked to canonical path'
+
+banner 'Linking again'
+dfm link -v
+
+banner 'Linking through the symlinked path'
+dfm link -v ~/dfmdir/files/.bashrc
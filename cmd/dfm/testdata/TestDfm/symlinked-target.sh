@@ -0,0 +1,27 @@
+#!/bin/bash
+# Tests a target directory which is reached through a symlinked parent.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+mkdir -p private/home
+ln -s "$(pwd)/private" linked
+export HOME="$(pwd)/linked/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir
+echo 'config' > ~/.bashrc
+echo 'config' > ~/.vimrc
+dfm init --repos files
+
+banner 'Adding through the canonical path'
+cd "$(pwd)/private/home"
+dfm add ./.bashrc
+
+banner 'Adding through the symlinked path'
+cd ~
+dfm add ./.vimrc
+
+banner 'Adding outside of the target'
+echo 'config' > ../outside
+dfm add ../outside && fail 'added a file outside of the target'
+true
@@ -0,0 +1,15 @@
+#!/bin/bash
+# Tests that --timing reports where the time of a sync went.
+set -e -o pipefail
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+
+dfm init --repos files
+# Durations change on every run.
+dfm link --timing | sed -E 's/[0-9.]+(µs|ms|ns|s) */TIME /; s/ $//'
+dfm link --timing -o json | tail -n 1 | sed -E 's/"(file_list|plan|sync|autoclean|save_config|duration)":[0-9]+/"\1":TIME/g'
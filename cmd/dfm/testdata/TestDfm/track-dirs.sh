@@ -0,0 +1,42 @@
+#!/bin/bash
+# Tests that new files in the track_dirs directories are added by a sync.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p "$DFM_DIR" ~/.config/fish/functions
+echo 'function ll; ls -l $argv; end' > ~/.config/fish/functions/ll.fish
+
+dfm init --repos files
+echo 'track_dirs = [".config/fish/functions"]' >> "$DFM_DIR/.dfm.toml"
+echo 'ignore = ["*.bak"]' >> "$DFM_DIR/.dfm.toml"
+dfm add ~/.config/fish/functions
+
+banner 'New files are added'
+echo 'function gs; git status; end' > ~/.config/fish/functions/gs.fish
+echo 'old' > ~/.config/fish/functions/gs.fish.bak
+dfm link
+[ -L ~/.config/fish/functions/gs.fish ] || fail "gs.fish was not linked"
+[ -L ~/.config/fish/functions/gs.fish.bak ] && fail "the ignored file was added"
+dfm link
+
+banner 'Opting out'
+echo 'function gd; git diff; end' > ~/.config/fish/functions/gd.fish
+dfm link --no-auto-add
+[ -L ~/.config/fish/functions/gd.fish ] && fail "gd.fish was added"
+
+banner 'Copies'
+dfm copy
+[ -L ~/.config/fish/functions/gd.fish ] && fail "gd.fish was linked"
+cat ~/dfmdir/files/.config/fish/functions/gd.fish
+
+banner 'Several repos need track_repo'
+mkdir ~/dfmdir/work
+sed -i.orig 's/^repos = .*/repos = ["files", "work"]/' "$DFM_DIR/.dfm.toml"
+echo 'function gl; git log; end' > ~/.config/fish/functions/gl.fish
+dfm link
+echo 'track_repo = "work"' >> "$DFM_DIR/.dfm.toml"
+dfm link
+find ~/dfmdir/work -type f | sort
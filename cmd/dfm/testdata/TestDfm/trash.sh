@@ -0,0 +1,30 @@
+#!/bin/bash
+# Tests that removed copies can be kept in the trash.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files/.config
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.config/app.conf
+
+dfm init --repos files
+dfm copy ~/.config/app.conf
+dfm link ~/.bashrc
+dfm trash list
+
+banner "Removed copies are moved to the trash"
+dfm remove --trash
+[ -e ~/.config/app.conf ] && fail 'app.conf was not removed'
+# The trash directories are named after the time, so only show the paths.
+dfm trash list | cut -f2
+[ "$(cat ~/dfmdir/.trash/*/.config/app.conf)" = 'config' ] || fail 'app.conf is not in the trash'
+
+banner "Emptying the trash"
+dfm trash empty --dry-run
+dfm trash empty
+[ -e ~/dfmdir/.trash ] && fail 'the trash was not emptied'
+dfm trash list
+true
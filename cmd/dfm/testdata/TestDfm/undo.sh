@@ -0,0 +1,33 @@
+#!/bin/bash
+# Tests that dfm undo restores the files removed by the last run.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.vimrc
+echo 'config' > ~/dotfiles/files/.inputrc
+
+dfm init --repos files
+dfm link ~/.bashrc ~/.vimrc
+dfm copy ~/.inputrc
+dfm undo && fail 'there should be nothing to undo'
+
+banner 'Removed files are restored'
+dfm remove --trash
+dfm undo --dry-run
+dfm undo
+[ "$(readlink ~/.bashrc)" = "$DFM_DIR/files/.bashrc" ] || fail '.bashrc was not linked again'
+[ -f ~/.inputrc ] || fail '.inputrc was not restored'
+dfm undo && fail 'an undo should not be undone'
+
+banner 'Overwritten files are restored from their backup'
+echo 'local' > ~/.zshrc
+echo 'config' > ~/dotfiles/files/.zshrc
+dfm link --force --backup
+dfm undo
+[ "$(cat ~/.zshrc)" = 'local' ] || fail '.zshrc was not restored'
+true
@@ -0,0 +1,39 @@
+#!/bin/bash
+# Tests pulling and linking with dfm update.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+export GIT_AUTHOR_NAME=test GIT_AUTHOR_EMAIL=test@example.com
+export GIT_COMMITTER_NAME=test GIT_COMMITTER_EMAIL=test@example.com
+export GIT_AUTHOR_DATE=2020-01-01T00:00:00Z GIT_COMMITTER_DATE=2020-01-01T00:00:00Z
+
+mkdir -p upstream/files ~
+echo 'bash config' > upstream/files/.bashrc
+git -C upstream init --quiet
+git -C upstream add .
+git -C upstream commit --quiet -m 'Add .bashrc'
+dfm init --clone "$(pwd)/upstream" --repos files --link
+
+echo 'vim config' > upstream/files/.vimrc
+git -C upstream add .
+git -C upstream commit --quiet -m 'Add .vimrc'
+
+banner 'Dry run'
+dfm update --dry-run
+[ ! -e ~/.vimrc ] || fail 'dry run linked .vimrc'
+
+banner 'Pulling and linking'
+dfm update
+[ -L ~/.vimrc ] || fail '.vimrc is not a symlink'
+
+banner 'Pull fails'
+echo 'local' > "$DFM_DIR/files/.local"
+git -C "$DFM_DIR" add files/.local
+git -C "$DFM_DIR" commit --quiet -m 'Add .local'
+echo 'upstream' > upstream/files/.upstream
+git -C upstream add .
+git -C upstream commit --quiet -m 'Add .upstream'
+dfm update && fail 'update succeeded after diverging'
+[ -L ~/.local ] || fail 'link did not run after a failed pull'
@@ -0,0 +1,32 @@
+#!/bin/bash
+# Tests choosing between variants of a file for each machine.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+host="$(hostname)"
+
+mkdir -p ~/dfmdir/files
+echo 'default' > ~/dfmdir/files/.gitconfig##default
+echo 'other' > ~/dfmdir/files/.gitconfig##other-host
+echo 'other' > ~/dfmdir/files/.plan##other-host
+
+dfm init --repos files
+dfm link
+cat ~/.gitconfig
+[ -e ~/.plan ] && fail '.plan was linked'
+
+banner "More specific variants win"
+echo 'host' > ~/dfmdir/files/.gitconfig##"$host"
+dfm link
+cat ~/.gitconfig
+
+banner "Adding a variant"
+echo 'vimrc' > ~/.vimrc
+dfm add --variant "$host" ~/.vimrc > output.txt
+sed "s/$host/HOST/g" output.txt
+[ -f ~/dfmdir/files/.vimrc##"$host" ] || fail 'variant was not created'
+cat ~/.vimrc
+dfm add --variant other-host ~/.bashrc > output.txt 2>&1 && fail 'added a variant for another machine'
+sed "s/$host/HOST/g" output.txt
@@ -0,0 +1,31 @@
+#!/bin/bash
+# Tests checking that tracked files match the repos.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dfmdir"
+
+mkdir -p ~/dfmdir/files
+echo 'config' > ~/dfmdir/files/.bashrc
+echo 'config' > ~/dfmdir/files/.vimrc
+echo 'config' > ~/dfmdir/files/.zshrc
+
+dfm init --repos files
+dfm link ~/.bashrc ~/.vimrc
+dfm copy ~/.zshrc
+
+banner 'Everything matches'
+dfm verify
+dfm verify --checksum
+
+banner 'Problems are listed'
+echo 'edited' > ~/.zshrc
+rm ~/.vimrc
+cp -p ~/dfmdir/.dfm.toml ~/config.bak
+dfm verify && fail 'verify did not fail'
+dfm verify --porcelain && fail 'verify did not fail'
+dfm verify -o json ~/.zshrc && fail 'verify did not fail'
+cmp ~/dfmdir/.dfm.toml ~/config.bak || fail 'verify changed the config'
+[ -e ~/.vimrc ] && fail 'verify created a file'
+true
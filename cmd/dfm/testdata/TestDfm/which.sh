@@ -0,0 +1,24 @@
+#!/bin/bash
+# Tests that dfm which shows the repos providing a file.
+set -e
+. "$(dirname "$0")/../helpers.sh"
+
+export HOME="$(pwd)/home"
+export DFM_DIR="$HOME/dotfiles"
+
+mkdir -p ~/dotfiles/files ~/dotfiles/work
+echo 'config' > ~/dotfiles/files/.bashrc
+echo 'config' > ~/dotfiles/files/.vimrc
+echo 'work config' > ~/dotfiles/work/.bashrc
+
+dfm init --repos files,work
+dfm which ~/.bashrc ~/.vimrc
+dfm which --all ~/.bashrc
+
+banner 'Paths can be used in substitutions'
+[ "$(command dfm which --path-only ~/.vimrc)" = "$DFM_DIR/files/.vimrc" ] || fail 'wrong path'
+dfm which --output=json ~/.bashrc
+
+banner 'Files which are not in a repo'
+dfm which ~/.inputrc && fail 'which should fail for files which are not in a repo'
+true
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+// watchDebounce is how long the repos must be quiet before the changed files
+// are synced. Editors often write several files when saving, and this
+// combines them into a single sync.
+const watchDebounce = 200 * time.Millisecond
+
+func runWatch(cmd *cobra.Command, args []string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatal(err)
+	}
+	defer watcher.Close()
+	for _, repo := range app.Config.Repos() {
+		if err := watchTree(watcher, app.RepoPath(repo, "")); err != nil {
+			fatal(err)
+		}
+	}
+	if outputFormat == "text" {
+		fmt.Fprintln(os.Stderr, colorize(colorDim, "watching for changes, press Ctrl-C to stop"))
+	}
+
+	changed := map[string]bool{}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			// Any sync has already finished, since syncs happen on this
+			// goroutine.
+			printSummary()
+			handleCommandError(nil)
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			relative, ok := watchedRelative(filepath.ToSlash(event.Name))
+			if !ok || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if event.Op&fsnotify.Create != 0 {
+				// New directories need to be watched as well.
+				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+					if err := watchTree(watcher, event.Name); err != nil {
+						printError(err)
+					}
+				}
+			}
+			changed[relative] = true
+			debounce = time.After(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			printError(err)
+		case <-debounce:
+			debounce = nil
+			syncChanged(changed)
+			changed = map[string]bool{}
+		}
+	}
+}
+
+// syncChanged links or copies the changed files. The sync is not canceled by
+// Ctrl-C, so that it never leaves the target directory half-synced.
+func syncChanged(changed map[string]bool) {
+	filenames := make([]string, 0, len(changed))
+	for relative := range changed {
+		filenames = append(filenames, relative)
+	}
+	sort.Strings(filenames)
+	var err error
+	if watchCopy {
+		err = app.CopyChangedContext(context.Background(), filenames, errorHandler)
+	} else {
+		err = app.LinkChangedContext(context.Background(), filenames, errorHandler)
+	}
+	if err != nil {
+		printError(err)
+	}
+}
+
+// watchTree watches the directory and all of its subdirectories, since
+// fsnotify does not watch recursively.
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.IsDir() {
+			return nil
+		} else if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// watchedRelative converts the path of a changed file to the path in the
+// target directory it is synced to, using the repo which contains it. When
+// repos are nested, the innermost repo is used. Changes inside of a .git
+// directory are ignored.
+func watchedRelative(filename string) (string, bool) {
+	var relative, watchedRepo string
+	var found bool
+	longest := 0
+	for _, repo := range app.Config.Repos() {
+		repoPath := app.RepoPath(repo, "")
+		if strings.HasPrefix(filename, repoPath+"/") && len(repoPath) > longest {
+			relative = filename[len(repoPath)+1:]
+			watchedRepo = repo
+			longest = len(repoPath)
+			found = true
+		}
+	}
+	if !found {
+		return "", false
+	}
+	for _, component := range strings.Split(relative, "/") {
+		if component == ".git" {
+			return "", false
+		}
+	}
+	return app.TargetRelative(watchedRepo, relative), true
+}
@@ -0,0 +1,29 @@
+package dfm
+
+// Diagnose checks the repos for problems which syncing can't fix on its own,
+// and returns an error for each file which is affected. Nothing is modified.
+func (dfm *Dfm) Diagnose() ([]*FileError, error) {
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return nil, err
+	}
+	var problems []*FileError
+
+	// Files whose names differ only in case can be synced to a case-sensitive
+	// target, but the same repo would break on another machine.
+	collisions := caseCollisions(fileList.Keys())
+	for _, relative := range fileList.Keys() {
+		if other, ok := collisions[relative]; ok {
+			problems = append(problems, NewFileErrorf(relative, "differs only in case from %s, so they can't both be synced to a case-insensitive filesystem", other))
+		}
+	}
+
+	// A file which was replaced by a directory in the repo can't be synced
+	// until the old file is gone from the target.
+	for _, relative := range fileList.Keys() {
+		if dir := dfm.syncedAsFile(relative); dir != "" {
+			problems = append(problems, NewFileErrorf(relative, "%s was synced as a whole, but the repo now has files inside it", dir))
+		}
+	}
+	return problems, nil
+}
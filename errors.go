@@ -1,18 +1,22 @@
-package main
+package dfm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 )
 
 // ErrorHandler is the type of function called when dfm encounters an error with
-// a particular file. The encountered error will be passed in. Dfm's behavior is
+// a particular file. The encountered error will be passed in, describing what
+// dfm was attempting in its Operation, Repo, Source and Target. Dfm's behavior is
 // based on the result of the handler. If the handler returns nil, dfm will
 // ignore the failure and continue. If the handler returns `dfm.Retry`, dfm will
 // attempt the operation again (and call the handler with the new error, if
-// any). If the handler returns anything else, dfm will abort and return the
-// error.
+// any), up to MaxRetries times. To wait before attempting it again, return
+// RetryAfter instead. If the handler returns anything else, dfm will abort and
+// return the error.
 type ErrorHandler func(err *FileError) error
 
 // Retry is used by ErrorHandler to signal to dfm to attempt the file operation
@@ -20,28 +24,86 @@ type ErrorHandler func(err *FileError) error
 // being named ErrRetry.
 var Retry = errors.New("retry this file").(error)
 
+// RetryAfter is used by ErrorHandler like Retry, but dfm waits for the delay
+// before attempting the file operation again. This gives transient errors, like
+// those of network file systems, a chance to clear up.
+func RetryAfter(delay time.Duration) error {
+	return &retryAfterError{delay}
+}
+
+type retryAfterError struct {
+	delay time.Duration
+}
+
+func (err *retryAfterError) Error() string {
+	return fmt.Sprintf("retry this file after %s", err.delay)
+}
+
+// retryDelay checks if the ErrorHandler asked to retry, and how long to wait
+// before doing so.
+func retryDelay(err error) (retry bool, delay time.Duration) {
+	if err == Retry {
+		return true, 0
+	} else if retryErr, ok := err.(*retryAfterError); ok {
+		return true, retryErr.delay
+	}
+	return false, 0
+}
+
 // ErrNotNeeded means that the file was not updated because it was already up to
 // date. This is only used in logging.
 var ErrNotNeeded = errors.New("already up to date")
 
+// ErrModifiedOutside means that the autoclean left a file in the target,
+// because it was changed since dfm last synced it. This is only used in
+// logging.
+var ErrModifiedOutside = errors.New("not removing: modified outside dfm")
+
+// TooManyRemovalsError is returned by a sync when the autoclean would remove
+// more files than the autoclean_limit config option allows, and
+// Dfm.ConfirmRemovals did not allow it. Nothing is modified.
+type TooManyRemovalsError struct {
+	// Files which the autoclean would remove
+	Files []string
+	// The number of files which may be removed without confirmation
+	Limit int
+}
+
+func (err *TooManyRemovalsError) Error() string {
+	return fmt.Sprintf("autoclean would remove %d files, more than the limit of %d", len(err.Files), err.Limit)
+}
+
+// TooManyAddsError is returned by AddFiles when the directories being added
+// contain more files than AddLimit, or more bytes than AddSizeLimit, and
+// Dfm.ConfirmAdd did not allow it. Nothing is added.
+type TooManyAddsError struct {
+	// Files found in the directories
+	Files []string
+	// Total size of the files in bytes
+	Size int64
+}
+
+func (err *TooManyAddsError) Error() string {
+	return fmt.Sprintf("not adding %d files totaling %d KB from directories; the limit without confirmation is %d files or %d MB", len(err.Files), (err.Size+1023)/1024, AddLimit, AddSizeLimit>>20)
+}
+
 // IsNotNeeded checks if the given error is ErrNotNeeded, after unwrapping
 func IsNotNeeded(err error) bool {
-	if err == ErrNotNeeded {
-		return true
-	}
-	if fileErr, ok := err.(*FileError); ok {
-		if fileErr.Cause() == ErrNotNeeded {
-			return true
-		}
-	}
-	return false
+	return errors.Is(err, ErrNotNeeded)
 }
 
 // FileError represents any error dfm encountered while managing files.
 type FileError struct {
 	Message  string
 	Filename string
-	cause    error
+	// What dfm was attempting when the error happened, as one of the Operation
+	// constants, with the repo and the absolute paths involved. These are set
+	// on every error passed to an ErrorHandler, but may be empty otherwise.
+	Operation string
+	Repo      string
+	Source    string
+	Target    string
+	cause     error
 }
 
 // NewFileError creates a new FileError for the provided file.
@@ -95,24 +157,69 @@ func (err *FileError) Cause() error {
 	return err.cause
 }
 
+// Unwrap returns the underlying cause of the error, so that errors.Is and
+// errors.As look through the FileError.
+func (err *FileError) Unwrap() error {
+	return err.Cause()
+}
+
+// MaxRetries is the number of times a file operation is retried when the
+// ErrorHandler keeps returning Retry, before dfm gives up on it.
+const MaxRetries = 10
+
+// fileAttempt describes the operation which processWithRetry attempts, see the
+// fields of FileError.
+type fileAttempt struct {
+	operation string
+	repo      string
+	source    string
+	target    string
+}
+
 // processWithRetry calls the given function one or more times. If the function
-// returns an error, the ErrorHandler can indicate to retry the function again.
+// returns an error, the ErrorHandler can indicate to retry the function again,
+// up to MaxRetries times. After that, the handler is called one last time with
+// an error saying so, and the file is skipped if it returns nil, or the
+// operation is aborted otherwise. If the context is canceled while waiting
+// to retry, the operation is aborted with the context's error.
 func processWithRetry(
+	ctx context.Context,
 	errorHandler ErrorHandler,
+	attempt fileAttempt,
 	process func() *FileError,
 ) (skipped, aborted bool, reason error) {
-retry:
-	rawErr := process()
-	if rawErr == nil {
-		return false, false, nil
-	} else if IsNotNeeded(rawErr) {
-		return true, false, rawErr
-	}
-	newErr := errorHandler(rawErr)
-	if newErr == nil {
-		return true, false, rawErr
-	} else if newErr == Retry {
-		goto retry
+	for retries := 0; ; retries++ {
+		rawErr := process()
+		if rawErr == nil {
+			return false, false, nil
+		} else if IsNotNeeded(rawErr) {
+			return true, false, rawErr
+		}
+		if retries == MaxRetries {
+			gaveUp := *rawErr
+			gaveUp.Message = fmt.Sprintf("gave up after %d retries: %s", MaxRetries, rawErr.Message)
+			rawErr = &gaveUp
+		}
+		if rawErr.Operation == "" {
+			rawErr.Operation = attempt.operation
+			rawErr.Repo = attempt.repo
+			rawErr.Source = attempt.source
+			rawErr.Target = attempt.target
+		}
+		newErr := errorHandler(rawErr)
+		if newErr == nil {
+			return true, false, rawErr
+		}
+		retry, delay := retryDelay(newErr)
+		if !retry {
+			return false, true, newErr
+		} else if retries == MaxRetries {
+			return false, true, rawErr
+		}
+		select {
+		case <-ctx.Done():
+			return false, true, ctx.Err()
+		case <-time.After(delay):
+		}
 	}
-	return false, true, newErr
 }
@@ -0,0 +1,136 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+)
+
+// Level is the severity of an Event.
+type Level int
+
+const (
+	// LevelDebug is for operations which didn't need to do anything, like
+	// files which were already up to date.
+	LevelDebug Level = iota
+	// LevelInfo is for operations which changed something, or would have in
+	// a dry run.
+	LevelInfo
+	// LevelWarning is for problems which did not stop the operation, and
+	// files which were left alone because they were modified outside of dfm.
+	LevelWarning
+	// LevelError is for operations which failed.
+	LevelError
+)
+
+// String returns the name of the level, like "warning".
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// Event describes a single operation dfm performed, see EventHandler.
+type Event struct {
+	// One of the Operation constants
+	Operation string
+	// Path relative to the target directory. For some operations, like
+	// OperationGit, this is described by the operation instead.
+	Relative string
+	// Name of the repo the file belongs to, if any
+	Repo string
+	// Absolute path to the file in the repo, or "" if there is none. For
+	// OperationCreateRepo, the repo itself, for OperationBackup, the file in
+	// the target directory, for OperationRestore, the file in the trash or
+	// the backup, and for OperationMove, the old path in the repo.
+	Source string
+	// Absolute path to the file in the target directory, or "" if there is
+	// none. For OperationBackup, the backup, and for OperationMove, the new
+	// path in the repo.
+	Target string
+	// The error for operations which failed, or the reason for operations
+	// which were skipped, the same as the reason passed to a Logger
+	Err error
+	// Set when the operation was only simulated
+	DryRun bool
+	Level  Level
+}
+
+// EventHandler receives an Event for every operation dfm performs.
+type EventHandler interface {
+	HandleEvent(event Event)
+}
+
+// EventHandlerFunc is an EventHandler which calls the function.
+type EventHandlerFunc func(event Event)
+
+// HandleEvent calls the function with the event.
+func (handler EventHandlerFunc) HandleEvent(event Event) {
+	handler(event)
+}
+
+// HandleEvent calls the Logger with the parts of the event which it accepts,
+// so that a Logger can be used as an EventHandler.
+func (logger Logger) HandleEvent(event Event) {
+	logger(event.Operation, event.Relative, event.Repo, event.Err)
+}
+
+// newEvent describes a logged operation as an Event.
+func (dfm *Dfm) newEvent(operation, relative, repo string, reason error) Event {
+	event := Event{
+		Operation: operation,
+		Relative:  relative,
+		Repo:      repo,
+		Err:       reason,
+		DryRun:    dfm.DryRun,
+		Level:     eventLevel(operation, reason),
+	}
+	switch operation {
+	case OperationCreateRepo:
+		event.Source = dfm.RepoPath(repo, "")
+	case OperationWarning, OperationOnChange, OperationGit:
+	case OperationBackup:
+		event.Source = dfm.TargetPath(relative)
+		event.Target = dfm.BackupPath(relative)
+	default:
+		if repo != "" {
+			event.Source = dfm.SourcePath(repo, relative)
+		}
+		event.Target = dfm.TargetPath(relative)
+	}
+	return event
+}
+
+// eventLevel returns the severity of a logged operation.
+func eventLevel(operation string, reason error) Level {
+	switch operation {
+	case OperationWarning:
+		return LevelWarning
+	case OperationSkip:
+		if IsNotNeeded(reason) {
+			return LevelDebug
+		} else if errors.Is(reason, ErrModifiedOutside) {
+			return LevelWarning
+		}
+		return LevelError
+	case OperationEject:
+		if IsNotNeeded(reason) {
+			return LevelDebug
+		}
+	case OperationRemove:
+		if reason != nil && !errors.Is(reason, os.ErrNotExist) {
+			return LevelError
+		}
+	case OperationChmod, OperationOnChange, OperationPurge:
+		if reason != nil {
+			return LevelError
+		}
+	}
+	return LevelInfo
+}
@@ -0,0 +1,40 @@
+package dfm
+
+// orderedFiles maps relative paths to the repo which provides them, and
+// remembers the order the paths were added in. Setting a path which is
+// already in the list changes its repo without moving it, so later repos
+// override earlier ones.
+type orderedFiles struct {
+	// Relative paths in the order they were added
+	keys  []string
+	repos map[string]string
+}
+
+func newOrderedFiles() *orderedFiles {
+	return &orderedFiles{repos: map[string]string{}}
+}
+
+// Set adds the relative path, or changes its repo if it is already listed.
+func (files *orderedFiles) Set(relative, repo string) {
+	if _, ok := files.repos[relative]; !ok {
+		files.keys = append(files.keys, relative)
+	}
+	files.repos[relative] = repo
+}
+
+// Get returns the repo which provides the relative path, and whether it is
+// listed at all.
+func (files *orderedFiles) Get(relative string) (string, bool) {
+	repo, ok := files.repos[relative]
+	return repo, ok
+}
+
+// Len returns the number of paths in the list.
+func (files *orderedFiles) Len() int {
+	return len(files.keys)
+}
+
+// Keys returns the relative paths in order. The slice must not be modified.
+func (files *orderedFiles) Keys() []string {
+	return files.keys
+}
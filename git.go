@@ -0,0 +1,153 @@
+package dfm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// findGit returns the path to the git executable.
+func findGit() (string, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return "", fmt.Errorf("git: executable not found")
+	}
+	return gitPath, nil
+}
+
+// CloneRepository clones the git repository at url into dir. The directory must
+// be empty or not exist. If the clone fails, dir is left the way it was found.
+func CloneRepository(url, dir string) error {
+	gitPath, err := findGit()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	existed := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	} else if len(entries) > 0 {
+		return NewFileError(dir, "cannot clone into a directory that is not empty")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(gitPath, "clone", "--quiet", "--", url, dir)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if existed {
+			entries, _ = ioutil.ReadDir(dir)
+			for _, entry := range entries {
+				os.RemoveAll(pathJoin(dir, entry.Name()))
+			}
+		} else {
+			os.RemoveAll(dir)
+		}
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return fmt.Errorf("git clone failed: %s", message)
+	}
+	return nil
+}
+
+// isGitRepository returns true if dir is inside of a git work tree.
+func isGitRepository(gitPath, dir string) bool {
+	cmd := exec.Command(gitPath, "rev-parse", "--is-inside-work-tree")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+// RunGit runs git with the given arguments in the dfm directory, connected to
+// the given streams. It fails without running anything if git is not installed
+// or the dfm directory is not a git repository. If git itself fails, the
+// *exec.ExitError is returned, so that the exit code is available.
+func (dfm *Dfm) RunGit(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	gitPath, err := findGit()
+	if err != nil {
+		return err
+	}
+	if !isGitRepository(gitPath, dfm.Config.path) {
+		return NewFileError(dfm.Config.path, "not a git repository")
+	}
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = dfm.Config.path
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// gitConfig is the [git] table of the config file.
+type gitConfig struct {
+	// Commit files to git after adding them
+	Autocommit bool `toml:"autocommit,omitempty"`
+}
+
+// commitAdded commits the files which were just added to the given repo. The
+// relative paths are the target-relative paths of the added files. If the dfm
+// directory is not a git repository, nothing is committed. In a dry run, the
+// git commands are logged but not run.
+func (dfm *Dfm) commitAdded(repo string, relatives []string) error {
+	if len(relatives) == 0 {
+		return nil
+	}
+	runCommand := dfm.RunCommand
+	if runCommand == nil {
+		runCommand = dfm.runShellCommand
+	}
+	if err := runCommand("git rev-parse --is-inside-work-tree >/dev/null 2>&1", nil); err != nil {
+		return nil
+	}
+	paths := make([]string, len(relatives))
+	for i, relative := range relatives {
+		paths[i] = shellQuote(pathJoin(repo, relative))
+	}
+	message := "Add " + strings.Join(relatives, ", ")
+	commands := []string{
+		"git add -- " + strings.Join(paths, " "),
+		"git commit --quiet -m " + shellQuote(message) + " -- " + strings.Join(paths, " "),
+	}
+	for _, command := range commands {
+		if !dfm.DryRun {
+			if err := runCommand(command, nil); err != nil {
+				return fmt.Errorf("%s: %s", command, err)
+			}
+		}
+		dfm.log(OperationGit, command, "", nil)
+	}
+	return nil
+}
+
+// Pull updates the dfm directory using git pull --ff-only, if it is a git
+// repository. In a dry run, it runs git fetch instead and logs the commits
+// which would be pulled.
+func (dfm *Dfm) Pull() error {
+	runCommand := dfm.RunCommand
+	if runCommand == nil {
+		runCommand = dfm.runShellCommand
+	}
+	if err := runCommand("git rev-parse --is-inside-work-tree >/dev/null 2>&1", nil); err != nil {
+		return nil
+	}
+	commands := []string{"git pull --ff-only --quiet"}
+	if dfm.DryRun {
+		commands = []string{"git fetch --quiet", "git log --oneline HEAD..@{upstream}"}
+	}
+	for _, command := range commands {
+		if err := runCommand(command, nil); err != nil {
+			return fmt.Errorf("%s: %s", command, err)
+		}
+		if !dfm.DryRun {
+			dfm.log(OperationGit, command, "", nil)
+		}
+	}
+	return nil
+}
@@ -3,11 +3,12 @@ module github.com/cgamesplay/dfm
 go 1.13
 
 require (
-	github.com/cevaris/ordered_map v0.0.0-20190319150403-3adeae072e73
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/mitchellh/go-wordwrap v1.0.0
 	github.com/pelletier/go-toml v1.6.0
 	github.com/spf13/afero v1.1.2
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.2.2
-	golang.org/x/text v0.3.8 // indirect
+	golang.org/x/text v0.3.8
 )
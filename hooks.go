@@ -0,0 +1,238 @@
+package dfm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const (
+	// HookPreSync runs before files are linked, copied, or removed.
+	HookPreSync = "pre_sync"
+	// HookPostSync runs after files are linked, copied, or removed. By default
+	// it only runs when at least one file changed.
+	HookPostSync = "post_sync"
+)
+
+// hookDir is the directory inside of the dfm directory which holds executable
+// hooks, named after the hook they implement.
+const hookDir = "hooks"
+
+// hooksConfig is the [hooks] table of the config file.
+type hooksConfig struct {
+	PreSync  []string `toml:"pre_sync,omitempty"`
+	PostSync []string `toml:"post_sync,omitempty"`
+	// Run the post_sync hooks even if no files changed
+	PostSyncAlways bool `toml:"post_sync_always,omitempty"`
+	// Abort when a hook fails, instead of only warning about it
+	Fatal bool `toml:"fatal,omitempty"`
+}
+
+// CommandRunner is the type of function used to run hooks. The command is a
+// shell command, and env holds the additional environment variables for it.
+type CommandRunner func(command string, env []string) error
+
+// runShellCommand runs the command with sh in the dfm directory. The output of
+// the command goes to stderr, so that it doesn't mix with dfm's own output.
+func (dfm *Dfm) runShellCommand(command string, env []string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = dfm.Config.path
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("sh: %w", exec.ErrNotFound)
+	}
+	return err
+}
+
+// shellQuote quotes the string for use as a single word in a shell command.
+func shellQuote(word string) string {
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+// hookCommands lists the commands for the hook: first the ones from the config
+// file, then the executable in the hooks directory, if there is one.
+func (dfm *Dfm) hookCommands(hook string) []string {
+	var commands []string
+	switch hook {
+	case HookPreSync:
+		commands = append(commands, dfm.Config.hooks.PreSync...)
+	case HookPostSync:
+		commands = append(commands, dfm.Config.hooks.PostSync...)
+	}
+	hookPath := pathJoin(dfm.Config.path, hookDir, hook)
+	if stat, err := dfm.fs.Stat(hookPath); err == nil && stat.Mode().IsRegular() && stat.Mode()&0111 != 0 {
+		commands = append(commands, shellQuote(hookPath))
+	}
+	return commands
+}
+
+// runHook runs every command for the hook. The operation is the one being
+// synced, and changed reports whether it changed any files. A failing command
+// is logged as a warning, unless the hooks are configured as fatal, in which
+// case the error is returned and the remaining commands are not run.
+func (dfm *Dfm) runHook(hook, operation string, changed bool) error {
+	if hook == HookPostSync && (dfm.DryRun || (!changed && !dfm.Config.hooks.PostSyncAlways)) {
+		return nil
+	}
+	commands := dfm.hookCommands(hook)
+	if len(commands) == 0 {
+		return nil
+	}
+	env := []string{
+		"DFM_DIR=" + dfm.Config.path,
+		"DFM_TARGET=" + dfm.Config.targetPath,
+		"DFM_HOOK=" + hook,
+		"DFM_OPERATION=" + hookOperation(operation),
+	}
+	if hook == HookPostSync {
+		env = append(env, "DFM_CHANGED="+boolEnv(changed))
+	}
+	if dfm.DryRun {
+		env = append(env, "DFM_DRY_RUN=1")
+	}
+	runCommand := dfm.RunCommand
+	if runCommand == nil {
+		runCommand = dfm.runShellCommand
+	}
+	for _, command := range commands {
+		if err := runCommand(command, env); err != nil {
+			hookErr := NewFileErrorf(hook, "hook %#v failed: %s", command, err)
+			if dfm.Config.hooks.Fatal {
+				return hookErr
+			}
+			dfm.log(OperationWarning, hook, "", hookErr)
+		}
+	}
+	return nil
+}
+
+// onChangeCommand is a command from the [onchange] table, along with the
+// changed files which caused it to run.
+type onChangeCommand struct {
+	command string
+	files   []string
+}
+
+// matchOnChange finds the commands whose patterns match any of the changed
+// files. Each command is listed once, even if several files or patterns match
+// it. Commands are ordered by their first matching pattern.
+func matchOnChange(onChange map[string]string, changed []string) []onChangeCommand {
+	patterns := make([]string, 0, len(onChange))
+	for pattern := range onChange {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	var commands []onChangeCommand
+	index := map[string]int{}
+	for _, pattern := range patterns {
+		command := onChange[pattern]
+		for _, relative := range changed {
+			if !matchesPattern(pattern, relative) {
+				continue
+			}
+			i, ok := index[command]
+			if !ok {
+				i = len(commands)
+				index[command] = i
+				commands = append(commands, onChangeCommand{command: command})
+			}
+			commands[i].files = append(commands[i].files, relative)
+		}
+	}
+	for i := range commands {
+		sort.Strings(commands[i].files)
+		commands[i].files = uniqueStrings(commands[i].files)
+	}
+	return commands
+}
+
+// uniqueStrings removes adjacent duplicates from the sorted slice.
+func uniqueStrings(sorted []string) []string {
+	result := sorted[:0]
+	for i, str := range sorted {
+		if i == 0 || str != sorted[i-1] {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+// runOnChange runs the [onchange] commands matching the changed files. In a
+// dry run, the commands are only logged. Failures are handled the same way as
+// for hooks.
+func (dfm *Dfm) runOnChange(operation string, changed []string) error {
+	runCommand := dfm.RunCommand
+	if runCommand == nil {
+		runCommand = dfm.runShellCommand
+	}
+	for _, match := range matchOnChange(dfm.Config.onChange, changed) {
+		if dfm.DryRun {
+			dfm.log(OperationOnChange, match.command, "", nil)
+			continue
+		}
+		env := []string{
+			"DFM_DIR=" + dfm.Config.path,
+			"DFM_TARGET=" + dfm.Config.targetPath,
+			"DFM_OPERATION=" + hookOperation(operation),
+			"DFM_CHANGED_FILES=" + strings.Join(match.files, "\n"),
+		}
+		var cmdErr error
+		if err := runCommand(match.command, env); err != nil {
+			cmdErr = NewFileErrorf(match.command, "command failed: %s", err)
+			if dfm.Config.hooks.Fatal {
+				return cmdErr
+			}
+		}
+		dfm.log(OperationOnChange, match.command, "", cmdErr)
+	}
+	return nil
+}
+
+// withHooks runs the pre_sync hooks, the sync, the [onchange] commands for the
+// files which changed, and then the post_sync hooks. Nothing is run after the
+// sync if it fails.
+func (dfm *Dfm) withHooks(operation string, sync func() error) error {
+	if err := dfm.runHook(HookPreSync, operation, false); err != nil {
+		return err
+	}
+	dfm.changed = []string{}
+	err := sync()
+	changed := dfm.changed
+	dfm.changed = nil
+	if err != nil {
+		return err
+	}
+	if err := dfm.runOnChange(operation, changed); err != nil {
+		return err
+	}
+	return dfm.runHook(HookPostSync, operation, len(changed) > 0)
+}
+
+// hookOperation converts the operation to the name of the command, which is
+// given to hooks as DFM_OPERATION.
+func hookOperation(operation string) string {
+	switch operation {
+	case OperationLink:
+		return "link"
+	case OperationCopy:
+		return "copy"
+	case OperationRemove:
+		return "remove"
+	case OperationMove:
+		return "move"
+	}
+	return operation
+}
+
+func boolEnv(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,56 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ignorePatterns returns the patterns of files which are skipped when adding a
+// directory to the repo: the ignore config option, followed by the lines of
+// the repo's IgnoreFilename. Blank lines and lines starting with # are
+// skipped.
+func (dfm *Dfm) ignorePatterns(repo string) ([]string, error) {
+	patterns := append([]string(nil), dfm.Config.ignore...)
+	bytes, err := afero.ReadFile(dfm.fs, pathJoin(dfm.RepoPath(repo, ""), IgnoreFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return patterns, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, nil
+}
+
+// isIgnored returns true if the relative path in the target directory, which
+// was found inside of the directory dir, matches any of the patterns. Like in
+// .gitignore, a pattern without a slash matches a file or directory with that
+// name anywhere inside of dir, and other patterns are matched against the
+// whole path. A pattern which matches a directory matches everything inside
+// it.
+func isIgnored(patterns []string, dir, relative string) bool {
+	inside := strings.TrimPrefix(relative, dir+"/")
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/")
+		if strings.Contains(pattern, "/") {
+			if matchesPattern(pattern, relative) {
+				return true
+			}
+			continue
+		}
+		for _, element := range strings.Split(inside, "/") {
+			if matched, _ := path.Match(pattern, element); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package dfm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// JournalFilename is the file in the dfm directory where every change dfm
+// makes to the target directory, the repos or the manifest is recorded, one
+// JSON object per line.
+const JournalFilename = ".dfm-journal"
+
+// JournalEntry is a single change recorded in the journal.
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	// Identifies the run of dfm which made the change, so that changes can
+	// be undone together
+	Run string `json:"run,omitempty"`
+	// The dfm command which made the change, like "link" or "remove"
+	Command string `json:"command,omitempty"`
+	// One of the Operation constants
+	Operation string `json:"operation"`
+	// Path relative to the target directory
+	Relative string `json:"path"`
+	Repo     string `json:"repo,omitempty"`
+	// "ok", or the error message if the operation failed
+	Result string `json:"result"`
+	// Where the previous contents of the file were kept, for files which were
+	// moved to the trash or backed up
+	Saved string `json:"saved,omitempty"`
+	// For removed files, whether the file was synced by dfm copy
+	Copy bool `json:"copy,omitempty"`
+}
+
+// JournalPath returns the path to the journal.
+func (dfm *Dfm) JournalPath() string {
+	return path.Join(dfm.Config.path, JournalFilename)
+}
+
+// isJournaled returns true if the operation changes files, and so is recorded
+// in the journal.
+func isJournaled(operation string) bool {
+	switch operation {
+	case OperationAdd, OperationLink, OperationCopy, OperationRemove,
+		OperationAdopt, OperationOverwrite, OperationBackup, OperationPrune,
+		OperationChmod, OperationRestore, OperationEject, OperationPurge,
+		OperationMove:
+		return true
+	}
+	return false
+}
+
+// journal appends a logged operation to the journal. Nothing is recorded in a
+// dry run. If the journal can't be written, a warning is logged the first time
+// and the operation is otherwise unaffected.
+func (dfm *Dfm) journal(operation, relative, repo string, reason error) {
+	if dfm.DryRun || dfm.journalFailed || !isJournaled(operation) {
+		return
+	}
+	if dfm.journalRun == "" {
+		dfm.journalRun = time.Now().Format(time.RFC3339Nano)
+	}
+	entry := JournalEntry{
+		Time:      time.Now(),
+		Run:       dfm.journalRun,
+		Command:   dfm.Command,
+		Operation: operation,
+		Relative:  relative,
+		Repo:      repo,
+		Result:    "ok",
+	}
+	if reason != nil {
+		entry.Result = reason.Error()
+	}
+	switch operation {
+	case OperationRemove:
+		_, checksum := dfm.Config.checksums[relative]
+		entry.Copy = checksum && !dfm.Config.copied[relative]
+		if dfm.trashTime != "" {
+			trashed := path.Join(dfm.TrashPath(), dfm.trashTime, relative)
+			if _, err := lstat(dfm.fs, trashed); err == nil {
+				entry.Saved = trashed
+			}
+		}
+	case OperationBackup:
+		entry.Saved = dfm.BackupPath(relative)
+	}
+	if err := dfm.appendJournal(entry); err != nil {
+		dfm.journalFailed = true
+		dfm.log(OperationWarning, JournalFilename, "", NewFileErrorf(dfm.JournalPath(), "can't write to the journal: %s", err))
+	}
+}
+
+func (dfm *Dfm) appendJournal(entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := dfm.fs.OpenFile(dfm.JournalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// History returns the entries in the journal, oldest first. If relative is set,
+// only the entries for that file, or for files inside that directory, are
+// returned. If limit is positive, only the last limit entries are returned.
+func (dfm *Dfm) History(relative string, limit int) ([]JournalEntry, error) {
+	file, err := dfm.fs.Open(dfm.JournalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line may have been cut off if dfm was killed while
+			// writing it.
+			continue
+		}
+		if relative == "" || relative == "." || entry.Relative == relative || strings.HasPrefix(entry.Relative, relative+"/") {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,87 @@
+package dfm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// MigrateTarget moves every tracked file to a new target directory, for
+// example after the home directory was renamed. Each file which dfm still
+// owns is removed from the old target directory, if it exists at all, and is
+// synced to the new one the same way it was synced before: copies stay
+// copies, and everything else is linked. The new target directory must
+// already exist.
+func (dfm *Dfm) MigrateTarget(newTarget string, errorHandler ErrorHandler) error {
+	return dfm.MigrateTargetContext(context.Background(), newTarget, errorHandler)
+}
+
+// MigrateTargetContext is MigrateTarget with support for cancellation. If the
+// context is canceled, no more files are synced and the context's error is
+// returned.
+func (dfm *Dfm) MigrateTargetContext(ctx context.Context, newTarget string, errorHandler ErrorHandler) error {
+	if stat, err := dfm.fs.Stat(newTarget); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", newTarget)
+	} else if err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", newTarget)
+	}
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return err
+	}
+	tracked := manifestToConfig(dfm.Config.manifest)
+	sort.Strings(tracked)
+	linked, copied := newOrderedFiles(), newOrderedFiles()
+	for _, relative := range tracked {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The old target directory may be gone entirely.
+		if _, err := lstat(dfm.fs, dfm.TargetPath(relative)); err == nil {
+			if !dfm.ownsTarget(relative) {
+				dfm.logPaths(OperationSkip, relative, "", "", dfm.TargetPath(relative), WrapFileError(ErrModifiedOutside, relative))
+			} else if dfm.DryRun {
+				dfm.logPaths(OperationRemove, relative, "", "", dfm.TargetPath(relative), nil)
+			} else {
+				dfm.logPaths(OperationRemove, relative, "", "", dfm.TargetPath(relative), dfm.removeFile(relative, dfm.TargetPath(relative)))
+			}
+		}
+		repo, ok := fileList.Get(relative)
+		if !ok {
+			// Nothing provides the file anymore, so it is only forgotten.
+			delete(dfm.Config.manifest, relative)
+			continue
+		}
+		if dfm.isCopy(relative, repo) {
+			copied.Set(relative, repo)
+		} else {
+			linked.Set(relative, repo)
+		}
+	}
+
+	dfm.Config.SetTargetPath(newTarget)
+	linkPlan := newPlan(OperationLink)
+	dfm.planFiles(linkPlan, linked)
+	err = dfm.applyPlan(ctx, linkPlan, errorHandler, dfm.handleLink)
+	if err == nil {
+		copyPlan := newPlan(OperationCopy)
+		dfm.planFiles(copyPlan, copied)
+		err = dfm.applyPlan(ctx, copyPlan, errorHandler, dfm.handleCopy)
+	}
+	if saveErr := dfm.saveConfig(); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// isCopy returns true if the tracked file was synced by dfm copy, rather than
+// by dfm link. Copies made because symlinks couldn't be created are synced by
+// dfm link.
+func (dfm *Dfm) isCopy(relative, repo string) bool {
+	_, ok := dfm.Config.checksums[relative]
+	return ok && !dfm.Config.copied[relative] && !dfm.useHardLink(relative, repo)
+}
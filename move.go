@@ -0,0 +1,305 @@
+package dfm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Move renames a tracked file: the file is moved to the new path inside the
+// repo which provides it, keeping any variant suffix, the old link or copy is
+// removed from the target directory, and the file is synced to the new path
+// the same way it was synced before. Directories which are left empty, in the
+// repo and in the target, are removed. Unless Force is set, Move refuses to
+// overwrite a file which any repo or the target directory already has at the
+// new path, and to move a copy which was changed since it was synced.
+func (dfm *Dfm) Move(from, to string, errorHandler ErrorHandler) error {
+	return dfm.MoveContext(context.Background(), from, to, errorHandler)
+}
+
+// MoveContext is Move with support for cancellation.
+func (dfm *Dfm) MoveContext(ctx context.Context, from, to string, errorHandler ErrorHandler) error {
+	if from == to {
+		return NewFileErrorf(from, "can't be moved to itself")
+	} else if strings.HasPrefix(to, from+"/") {
+		return NewFileErrorf(from, "can't be moved inside itself")
+	} else if !dfm.Config.manifest[from] {
+		return NewFileError(from, "not tracked by dfm")
+	}
+	providers, err := dfm.Which(from)
+	if err != nil {
+		return err
+	} else if len(providers) == 0 {
+		return NewFileError(from, "not in any repo")
+	}
+	provider := providers[0]
+	if err := dfm.checkMoveDestination(to); err != nil {
+		return err
+	}
+	if !dfm.Force {
+		if modified, err := dfm.isModifiedCopy(from, provider.SourcePath); err != nil {
+			return WrapFileError(err, from)
+		} else if modified {
+			return NewFileErrorf(from, "not moving: the file differs from the one in %s", provider.Repo)
+		}
+	}
+	// The variant suffix, if any, stays with the file.
+	suffix := strings.TrimPrefix(provider.SourcePath, dfm.RepoPath(provider.Repo, from))
+	dest := dfm.RepoPath(provider.Repo, to) + suffix
+
+	return dfm.withHooks(OperationMove, func() error {
+		if err := dfm.moveRepoFile(provider, dest); err != nil {
+			return WrapFileError(err, from)
+		}
+		dfm.logPaths(OperationMove, from, provider.Repo, provider.SourcePath, dest, nil)
+
+		_, wasCopied := dfm.Config.checksums[from]
+		if dfm.Config.copied[from] {
+			dfm.Config.copied[to] = true
+			delete(dfm.Config.copied, from)
+		}
+		nextManifest := make(map[string]bool, len(dfm.Config.manifest))
+		for filename := range dfm.Config.manifest {
+			nextManifest[filename] = true
+		}
+		delete(nextManifest, from)
+		err := dfm.autoclean(ctx, nextManifest, ReasonNoLongerTracked)
+		if err == nil {
+			fileList := newOrderedFiles()
+			fileList.Set(to, provider.Repo)
+			if wasCopied && !dfm.Config.copied[to] {
+				plan := newPlan(OperationCopy)
+				dfm.planFiles(plan, fileList)
+				err = dfm.applyPlan(ctx, plan, errorHandler, dfm.handleCopy)
+			} else {
+				plan := newPlan(OperationLink)
+				dfm.planFiles(plan, fileList)
+				err = dfm.applyPlan(ctx, plan, errorHandler, dfm.handleLink)
+			}
+		}
+		// The file is at the new path in the repo now.
+		dfm.Config.unmapPath(from)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
+}
+
+// checkMoveDestination returns an error if a repo or the target directory
+// already has a file at the path a file is being moved to, unless Force is
+// set.
+func (dfm *Dfm) checkMoveDestination(to string) error {
+	if dfm.Force {
+		return nil
+	}
+	providers, err := dfm.Which(to)
+	if err != nil {
+		return err
+	} else if len(providers) > 0 {
+		return NewFileErrorf(to, "already exists in %s", providers[0].Repo)
+	}
+	if _, err := lstat(dfm.fs, dfm.TargetPath(to)); err == nil {
+		return NewFileError(to, "already exists in the target directory")
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return WrapFileError(err, to)
+	}
+	return nil
+}
+
+// moveRepoFile moves the file which provides a tracked file to dest in the
+// same repo, and removes the directories in the repo which are left empty.
+// With Force, a file which is already at dest is replaced.
+func (dfm *Dfm) moveRepoFile(provider Provider, dest string) error {
+	if dfm.DryRun {
+		return nil
+	}
+	if err := dfm.fs.MkdirAll(path.Dir(dest), 0777); err != nil {
+		return err
+	}
+	if dfm.Force {
+		// The file being replaced is still in git, if the repo uses it.
+		if err := dfm.fs.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+	if err := MoveFile(dfm.fs, provider.SourcePath, dest); err != nil {
+		return err
+	}
+	return CleanDirectories(dfm.fs, path.Dir(provider.SourcePath), dfm.RepoPath(provider.Repo, ""))
+}
+
+// MoveToRepo moves the given files from the repo which syncs them to repo,
+// keeping any variant suffix. The manifest is left alone. A file which is
+// linked in the target directory is linked to its new place before the old
+// one is removed, so the link never breaks. A file which repo already has, or
+// which would still be synced from another repo after the move, is passed to
+// the errorHandler.
+func (dfm *Dfm) MoveToRepo(inputFilenames []string, repo string, errorHandler ErrorHandler) error {
+	return dfm.MoveToRepoContext(context.Background(), inputFilenames, repo, errorHandler)
+}
+
+// MoveToRepoContext is MoveToRepo with support for cancellation. If the
+// context is canceled, no more files are moved and the context's error is
+// returned.
+func (dfm *Dfm) MoveToRepoContext(ctx context.Context, inputFilenames []string, repo string, errorHandler ErrorHandler) error {
+	if err := dfm.assertIsActiveRepo(repo); err != nil {
+		return err
+	}
+	return dfm.withHooks(OperationMove, func() error {
+		err := dfm.moveFilesToRepo(ctx, inputFilenames, repo, errorHandler)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
+}
+
+// moveFilesToRepo is the implementation of MoveToRepo, without the hooks and
+// without saving the config.
+func (dfm *Dfm) moveFilesToRepo(ctx context.Context, inputFilenames []string, repo string, errorHandler ErrorHandler) error {
+	for _, relative := range inputFilenames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		providers, err := dfm.Which(relative)
+		if err != nil {
+			return err
+		}
+		var provider Provider
+		dest := dfm.RepoPath(repo, relative)
+		attempt := fileAttempt{OperationMove, repo, dest, dfm.TargetPath(relative)}
+		skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+			if len(providers) == 0 {
+				return NewFileError(relative, "not in any repo")
+			}
+			provider = providers[0]
+			if err := dfm.checkRepoMove(providers, repo); err != nil {
+				return err
+			}
+			// The variant suffix, if any, stays with the file.
+			dest = dfm.RepoPath(repo, relative) + strings.TrimPrefix(provider.SourcePath, dfm.RepoPath(provider.Repo, relative))
+			return nil
+		})
+		if abort {
+			return fileErr
+		} else if skip {
+			dfm.log(OperationSkip, relative, provider.Repo, fileErr)
+			continue
+		}
+		if err := dfm.moveToRepo(ctx, provider, repo, dest, errorHandler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRepoMove returns an error if the file provided by providers can't be
+// moved to repo: if it is already synced from there, if repo already has it,
+// or if another repo would take precedence over repo afterwards.
+func (dfm *Dfm) checkRepoMove(providers []Provider, repo string) *FileError {
+	relative := providers[0].Relative
+	if providers[0].Repo == repo {
+		return WrapFileError(ErrNotNeeded, relative)
+	}
+	for _, provider := range providers[1:] {
+		if provider.Repo == repo {
+			return NewFileErrorf(relative, "already exists in %s", repo)
+		}
+	}
+	if len(providers) > 1 {
+		// Later repos take precedence.
+		for _, configured := range dfm.Config.repos {
+			if configured == repo {
+				return NewFileErrorf(relative, "would still be synced from %s, which takes precedence over %s", providers[1].Repo, repo)
+			} else if configured == providers[1].Repo {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// moveToRepo moves a single file from the repo which provides it to dest in
+// repo. Files are copied first, and a link in the target directory is
+// replaced by a link to the copy before the original is removed. Linked
+// directories and hard linked files are renamed instead, since a hard link
+// stays the same file, and a directory is relinked afterwards.
+func (dfm *Dfm) moveToRepo(ctx context.Context, provider Provider, repo, dest string, errorHandler ErrorHandler) error {
+	relative := provider.Relative
+	target := dfm.TargetPath(relative)
+	attempt := fileAttempt{OperationMove, repo, dest, target}
+	linked, err := IsLinkedFile(dfm.fs, provider.SourcePath, target)
+	if err != nil {
+		return WrapFileError(err, relative)
+	}
+	rename, err := afero.IsDir(dfm.fs, provider.SourcePath)
+	if err != nil {
+		return WrapFileError(err, relative)
+	} else if !rename && !linked {
+		if rename, err = IsHardLinkedFile(dfm.fs, provider.SourcePath, target); err != nil {
+			return WrapFileError(err, relative)
+		}
+	}
+	skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+		if dfm.DryRun {
+			return nil
+		}
+		err := dfm.fs.MkdirAll(path.Dir(dest), 0777)
+		if err == nil && rename {
+			err = MoveFile(dfm.fs, provider.SourcePath, dest)
+		} else if err == nil {
+			err = CopyFile(dfm.fs, provider.SourcePath, dest)
+		}
+		if err != nil {
+			return WrapFileError(err, relative)
+		}
+		return nil
+	})
+	if abort {
+		return fileErr
+	} else if skip {
+		dfm.log(OperationSkip, relative, provider.Repo, fileErr)
+		return nil
+	}
+
+	if linked && dfm.Config.manifest[relative] {
+		fileList := newOrderedFiles()
+		fileList.Set(relative, repo)
+		plan := newPlan(OperationLink)
+		dfm.planFiles(plan, fileList)
+		if err := dfm.applyPlan(ctx, plan, errorHandler, dfm.handleLink); err != nil {
+			return err
+		}
+		if relinked, _ := IsLinkedFile(dfm.fs, dest, target); !relinked && !dfm.DryRun && !rename {
+			// The link still points to the original, so the move is
+			// undone by removing the copy.
+			return dfm.fs.Remove(dest)
+		}
+	}
+	if !dfm.DryRun && !rename {
+		skip, abort, fileErr = processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+			if err := dfm.fs.Remove(provider.SourcePath); err != nil {
+				return WrapFileError(err, relative)
+			}
+			return nil
+		})
+		if abort {
+			return fileErr
+		} else if skip {
+			dfm.log(OperationSkip, relative, provider.Repo, fileErr)
+			return nil
+		}
+	}
+	if !dfm.DryRun {
+		if err := CleanDirectories(dfm.fs, path.Dir(provider.SourcePath), dfm.RepoPath(provider.Repo, "")); err != nil {
+			return WrapFileError(err, relative)
+		}
+	}
+	dfm.logPaths(OperationMove, relative, repo, provider.SourcePath, dest, nil)
+	return nil
+}
@@ -0,0 +1,243 @@
+package dfm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DotPrefix is how repos which use the dot_prefix option store the leading
+// dot of files and directories, so that they aren't hidden in the repo.
+const DotPrefix = "dot_"
+
+// repoRelative returns the path in the repo which provides the file at the
+// relative path in the target directory. This is the same path, unless the
+// [map] table stores the file, or a directory containing it, somewhere else,
+// or the repo uses the dot_prefix option.
+func (config *Config) repoRelative(repo, relative string) string {
+	mapped, target := config.mapping(relative)
+	if mapped == "" {
+		return config.encodeDots(repo, relative)
+	}
+	return mapped + config.encodeDots(repo, relative[len(target):])
+}
+
+// targetRelative is the reverse of repoRelative: it returns the path in the
+// target directory which the file at the path in the repo is synced to.
+func (config *Config) targetRelative(repo, repoRelative string) string {
+	best := ""
+	for mapped := range config.pathMap {
+		if containsRelative(mapped, repoRelative) && len(mapped) > len(best) {
+			best = mapped
+		}
+	}
+	if best == "" {
+		return config.decodeDots(repo, repoRelative)
+	}
+	return config.pathMap[best] + config.decodeDots(repo, repoRelative[len(best):])
+}
+
+// TargetRelative returns the path in the target directory which the file at
+// the relative path in the repo is synced to, according to the [map] table and
+// the dot_prefix option.
+func (dfm *Dfm) TargetRelative(repo, repoRelative string) string {
+	return dfm.Config.targetRelative(repo, repoRelative)
+}
+
+// mapping returns the entry of the [map] table which contains the relative
+// path in the target directory, or "" if there is none. The most specific
+// entry wins.
+func (config *Config) mapping(relative string) (string, string) {
+	best, bestTarget := "", ""
+	for _, repoRelative := range config.mappedPaths() {
+		target := config.pathMap[repoRelative]
+		if containsRelative(target, relative) && (best == "" || len(target) > len(bestTarget)) {
+			best, bestTarget = repoRelative, target
+		}
+	}
+	return best, bestTarget
+}
+
+// usesDotPrefix returns true if the repo stores leading dots as DotPrefix.
+func (config *Config) usesDotPrefix(repo string) bool {
+	return containsString(config.dotPrefix, repo)
+}
+
+// encodeDots replaces the leading dot of each element of the path with
+// DotPrefix, if the repo uses the dot_prefix option.
+func (config *Config) encodeDots(repo, relative string) string {
+	if !config.usesDotPrefix(repo) || !strings.Contains(relative, ".") {
+		return relative
+	}
+	elements := strings.Split(relative, "/")
+	for i, element := range elements {
+		if strings.HasPrefix(element, ".") && element != "." && element != ".." {
+			elements[i] = DotPrefix + element[1:]
+		}
+	}
+	return strings.Join(elements, "/")
+}
+
+// decodeDots is the reverse of encodeDots.
+func (config *Config) decodeDots(repo, repoRelative string) string {
+	if !config.usesDotPrefix(repo) || !strings.Contains(repoRelative, DotPrefix) {
+		return repoRelative
+	}
+	elements := strings.Split(repoRelative, "/")
+	for i, element := range elements {
+		if strings.HasPrefix(element, DotPrefix) {
+			elements[i] = "." + element[len(DotPrefix):]
+		}
+	}
+	return strings.Join(elements, "/")
+}
+
+// mappedPaths returns the paths in the repos which are mapped to a path in
+// the target directory, in order.
+func (config *Config) mappedPaths() []string {
+	paths := make([]string, 0, len(config.pathMap))
+	for repoRelative := range config.pathMap {
+		paths = append(paths, repoRelative)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// MapConflictError is returned by CheckMap when the [map] table can't be
+// used.
+type MapConflictError struct {
+	// Problems, one for each path which is mapped wrongly
+	Problems []string
+	Path     string
+}
+
+func (err *MapConflictError) Error() string {
+	return fmt.Sprintf("invalid [map] table in %s:\n  %s", err.Path, strings.Join(err.Problems, "\n  "))
+}
+
+// CheckMap returns a MapConflictError if the [map] table maps several paths in
+// the repos to the same path in the target directory, or maps a path outside
+// of the repos or the target directory.
+func (config *Config) CheckMap() error {
+	var problems []string
+	mappedTo := map[string]string{}
+	for _, repoRelative := range config.mappedPaths() {
+		target := config.pathMap[repoRelative]
+		if !isRelativeInside(repoRelative) {
+			problems = append(problems, fmt.Sprintf("%s: not a path inside the repo", repoRelative))
+		} else if !isRelativeInside(target) {
+			problems = append(problems, fmt.Sprintf("%s: %s is not a path inside the target directory", repoRelative, target))
+		} else if other, ok := mappedTo[target]; ok {
+			problems = append(problems, fmt.Sprintf("%s: both %s and %s are mapped to it", target, other, repoRelative))
+		} else {
+			mappedTo[target] = repoRelative
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &MapConflictError{Problems: problems, Path: pathJoin(config.path, TomlFilename)}
+}
+
+// mapPath records that the file at the relative path in the target directory
+// is stored at repoRelative in the repos. A path in the repos can only be
+// mapped to one file, and a file can only be stored at one path.
+func (config *Config) mapPath(repoRelative, relative string) error {
+	if current, ok := config.pathMap[repoRelative]; ok && current != relative {
+		return NewFileErrorf(relative, "%s is already used for %s", repoRelative, current)
+	} else if current, _ := config.mapping(relative); current != "" && current != repoRelative {
+		return NewFileErrorf(relative, "already stored in %s", current)
+	}
+	if config.pathMap == nil {
+		config.pathMap = map[string]string{}
+	}
+	config.pathMap[repoRelative] = relative
+	return nil
+}
+
+// unmapPath removes the mapping for the file at the relative path in the
+// target directory, if it has one of its own. Mappings of the directories
+// containing it are kept.
+func (config *Config) unmapPath(relative string) {
+	if repoRelative, target := config.mapping(relative); target == relative {
+		delete(config.pathMap, repoRelative)
+	}
+}
+
+// cleanRepoRelative checks that the path given to StoreAs is inside of the
+// repo, and returns it in the form used by the [map] table.
+func cleanRepoRelative(repoRelative string) (string, error) {
+	cleaned := NormalizePath(path.Clean(strings.Replace(repoRelative, "\\", "/", -1)))
+	if !isRelativeInside(cleaned) {
+		return "", NewFileError(repoRelative, "not a path inside the repo")
+	} else if _, selector := splitVariant(cleaned); selector != "" {
+		return "", NewFileError(repoRelative, "can't include a variant; use --variant instead")
+	}
+	return cleaned, nil
+}
+
+// isRelativeInside returns true if the cleaned path is relative and points
+// inside of the directory it is relative to, not at the directory itself.
+func isRelativeInside(relative string) bool {
+	return !isAbs(relative) && relative != "." && relative != ".." && !strings.HasPrefix(relative, "../")
+}
+
+// containsRelative returns true if the relative path is dir or inside of it.
+func containsRelative(dir, relative string) bool {
+	return dir == "." || relative == dir || strings.HasPrefix(relative, dir+"/")
+}
+
+// populateMappedFileList is populateRepoFileList for configs with a [map]
+// table, and repos which use the dot_prefix option. The files are found under the path they are stored at in the repo,
+// then listed under the path they are synced to, so files stored elsewhere are
+// found when the directory they are synced to is listed, and left out when the
+// directory they are stored in is. A file in the repo which the [map] table
+// hides, because another path in the repo is synced to the same place, is an
+// error, as is a file stored under its literal name in a repo which uses the
+// dot_prefix option.
+func (dfm *Dfm) populateMappedFileList(repo, relative string, fileList *orderedFiles) error {
+	if err := dfm.Config.CheckMap(); err != nil {
+		return err
+	}
+	linkedDir := func(dir string) bool {
+		return dfm.isLinkedDir(repo, dir)
+	}
+	root := dfm.Config.repoRoot(repo)
+	relative = NormalizePath(path.Clean(relative))
+	walkRoot := dfm.Config.repoRelative(repo, relative)
+	repoFiles := newOrderedFiles()
+	err := populateFileList(dfm.fs, root, walkRoot, repoFiles, repo, linkedDir, dfm.variantSelectors())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	found := err == nil
+	for _, repoRelative := range dfm.Config.mappedPaths() {
+		target := dfm.Config.pathMap[repoRelative]
+		if (found && containsRelative(walkRoot, repoRelative)) || !containsRelative(relative, target) {
+			// Either the walk already found it, or it isn't wanted.
+			continue
+		}
+		if err := populateFileList(dfm.fs, root, repoRelative, repoFiles, repo, linkedDir, dfm.variantSelectors()); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return err
+	}
+	for _, repoRelative := range repoFiles.Keys() {
+		target := dfm.Config.targetRelative(repo, repoRelative)
+		if repoRelative == IgnoreFilename || !containsRelative(relative, target) {
+			continue
+		} else if expected := dfm.Config.repoRelative(repo, target); expected != repoRelative {
+			return NewFileErrorf(target, "%s in %s is synced here, but dfm expects it at %s", repoRelative, repo, expected)
+		}
+		fileList.Set(target, repo)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Paths inside of dfm always use forward slashes, including absolute paths on
+// Windows like "C:/Users/me". Paths from the operating system are converted
+// with filepath.ToSlash when they enter dfm, and the path package is used for
+// everything else. The os package accepts forward slashes on every platform.
+//
+// Relative paths are also normalized to Unicode NFC, since macOS may store
+// names decomposed (NFD) while a repo created elsewhere has them composed.
+// Names on disk are looked up with the same normalization, see
+// normalizedJoin.
+
+// windowsPaths is true when absolute paths may start with a drive letter.
+var windowsPaths = runtime.GOOS == "windows"
+
+// isAbs returns true if the slash-separated path is absolute.
+func isAbs(p string) bool {
+	if path.IsAbs(p) {
+		return true
+	}
+	return windowsPaths && len(p) >= 3 && p[1] == ':' && p[2] == '/' &&
+		('a' <= p[0] && p[0] <= 'z' || 'A' <= p[0] && p[0] <= 'Z')
+}
+
+// RelativePath returns the path of target relative to the directory root, and
+// whether target is inside of root at all. Both paths must be absolute and
+// slash-separated. The relative path of root itself is ".".
+func RelativePath(root, target string) (string, bool) {
+	root = path.Clean(root)
+	target = path.Clean(target)
+	if target == root {
+		return ".", true
+	}
+	// A root like "/" or "C:/" already ends with a separator.
+	prefix := root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if strings.HasPrefix(target, prefix) {
+		return target[len(prefix):], true
+	}
+	return "", false
+}
+
+// isInside returns true if target is root or inside of it.
+func isInside(root, target string) bool {
+	_, ok := RelativePath(root, target)
+	return ok
+}
+
+// resolvePath resolves every symlink in the path p, so that directories
+// reached through different links can be compared. Paths which don't exist
+// are returned as given. Only paths on the real filesystem are resolved.
+func resolvePath(fs afero.Fs, p string) string {
+	if _, ok := fs.(*afero.OsFs); !ok {
+		return p
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.FromSlash(p))
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(resolved)
+}
+
+// canonicalPath is like resolvePath, but leaves the final component alone,
+// since dfm cares about a link itself rather than what it points to.
+func canonicalPath(fs afero.Fs, p string) string {
+	dir, base := path.Split(path.Clean(p))
+	if base == "" {
+		return p
+	}
+	return pathJoin(resolvePath(fs, dir), base)
+}
+
+// ResolvePath resolves every symlink in the absolute, slash-separated path p.
+func (dfm *Dfm) ResolvePath(p string) string {
+	return resolvePath(dfm.fs, p)
+}
+
+// CanonicalPath resolves symlinks in the directories leading to the absolute,
+// slash-separated path p.
+func (dfm *Dfm) CanonicalPath(p string) string {
+	return canonicalPath(dfm.fs, p)
+}
+
+// NormalizePath converts the relative path to Unicode NFC, which dfm uses to
+// identify files.
+func NormalizePath(relative string) string {
+	if isASCII(relative) {
+		return relative
+	}
+	return norm.NFC.String(relative)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizedJoin joins the relative path to root. If the path doesn't exist
+// as given, but an entry whose name differs only in Unicode normalization
+// does, the path to that entry is returned instead.
+func normalizedJoin(fs afero.Fs, root, relative string) string {
+	joined := pathJoin(root, relative)
+	if isASCII(relative) || isAbs(relative) {
+		return joined
+	} else if _, err := lstat(fs, joined); !errors.Is(err, os.ErrNotExist) {
+		return joined
+	}
+	parent, base := root, path.Base(relative)
+	if dir := path.Dir(relative); dir != "." {
+		parent = normalizedJoin(fs, root, dir)
+	}
+	entries, err := afero.ReadDir(fs, parent)
+	if err == nil {
+		normalized := NormalizePath(base)
+		for _, entry := range entries {
+			if NormalizePath(entry.Name()) == normalized {
+				return pathJoin(parent, entry.Name())
+			}
+		}
+	}
+	return pathJoin(parent, base)
+}
+
+// isCaseInsensitive reports whether names in the directory which differ only
+// in case refer to the same file. This is checked by looking up the directory
+// itself (or its nearest parent with letters in its name) with the case of
+// its name swapped. Only the real filesystem is checked.
+func isCaseInsensitive(fs afero.Fs, dir string) bool {
+	if _, ok := fs.(*afero.OsFs); !ok {
+		return false
+	}
+	for p := path.Clean(dir); ; p = path.Dir(p) {
+		parent, base := path.Split(p)
+		swapped := swapCase(base)
+		if swapped != base {
+			original, err := os.Stat(filepath.FromSlash(p))
+			if err != nil {
+				return false
+			}
+			other, err := os.Stat(filepath.FromSlash(parent + swapped))
+			return err == nil && os.SameFile(original, other)
+		} else if path.Dir(p) == p {
+			return false
+		}
+	}
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if upper := unicode.ToUpper(r); upper != r {
+			return upper
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+// targetIsCaseInsensitive returns true if the target can't hold files whose
+// names differ only in case, according to the target_case config option or
+// by checking the filesystem.
+func (dfm *Dfm) targetIsCaseInsensitive() bool {
+	switch dfm.Config.targetCase {
+	case CaseSensitive:
+		return false
+	case CaseInsensitive:
+		return true
+	}
+	return isCaseInsensitive(dfm.fs, dfm.Config.targetPath)
+}
+
+// caseCollisions finds the relative paths which differ only in case from
+// another path in the list. The result maps each of them to the first other
+// path it collides with.
+func caseCollisions(relatives []string) map[string]string {
+	folded := make(map[string][]string, len(relatives))
+	for _, relative := range relatives {
+		key := strings.ToLower(relative)
+		folded[key] = append(folded[key], relative)
+	}
+	collisions := map[string]string{}
+	for _, group := range folded {
+		if len(group) < 2 {
+			continue
+		}
+		for i, relative := range group {
+			collisions[relative] = group[(i+1)%len(group)]
+		}
+	}
+	return collisions
+}
@@ -0,0 +1,123 @@
+package dfm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// permissionRule finds the mode required for the relative path by the
+// [permissions] table. When several patterns match, the longest one is used.
+// The returned mode is 0 if no pattern matches.
+func (dfm *Dfm) permissionRule(relative string) (os.FileMode, error) {
+	patterns := make([]string, 0, len(dfm.Config.permissions))
+	for pattern := range dfm.Config.permissions {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	for _, pattern := range patterns {
+		if !matchesPattern(pattern, relative) {
+			continue
+		}
+		value := dfm.Config.permissions[pattern]
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return 0, NewFileErrorf(relative, "invalid mode %#v for %#v in [permissions]", value, pattern)
+		}
+		return os.FileMode(mode), nil
+	}
+	return 0, nil
+}
+
+// permissionPath returns the file whose mode the [permissions] table applies
+// to. Links don't have a meaningful mode of their own, so for them the rule
+// applies to the repo file.
+func permissionPath(operation string, action Action) string {
+	if operation == OperationCopy {
+		return action.Destination
+	}
+	return action.Source
+}
+
+// fixPermissions applies the [permissions] rule to a file which was just
+// synced, logging OperationChmod if the mode had to be changed. In a dry run,
+// the change is only logged.
+func (dfm *Dfm) fixPermissions(operation string, action Action) {
+	if action.Type == ActionChmod {
+		// The mode was already set by the action.
+		return
+	}
+	mode, err := dfm.permissionRule(action.Relative)
+	if err == nil && mode == 0 {
+		return
+	}
+	if err == nil {
+		filename := permissionPath(operation, action)
+		if dfm.DryRun && operation == OperationCopy && action.Type != ActionNone {
+			// The copy wasn't made, but it would have had the mode of the
+			// repo file.
+			filename = action.Source
+		}
+		var stat os.FileInfo
+		if stat, err = dfm.fs.Stat(filename); err == nil {
+			if stat.Mode().Perm() == mode {
+				return
+			} else if !dfm.DryRun {
+				err = dfm.fs.Chmod(permissionPath(operation, action), stat.Mode()&^os.ModePerm|mode)
+			}
+		}
+		if err != nil {
+			err = WrapFileError(err, action.Relative)
+		}
+	}
+	dfm.logPaths(OperationChmod, action.Relative, action.Repo, action.Source, action.Destination, err)
+}
+
+// copyMode returns the mode a copy of the repo file should have. This is the
+// mode of the repo file, unless the [permissions] table has a rule for it.
+func (dfm *Dfm) copyMode(action Action) (os.FileMode, error) {
+	if mode, err := dfm.permissionRule(action.Relative); err == nil && mode != 0 {
+		return mode, nil
+	}
+	stat, err := dfm.fs.Stat(action.Source)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Mode().Perm(), nil
+}
+
+// copyModeChanged returns true if the mode of the copy doesn't match the repo
+// file, unless the ignore_modes option is set.
+func (dfm *Dfm) copyModeChanged(action Action) bool {
+	if dfm.Config.ignoreModes {
+		return false
+	}
+	mode, err := dfm.copyMode(action)
+	if err != nil {
+		return false
+	}
+	stat, err := dfm.fs.Stat(action.Destination)
+	return err == nil && stat.Mode().Perm() != mode
+}
+
+// checkPermissions describes how the file violates its [permissions] rule, or
+// returns "" if it doesn't.
+func (dfm *Dfm) checkPermissions(relative, filename string) string {
+	mode, err := dfm.permissionRule(relative)
+	if err != nil {
+		return err.(*FileError).Message
+	} else if mode == 0 {
+		return ""
+	}
+	stat, err := dfm.fs.Stat(filename)
+	if err != nil || stat.Mode().Perm() == mode {
+		return ""
+	}
+	return fmt.Sprintf("mode is %04o, should be %04o", stat.Mode().Perm(), mode)
+}
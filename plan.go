@@ -0,0 +1,1158 @@
+package dfm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// ActionNone means the target file is already up to date.
+	ActionNone = "none"
+	// ActionCreateLink means a link to the repo file will be created.
+	ActionCreateLink = "create-link"
+	// ActionCreateHardLink means a hard link to the repo file will be
+	// created.
+	ActionCreateHardLink = "create-hardlink"
+	// ActionCopy means the repo file will be copied to the target.
+	ActionCopy = "copy"
+	// ActionChmod means the target is an identical copy of the repo file, but
+	// its mode will be changed to match.
+	ActionChmod = "chmod"
+	// ActionReplaceFile means the existing target file will be removed, then
+	// linked or copied according to the operation being planned.
+	ActionReplaceFile = "replace-file"
+	// ActionRemove means the target file will be removed.
+	ActionRemove = "remove"
+	// ActionMkdir means a directory will be created in the target.
+	ActionMkdir = "mkdir"
+	// ActionRmdir means an empty directory will be removed from the target.
+	ActionRmdir = "rmdir"
+	// ActionForget means the file will no longer be tracked, but is left in
+	// the target because it was changed outside of dfm.
+	ActionForget = "forget"
+)
+
+const (
+	// ReasonNewFile means the target file does not exist yet.
+	ReasonNewFile = "new file"
+	// ReasonUpToDate means the target file does not need to be changed.
+	ReasonUpToDate = "already up to date"
+	// ReasonRepoChanged means the target file is a link to the same file in a
+	// different repo.
+	ReasonRepoChanged = "repo changed"
+	// ReasonDirMoved means the target file is a link to the source file at the
+	// place where the dfm directory used to be.
+	ReasonDirMoved = "dfm directory moved"
+	// ReasonReplaceLink means the target file is a link which will be replaced
+	// by a copy, or by a different kind of link.
+	ReasonReplaceLink = "replacing link"
+	// ReasonModeChanged means the target file is an identical copy with a
+	// different mode than the repo file.
+	ReasonModeChanged = "mode changed"
+	// ReasonIdenticalFile means the target file is not managed by dfm, but has
+	// the same contents as the repo file, so it will be replaced.
+	ReasonIdenticalFile = "identical file"
+	// ReasonFileExists means the target file exists and is not managed by dfm.
+	// The action will fail unless the existing file is removed.
+	ReasonFileExists = "file exists"
+	// ReasonRemovedFromRepo means the file is tracked but no longer provided
+	// by any repo.
+	ReasonRemovedFromRepo = "removed from repo"
+	// ReasonBrokenLink means the target file is an untracked link into the
+	// repos whose destination no longer exists.
+	ReasonBrokenLink = "broken link"
+	// ReasonNoLongerTracked means the file was explicitly removed.
+	ReasonNoLongerTracked = "no longer tracked"
+	// ReasonParentDirectory means the directory is needed to hold a file.
+	ReasonParentDirectory = "parent directory"
+	// ReasonEmptyDirectory means the directory will be empty after the
+	// planned removals.
+	ReasonEmptyDirectory = "empty directory"
+	// ReasonTargetMissing means the file is tracked, but neither the target
+	// nor any repo has it anymore, so there is nothing left to remove.
+	ReasonTargetMissing = "target missing"
+	// ReasonModifiedOutside means the target file is no longer a link into
+	// the repos, or a copy which matches what dfm last synced.
+	ReasonModifiedOutside = "modified outside dfm"
+)
+
+// Action is a single step dfm needs to take to bring the target directory up to
+// date.
+type Action struct {
+	// One of the Action constants
+	Type string `json:"action"`
+	// Path relative to the target directory
+	Relative string `json:"path"`
+	// The repo which provides the file, if any
+	Repo string `json:"repo,omitempty"`
+	// Absolute path to the file in the repo, if any
+	Source string `json:"source,omitempty"`
+	// Absolute path to the file in the target directory
+	Destination string `json:"destination"`
+	// One of the Reason constants
+	Reason string `json:"reason"`
+	// What the target file currently is, one of the State constants
+	State string `json:"state"`
+	// When set, the file is hard linked instead of symlinked
+	HardLink bool `json:"hard_link,omitempty"`
+	// When set, the file is copied instead of symlinked, because symlinks
+	// couldn't be created when it was first synced
+	Copy bool `json:"copy,omitempty"`
+	// Error encountered while checking the target, which will be reported
+	// when the action is applied.
+	Err error `json:"-"`
+	// Set when the file can't be synced no matter what is in the target, so
+	// retrying shouldn't plan the file again.
+	blocked bool
+}
+
+const (
+	// StateMissing means the target file does not exist.
+	StateMissing = "missing"
+	// StateLinked means the target file is a link to the source.
+	StateLinked = "linked"
+	// StateHardLinked means the target file is a hard link to the source.
+	StateHardLinked = "hardlinked"
+	// StateLink means the target file is a link to something other than the
+	// source.
+	StateLink = "link"
+	// StateFile means the target file exists and is not a link.
+	StateFile = "file"
+	// StateDirectory means the target is a directory.
+	StateDirectory = "directory"
+	// StateUnknown means the target could not be checked. The Err field of the
+	// action has the reason.
+	StateUnknown = "unknown"
+)
+
+// Plan is the ordered list of actions needed to perform an operation. Use
+// PlanLink or PlanCopy to create one, and Apply to perform it.
+type Plan struct {
+	// OperationLink or OperationCopy
+	Operation string
+	Actions   []Action
+	// Files which should be tracked after the plan is applied, in addition to
+	// the ones synced by the plan. Nil for partial syncs.
+	manifest map[string]bool
+	// Tracked files which are dropped from the manifest without touching the
+	// target, because another tracked file is stored in the same place
+	forget []string
+	// Directories which the plan has already created
+	createdDirs map[string]bool
+	// Logged for each synced file instead of Operation, if set
+	logOperation string
+}
+
+func newPlan(operation string) *Plan {
+	return &Plan{Operation: operation, createdDirs: map[string]bool{}}
+}
+
+// PlanLink returns the plan for linking all files in all repos and running the
+// autoclean, without modifying anything.
+func (dfm *Dfm) PlanLink() (*Plan, error) {
+	return dfm.planSync(OperationLink)
+}
+
+// PlanCopy returns the plan for copying all files in all repos and running the
+// autoclean, without modifying anything.
+func (dfm *Dfm) PlanCopy() (*Plan, error) {
+	return dfm.planSync(OperationCopy)
+}
+
+// PlanLinkFiles returns the plan for linking only the given files. The plan
+// does not remove anything.
+func (dfm *Dfm) PlanLinkFiles(inputFilenames []string) (*Plan, error) {
+	return dfm.planPartialSync(inputFilenames, OperationLink)
+}
+
+// PlanCopyFiles returns the plan for copying only the given files. The plan
+// does not remove anything.
+func (dfm *Dfm) PlanCopyFiles(inputFilenames []string) (*Plan, error) {
+	return dfm.planPartialSync(inputFilenames, OperationCopy)
+}
+
+// Changes returns the actions which would change something, or which would
+// fail. When there are none, the target is in sync.
+func (plan *Plan) Changes() []Action {
+	var changes []Action
+	for _, action := range plan.Actions {
+		if action.Type != ActionNone || action.Err != nil {
+			changes = append(changes, action)
+		}
+	}
+	return changes
+}
+
+// Apply performs every action in the plan and saves the updated manifest.
+// Actions which fail are passed to the errorHandler. In dry run mode, the
+// actions are only logged.
+func (dfm *Dfm) Apply(plan *Plan, errorHandler ErrorHandler) error {
+	return dfm.ApplyContext(context.Background(), plan, errorHandler)
+}
+
+// ApplyContext is Apply with support for cancellation. If the context is
+// canceled, the remaining actions are skipped and the context's error is
+// returned.
+func (dfm *Dfm) ApplyContext(ctx context.Context, plan *Plan, errorHandler ErrorHandler) error {
+	handleFile := dfm.handleLink
+	if plan.Operation == OperationCopy {
+		handleFile = dfm.handleCopy
+	}
+	return dfm.withHooks(plan.Operation, func() error {
+		err := dfm.applyPlan(ctx, plan, errorHandler, handleFile)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
+}
+
+// planSync lists all files to be synced and all tracked files which should be
+// removed.
+func (dfm *Dfm) planSync(operation string) (*Plan, error) {
+	if err := dfm.checkOnlyRepos(); err != nil {
+		return nil, err
+	}
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return nil, err
+	}
+	fileList, excluded := dfm.filterFileList(fileList)
+
+	plan := newPlan(operation)
+	dfm.planFiles(plan, fileList)
+	plan.manifest = make(map[string]bool, fileList.Len())
+	for _, relative := range fileList.Keys() {
+		plan.manifest[relative] = true
+	}
+	dfm.keepExcluded(plan.manifest, excluded)
+	dfm.planRemovals(plan, plan.manifest, ReasonRemovedFromRepo)
+	if dfm.PruneBroken {
+		if err := dfm.planBrokenLinks(plan); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// planPartialSync plans to sync the given files, without removing anything.
+func (dfm *Dfm) planPartialSync(inputFilenames []string, operation string) (*Plan, error) {
+	if err := dfm.checkOnlyRepos(); err != nil {
+		return nil, err
+	}
+	fileList, err := dfm.buildFileList(inputFilenames)
+	if err != nil {
+		return nil, err
+	}
+	fileList, _ = dfm.filterFileList(fileList)
+	plan := newPlan(operation)
+	dfm.planFiles(plan, fileList)
+	return plan, nil
+}
+
+// planFiles adds the actions to sync every file in the file list to the plan.
+// On a case-insensitive target, files whose names differ only in case would
+// overwrite each other, so they fail instead.
+func (dfm *Dfm) planFiles(plan *Plan, fileList *orderedFiles) {
+	defer dfm.addTime(phasePlan, dfm.timer())
+	var collisions map[string]string
+	if dfm.targetIsCaseInsensitive() {
+		collisions = caseCollisions(fileList.Keys())
+	}
+	for _, relative := range fileList.Keys() {
+		repo, _ := fileList.Get(relative)
+		action := dfm.planFile(plan.Operation, relative, repo)
+		if other, ok := collisions[action.Relative]; ok {
+			action.Err = NewFileErrorf(action.Relative, "differs only in case from %s, and the target is case-insensitive", other)
+			action.blocked = true
+		}
+		if repos, ok := dfm.shadowed[action.Relative]; ok && dfm.Config.conflicts == ConflictsError {
+			action.Err = conflictError(action.Relative, repos)
+			action.blocked = true
+		}
+		if dir := dfm.syncedAsFile(action.Relative); dir != "" {
+			// Creating the directory would go through the old link, into
+			// the repo.
+			action.Err = NewFileErrorf(action.Relative, "%s was synced as a whole, but the repo now has files inside it; sync again once it has been removed", dir)
+			action.blocked = true
+		}
+		if !action.blocked && (action.Type == ActionCreateLink || action.Type == ActionCreateHardLink || action.Type == ActionCopy) {
+			dfm.planDirectories(plan, path.Dir(action.Relative), action.Repo)
+		}
+		plan.Actions = append(plan.Actions, action)
+	}
+}
+
+// planFile decides what needs to happen to sync a single file from the given
+// repo, based on the current state of the target.
+func (dfm *Dfm) planFile(operation, relative, repo string) Action {
+	action := Action{
+		Type:        ActionCreateLink,
+		Relative:    relative,
+		Repo:        repo,
+		Source:      dfm.SourcePath(repo, relative),
+		Destination: dfm.TargetPath(relative),
+		Reason:      ReasonNewFile,
+	}
+	sourceIsDir, _ := afero.IsDir(dfm.fs, action.Source)
+	if operation == OperationCopy {
+		action.Type = ActionCopy
+		if sourceIsDir {
+			action.Err = NewFileError(relative, "directory is linked as a whole and cannot be copied")
+		}
+	} else if dfm.Config.copied[relative] {
+		action.Type = ActionCopy
+		action.Copy = true
+	} else if !sourceIsDir && dfm.useHardLink(relative, repo) {
+		action.Type = ActionCreateHardLink
+		action.HardLink = true
+	}
+	stat, err := lstat(dfm.fs, action.Destination)
+	if errors.Is(err, os.ErrNotExist) {
+		action.State = StateMissing
+		return action
+	} else if err != nil {
+		action.State = StateUnknown
+		action.Err = err
+		return action
+	}
+	linked, err := IsLinkedFile(dfm.fs, action.Source, action.Destination)
+	if err != nil {
+		action.State = StateUnknown
+		action.Err = err
+		return action
+	}
+	hardLinked := false
+	if !linked && stat.Mode().IsRegular() {
+		if hardLinked, err = IsHardLinkedFile(dfm.fs, action.Source, action.Destination); err != nil {
+			action.State = StateUnknown
+			action.Err = err
+			return action
+		}
+	}
+	switch {
+	case linked:
+		action.State = StateLinked
+	case hardLinked:
+		action.State = StateHardLinked
+	case stat.IsDir():
+		action.State = StateDirectory
+	case stat.Mode()&os.ModeSymlink != 0 || dfm.linkedRepo(relative) != "":
+		action.State = StateLink
+	default:
+		action.State = StateFile
+	}
+	switch {
+	case operation == OperationLink && (linked && !action.HardLink || hardLinked && action.HardLink):
+		action.Type = ActionNone
+		action.Reason = ReasonUpToDate
+	case linked || hardLinked:
+		// We allow copy to replace a link to its source file. This should
+		// only come up when ejecting, or when switching between symlinks
+		// and hard links.
+		action.Type = ActionReplaceFile
+		action.Reason = ReasonReplaceLink
+	case dfm.isMovedLink(repo, action.Source, action.Destination):
+		action.State = StateLink
+		action.Type = ActionReplaceFile
+		action.Reason = ReasonDirMoved
+	case dfm.Config.manifest[relative] && action.State == StateLink && dfm.linkedRepo(relative) != "":
+		// The file moved from one repo to another.
+		action.Type = ActionReplaceFile
+		action.Reason = ReasonRepoChanged
+	case (operation == OperationCopy || action.Copy) && action.State == StateFile && !sourceIsDir:
+		// An identical copy only needs its mode brought up to date.
+		identical, err := IsIdenticalFile(dfm.fs, action.Source, action.Destination)
+		switch {
+		case err != nil:
+			action.State = StateUnknown
+			action.Err = err
+		case !identical:
+			action.Reason = ReasonFileExists
+		case dfm.copyModeChanged(action):
+			action.Type = ActionChmod
+			action.Reason = ReasonModeChanged
+		default:
+			action.Type = ActionNone
+			action.Reason = ReasonUpToDate
+		}
+	case action.State == StateFile && !sourceIsDir:
+		// A file which is identical to the repo file can be replaced
+		// without losing anything.
+		identical, err := IsIdenticalFile(dfm.fs, action.Source, action.Destination)
+		switch {
+		case err != nil:
+			action.State = StateUnknown
+			action.Err = err
+		case identical:
+			action.Type = ActionReplaceFile
+			action.Reason = ReasonIdenticalFile
+		default:
+			action.Reason = ReasonFileExists
+		}
+	default:
+		action.Reason = ReasonFileExists
+		if action.State == StateDirectory && !(dfm.Force && dfm.ForceDirs) {
+			action.Err = NewFileError(relative, "target is a directory, refusing to replace it")
+		}
+	}
+	return action
+}
+
+// linkedRepo returns the configured repo that the target file is a link into,
+// or "" if there isn't one.
+func (dfm *Dfm) linkedRepo(relative string) string {
+	for _, repo := range dfm.Config.repos {
+		if dfm.isLinkedToRepo(repo, relative) {
+			return repo
+		}
+	}
+	return ""
+}
+
+// isMovedLink returns true if dest is a link to source as it was before the dfm
+// directory was moved. The old location is either listed in the
+// previous_paths config option, or inferred when the link is broken and ends
+// with the same repo and path as the source.
+func (dfm *Dfm) isMovedLink(repo, source, dest string) bool {
+	link, ok := readLink(dfm.fs, dest)
+	if !ok {
+		return false
+	}
+	link = NormalizePath(pathJoin(path.Dir(dest), link))
+	if link == source {
+		return false
+	}
+	// The part of the source path which stayed the same. Repos outside of
+	// the dfm directory keep their own name.
+	suffix, ok := RelativePath(dfm.Config.path, source)
+	if !ok {
+		suffix, _ = RelativePath(path.Dir(dfm.RepoPath(repo, "")), source)
+	}
+	for _, previous := range dfm.Config.previousPaths {
+		if link == pathJoin(previous, suffix) {
+			return true
+		}
+	}
+	if !strings.HasSuffix(link, "/"+suffix) {
+		return false
+	}
+	_, err := lstat(dfm.fs, link)
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// ownsTarget returns true if the tracked file in the target is still the one
+// dfm synced: a link into the dfm directory, one of its previous_paths, or one
+// of the repos, or a copy or hard link whose contents match the checksum
+// recorded when it was synced. A file which no longer exists is owned, since
+// removing it is harmless.
+func (dfm *Dfm) ownsTarget(relative string) bool {
+	switch dfm.fs.(type) {
+	case *afero.OsFs, *afero.MemMapFs:
+	default:
+		// Links can only be read on these filesystems.
+		return true
+	}
+	targetPath := dfm.TargetPath(relative)
+	stat, err := lstat(dfm.fs, targetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	} else if err != nil {
+		return false
+	}
+	if link, ok := readLink(dfm.fs, targetPath); ok {
+		link = pathJoin(path.Dir(targetPath), link)
+		if isInside(dfm.Config.path, link) {
+			return true
+		}
+		for _, previous := range dfm.Config.previousPaths {
+			if isInside(previous, link) {
+				return true
+			}
+		}
+		for _, repo := range dfm.Config.repos {
+			if isInside(dfm.RepoPath(repo, ""), link) {
+				return true
+			}
+		}
+		return false
+	} else if !stat.Mode().IsRegular() {
+		return false
+	}
+	expected, ok := dfm.Config.checksums[relative]
+	if !ok {
+		return false
+	}
+	actual, err := fileChecksum(dfm.fs, targetPath)
+	return err == nil && actual == expected
+}
+
+// recordChecksum remembers the contents of the copy or hard link at
+// targetPath, so that ownsTarget can tell whether it was changed later.
+func (dfm *Dfm) recordChecksum(relative, targetPath string) {
+	if checksum, err := fileChecksum(dfm.fs, targetPath); err == nil {
+		dfm.Config.checksums[relative] = checksum
+	}
+}
+
+// targetState returns the State of a tracked file in the target.
+func (dfm *Dfm) targetState(relative string) string {
+	stat, err := lstat(dfm.fs, dfm.TargetPath(relative))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return StateMissing
+	case err != nil:
+		return StateUnknown
+	case stat.IsDir():
+		return StateDirectory
+	case stat.Mode()&os.ModeSymlink != 0 || dfm.linkedRepo(relative) != "":
+		return StateLink
+	}
+	return StateFile
+}
+
+// syncedAsFile returns the parent directory of relative which is tracked as a
+// single file and is still not a directory in the target, if there is one.
+// This happens when a file in the repo is replaced by a directory.
+func (dfm *Dfm) syncedAsFile(relative string) string {
+	for dir := path.Dir(relative); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if !dfm.Config.manifest[dir] {
+			continue
+		}
+		if stat, err := lstat(dfm.fs, dfm.TargetPath(dir)); err == nil && !stat.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// planDirectories adds an action to create each missing directory in the
+// target, from the top down.
+func (dfm *Dfm) planDirectories(plan *Plan, dir, repo string) {
+	if dir == "." || dir == "/" || plan.createdDirs[dir] {
+		return
+	}
+	dfm.planDirectories(plan, path.Dir(dir), repo)
+	if _, err := dfm.fs.Stat(dfm.TargetPath(dir)); err == nil {
+		return
+	}
+	plan.createdDirs[dir] = true
+	plan.Actions = append(plan.Actions, Action{
+		Type:        ActionMkdir,
+		Relative:    dir,
+		Repo:        repo,
+		Source:      dfm.RepoPath(repo, dir),
+		Destination: dfm.TargetPath(dir),
+		Reason:      ReasonParentDirectory,
+		State:       StateMissing,
+	})
+}
+
+// planRemovals adds an action to remove every tracked file which is not listed
+// in nextManifest, followed by actions to remove the directories which would
+// be left empty.
+func (dfm *Dfm) planRemovals(plan *Plan, nextManifest map[string]bool, reason string) {
+	defer dfm.addTime(phasePlan, dfm.timer())
+	// On a case-insensitive target, a file which was renamed to change only
+	// its case is the same file as the one which replaces it.
+	var kept map[string]bool
+	if dfm.targetIsCaseInsensitive() {
+		kept = make(map[string]bool, len(nextManifest))
+		for filename := range nextManifest {
+			kept[strings.ToLower(filename)] = true
+		}
+	}
+	var toRemove []string
+	for filename := range dfm.Config.manifest {
+		if nextManifest[filename] || insideTrackedDir(nextManifest, filename) {
+			continue
+		} else if kept[strings.ToLower(filename)] {
+			plan.forget = append(plan.forget, filename)
+			continue
+		}
+		toRemove = append(toRemove, filename)
+	}
+	sort.Strings(toRemove)
+	if reason == ReasonRemovedFromRepo {
+		// Files which were already removed by hand only need to be
+		// dropped from the manifest.
+		existing := toRemove[:0]
+		for _, filename := range toRemove {
+			if dfm.targetState(filename) != StateMissing {
+				existing = append(existing, filename)
+				continue
+			}
+			plan.Actions = append(plan.Actions, Action{
+				Type:        ActionForget,
+				Relative:    filename,
+				Destination: dfm.TargetPath(filename),
+				Reason:      ReasonTargetMissing,
+				State:       StateMissing,
+			})
+		}
+		toRemove = existing
+	}
+	if reason == ReasonRemovedFromRepo && !dfm.Force {
+		// The user may have replaced the file since it was synced, so the
+		// autoclean only removes files which dfm still owns.
+		owned := toRemove[:0]
+		for _, filename := range toRemove {
+			if dfm.ownsTarget(filename) {
+				owned = append(owned, filename)
+				continue
+			}
+			plan.Actions = append(plan.Actions, Action{
+				Type:        ActionForget,
+				Relative:    filename,
+				Destination: dfm.TargetPath(filename),
+				Reason:      ReasonModifiedOutside,
+				State:       dfm.targetState(filename),
+			})
+		}
+		toRemove = owned
+	}
+	// Directories which will hold files after the plan is applied can't be
+	// removed, even if they are currently empty.
+	needed := map[string]bool{}
+	for _, action := range plan.Actions {
+		for dir := path.Dir(action.Relative); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			needed[dir] = true
+		}
+	}
+	removed := make(map[string]bool, len(toRemove))
+	dirs := map[string]bool{}
+	for _, filename := range toRemove {
+		plan.Actions = append(plan.Actions, Action{
+			Type:        ActionRemove,
+			Relative:    filename,
+			Destination: dfm.TargetPath(filename),
+			Reason:      reason,
+			State:       dfm.targetState(filename),
+		})
+		removed[filename] = true
+		for dir := path.Dir(filename); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// Visit the deepest directories first, so that a directory which only
+	// contains empty directories is removed as well.
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Slice(sortedDirs, func(i, j int) bool {
+		di, dj := strings.Count(sortedDirs[i], "/"), strings.Count(sortedDirs[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return sortedDirs[i] < sortedDirs[j]
+	})
+	for _, dir := range sortedDirs {
+		if needed[dir] {
+			continue
+		}
+		entries, err := afero.ReadDir(dfm.fs, dfm.TargetPath(dir))
+		if err != nil {
+			continue
+		}
+		empty := true
+		for _, entry := range entries {
+			if !removed[pathJoin(dir, entry.Name())] {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			removed[dir] = true
+			plan.Actions = append(plan.Actions, Action{
+				Type:        ActionRmdir,
+				Relative:    dir,
+				Destination: dfm.TargetPath(dir),
+				Reason:      ReasonEmptyDirectory,
+				State:       StateDirectory,
+			})
+		}
+	}
+}
+
+// planBrokenLinks adds an action to remove every link in the target directory
+// which points into the dfm directory or one of the repos, but whose
+// destination no longer exists. These are usually left behind by files which
+// were removed from a repo when the manifest didn't know about them. Links
+// which point anywhere else are never touched, and neither are files which
+// the plan already has an action for.
+func (dfm *Dfm) planBrokenLinks(plan *Plan) error {
+	planned := make(map[string]bool, len(plan.Actions))
+	for _, action := range plan.Actions {
+		planned[action.Relative] = true
+	}
+	var broken []string
+	err := dfm.walkTargetLinks(func(relative, link string) {
+		if planned[relative] || !dfm.isInsideRepos(link) {
+			return
+		} else if _, err := lstat(dfm.fs, link); errors.Is(err, os.ErrNotExist) {
+			broken = append(broken, relative)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, relative := range broken {
+		plan.Actions = append(plan.Actions, Action{
+			Type:        ActionRemove,
+			Relative:    relative,
+			Destination: dfm.TargetPath(relative),
+			Reason:      ReasonBrokenLink,
+			State:       StateLink,
+		})
+	}
+	return nil
+}
+
+// insideTrackedDir returns true if any parent directory of the relative path is
+// in the manifest, meaning that the directory is linked as a whole. Removing
+// the file would remove it from the repo through the directory link, so it is
+// only removed from the manifest.
+func insideTrackedDir(manifest map[string]bool, relative string) bool {
+	for dir := path.Dir(relative); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if manifest[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// planChangedSync plans syncing the given paths after they changed in the
+// repos. Unlike planPartialSync, paths don't need to exist in any repo: tracked
+// files under the paths which are no longer provided by any repo are removed.
+func (dfm *Dfm) planChangedSync(inputFilenames []string, operation string) (*Plan, error) {
+	if err := dfm.checkOnlyRepos(); err != nil {
+		return nil, err
+	}
+	fileList := newOrderedFiles()
+	for _, path := range inputFilenames {
+		for _, repo := range dfm.Config.repos {
+			err := dfm.populateRepoFileList(repo, path, fileList)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	fileList, excluded := dfm.filterFileList(sortFileList(fileList))
+	plan := newPlan(operation)
+	dfm.planFiles(plan, fileList)
+
+	nextManifest := make(map[string]bool, len(dfm.Config.manifest))
+	for filename := range dfm.Config.manifest {
+		changed := false
+		for _, path := range inputFilenames {
+			// A changed variant changes the file it provides.
+			path, _ = splitVariant(path)
+			if path == "." || filename == path || strings.HasPrefix(filename, path+"/") {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			nextManifest[filename] = true
+		}
+	}
+	for _, relative := range fileList.Keys() {
+		nextManifest[relative] = true
+	}
+	dfm.keepExcluded(nextManifest, excluded)
+	dfm.planRemovals(plan, nextManifest, ReasonRemovedFromRepo)
+	return plan, nil
+}
+
+// runChangedSync applies planChangedSync.
+func (dfm *Dfm) runChangedSync(
+	ctx context.Context,
+	inputFilenames []string,
+	errorHandler ErrorHandler,
+	operation string,
+	handleFile func(s, d string) error,
+) error {
+	return dfm.withHooks(operation, func() error {
+		plan, err := dfm.planChangedSync(inputFilenames, operation)
+		if err != nil {
+			return err
+		}
+		err = dfm.applyPlan(ctx, plan, errorHandler, handleFile)
+		if saveErr := dfm.saveConfig(); saveErr != nil {
+			return saveErr
+		}
+		return err
+	})
+}
+
+// applyPlan performs every action in the plan, using handleFile to create the
+// synced files, and updates the manifest. If the errorHandler aborts or the
+// context is canceled, the remaining actions are not performed. The manifest
+// then contains all previously tracked files which were not removed, plus all
+// files which were synced.
+func (dfm *Dfm) applyPlan(
+	ctx context.Context,
+	plan *Plan,
+	errorHandler ErrorHandler,
+	handleFile func(s, d string) error,
+) error {
+	if err := dfm.confirmRemovals(plan); err != nil {
+		return err
+	}
+	// Directories are created first, so that files can be synced in
+	// parallel.
+	var fileActions []Action
+	for _, action := range plan.Actions {
+		switch action.Type {
+		case ActionMkdir:
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			attempt := fileAttempt{plan.Operation, action.Repo, action.Source, action.Destination}
+			_, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, func() *FileError {
+				if err := dfm.applyAction(action, handleFile); err != nil {
+					return WrapFileError(err, action.Relative)
+				}
+				return nil
+			})
+			if abort {
+				return fileErr
+			} else if fileErr != nil {
+				dfm.logPaths(OperationSkip, action.Relative, action.Repo, action.Source, action.Destination, fileErr)
+			}
+		case ActionRemove, ActionRmdir, ActionForget:
+		default:
+			fileActions = append(fileActions, action)
+		}
+	}
+
+	if err := dfm.applyFileActions(ctx, plan, fileActions, errorHandler, handleFile); err != nil {
+		return err
+	}
+
+	defer dfm.addTime(phaseAutoclean, dfm.timer())
+	for _, action := range plan.Actions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch action.Type {
+		case ActionRmdir:
+			dfm.applyAction(action, handleFile)
+		case ActionRemove:
+			err := dfm.applyAction(action, handleFile)
+			dfm.logPaths(OperationRemove, action.Relative, "", "", action.Destination, err)
+			if err == nil || errors.Is(err, os.ErrNotExist) {
+				delete(dfm.Config.manifest, action.Relative)
+			}
+		case ActionForget:
+			if action.Reason == ReasonTargetMissing {
+				dfm.log(OperationPrune, action.Relative, "", nil)
+			} else {
+				dfm.log(OperationSkip, action.Relative, "", WrapFileError(ErrModifiedOutside, action.Relative))
+			}
+			delete(dfm.Config.manifest, action.Relative)
+		}
+	}
+	for _, filename := range plan.forget {
+		delete(dfm.Config.manifest, filename)
+	}
+	for filename := range plan.manifest {
+		dfm.Config.manifest[filename] = true
+	}
+	// Files inside of a directory which is linked as a whole are tracked as
+	// part of the directory.
+	for filename := range dfm.Config.manifest {
+		if insideTrackedDir(dfm.Config.manifest, filename) {
+			delete(dfm.Config.manifest, filename)
+		}
+	}
+	return nil
+}
+
+// confirmRemovals checks that the autoclean in the plan doesn't remove more
+// files than the autoclean limit, unless ConfirmRemovals allows it. A typo in
+// the repos list would otherwise remove every tracked file at once. In dry run
+// mode, the removals are logged after a warning instead.
+func (dfm *Dfm) confirmRemovals(plan *Plan) error {
+	limit := dfm.Config.AutocleanLimit()
+	if limit < 0 {
+		return nil
+	}
+	var files []string
+	for _, action := range plan.Actions {
+		if action.Type == ActionRemove && action.Reason == ReasonRemovedFromRepo {
+			files = append(files, action.Relative)
+		}
+	}
+	if len(files) <= limit {
+		return nil
+	}
+	err := &TooManyRemovalsError{Files: files, Limit: limit}
+	if dfm.DryRun {
+		dfm.log(OperationWarning, "", "", err)
+		return nil
+	} else if dfm.ConfirmRemovals != nil && dfm.ConfirmRemovals(files) {
+		return nil
+	}
+	return err
+}
+
+// fileResult is the outcome of syncing a single file.
+type fileResult struct {
+	skip, abort bool
+	err         error
+	// The file was copied because symlinks couldn't be created.
+	fallback bool
+	// Checksum of the synced copy or hard link, if it is one.
+	checksum string
+	// OperationOverwrite or OperationBackup, if a file was in the way.
+	cleared string
+	// The file was not attempted because the sync was aborted or canceled.
+	notRun bool
+	// How long the file took to sync, when Timing is set
+	elapsed time.Duration
+}
+
+// applyFileActions syncs the files using up to dfm.Jobs workers. Results are
+// logged and added to the manifest in the same order as the actions, and the
+// errorHandler is never called concurrently. When the errorHandler aborts or
+// the context is canceled, no more files are started, but the files already
+// in progress are finished and logged.
+func (dfm *Dfm) applyFileActions(
+	ctx context.Context,
+	plan *Plan,
+	actions []Action,
+	errorHandler ErrorHandler,
+	handleFile func(s, d string) error,
+) error {
+	operation := plan.Operation
+	var aborted int32
+	stopped := func() bool {
+		return atomic.LoadInt32(&aborted) != 0 || ctx.Err() != nil
+	}
+	apply := func(action Action, errorHandler ErrorHandler) fileResult {
+		result := dfm.applyFileAction(ctx, operation, action, errorHandler, handleFile)
+		if result.abort {
+			atomic.StoreInt32(&aborted, 1)
+		}
+		return result
+	}
+	next := func(i int) fileResult {
+		if stopped() {
+			return fileResult{notRun: true}
+		}
+		return apply(actions[i], errorHandler)
+	}
+
+	if dfm.Jobs > 1 {
+		var handlerLock sync.Mutex
+		lockedHandler := func(err *FileError) error {
+			handlerLock.Lock()
+			defer handlerLock.Unlock()
+			return errorHandler(err)
+		}
+		results := make([]chan fileResult, len(actions))
+		for i := range results {
+			results[i] = make(chan fileResult, 1)
+		}
+		workers := make(chan struct{}, dfm.Jobs)
+		go func() {
+			for i, action := range actions {
+				workers <- struct{}{}
+				if stopped() {
+					<-workers
+					results[i] <- fileResult{notRun: true}
+					continue
+				}
+				go func(i int, action Action) {
+					results[i] <- apply(action, lockedHandler)
+					<-workers
+				}(i, action)
+			}
+		}()
+		next = func(i int) fileResult {
+			return <-results[i]
+		}
+	}
+
+	var overallErr error
+	var synced, fallbacks []string
+	for i, action := range actions {
+		result := next(i)
+		if result.notRun {
+			if overallErr == nil {
+				overallErr = ctx.Err()
+			}
+			continue
+		}
+		// Even if there is an error, we don't want autoclean to remove
+		// this file.
+		synced = append(synced, action.Relative)
+		if result.abort {
+			if overallErr == nil {
+				overallErr = result.err
+			}
+			continue
+		}
+		if result.cleared == OperationBackup {
+			dfm.logPaths(result.cleared, action.Relative, "", action.Destination, dfm.BackupPath(action.Relative), nil)
+		} else if result.cleared != "" {
+			dfm.logPaths(result.cleared, action.Relative, "", "", action.Destination, nil)
+		}
+		fileOperation := operation
+		if plan.logOperation != "" {
+			fileOperation = plan.logOperation
+		}
+		if result.skip && !(fileOperation == OperationEject && IsNotNeeded(result.err)) {
+			fileOperation = OperationSkip
+		} else if action.Type == ActionChmod {
+			fileOperation = OperationChmod
+		} else if result.fallback {
+			dfm.log(OperationWarning, action.Relative, action.Repo, NewFileError(action.Relative, "symlinks can't be created here, so the file was copied instead"))
+			fallbacks = append(fallbacks, action.Relative)
+			fileOperation = OperationCopy
+		}
+		dfm.logPaths(fileOperation, action.Relative, action.Repo, action.Source, action.Destination, result.err)
+		dfm.addFileTime(action.Relative, result.elapsed)
+		if result.err == nil || IsNotNeeded(result.err) {
+			dfm.fixPermissions(operation, action)
+			if result.checksum != "" {
+				dfm.Config.checksums[action.Relative] = result.checksum
+			} else if !dfm.DryRun {
+				delete(dfm.Config.checksums, action.Relative)
+			}
+		}
+		if dfm.Progress != nil {
+			dfm.Progress(i+1, len(actions))
+		}
+	}
+	// All workers are finished, so the manifest and the copies can be
+	// updated. Workers which retry a file read the copies while planning it.
+	for _, relative := range synced {
+		dfm.Config.manifest[relative] = true
+	}
+	for _, relative := range fallbacks {
+		dfm.Config.copied[relative] = true
+	}
+	return overallErr
+}
+
+// applyFileAction syncs a single file, retrying as requested by the
+// errorHandler.
+func (dfm *Dfm) applyFileAction(
+	ctx context.Context,
+	operation string,
+	action Action,
+	errorHandler ErrorHandler,
+	handleFile func(s, d string) error,
+) fileResult {
+	start := dfm.timer()
+	attempted := false
+	fallback := false
+	cleared := ""
+	attempt := fileAttempt{operation, action.Repo, action.Source, action.Destination}
+	skip, abort, fileErr := processWithRetry(ctx, errorHandler, attempt, dfm.withForce(func() *FileError {
+		if attempted && !action.blocked {
+			// The error handler may have changed the target, so decide
+			// again what needs to be done.
+			action = dfm.planFile(operation, action.Relative, action.Repo)
+		}
+		attempted = true
+		rawErr := dfm.applyAction(action, handleFile)
+		if operation == OperationLink && dfm.useLinkFallback() && isSymlinkUnsupported(rawErr) {
+			// Any file being replaced was already removed.
+			action.Type = ActionCopy
+			action.Copy = true
+			rawErr = dfm.applyAction(action, handleFile)
+			fallback = rawErr == nil
+		}
+		if rawErr == nil {
+			return nil
+		}
+		return WrapFileError(rawErr, action.Relative)
+	}, &cleared))
+	result := fileResult{skip: skip, abort: abort, err: fileErr, fallback: fallback, cleared: cleared}
+	copied := operation == OperationCopy || action.Copy || action.HardLink
+	if copied && !dfm.DryRun && (fileErr == nil || IsNotNeeded(fileErr)) {
+		// Copies are checked here, since the workers run in parallel.
+		result.checksum, _ = fileChecksum(dfm.fs, action.Destination)
+	}
+	if dfm.Timing {
+		result.elapsed = time.Since(start)
+	}
+	return result
+}
+
+// applyAction performs a single action. In dry run mode, this only reports the
+// errors that were found while planning.
+func (dfm *Dfm) applyAction(action Action, handleFile func(s, d string) error) error {
+	if action.Err != nil {
+		return action.Err
+	} else if action.Type == ActionNone {
+		return ErrNotNeeded
+	} else if dfm.DryRun && action.Reason == ReasonFileExists {
+		// Report the error which syncing the file would run into.
+		return &os.PathError{Op: action.Type, Path: action.Destination, Err: syscall.EEXIST}
+	} else if dfm.DryRun {
+		return nil
+	}
+	switch action.Type {
+	case ActionMkdir:
+		return MakeDirAll(dfm.fs, action.Relative, dfm.RepoPath(action.Repo, ""), dfm.Config.targetPath)
+	case ActionRmdir:
+		// A removal may have failed, so only remove directories which are
+		// actually empty.
+		entries, err := afero.ReadDir(dfm.fs, action.Destination)
+		if err != nil || len(entries) > 0 {
+			return err
+		}
+		return dfm.fs.Remove(action.Destination)
+	case ActionRemove:
+		return dfm.removeFile(action.Relative, action.Destination)
+	case ActionChmod:
+		mode, err := dfm.copyMode(action)
+		if err != nil {
+			return err
+		}
+		return dfm.fs.Chmod(action.Destination, mode)
+	case ActionReplaceFile:
+		if action.Reason == ReasonDirMoved || action.Reason == ReasonRepoChanged {
+			// Create the new file next to the old link and rename it over
+			// the link, so the file is never missing.
+			temp := action.Destination + ".dfm-new"
+			if err := RemoveFile(dfm.fs, temp); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			if err := dfm.createFile(action, handleFile, temp); err != nil {
+				return err
+			}
+			return dfm.fs.Rename(temp, action.Destination)
+		}
+		if err := RemoveFile(dfm.fs, action.Destination); err != nil {
+			return err
+		}
+	}
+	return dfm.createFile(action, handleFile, action.Destination)
+}
+
+// createFile creates the synced file for the action at dest.
+func (dfm *Dfm) createFile(action Action, handleFile func(s, d string) error, dest string) error {
+	if action.HardLink {
+		return HardLinkFile(dfm.fs, action.Source, dest)
+	} else if action.Copy {
+		return dfm.handleCopy(action.Source, dest)
+	}
+	return handleFile(action.Source, dest)
+}
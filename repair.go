@@ -0,0 +1,83 @@
+package dfm
+
+import (
+	"context"
+	"sort"
+)
+
+// Repair brings every tracked file back in line with the repo which provides
+// it, making the smallest change that fixes it: links into the wrong repo or
+// into the old location of the dfm directory are pointed at the right file,
+// and missing links and copies are created again. Files whose problems need a
+// human decision, like copies which were modified in the target or regular
+// files in the way of a link, are left alone and returned instead, sorted by
+// path. Tracked files which no repo provides anymore are left for autoclean.
+func (dfm *Dfm) Repair(errorHandler ErrorHandler) ([]*FileError, error) {
+	return dfm.RepairContext(context.Background(), errorHandler)
+}
+
+// RepairContext is Repair with support for cancellation. If the context is
+// canceled, no more files are repaired and the context's error is returned.
+func (dfm *Dfm) RepairContext(ctx context.Context, errorHandler ErrorHandler) ([]*FileError, error) {
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return nil, err
+	}
+	tracked := manifestToConfig(dfm.Config.manifest)
+	sort.Strings(tracked)
+	var problems []*FileError
+	linked, copied := newOrderedFiles(), newOrderedFiles()
+	for _, relative := range tracked {
+		repo, ok := fileList.Get(relative)
+		if !ok {
+			continue
+		}
+		operation, files := OperationLink, linked
+		if dfm.isCopy(relative, repo) {
+			operation, files = OperationCopy, copied
+		}
+		action := dfm.planFile(operation, relative, repo)
+		if problem := repairProblem(action); problem != nil {
+			problems = append(problems, problem)
+		} else if action.Type != ActionNone {
+			files.Set(relative, repo)
+		}
+	}
+
+	linkPlan := newPlan(OperationLink)
+	dfm.planFiles(linkPlan, linked)
+	err = dfm.applyPlan(ctx, linkPlan, errorHandler, dfm.handleLink)
+	if err == nil {
+		copyPlan := newPlan(OperationCopy)
+		dfm.planFiles(copyPlan, copied)
+		err = dfm.applyPlan(ctx, copyPlan, errorHandler, dfm.handleCopy)
+	}
+	if saveErr := dfm.saveConfig(); saveErr != nil {
+		return problems, saveErr
+	}
+	return problems, err
+}
+
+// repairProblem returns the reason a planned action can't be applied by
+// Repair, or nil if it can.
+func repairProblem(action Action) *FileError {
+	if action.Err != nil {
+		return WrapFileError(action.Err, action.Relative)
+	}
+	switch action.Type {
+	case ActionNone, ActionChmod, ActionCreateLink, ActionCreateHardLink, ActionCopy:
+		if action.Reason != ReasonFileExists {
+			return nil
+		}
+	case ActionReplaceFile:
+		return nil
+	}
+	switch action.State {
+	case StateLink:
+		return NewFileError(action.Relative, "links to a file outside of dfm")
+	case StateDirectory:
+		return NewFileError(action.Relative, "target is a directory")
+	default:
+		return NewFileError(action.Relative, "modified outside dfm")
+	}
+}
@@ -0,0 +1,70 @@
+package dfm
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// walkTargetLinks calls fn with every link in the target directory, and the
+// absolute path the link points to. The dfm directory and the repos are
+// skipped, as well as directories matching Exclude and directories which
+// can't be read. Linked directories are not followed.
+func (dfm *Dfm) walkTargetLinks(fn func(relative, link string)) error {
+	root := dfm.Config.targetPath
+	return afero.Walk(dfm.fs, root, func(filename string, info os.FileInfo, err error) error {
+		// The walk uses the separator of the operating system.
+		filename = filepath.ToSlash(filename)
+		relative, _ := RelativePath(root, filename)
+		relative = NormalizePath(relative)
+		if err != nil {
+			// Directories which can't be read can't hold links dfm made.
+			if info != nil && info.IsDir() && filename != root {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if info.IsDir() {
+			if filename != root && (dfm.isInsideRepos(filename) || dfm.isExcluded(relative)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if link, ok := readLink(dfm.fs, filename); ok {
+			fn(relative, pathJoin(path.Dir(filename), link))
+		}
+		return nil
+	})
+}
+
+// TrackExistingLinks adds every untracked link in the target directory which
+// dfm would have made, pointing to the file one of the repos provides at the
+// same path, to the manifest, and returns their relative paths. This rebuilds the manifest
+// after the config file was lost, so that the autoclean works again without
+// syncing anything. Links which point anywhere else are ignored. Nothing in
+// the target directory is changed.
+func (dfm *Dfm) TrackExistingLinks() ([]string, error) {
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return nil, err
+	}
+	var tracked []string
+	err = dfm.walkTargetLinks(func(relative, link string) {
+		if dfm.Config.manifest[relative] {
+			return
+		} else if _, ok := fileList.Get(relative); !ok || dfm.linkedRepo(relative) == "" {
+			return
+		} else if _, err := dfm.fs.Stat(link); err != nil {
+			return
+		}
+		tracked = append(tracked, relative)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, relative := range tracked {
+		dfm.Config.manifest[relative] = true
+	}
+	return tracked, dfm.saveConfig()
+}
@@ -0,0 +1,87 @@
+package dfm
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// SensitiveBlock means AddFiles refuses to add matching files, unless
+	// AllowSensitive is set.
+	SensitiveBlock = "block"
+	// SensitiveWarn means AddFiles adds matching files, but logs a warning.
+	SensitiveWarn = "warn"
+	// SensitiveAllow means matching files are not sensitive. This is used to
+	// disable one of the default patterns.
+	SensitiveAllow = "allow"
+)
+
+// defaultSensitive are the patterns of files which usually hold secrets. The
+// [sensitive] config table can override them.
+var defaultSensitive = map[string]string{
+	".ssh/id_*":        SensitiveBlock,
+	".aws/credentials": SensitiveBlock,
+	".netrc":           SensitiveBlock,
+	"*_history":        SensitiveBlock,
+	".gnupg/*":         SensitiveBlock,
+}
+
+// matchesSensitive returns true if the sensitive pattern matches the relative
+// path. Patterns without a slash match the name of the file in any directory,
+// like in gitignore files.
+func matchesSensitive(pattern, relative string) bool {
+	if !strings.Contains(pattern, "/") {
+		if matched, _ := path.Match(pattern, path.Base(relative)); matched {
+			return true
+		}
+	}
+	return matchesPattern(pattern, relative)
+}
+
+// sensitiveMatch returns the pattern which marks the file as sensitive, and
+// whether the file should be blocked or only warned about. The action is ""
+// if the file is not sensitive. When several patterns match, the most
+// restrictive one is used. Unknown actions are treated as SensitiveBlock.
+func (dfm *Dfm) sensitiveMatch(relative string) (string, string) {
+	rules := make(map[string]string, len(defaultSensitive)+len(dfm.Config.sensitive))
+	for pattern, action := range defaultSensitive {
+		rules[pattern] = action
+	}
+	for pattern, action := range dfm.Config.sensitive {
+		rules[pattern] = action
+	}
+	patterns := make([]string, 0, len(rules))
+	for pattern := range rules {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	var matchedPattern, matchedAction string
+	for _, pattern := range patterns {
+		action := rules[pattern]
+		if action == SensitiveAllow || !matchesSensitive(pattern, relative) {
+			continue
+		}
+		if action != SensitiveWarn {
+			action = SensitiveBlock
+		}
+		if matchedAction == "" || (action == SensitiveBlock && matchedAction != SensitiveBlock) {
+			matchedPattern, matchedAction = pattern, action
+		}
+	}
+	return matchedPattern, matchedAction
+}
+
+// checkSensitive returns an error if the file should not be added because it
+// probably holds secrets. Files which are only warned about are logged.
+func (dfm *Dfm) checkSensitive(relative, repo string) error {
+	pattern, action := dfm.sensitiveMatch(relative)
+	switch {
+	case action == "":
+		return nil
+	case action == SensitiveBlock && !dfm.AllowSensitive:
+		return NewFileErrorf(relative, "refusing to add a file which may contain secrets (matches %#v). To add it anyway, use --allow-sensitive, or set the pattern to \"warn\" in the [sensitive] table of the config", pattern)
+	}
+	dfm.log(OperationWarning, relative, repo, NewFileErrorf(relative, "this file may contain secrets (matches %#v)", pattern))
+	return nil
+}
@@ -0,0 +1,66 @@
+package dfm
+
+// Stats summarizes the setup, see Dfm.Stats.
+type Stats struct {
+	// Number of files each repo provides, in the same order as the repos.
+	// Files which are overridden by another repo are not counted.
+	Repos []RepoStats `json:"repos"`
+	// Number of files in the manifest
+	Tracked int `json:"tracked"`
+	// Number of tracked files which are synced as links, including hard
+	// links
+	Links int `json:"links"`
+	// Number of tracked files which are synced as copies
+	Copies int `json:"copies"`
+	// Number of files which are not up to date, including files which could
+	// not be checked
+	OutOfSync int `json:"out_of_sync"`
+	// Total size of the copies in the target directory
+	CopiedBytes int64 `json:"copied_bytes"`
+}
+
+// RepoStats is the number of files provided by a single repo.
+type RepoStats struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+}
+
+// Stats gathers an overview of every repo and tracked file, using the same
+// checks as Status. Stats does not modify the filesystem or the manifest.
+func (dfm *Dfm) Stats() (*Stats, error) {
+	statuses, err := dfm.Status(nil)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Tracked: len(dfm.Config.manifest)}
+	files := map[string]int{}
+	for _, status := range statuses {
+		if status.Repo != "" {
+			files[status.Repo]++
+		}
+		switch {
+		case status.Err != nil:
+			stats.OutOfSync++
+		case status.State == StatusLinked:
+			if dfm.Config.manifest[status.Relative] {
+				stats.Links++
+			}
+		case status.State == StatusCopiedIdentical || status.State == StatusCopiedModified:
+			if dfm.Config.manifest[status.Relative] {
+				stats.Copies++
+				if stat, err := dfm.fs.Stat(status.TargetPath); err == nil {
+					stats.CopiedBytes += stat.Size()
+				}
+			}
+			if status.State == StatusCopiedModified {
+				stats.OutOfSync++
+			}
+		default:
+			stats.OutOfSync++
+		}
+	}
+	for _, repo := range dfm.Config.repos {
+		stats.Repos = append(stats.Repos, RepoStats{Name: repo, Files: files[repo]})
+	}
+	return stats, nil
+}
@@ -0,0 +1,149 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// StatusLinked means the target file is a link to the repo file.
+	StatusLinked = "linked"
+	// StatusCopiedIdentical means the target file is a copy of the repo file
+	// with the same contents.
+	StatusCopiedIdentical = "copied-identical"
+	// StatusCopiedModified means the target file is a tracked copy of the repo
+	// file, but the contents have changed.
+	StatusCopiedModified = "copied-modified"
+	// StatusMissing means the repo file has not been synced to the target.
+	StatusMissing = "missing"
+	// StatusConflict means the target file exists but is not managed by dfm.
+	StatusConflict = "conflict"
+	// StatusOrphaned means the file is tracked but no repo provides it anymore,
+	// so the next sync will remove it.
+	StatusOrphaned = "orphaned"
+)
+
+// FileStatus describes the state of a single file in the target directory.
+type FileStatus struct {
+	// Path relative to the target directory
+	Relative string `json:"path"`
+	// The repo which provides the file, or "" if the file is orphaned
+	Repo string `json:"repo,omitempty"`
+	// Absolute path to the file in the target directory
+	TargetPath string `json:"target"`
+	// One of the Status constants
+	State string `json:"state"`
+	// Describes how the file violates its rule in the [permissions] table,
+	// if it does.
+	PermissionProblem string `json:"permission_problem,omitempty"`
+	// Error encountered while checking the file. State is not meaningful when
+	// this is set.
+	Err error `json:"-"`
+}
+
+// Status reports the state of the given files, or of all files if no paths are
+// given. This includes every file provided by a repo as well as every tracked
+// file. The results are sorted by path. Status does not modify the filesystem
+// or the manifest.
+func (dfm *Dfm) Status(paths []string) ([]FileStatus, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	fileList := newOrderedFiles()
+	orphans := map[string]bool{}
+	for _, path := range paths {
+		found := false
+		for _, repo := range dfm.Config.repos {
+			err := dfm.populateRepoFileList(repo, path, fileList)
+			if err == nil {
+				found = true
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		for filename := range dfm.Config.manifest {
+			if path == "." || filename == path || strings.HasPrefix(filename, path+"/") {
+				orphans[filename] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, NewFileError(path, "not found in any active repositories")
+		}
+	}
+
+	results := make([]FileStatus, 0, fileList.Len()+len(orphans))
+	for _, relative := range fileList.Keys() {
+		repo, _ := fileList.Get(relative)
+		delete(orphans, relative)
+		status := dfm.fileStatus(relative, repo)
+		switch status.State {
+		case StatusLinked:
+			status.PermissionProblem = dfm.checkPermissions(relative, dfm.SourcePath(status.Repo, relative))
+		case StatusCopiedIdentical, StatusCopiedModified:
+			status.PermissionProblem = dfm.checkPermissions(relative, status.TargetPath)
+		}
+		results = append(results, status)
+	}
+	for relative := range orphans {
+		results = append(results, FileStatus{
+			Relative:   relative,
+			TargetPath: dfm.TargetPath(relative),
+			State:      StatusOrphaned,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Relative < results[j].Relative
+	})
+	return results, nil
+}
+
+// fileStatus checks a single file provided by the given repo.
+func (dfm *Dfm) fileStatus(relative, repo string) FileStatus {
+	status := FileStatus{
+		Relative:   relative,
+		Repo:       repo,
+		TargetPath: dfm.TargetPath(relative),
+	}
+	repoPath := dfm.SourcePath(repo, relative)
+	stat, err := lstat(dfm.fs, status.TargetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		status.State = StatusMissing
+		return status
+	} else if err != nil {
+		status.Err = err
+		return status
+	}
+	linked, err := IsLinkedFile(dfm.fs, repoPath, status.TargetPath)
+	if err != nil {
+		status.Err = err
+		return status
+	} else if linked {
+		status.State = StatusLinked
+		return status
+	} else if !stat.Mode().IsRegular() || dfm.linkedRepo(relative) != "" {
+		status.State = StatusConflict
+		return status
+	}
+	hardLinked, err := IsHardLinkedFile(dfm.fs, repoPath, status.TargetPath)
+	if err != nil {
+		status.Err = err
+		return status
+	} else if hardLinked {
+		status.State = StatusLinked
+		return status
+	}
+	identical, err := IsIdenticalFile(dfm.fs, repoPath, status.TargetPath)
+	if err != nil {
+		status.Err = err
+	} else if identical {
+		status.State = StatusCopiedIdentical
+	} else if dfm.Config.manifest[relative] {
+		status.State = StatusCopiedModified
+	} else {
+		status.State = StatusConflict
+	}
+	return status
+}
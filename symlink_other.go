@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package dfm
+
+// isSymlinkPrivilegeError returns true if the error means that this process
+// isn't allowed to create symlinks. This only happens on Windows.
+func isSymlinkPrivilegeError(err error) bool {
+	return false
+}
@@ -0,0 +1,17 @@
+package dfm
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorPrivilegeNotHeld is ERROR_PRIVILEGE_NOT_HELD, which is returned when
+// creating a symlink without Developer Mode or administrator rights.
+const errorPrivilegeNotHeld syscall.Errno = 1314
+
+// isSymlinkPrivilegeError returns true if the error means that this process
+// isn't allowed to create symlinks.
+func isSymlinkPrivilegeError(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == errorPrivilegeNotHeld
+}
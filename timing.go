@@ -0,0 +1,104 @@
+package dfm
+
+import (
+	"sort"
+	"time"
+)
+
+// SlowestFiles is the number of files listed in Timings.Slowest.
+const SlowestFiles = 10
+
+// Timings measures where the time of a command went, see Dfm.Timing. Each
+// duration is the total over the whole command, and is in nanoseconds in
+// JSON.
+type Timings struct {
+	// Listing the files in the repos
+	FileList time.Duration `json:"file_list"`
+	// Comparing each file with the target to decide what needs to be done
+	Plan time.Duration `json:"plan"`
+	// Syncing the files, added up over every file. When files are synced in
+	// parallel, this can be more than the time that actually passed.
+	Sync time.Duration `json:"sync"`
+	// Removing files which are no longer provided by any repo
+	Autoclean time.Duration `json:"autoclean"`
+	// Saving the manifest
+	SaveConfig time.Duration `json:"save_config"`
+	// The files which took the longest to sync, slowest first
+	Slowest []FileTiming `json:"slowest"`
+}
+
+// FileTiming is the time it took to sync a single file.
+type FileTiming struct {
+	Relative string        `json:"path"`
+	Duration time.Duration `json:"duration"`
+}
+
+type phase int
+
+const (
+	phaseFileList phase = iota
+	phasePlan
+	phaseAutoclean
+	phaseSaveConfig
+)
+
+// Timings returns the durations measured so far, or nil unless Timing is set.
+func (dfm *Dfm) Timings() *Timings {
+	if dfm.timings == nil {
+		return nil
+	}
+	timings := *dfm.timings
+	timings.Slowest = append([]FileTiming(nil), dfm.timings.Slowest...)
+	sort.SliceStable(timings.Slowest, func(i, j int) bool {
+		return timings.Slowest[i].Duration > timings.Slowest[j].Duration
+	})
+	if len(timings.Slowest) > SlowestFiles {
+		timings.Slowest = timings.Slowest[:SlowestFiles]
+	}
+	return &timings
+}
+
+// timer returns the current time, to be passed to addTime later. Without
+// Timing, the clock isn't read at all. Safe to call from the sync workers.
+func (dfm *Dfm) timer() time.Time {
+	if !dfm.Timing {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// addTime adds the time since start to the phase.
+func (dfm *Dfm) addTime(phase phase, start time.Time) {
+	if !dfm.Timing {
+		return
+	}
+	timings := dfm.startTimings()
+	elapsed := time.Since(start)
+	switch phase {
+	case phaseFileList:
+		timings.FileList += elapsed
+	case phasePlan:
+		timings.Plan += elapsed
+	case phaseAutoclean:
+		timings.Autoclean += elapsed
+	case phaseSaveConfig:
+		timings.SaveConfig += elapsed
+	}
+}
+
+// addFileTime records the time it took to sync a single file.
+func (dfm *Dfm) addFileTime(relative string, elapsed time.Duration) {
+	if !dfm.Timing {
+		return
+	}
+	timings := dfm.startTimings()
+	timings.Sync += elapsed
+	timings.Slowest = append(timings.Slowest, FileTiming{Relative: relative, Duration: elapsed})
+}
+
+func (dfm *Dfm) startTimings() *Timings {
+	if dfm.timings == nil {
+		dfm.timings = &Timings{}
+	}
+	return dfm.timings
+}
@@ -0,0 +1,106 @@
+package dfm
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// trackRepo returns the repo which new files in the track_dirs directories
+// are added to: the track_repo config option, or the only repo if there is
+// just one.
+func (dfm *Dfm) trackRepo() (string, error) {
+	if dfm.Config.trackRepo != "" {
+		return dfm.Config.trackRepo, dfm.assertIsActiveRepo(dfm.Config.trackRepo)
+	} else if len(dfm.Config.repos) == 1 {
+		return dfm.Config.repos[0], nil
+	}
+	return "", errors.New("set track_repo to choose the repo new files are added to")
+}
+
+// autoAdd adds the regular files in the track_dirs directories which no repo
+// provides and which aren't tracked yet to the track repo, the same as
+// AddFiles. Files matching the repo's ignore patterns or Exclude are left
+// alone. A directory with more new files than AddLimit, or more bytes than
+// AddSizeLimit, is warned about and skipped, since it probably contains
+// something which doesn't belong in the repo. Problems with the setting
+// itself are warnings too, so that they don't stop the sync.
+func (dfm *Dfm) autoAdd(ctx context.Context, operation string, errorHandler ErrorHandler) error {
+	if dfm.NoAutoAdd || len(dfm.Config.trackDirs) == 0 {
+		return nil
+	}
+	repo, err := dfm.trackRepo()
+	if err != nil {
+		dfm.log(OperationWarning, dfm.Config.trackDirs[0], "", NewFileErrorf(dfm.Config.trackDirs[0], "not adding new files: %s", err))
+		return nil
+	} else if len(dfm.OnlyRepos) > 0 && !dfm.isOnlyRepo(repo) {
+		return nil
+	}
+	patterns, err := dfm.ignorePatterns(repo)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, dir := range dfm.Config.trackDirs {
+		if !isRelativeInside(dir) {
+			dfm.log(OperationWarning, dir, "", NewFileError(dir, "track_dirs must be inside the target directory"))
+			continue
+		}
+		found, err := dfm.untrackedFiles(repo, dir, patterns)
+		if err != nil {
+			return err
+		} else if len(found) == 0 {
+			continue
+		}
+		var size int64
+		for _, relative := range found {
+			if stat, err := lstat(dfm.fs, dfm.TargetPath(relative)); err == nil {
+				size += stat.Size()
+			}
+		}
+		if len(found) > AddLimit || size > AddSizeLimit {
+			dfm.log(OperationWarning, dir, repo, NewFileErrorf(dir, "not adding %d new files totaling %d KB; add them with dfm add, or ignore them", len(found), (size+1023)/1024))
+			continue
+		}
+		files = append(files, found...)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return dfm.AddFilesContext(ctx, files, repo, operation == OperationLink, errorHandler)
+}
+
+// untrackedFiles returns the regular files in the directory in the target
+// directory which aren't tracked, aren't provided by any active repo, and
+// aren't ignored. A directory which doesn't exist, or which is a link, has
+// none.
+func (dfm *Dfm) untrackedFiles(repo, dir string, patterns []string) ([]string, error) {
+	if stat, err := lstat(dfm.fs, dfm.TargetPath(dir)); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, nil
+	}
+	provided := newOrderedFiles()
+	for _, active := range dfm.Config.repos {
+		if err := dfm.populateRepoFileList(active, dir, provided); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	targetFiles := newOrderedFiles()
+	if err := populateFileList(dfm.fs, dfm.Config.targetPath, dir, targetFiles, repo, nil, nil); err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, relative := range targetFiles.Keys() {
+		if _, ok := provided.Get(relative); ok || dfm.Config.manifest[relative] || dfm.isExcluded(relative) || isIgnored(patterns, dir, relative) {
+			continue
+		}
+		if stat, err := lstat(dfm.fs, dfm.TargetPath(relative)); err != nil || !stat.Mode().IsRegular() {
+			continue
+		}
+		found = append(found, relative)
+	}
+	return found, nil
+}
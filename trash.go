@@ -0,0 +1,115 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// TrashDirname is the directory in the dfm directory where removed files are
+// moved when the trash is enabled. Each run which removes files gets its own
+// directory inside of it, named after the time of the run.
+const TrashDirname = ".trash"
+
+// TrashTimeFormat is the time format used to name the directories in the
+// trash.
+const TrashTimeFormat = "2006-01-02T15-04-05"
+
+// TrashedFile is a file which was moved to the trash instead of being removed.
+type TrashedFile struct {
+	// Name of the directory in the trash, which is the time the file was
+	// removed in TrashTimeFormat
+	Time string `json:"time"`
+	// Path of the file relative to the target directory
+	Relative string `json:"path"`
+}
+
+// useTrash returns true if removed files should be moved to the trash.
+func (dfm *Dfm) useTrash() bool {
+	return dfm.Trash || dfm.Config.trash
+}
+
+// TrashPath returns the path to the trash directory.
+func (dfm *Dfm) TrashPath() string {
+	return path.Join(dfm.Config.path, TrashDirname)
+}
+
+// removeFile removes a file from the target directory, moving it to the trash
+// if it's enabled. Links are always removed, since their contents live in the
+// repo; only real files, which may have been edited, are kept.
+func (dfm *Dfm) removeFile(relative, dest string) error {
+	if !dfm.useTrash() {
+		return RemoveFile(dfm.fs, dest)
+	}
+	if isRegular, err := IsRegularFile(dfm.fs, dest); err != nil || !isRegular {
+		return RemoveFile(dfm.fs, dest)
+	} else if _, isLink := readLink(dfm.fs, dest); isLink {
+		return RemoveFile(dfm.fs, dest)
+	}
+	if dfm.trashTime == "" {
+		dfm.trashTime = time.Now().Format(TrashTimeFormat)
+	}
+	trashed := path.Join(dfm.TrashPath(), dfm.trashTime, relative)
+	if err := dfm.fs.MkdirAll(path.Dir(trashed), 0777); err != nil {
+		return err
+	}
+	// The dfm directory is usually a git repository, and the trash shouldn't
+	// show up in it.
+	gitignore := path.Join(dfm.TrashPath(), ".gitignore")
+	if _, err := dfm.fs.Stat(gitignore); errors.Is(err, os.ErrNotExist) {
+		if err := afero.WriteFile(dfm.fs, gitignore, []byte("*\n"), 0666); err != nil {
+			return err
+		}
+	}
+	return MoveFile(dfm.fs, dest, trashed)
+}
+
+// TrashedFiles lists the files in the trash, oldest first.
+func (dfm *Dfm) TrashedFiles() ([]TrashedFile, error) {
+	entries, err := afero.ReadDir(dfm.fs, dfm.TrashPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []TrashedFile
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		root := path.Join(dfm.TrashPath(), entry.Name())
+		var relatives []string
+		err := afero.Walk(dfm.fs, root, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if !info.IsDir() {
+				// The walk uses the separator of the operating system.
+				relative, _ := RelativePath(root, filepath.ToSlash(filename))
+				relatives = append(relatives, NormalizePath(relative))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(relatives)
+		for _, relative := range relatives {
+			files = append(files, TrashedFile{Time: entry.Name(), Relative: relative})
+		}
+	}
+	return files, nil
+}
+
+// EmptyTrash permanently deletes every file in the trash. In dry run mode,
+// nothing is deleted.
+func (dfm *Dfm) EmptyTrash() error {
+	if dfm.DryRun {
+		return nil
+	}
+	return dfm.fs.RemoveAll(dfm.TrashPath())
+}
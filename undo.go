@@ -0,0 +1,144 @@
+package dfm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Undo reverts the files which the most recent run of dfm removed or
+// overwrote, using the journal: removed files are put back from the trash, or
+// synced again from the repo the same way they were before, and files which
+// were backed up by Force are moved back from their backup. Their manifest
+// entries are restored as well. Changes which can't be reverted, like files
+// which were overwritten without a backup, are returned instead. Undo refuses
+// to undo another undo.
+func (dfm *Dfm) Undo(errorHandler ErrorHandler) ([]*FileError, error) {
+	return dfm.UndoContext(context.Background(), errorHandler)
+}
+
+// UndoContext is Undo with support for cancellation. If the context is
+// canceled, no more files are restored and the context's error is returned.
+func (dfm *Dfm) UndoContext(ctx context.Context, errorHandler ErrorHandler) ([]*FileError, error) {
+	entries, err := dfm.History("", 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[len(entries)-1].Run == "" {
+		return nil, errors.New("nothing to undo")
+	}
+	last := entries[len(entries)-1]
+	if last.Command == "undo" {
+		return nil, errors.New("the last run was an undo, which can't be undone")
+	}
+	var run []JournalEntry
+	for _, entry := range entries {
+		if entry.Run == last.Run && entry.Result == "ok" {
+			run = append(run, entry)
+		}
+	}
+
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return nil, err
+	}
+	var problems []*FileError
+	linked, copied := newOrderedFiles(), newOrderedFiles()
+	undone := false
+	for i := len(run) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return problems, err
+		}
+		entry := run[i]
+		switch entry.Operation {
+		case OperationRemove:
+			undone = true
+			if entry.Saved != "" {
+				problems = dfm.restore(problems, entry.Relative, entry.Saved, true)
+			} else if repo, ok := fileList.Get(entry.Relative); !ok {
+				problems = append(problems, NewFileError(entry.Relative, "can't be restored: no repo provides it anymore"))
+			} else if entry.Copy && !dfm.useHardLink(entry.Relative, repo) {
+				copied.Set(entry.Relative, repo)
+			} else {
+				linked.Set(entry.Relative, repo)
+			}
+		case OperationBackup:
+			undone = true
+			problems = dfm.restore(problems, entry.Relative, entry.Saved, false)
+		case OperationOverwrite:
+			undone = true
+			problems = append(problems, NewFileError(entry.Relative, "can't be restored: it was overwritten without a backup"))
+		case OperationAdopt:
+			undone = true
+			problems = append(problems, NewFileErrorf(entry.Relative, "can't be restored: the file in %s was replaced; restore it with git", entry.Repo))
+		}
+	}
+	if !undone {
+		return nil, fmt.Errorf("nothing to undo: the last run (dfm %s) didn't remove or overwrite any files", last.Command)
+	}
+
+	linkPlan := newPlan(OperationLink)
+	dfm.planFiles(linkPlan, sortFileList(linked))
+	err = dfm.applyPlan(ctx, linkPlan, errorHandler, dfm.handleLink)
+	if err == nil {
+		copyPlan := newPlan(OperationCopy)
+		dfm.planFiles(copyPlan, sortFileList(copied))
+		err = dfm.applyPlan(ctx, copyPlan, errorHandler, dfm.handleCopy)
+	}
+	if saveErr := dfm.saveConfig(); saveErr != nil {
+		return problems, saveErr
+	}
+	return problems, err
+}
+
+// restore restores a single file with restoreFile, and logs it. If that fails,
+// the problem is added to the list.
+func (dfm *Dfm) restore(problems []*FileError, relative, saved string, tracked bool) []*FileError {
+	if err := dfm.restoreFile(relative, saved, tracked); err != nil {
+		return append(problems, WrapFileError(err, relative))
+	}
+	dfm.logPaths(OperationRestore, relative, "", saved, dfm.TargetPath(relative), nil)
+	return problems
+}
+
+// restoreFile moves a file which was kept in the trash or as a backup back to
+// the target directory. A file which was removed from the target is tracked
+// again. A file which was backed up was replaced by a file from a repo, which
+// is removed first, so the backed up file is no longer tracked.
+func (dfm *Dfm) restoreFile(relative, saved string, tracked bool) error {
+	dest := dfm.TargetPath(relative)
+	if _, err := lstat(dfm.fs, saved); err != nil {
+		return err
+	}
+	if !tracked && dfm.Config.manifest[relative] {
+		if !dfm.ownsTarget(relative) {
+			return WrapFileError(ErrModifiedOutside, relative)
+		}
+		if !dfm.DryRun {
+			if err := RemoveFile(dfm.fs, dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	} else if _, err := lstat(dfm.fs, dest); err == nil {
+		return errors.New("can't be restored: another file is in the way")
+	}
+	if dfm.DryRun {
+		return nil
+	}
+	if err := dfm.fs.MkdirAll(path.Dir(dest), 0777); err != nil {
+		return err
+	}
+	if err := MoveFile(dfm.fs, saved, dest); err != nil {
+		return err
+	}
+	if tracked {
+		dfm.Config.manifest[relative] = true
+		dfm.recordChecksum(relative, dest)
+	} else {
+		delete(dfm.Config.manifest, relative)
+		delete(dfm.Config.checksums, relative)
+	}
+	return nil
+}
@@ -1,12 +1,19 @@
-package main
+package dfm
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
-	"github.com/cevaris/ordered_map"
 	"github.com/spf13/afero"
 )
 
@@ -16,7 +23,7 @@ func pathJoin(components ...string) string {
 	}
 	result := components[len(components)-1]
 	for i := len(components) - 2; i >= 0; i-- {
-		if path.IsAbs(result) {
+		if isAbs(result) {
 			return result
 		}
 		result = path.Join(components[i], result)
@@ -25,43 +32,133 @@ func pathJoin(components ...string) string {
 }
 
 // populateFileList scans the relative filename, recursively adding paths
-// relative to root to fileList with the given value. The filename can be ".",
-// in which case the entire root will be scanned.
+// relative to root to fileList with the given repo. The filename can be ".",
+// in which case the entire root will be scanned. Directories for which
+// linkedDir returns true are added as a single entry instead of being scanned,
+// and a filename inside of such a directory adds the directory. The linkedDir
+// function may be nil.
+//
+// When selectors is not nil, files with a VariantSeparator suffix are added
+// without the suffix if their selector is one of the selectors, and skipped
+// otherwise. A filename which doesn't exist is added if a matching variant of
+// it does.
 func populateFileList(
 	fs afero.Fs,
 	root, filename string,
-	fileList *ordered_map.OrderedMap,
-	value string,
+	fileList *orderedFiles,
+	repo string,
+	linkedDir func(relative string) bool,
+	selectors []string,
 ) error {
-	filename = pathJoin(root, filename)
+	filename = NormalizePath(filename)
+	if linkedDir != nil {
+		components := strings.Split(path.Clean(filename), "/")
+		for i := range components {
+			dir := strings.Join(components[:i+1], "/")
+			if dir != "." && linkedDir(dir) {
+				fileList.Set(dir, repo)
+				return nil
+			}
+		}
+	}
+	if selectors != nil {
+		if _, err := lstat(fs, normalizedJoin(fs, root, filename)); errors.Is(err, os.ErrNotExist) {
+			for _, selector := range selectors {
+				if _, err := lstat(fs, normalizedJoin(fs, root, filename+VariantSeparator+selector)); err == nil {
+					fileList.Set(path.Clean(filename), repo)
+					return nil
+				}
+			}
+		}
+	}
+	filename = normalizedJoin(fs, root, filename)
 	return afero.Walk(fs, filename, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		// The walk uses the separator of the operating system.
+		path = filepath.ToSlash(path)
+		var relativePath string
+		if root == "." {
+			relativePath = path
+		} else if path == root {
+			relativePath = "."
+		} else {
+			relativePath = path[len(root)+1:]
+		}
+		relativePath = NormalizePath(relativePath)
 		if fi.IsDir() {
+			if linkedDir != nil && relativePath != "." && linkedDir(relativePath) {
+				fileList.Set(relativePath, repo)
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		var relativePath string
-		if root != "." {
-			relativePath = path[len(root)+1:]
-		} else {
-			relativePath = path
+		if selectors != nil {
+			stripped, selector := splitVariant(relativePath)
+			if selector != "" {
+				if !containsString(selectors, selector) {
+					return nil
+				}
+				relativePath = stripped
+			}
 		}
-		fileList.Set(relativePath, value)
+		fileList.Set(relativePath, repo)
 		return nil
 	})
 }
 
+// sortFileList returns a copy of the file list sorted by relative path, so
+// that files are synced and logged in the same order regardless of the order
+// the repos and directories were scanned in.
+func sortFileList(fileList *orderedFiles) *orderedFiles {
+	relatives := append([]string(nil), fileList.Keys()...)
+	sort.Strings(relatives)
+	sorted := newOrderedFiles()
+	for _, relative := range relatives {
+		repo, _ := fileList.Get(relative)
+		sorted.Set(relative, repo)
+	}
+	return sorted
+}
+
+// containsString returns true if the slice contains the string.
+func containsString(slice []string, str string) bool {
+	for _, item := range slice {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPattern returns true if the glob pattern matches the relative path or
+// any of its parent directories.
+func matchesPattern(pattern, relative string) bool {
+	pattern = path.Clean(pattern)
+	for relative != "." && relative != "/" {
+		if matched, _ := path.Match(pattern, relative); matched {
+			return true
+		}
+		relative = path.Dir(relative)
+	}
+	return false
+}
+
+// lstat returns the FileInfo for the given path without following symlinks, if
+// the fs supports it.
+func lstat(fs afero.Fs, path string) (os.FileInfo, error) {
+	if lstater, ok := fs.(afero.Lstater); ok {
+		stat, _, err := lstater.LstatIfPossible(path)
+		return stat, err
+	}
+	return fs.Stat(path)
+}
+
 // IsRegularFile will return true if the given file is a regular file (symlinks
 // not allowed)
 func IsRegularFile(fs afero.Fs, path string) (bool, error) {
-	var stat os.FileInfo
-	var err error
-	if lstater, ok := fs.(afero.Lstater); ok {
-		stat, _, err = lstater.LstatIfPossible(path)
-	} else {
-		stat, err = fs.Stat(path)
-	}
+	stat, err := lstat(fs, path)
 	if err != nil {
 		return false, err
 	} else if !stat.Mode().IsRegular() {
@@ -70,11 +167,48 @@ func IsRegularFile(fs afero.Fs, path string) (bool, error) {
 	return true, nil
 }
 
-// MakeDirAll will make sure all directories in dest/relative exist.
+// describeFileType describes a file which isn't a regular file, for error
+// messages, like "a directory".
+func describeFileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "a directory"
+	case mode&os.ModeSymlink != 0:
+		return "a symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "a named pipe"
+	case mode&os.ModeSocket != 0:
+		return "a socket"
+	case mode&os.ModeDevice != 0:
+		return "a device"
+	}
+	return "a special file"
+}
+
+// MakeDirAll will make sure all directories in dest/relative exist. Each new
+// directory is created with the mode of the corresponding directory in
+// source, or 0777 (before the umask) if there isn't one.
 func MakeDirAll(fs afero.Fs, relative, source, dest string) error {
-	// XXX - when creating directories, use source to find the permissions of
-	// each new directory.
-	return fs.MkdirAll(path.Join(dest, relative), 0777)
+	destPath := path.Join(dest, relative)
+	if stat, err := fs.Stat(destPath); err == nil {
+		if stat.IsDir() {
+			return nil
+		}
+		// This isn't reported as ErrExist, because --force must not remove
+		// the file.
+		return &os.PathError{Op: "mkdir", Path: destPath, Err: syscall.ENOTDIR}
+	}
+	if relative == "." || relative == "/" || relative == "" {
+		return fs.MkdirAll(destPath, 0777)
+	}
+	if err := MakeDirAll(fs, path.Dir(relative), source, dest); err != nil {
+		return err
+	}
+	mode := os.FileMode(0777)
+	if stat, err := fs.Stat(path.Join(source, relative)); err == nil && stat.IsDir() {
+		mode = stat.Mode().Perm()
+	}
+	return fs.Mkdir(destPath, mode)
 }
 
 // CleanDirectories will remove all empty directories in the given path,
@@ -98,71 +232,194 @@ func CleanDirectories(fs afero.Fs, emptyDir, root string) error {
 }
 
 // MoveFile will move the file from source to dest, failing if the file already
-// exists.
+// exists. If source and dest are on different filesystems, the file is copied
+// and the source is only removed once the copy is complete.
 func MoveFile(fs afero.Fs, source, dest string) error {
 	stat, _ := fs.Stat(dest)
 	if stat != nil {
 		return &os.PathError{Op: "move", Path: dest, Err: os.ErrExist}
 	}
-
-	switch fs.(type) {
-	case *afero.OsFs:
-		// This implementation shells out to mv to avoid cross-device failures
-		// that might happen with os.Rename.
-		cmd := exec.Command("mv", "-n", source, dest)
-		if err := cmd.Run(); err != nil {
-			if exitErr := err.(*exec.ExitError); exitErr != nil && len(exitErr.Stderr) > 0 {
-				return fmt.Errorf(string(exitErr.Stderr))
-			}
-			return fmt.Errorf("failed to move file")
-		}
-		return nil
-	case *afero.MemMapFs:
-		return fs.Rename(source, dest)
-	default:
-		return &os.LinkError{
-			Op:  "move",
-			Old: source,
-			New: dest,
-			Err: fmt.Errorf("unsupported afero fs"),
-		}
+	err := fs.Rename(source, dest)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	if err := CopyFile(fs, source, dest); err != nil {
+		return err
 	}
+	return fs.Remove(source)
 }
 
-// CopyFile will copy the file from source to dest.
+// CopyFile will copy the file from source to dest. The copy has the same mode
+// and modification time as the source. If the copy fails, dest is removed.
 func CopyFile(fs afero.Fs, source, dest string) error {
+	return copyFile(fs, source, dest, copyOptions{clone: true})
+}
+
+const (
+	// DefaultCopyBufferSize is the size of the buffer used to copy files.
+	DefaultCopyBufferSize = 128 * 1024
+	// DefaultCopyProgressSize is the size above which copying a file reports
+	// its progress.
+	DefaultCopyProgressSize = 64 * 1024 * 1024
+)
+
+// copyOptions controls how copyFile copies the file.
+type copyOptions struct {
+	// Try to clone the file before copying its data. On filesystems which
+	// support it, a clone shares the data of the source until either file is
+	// changed, which makes copying large files instant.
+	clone bool
+	// Size of the buffer used to copy the data, DefaultCopyBufferSize if 0
+	bufferSize int
+	// Files larger than this report their progress, DefaultCopyProgressSize
+	// if 0
+	progressSize int64
+	// Called with the number of bytes copied so far and the size of the file
+	progress func(copied, total int64)
+	// Replace dest if it already exists, instead of failing
+	replace bool
+}
+
+// copyFile is CopyFile with options. The data is written or cloned to a
+// temporary file next to dest, which is renamed once it is complete, so that
+// an interrupted copy never leaves a partial file at dest.
+func copyFile(fs afero.Fs, source, dest string, options copyOptions) error {
 	stat, _ := fs.Stat(dest)
-	if stat != nil {
+	if stat != nil && !options.replace {
 		return &os.PathError{Op: "copy", Path: dest, Err: os.ErrExist}
 	}
+	sourceStat, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	tempPath := pathJoin(path.Dir(dest), fmt.Sprintf(".%s.dfm-%d", path.Base(dest), os.Getpid()))
+	if _, ok := fs.(*afero.OsFs); ok && options.clone {
+		// If the clone fails for any reason, do a regular copy instead.
+		if cloneFile(source, tempPath) == nil {
+			return finishCopy(fs, sourceStat, tempPath, dest)
+		}
+	}
+	sourceFile, err := fs.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	tempFile, err := fs.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, sourceStat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	var reader io.Reader = sourceFile
+	progressSize := options.progressSize
+	if progressSize == 0 {
+		progressSize = DefaultCopyProgressSize
+	}
+	if options.progress != nil && sourceStat.Size() > progressSize {
+		reader = &progressReader{reader: sourceFile, total: sourceStat.Size(), progress: options.progress}
+	}
+	bufferSize := options.bufferSize
+	if bufferSize == 0 {
+		bufferSize = DefaultCopyBufferSize
+	}
+	if err = writeCopy(tempFile, reader, make([]byte, bufferSize)); err != nil {
+		fs.Remove(tempPath)
+		return err
+	}
+	return finishCopy(fs, sourceStat, tempPath, dest)
+}
+
+// finishCopy gives the complete copy at tempPath the mode and modification
+// time of the source, and renames it to dest. The copy is removed if either
+// fails.
+func finishCopy(fs afero.Fs, sourceStat os.FileInfo, tempPath, dest string) error {
+	err := copyMetadata(fs, sourceStat, tempPath)
+	if err == nil {
+		err = fs.Rename(tempPath, dest)
+	}
+	if err != nil {
+		fs.Remove(tempPath)
+	}
+	return err
+}
+
+// copyMetadata gives dest the mode and modification time of the source.
+func copyMetadata(fs afero.Fs, sourceStat os.FileInfo, dest string) error {
+	// The mode given when creating the file is subject to the umask.
+	if err := fs.Chmod(dest, sourceStat.Mode().Perm()); err != nil {
+		return err
+	}
+	return fs.Chtimes(dest, sourceStat.ModTime(), sourceStat.ModTime())
+}
 
+// writeCopy copies the contents of source into dest using the buffer, and
+// closes dest. The data is synced to disk, so that errors like a full
+// filesystem are reported here.
+func writeCopy(dest afero.File, source io.Reader, buffer []byte) error {
+	// Hide any WriterTo or ReaderFrom so that the buffer is always used.
+	if _, err := io.CopyBuffer(struct{ io.Writer }{dest}, struct{ io.Reader }{source}, buffer); err != nil {
+		dest.Close()
+		return err
+	}
+	if err := dest.Sync(); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+// progressReader reports the progress of reading a file with a known size.
+type progressReader struct {
+	reader   io.Reader
+	copied   int64
+	total    int64
+	progress func(copied, total int64)
+}
+
+func (reader *progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.copied += int64(n)
+		reader.progress(reader.copied, reader.total)
+	}
+	return n, err
+}
+
+// readLink returns the target of the symlink at path, and whether path is a
+// symlink at all.
+func readLink(fs afero.Fs, path string) (string, bool) {
 	switch fs.(type) {
 	case *afero.OsFs:
-		// This implementation shells out to cp to avoid dealing with
-		// permissions, timestamps, extended attributes, etc.
-		cmd := exec.Command("cp", "-pn", source, dest)
-		if err := cmd.Run(); err != nil {
-			if exitErr := err.(*exec.ExitError); exitErr != nil && len(exitErr.Stderr) > 0 {
-				return fmt.Errorf(string(exitErr.Stderr))
-			}
-			return fmt.Errorf("failed to copy file")
+		target, err := os.Readlink(filepath.FromSlash(path))
+		if err != nil {
+			return "", false
 		}
-		return nil
+		return filepath.ToSlash(target), true
 	case *afero.MemMapFs:
-		data, err := afero.ReadFile(fs, source)
-		if err != nil {
-			return err
+		bytes, err := afero.ReadFile(fs, path)
+		if err != nil || !strings.HasPrefix(string(bytes), "symlink to ") {
+			return "", false
 		}
-		err = afero.WriteFile(fs, dest, data, 0777)
-		return err
-	default:
-		return &os.LinkError{
-			Op:  "copy",
-			Old: source,
-			New: dest,
-			Err: fmt.Errorf("unsupported afero fs"),
+		return strings.TrimPrefix(string(bytes), "symlink to "), true
+	}
+	return "", false
+}
+
+// maxLinkDepth is the number of symlinks resolveLink follows before giving up,
+// the same as Linux.
+const maxLinkDepth = 40
+
+// resolveLink follows the chain of symlinks starting at p, and returns the
+// path of the file at the end of it. The error wraps os.ErrNotExist if the
+// chain ends at a file which doesn't exist.
+func resolveLink(fs afero.Fs, p string) (string, error) {
+	for i := 0; i < maxLinkDepth; i++ {
+		link, ok := readLink(fs, p)
+		if !ok {
+			_, err := lstat(fs, p)
+			return p, err
 		}
+		p = NormalizePath(pathJoin(path.Dir(p), link))
 	}
+	return "", &os.PathError{Op: "readlink", Path: p, Err: errors.New("too many levels of symbolic links")}
 }
 
 // IsLinkedFile decides if dest is already a link to source
@@ -170,7 +427,7 @@ func IsLinkedFile(fs afero.Fs, source, dest string) (bool, error) {
 	switch fs.(type) {
 	case *afero.OsFs:
 		stat, err := os.Lstat(dest)
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			return false, nil
 		} else if err != nil {
 			return false, err
@@ -178,32 +435,85 @@ func IsLinkedFile(fs afero.Fs, source, dest string) (bool, error) {
 			return false, nil
 		}
 		target, err := os.Readlink(dest)
-		if err != nil || target != source {
+		if err != nil {
 			return false, err
+		} else if NormalizePath(filepath.ToSlash(target)) == NormalizePath(source) {
+			// The link may have been written with a different Unicode
+			// normalization of the same name.
+			return true, nil
+		}
+		// The link may point to source through a symlinked directory, for
+		// example when the repo itself is a symlink.
+		resolvedTarget, err := filepath.EvalSymlinks(dest)
+		if err != nil {
+			return false, nil
 		}
-		return true, nil
+		resolvedSource, err := filepath.EvalSymlinks(source)
+		if err != nil {
+			return false, nil
+		}
+		return NormalizePath(resolvedTarget) == NormalizePath(resolvedSource), nil
 	case *afero.MemMapFs:
+		// Links to directories are emulated as files as well, so a directory
+		// is never a link.
+		if isDir, err := afero.IsDir(fs, dest); err == nil && isDir {
+			return false, nil
+		}
 		bytes, err := afero.ReadFile(fs, dest)
-		if os.IsNotExist(err) {
+		if errors.Is(err, os.ErrNotExist) {
 			return false, nil
 		} else if err != nil {
 			return false, err
 		}
-		matches := string(bytes) == "symlink to "+source
+		matches := NormalizePath(string(bytes)) == "symlink to "+NormalizePath(source)
 		return matches, nil
 	default:
 		return false, fmt.Errorf("unsupported afero fs")
 	}
 }
 
+// IsIdenticalFile decides if dest is a regular file with the same contents as
+// source.
+func IsIdenticalFile(fs afero.Fs, source, dest string) (bool, error) {
+	sourceStat, err := fs.Stat(source)
+	if err != nil {
+		return false, err
+	}
+	destStat, err := lstat(fs, dest)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if !destStat.Mode().IsRegular() || destStat.Size() != sourceStat.Size() {
+		return false, nil
+	}
+	sourceBytes, err := afero.ReadFile(fs, source)
+	if err != nil {
+		return false, err
+	}
+	destBytes, err := afero.ReadFile(fs, dest)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(sourceBytes, destBytes), nil
+}
+
 // LinkFile creates a link at dest that points to source.
 func LinkFile(fs afero.Fs, source, dest string) error {
-	if !path.IsAbs(source) {
+	if !isAbs(source) {
 		return fmt.Errorf("must use an absolute path for link source")
 	}
 	switch fs.(type) {
 	case *afero.OsFs:
-		return os.Symlink(source, dest)
+		err := os.Symlink(filepath.FromSlash(source), dest)
+		if isSymlinkPrivilegeError(err) {
+			return &FileError{
+				Message:  "creating symlinks requires Developer Mode or administrator rights on Windows, use dfm copy instead",
+				Filename: dest,
+				cause:    err,
+			}
+		}
+		return err
 	case *afero.MemMapFs:
 		stat, _ := fs.Stat(dest)
 		if stat != nil {
@@ -221,6 +531,93 @@ func LinkFile(fs afero.Fs, source, dest string) error {
 	}
 }
 
+// isSymlinkUnsupported returns true if the error from LinkFile means that
+// symlinks can't be created there at all, rather than that this particular
+// link failed.
+func isSymlinkUnsupported(err error) bool {
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) || linkErr.Op != "symlink" {
+		return false
+	}
+	switch linkErr.Err {
+	case syscall.EPERM, syscall.ENOTSUP, syscall.ENOSYS:
+		return true
+	}
+	return isSymlinkPrivilegeError(linkErr)
+}
+
+// HardLinkFile creates a hard link at dest to source. Hard links can't cross
+// filesystems, so in that case the error suggests copying the file instead.
+func HardLinkFile(fs afero.Fs, source, dest string) error {
+	switch fs.(type) {
+	case *afero.OsFs:
+		err := os.Link(source, dest)
+		if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
+			return NewFileError(dest, "cannot hard link across filesystems, use dfm copy instead")
+		}
+		return err
+	case *afero.MemMapFs:
+		stat, _ := fs.Stat(dest)
+		if stat != nil {
+			return &os.PathError{Op: "link", Path: dest, Err: os.ErrExist}
+		}
+		content := "hardlink to " + source
+		return afero.WriteFile(fs, dest, []byte(content), 0666)
+	default:
+		return &os.LinkError{
+			Op:  "link",
+			Old: source,
+			New: dest,
+			Err: fmt.Errorf("unsupported afero fs"),
+		}
+	}
+}
+
+// IsHardLinkedFile decides if dest is a hard link to source, meaning that both
+// are the same file.
+func IsHardLinkedFile(fs afero.Fs, source, dest string) (bool, error) {
+	switch fs.(type) {
+	case *afero.OsFs:
+		destStat, err := os.Lstat(dest)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		sourceStat, err := os.Lstat(source)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return os.SameFile(sourceStat, destStat), nil
+	case *afero.MemMapFs:
+		bytes, err := afero.ReadFile(fs, dest)
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return string(bytes) == "hardlink to "+source, nil
+	default:
+		return false, fmt.Errorf("unsupported afero fs")
+	}
+}
+
+// fileChecksum returns the hex-encoded SHA-256 of the file's contents.
+func fileChecksum(fs afero.Fs, path string) (string, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // RemoveFile removes the listed file.
 func RemoveFile(fs afero.Fs, path string) error {
 	return fs.Remove(path)
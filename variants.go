@@ -0,0 +1,96 @@
+package dfm
+
+import (
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// VariantSeparator separates a filename in a repo from the selector of the
+// variant it provides. For example, ".gitconfig##work-laptop" provides
+// ".gitconfig" on the machine with the hostname "work-laptop". The selector
+// can be a hostname, an operating system as reported by runtime.GOOS, or
+// "default".
+const VariantSeparator = "##"
+
+// VariantDefault is the selector of the variant used when no other variant
+// matches.
+const VariantDefault = "default"
+
+// variantSelectors lists the selectors which match this machine, most
+// specific first.
+func (dfm *Dfm) variantSelectors() []string {
+	var selectors []string
+	if dfm.Config.hostname != "" {
+		selectors = append(selectors, dfm.Config.hostname)
+	}
+	return append(selectors, runtime.GOOS, VariantDefault)
+}
+
+// splitVariant splits the variant selector from the last component of the
+// path. If the path is not a variant, the selector is "".
+func splitVariant(relative string) (string, string) {
+	base := path.Base(relative)
+	i := strings.Index(base, VariantSeparator)
+	if i == -1 {
+		return relative, ""
+	}
+	return relative[:len(relative)-len(base)+i], base[i+len(VariantSeparator):]
+}
+
+// variantCandidates lists the paths in the repo which could provide the
+// relative path on this machine, most specific first. The last candidate is
+// the file without any selector.
+func (dfm *Dfm) variantCandidates(repo, relative string) []string {
+	selectors := dfm.variantSelectors()
+	root, repoRelative := dfm.Config.repoRoot(repo), dfm.Config.repoRelative(repo, relative)
+	candidates := make([]string, 0, len(selectors)+1)
+	for _, selector := range selectors {
+		candidates = append(candidates, normalizedJoin(dfm.fs, root, repoRelative+VariantSeparator+selector))
+	}
+	return append(candidates, normalizedJoin(dfm.fs, root, repoRelative))
+}
+
+// SourcePath returns the path to the file inside of the given repo which
+// provides the relative path. This is the most specific variant which matches
+// this machine, or the file without a selector if no variant matches.
+func (dfm *Dfm) SourcePath(repo, relative string) string {
+	candidates := dfm.variantCandidates(repo, relative)
+	for _, candidate := range candidates[:len(candidates)-1] {
+		if stat, err := lstat(dfm.fs, candidate); err == nil && !stat.IsDir() {
+			return candidate
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// isLinkedToRepo returns true if the target file is a link to the file in the
+// repo or any of its variants, even ones which don't match this machine.
+func (dfm *Dfm) isLinkedToRepo(repo, relative string) bool {
+	targetPath := dfm.TargetPath(relative)
+	for _, candidate := range dfm.variantCandidates(repo, relative) {
+		if linked, _ := IsLinkedFile(dfm.fs, candidate, targetPath); linked {
+			return true
+		}
+	}
+	// The link may be to a variant for a different machine, for example if
+	// the hostname changed.
+	repoPath := dfm.RepoPath(repo, relative)
+	entries, err := afero.ReadDir(dfm.fs, path.Dir(repoPath))
+	if err != nil {
+		return false
+	}
+	prefix := path.Base(repoPath) + VariantSeparator
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		candidate := pathJoin(path.Dir(repoPath), entry.Name())
+		if linked, _ := IsLinkedFile(dfm.fs, candidate, targetPath); linked {
+			return true
+		}
+	}
+	return false
+}
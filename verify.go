@@ -0,0 +1,155 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// MismatchMissing means the tracked file does not exist in the target.
+	MismatchMissing = "missing"
+	// MismatchWrongLink means the target file is a link to something other
+	// than the repo file.
+	MismatchWrongLink = "wrong-link"
+	// MismatchModified means the target file is a copy whose contents differ
+	// from the repo file.
+	MismatchModified = "modified"
+	// MismatchNotAFile means the target is neither a link nor a regular file,
+	// for example a directory.
+	MismatchNotAFile = "not-a-file"
+	// MismatchOrphaned means the file is tracked but no repo provides it
+	// anymore.
+	MismatchOrphaned = "orphaned"
+)
+
+// Mismatch is a tracked file in the target directory which doesn't match the
+// repo file it was synced from.
+type Mismatch struct {
+	// Path relative to the target directory
+	Relative string `json:"path"`
+	// The repo which provides the file, or "" if the file is orphaned
+	Repo string `json:"repo,omitempty"`
+	// Absolute path to the file in the target directory
+	TargetPath string `json:"target"`
+	// One of the Mismatch constants
+	Problem string `json:"problem"`
+	// Where the target file links to, for MismatchWrongLink
+	Link string `json:"link,omitempty"`
+	// Error encountered while checking the file. Problem is not meaningful
+	// when this is set.
+	Err error `json:"-"`
+}
+
+// Verify checks that every tracked file under the given paths, or every
+// tracked file if no paths are given, still matches the repo file which
+// provides it: links have to point to the repo file, and copies have to have
+// the same contents. Copies with the same size and modification time as the
+// repo file are assumed to be identical, unless checksum is set, in which
+// case the contents of every copy are hashed. Only the files which don't
+// match are returned, sorted by path. Verify does not modify the filesystem or
+// the manifest.
+func (dfm *Dfm) Verify(paths []string, checksum bool) ([]Mismatch, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	tracked := map[string]bool{}
+	for _, path := range paths {
+		found := false
+		for filename := range dfm.Config.manifest {
+			if path == "." || filename == path || strings.HasPrefix(filename, path+"/") {
+				tracked[filename] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, NewFileError(path, "not tracked")
+		}
+	}
+	fileList, err := dfm.buildFileList([]string{"."})
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []Mismatch
+	for relative := range tracked {
+		mismatch := Mismatch{Relative: relative, TargetPath: dfm.TargetPath(relative)}
+		if repo, ok := fileList.Get(relative); !ok {
+			mismatch.Problem = MismatchOrphaned
+		} else {
+			mismatch.Repo = repo
+			mismatch.Problem, mismatch.Link, mismatch.Err = dfm.verifyFile(relative, repo, checksum)
+		}
+		if mismatch.Problem != "" || mismatch.Err != nil {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Relative < mismatches[j].Relative
+	})
+	return mismatches, nil
+}
+
+// verifyFile checks a single tracked file against the repo file which provides
+// it, and returns the Mismatch constant describing the problem, or "" if it
+// matches. For links to the wrong file, the destination of the link is
+// returned as well.
+func (dfm *Dfm) verifyFile(relative, repo string, checksum bool) (string, string, error) {
+	source := dfm.SourcePath(repo, relative)
+	dest := dfm.TargetPath(relative)
+	stat, err := lstat(dfm.fs, dest)
+	if errors.Is(err, os.ErrNotExist) {
+		return MismatchMissing, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	if link, ok := readLink(dfm.fs, dest); ok {
+		if linked, err := IsLinkedFile(dfm.fs, source, dest); err != nil {
+			return "", "", err
+		} else if !linked {
+			return MismatchWrongLink, link, nil
+		}
+		return "", "", nil
+	} else if !stat.Mode().IsRegular() {
+		return MismatchNotAFile, "", nil
+	}
+	if hardLinked, err := IsHardLinkedFile(dfm.fs, source, dest); err != nil || hardLinked {
+		return "", "", err
+	}
+	if same, err := dfm.sameContents(source, dest, checksum); err != nil {
+		return "", "", err
+	} else if !same {
+		return MismatchModified, "", nil
+	}
+	return "", "", nil
+}
+
+// sameContents compares the contents of two regular files. Unless checksum is
+// set, files with the same size and modification time are assumed to be the
+// same without reading them, since copies keep the modification time of the
+// repo file.
+func (dfm *Dfm) sameContents(source, dest string, checksum bool) (bool, error) {
+	sourceStat, err := dfm.fs.Stat(source)
+	if err != nil {
+		return false, err
+	}
+	destStat, err := dfm.fs.Stat(dest)
+	if err != nil {
+		return false, err
+	}
+	if sourceStat.Size() != destStat.Size() {
+		return false, nil
+	} else if !checksum && sourceStat.ModTime().Equal(destStat.ModTime()) {
+		return true, nil
+	}
+	sourceSum, err := fileChecksum(dfm.fs, source)
+	if err != nil {
+		return false, err
+	}
+	destSum, err := fileChecksum(dfm.fs, dest)
+	if err != nil {
+		return false, err
+	}
+	return sourceSum == destSum, nil
+}
@@ -0,0 +1,50 @@
+package dfm
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// Provider is a repo which contains a file in the target directory.
+type Provider struct {
+	// Path relative to the target directory
+	Relative string `json:"path"`
+	// Name of the repo
+	Repo string `json:"repo"`
+	// Absolute path to the file in the repo, including any variant suffix
+	SourcePath string `json:"source"`
+}
+
+// Which returns every repo which contains the given file, in order of
+// precedence: the first one is the repo which dfm syncs it from, and the rest
+// are shadowed by it. Files inside directories which are linked as a whole
+// are provided by the repo containing the directory. An empty slice means the
+// file isn't in any repo.
+func (dfm *Dfm) Which(relative string) ([]Provider, error) {
+	var providers []Provider
+	repos := dfm.Config.repos
+	for i := len(repos) - 1; i >= 0; i-- {
+		repo := repos[i]
+		fileList := newOrderedFiles()
+		if err := dfm.populateRepoFileList(repo, relative, fileList); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		provider := Provider{Relative: relative, Repo: repo, SourcePath: dfm.RepoPath(repo, relative)}
+		for _, key := range fileList.Keys() {
+			if key == relative {
+				provider.SourcePath = dfm.SourcePath(repo, relative)
+			} else if strings.HasPrefix(relative, key+"/") {
+				provider.SourcePath = pathJoin(dfm.SourcePath(repo, key), relative[len(key)+1:])
+			}
+		}
+		if _, err := lstat(dfm.fs, provider.SourcePath); errors.Is(err, os.ErrNotExist) {
+			// The file would be inside a linked directory, but isn't.
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}